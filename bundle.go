@@ -0,0 +1,403 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+// emix bundle structure, many files in one container
+// [zip header] [4-byte bundle magic] [entry contents] [toc] [32-byte toc hash] [8-byte toc offset] [4-byte bundle magic]
+//
+// toc: [4-byte entry count] [entries]
+// entry: [8-byte content offset] [8-byte content length] [4-byte emix header length] [emix header]
+// FileInfo.Name of entry is the slash-separated path relative to the bundle root,
+// directory entries have fs.ModeDir set in FileInfo.Mode and an empty content region,
+// hard link entries have FileInfo.LinkTarget set to the name of an earlier file entry and an empty content region,
+// so content of hard linked files is stored once
+
+var (
+	bundleMagic         = [4]byte{0x45, 0x4d, 0x58, 0x42} // EMXB
+	bundleTrailerLength = 32 + 8 + 4
+	bundleEntryMaxCount = 1 << 24
+
+	ErrInvalidBundle = errors.New("invalid emix bundle")
+	ErrUnsafePath    = errors.New("unsafe path")
+)
+
+// BundleEntry is a file of bundle
+type BundleEntry struct {
+	Header *EmixHeader
+	// content region of bundle
+	Offset int64
+	Length int64
+}
+
+// Path return the entry path using os-specific separators
+func (e *BundleEntry) Path() string {
+	return filepath.FromSlash(e.Header.FileInfo.Name)
+}
+
+// IsDir report whether the entry is a directory
+func (e *BundleEntry) IsDir() bool {
+	return fs.FileMode(e.Header.FileInfo.Mode).IsDir()
+}
+
+// IsLink report whether the entry is a hard link of an earlier entry
+func (e *BundleEntry) IsLink() bool {
+	return e.Header.FileInfo.LinkTarget != ""
+}
+
+// BundleWriter write files into a bundle, entry contents are written sequentially
+// and the toc is written on Close
+type BundleWriter struct {
+	w       io.Writer
+	offset  int64
+	entries []BundleEntry
+	ciphers *CipherCache
+	closed  bool
+}
+
+// NewBundleWriter write the bundle magic and return a BundleWriter
+func NewBundleWriter(w io.Writer) (*BundleWriter, error) {
+	buf := append(ZipHeader(), bundleMagic[:]...)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &BundleWriter{
+		w:       w,
+		offset:  int64(len(buf)),
+		ciphers: NewCipherCache(),
+	}, nil
+}
+
+// Add write a file content from r, header.FileInfo.Name must be a local slash-separated path,
+// FileInfo.Size and FileInfo.FileContentHash are computed from content
+func (b *BundleWriter) Add(header *EmixHeader, r io.Reader) error {
+	if b.closed {
+		return errors.New("bundle writer is closed")
+	}
+	if !isLocalSlashPath(header.FileInfo.Name) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, header.FileInfo.Name)
+	}
+	if err := header.Validate(); err != nil {
+		return err
+	}
+	if !header.EmbedPassword {
+		header.Ciphers = b.ciphers
+	}
+
+	hash := header.NewContentHash()
+	plainCounter := &countWriter{w: hash}
+	counter := &countWriter{w: b.w}
+	teer := io.TeeReader(r, plainCounter)
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return err
+		}
+		if err := EncryptContentWithSectorSize(cipher, teer, counter, header.ContentSectorSize()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := io.Copy(counter, teer); err != nil {
+			return err
+		}
+	}
+	header.FileInfo.Size = uint64(plainCounter.n)
+	copy(header.FileInfo.FileContentHash[:], hash.Sum(nil))
+
+	b.entries = append(b.entries, BundleEntry{
+		Header: header,
+		Offset: b.offset,
+		Length: counter.n,
+	})
+	b.offset += counter.n
+	return nil
+}
+
+// AddRaw copy raw content of size bytes from src without re-encrypting,
+// header.FileInfo must describe the content, see CopyContent
+func (b *BundleWriter) AddRaw(header *EmixHeader, src io.Reader, size int64) error {
+	if b.closed {
+		return errors.New("bundle writer is closed")
+	}
+	if !isLocalSlashPath(header.FileInfo.Name) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, header.FileInfo.Name)
+	}
+	if !header.EmbedPassword {
+		header.Ciphers = b.ciphers
+	}
+	if err := CopyContent(b.w, src, size); err != nil {
+		return err
+	}
+	b.entries = append(b.entries, BundleEntry{
+		Header: header,
+		Offset: b.offset,
+		Length: size,
+	})
+	b.offset += size
+	return nil
+}
+
+// AddDir add a directory entry without content, header.FileInfo.Mode must have fs.ModeDir set
+func (b *BundleWriter) AddDir(header *EmixHeader) error {
+	if b.closed {
+		return errors.New("bundle writer is closed")
+	}
+	if !isLocalSlashPath(header.FileInfo.Name) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, header.FileInfo.Name)
+	}
+	if !fs.FileMode(header.FileInfo.Mode).IsDir() {
+		return fmt.Errorf("not a directory: %s", header.FileInfo.Name)
+	}
+	if !header.EmbedPassword {
+		header.Ciphers = b.ciphers
+	}
+	header.FileInfo.Size = 0
+	b.entries = append(b.entries, BundleEntry{
+		Header: header,
+		Offset: b.offset,
+	})
+	return nil
+}
+
+// AddLink add a hard link entry of the file entry named target without content, Size and FileContentHash are of target
+func (b *BundleWriter) AddLink(header *EmixHeader, target string) error {
+	if b.closed {
+		return errors.New("bundle writer is closed")
+	}
+	if !isLocalSlashPath(header.FileInfo.Name) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, header.FileInfo.Name)
+	}
+	targetEntry, ok := findLinkTarget(b.entries, target)
+	if !ok {
+		return fmt.Errorf("link target %s is not a file of bundle", target)
+	}
+	if !header.EmbedPassword {
+		header.Ciphers = b.ciphers
+	}
+	header.FileInfo.LinkTarget = target
+	header.FileInfo.Size = targetEntry.Header.FileInfo.Size
+	header.FileInfo.FileContentHash = targetEntry.Header.FileInfo.FileContentHash
+	b.entries = append(b.entries, BundleEntry{
+		Header: header,
+		Offset: b.offset,
+	})
+	return nil
+}
+
+// findLinkTarget return the file entry named target, a directory or another link can not be a target
+func findLinkTarget(entries []BundleEntry, target string) (BundleEntry, bool) {
+	for _, entry := range entries {
+		if entry.Header.FileInfo.Name == target {
+			return entry, !entry.IsDir() && !entry.IsLink()
+		}
+	}
+	return BundleEntry{}, false
+}
+
+// Close write the toc, it does not close the underlying writer
+func (b *BundleWriter) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	toc := binary.BigEndian.AppendUint32(nil, uint32(len(b.entries)))
+	for _, entry := range b.entries {
+		encodedHeader, err := entry.Header.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		toc = binary.BigEndian.AppendUint64(toc, uint64(entry.Offset))
+		toc = binary.BigEndian.AppendUint64(toc, uint64(entry.Length))
+		toc = binary.BigEndian.AppendUint32(toc, uint32(len(encodedHeader)))
+		toc = append(toc, encodedHeader...)
+	}
+	hash := sha256.Sum256(toc)
+	toc = append(toc, hash[:]...)
+	toc = binary.BigEndian.AppendUint64(toc, uint64(b.offset))
+	toc = append(toc, bundleMagic[:]...)
+	_, err := b.w.Write(toc)
+	return err
+}
+
+// countWriter count written bytes
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BundleReader read files from a bundle
+type BundleReader struct {
+	r       io.ReaderAt
+	entries []BundleEntry
+	ciphers *CipherCache
+}
+
+// IsBundle check if the reader is an emix bundle
+func IsBundle(r io.Reader) (bool, error) {
+	buf := make([]byte, zipHeaderLength+len(bundleMagic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf[:zipHeaderLength], ZipHeader()) &&
+		bytes.Equal(buf[zipHeaderLength:], bundleMagic[:]), nil
+}
+
+// NewBundleReader read the toc of bundle, size is the total size of bundle,
+// password is used to decrypt entries without embedded password
+func NewBundleReader(r io.ReaderAt, size int64, password [16]byte) (*BundleReader, error) {
+	ok, err := IsBundle(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	headLength := int64(zipHeaderLength + len(bundleMagic))
+	if !ok || size < headLength+4+int64(bundleTrailerLength) {
+		return nil, ErrInvalidBundle
+	}
+
+	// trailer
+	trailer := make([]byte, bundleTrailerLength)
+	if _, err := r.ReadAt(trailer, size-int64(bundleTrailerLength)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[40:], bundleMagic[:]) {
+		return nil, ErrInvalidBundle
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(trailer[32:40]))
+	if tocOffset < headLength || tocOffset > size-int64(bundleTrailerLength)-4 {
+		return nil, ErrInvalidBundle
+	}
+	toc := make([]byte, size-int64(bundleTrailerLength)-tocOffset)
+	if _, err := r.ReadAt(toc, tocOffset); err != nil {
+		return nil, err
+	}
+	if hash := sha256.Sum256(toc); !bytes.Equal(hash[:], trailer[:32]) {
+		return nil, ErrInvalidBundle
+	}
+
+	// entries
+	b := &BundleReader{
+		r:       r,
+		ciphers: NewCipherCache(),
+	}
+	count := int(binary.BigEndian.Uint32(toc[:4]))
+	if count > bundleEntryMaxCount {
+		return nil, ErrInvalidBundle
+	}
+	i := 4
+	for n := 0; n < count; n++ {
+		if len(toc) < i+8+8+4 {
+			return nil, ErrInvalidBundle
+		}
+		offset := int64(binary.BigEndian.Uint64(toc[i : i+8]))
+		length := int64(binary.BigEndian.Uint64(toc[i+8 : i+16]))
+		headerLength := int(binary.BigEndian.Uint32(toc[i+16 : i+20]))
+		i += 20
+		if offset < headLength || length < 0 || offset+length > tocOffset || len(toc) < i+headerLength {
+			return nil, ErrInvalidBundle
+		}
+		header := &EmixHeader{
+			Password: password,
+			Ciphers:  b.ciphers,
+		}
+		if err := header.UnmarshalBinary(toc[i : i+headerLength]); err != nil {
+			return nil, err
+		}
+		if !isLocalSlashPath(header.FileInfo.Name) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsafePath, header.FileInfo.Name)
+		}
+		i += headerLength
+		entry := BundleEntry{
+			Header: header,
+			Offset: offset,
+			Length: length,
+		}
+		if (entry.IsDir() || entry.IsLink()) && length != 0 {
+			return nil, ErrInvalidBundle
+		}
+		if entry.IsLink() {
+			if _, ok := findLinkTarget(b.entries, header.FileInfo.LinkTarget); !ok {
+				return nil, ErrInvalidBundle
+			}
+		}
+		b.entries = append(b.entries, entry)
+	}
+	return b, nil
+}
+
+// Entries return all entries of bundle
+func (b *BundleReader) Entries() []BundleEntry {
+	return b.entries
+}
+
+// RawContent return the raw content reader of entry
+func (b *BundleReader) RawContent(entry BundleEntry) *io.SectionReader {
+	return io.NewSectionReader(b.r, entry.Offset, entry.Length)
+}
+
+// LinkTarget return the entry a hard link entry links to
+func (b *BundleReader) LinkTarget(entry BundleEntry) (BundleEntry, error) {
+	target, ok := findLinkTarget(b.entries, entry.Header.FileInfo.LinkTarget)
+	if !entry.IsLink() || !ok {
+		return BundleEntry{}, fmt.Errorf("%s is not a hard link entry", entry.Header.FileInfo.Name)
+	}
+	return target, nil
+}
+
+// Extract write the plain content of entry to w and verify the content hash,
+// content of a hard link entry is read from its target
+func (b *BundleReader) Extract(entry BundleEntry, w io.Writer) error {
+	if entry.IsDir() {
+		return fmt.Errorf("can not extract directory %s", entry.Header.FileInfo.Name)
+	}
+	if entry.IsLink() {
+		target, err := b.LinkTarget(entry)
+		if err != nil {
+			return err
+		}
+		entry = target
+	}
+	hash := entry.Header.NewContentHash()
+	mw := io.MultiWriter(w, hash)
+	content := b.RawContent(entry)
+	if entry.Header.EncryptData {
+		cipher, err := entry.Header.NewContentCipher()
+		if err != nil {
+			return err
+		}
+		err = DecryptContentWithSectorSize(cipher, content, mw, int64(entry.Header.FileInfo.Size), entry.Header.ContentSectorSize())
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := CopyContent(mw, content, int64(entry.Header.FileInfo.Size)); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(hash.Sum(nil), entry.Header.FileInfo.FileContentHash[:]) {
+		return fmt.Errorf("%w: content hash mismatch of %s", ErrInvalidEmixFileContent, entry.Header.FileInfo.Name)
+	}
+	return nil
+}
+
+// isLocalSlashPath check if path is a slash-separated path inside the root
+func isLocalSlashPath(path string) bool {
+	return filepath.IsLocal(filepath.FromSlash(path))
+}
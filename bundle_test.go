@@ -0,0 +1,124 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundle(t *testing.T) {
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	files := map[string][]byte{
+		"a.txt":     []byte("a"),
+		"b/c.txt":   make([]byte, 13*1024+7),
+		"b/d/e.bin": nil,
+	}
+	rand.Read(files["b/c.txt"])
+	names := []string{"a.txt", "b/c.txt", "b/d/e.bin"}
+
+	tests := []struct {
+		name   string
+		header EmixHeader
+	}{
+		{name: "standard"},
+		{name: "encrypt info", header: EmixHeader{EncryptInfo: true, Password: password}},
+		{name: "encrypt data", header: EmixHeader{EncryptInfo: true, EncryptData: true, Password: password}},
+		{name: "salted keys", header: EmixHeader{EncryptInfo: true, EncryptData: true, SaltedKeys: true, Password: password}},
+		{name: "embed password", header: EmixHeader{EncryptInfo: true, EncryptData: true, EmbedPassword: true, SaltedKeys: true, Password: [16]byte{9}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			bw, err := NewBundleWriter(buf)
+			assert.Nil(t, err)
+			for _, name := range names {
+				header := test.header
+				header.FileInfo = FileInfo{Name: name, Mode: 0644}
+				assert.Nil(t, bw.Add(&header, bytes.NewReader(files[name])))
+			}
+			assert.Nil(t, bw.Close())
+
+			ok, err := IsBundle(bytes.NewReader(buf.Bytes()))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			ok, err = IsEmixFile(bytes.NewReader(buf.Bytes()))
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			if test.header.EncryptInfo {
+				assert.False(t, bytes.Contains(buf.Bytes(), []byte("b/c.txt")))
+			}
+
+			br, err := NewBundleReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), password)
+			assert.Nil(t, err)
+			entries := br.Entries()
+			assert.Len(t, entries, len(names))
+			for i, entry := range entries {
+				assert.Equal(t, names[i], entry.Header.FileInfo.Name)
+				assert.Equal(t, uint64(len(files[names[i]])), entry.Header.FileInfo.Size)
+				out := bytes.NewBuffer(nil)
+				assert.Nil(t, br.Extract(entry, out))
+				assert.Equal(t, len(files[names[i]]), out.Len())
+				assert.True(t, bytes.Equal(files[names[i]], out.Bytes()))
+			}
+
+			// corrupt content
+			data := bytes.Clone(buf.Bytes())
+			data[entries[1].Offset+10] ^= 0xff
+			br, err = NewBundleReader(bytes.NewReader(data), int64(len(data)), password)
+			assert.Nil(t, err)
+			assert.ErrorIs(t, br.Extract(br.Entries()[1], bytes.NewBuffer(nil)), ErrInvalidEmixFileContent)
+
+			// corrupt toc
+			data = bytes.Clone(buf.Bytes())
+			data[len(data)-bundleTrailerLength-1] ^= 0xff
+			_, err = NewBundleReader(bytes.NewReader(data), int64(len(data)), password)
+			assert.ErrorIs(t, err, ErrInvalidBundle)
+		})
+	}
+
+	t.Run("unsafe path", func(t *testing.T) {
+		bw, err := NewBundleWriter(bytes.NewBuffer(nil))
+		assert.Nil(t, err)
+		for _, name := range []string{"../a.txt", "/a.txt", "a/../../b", ""} {
+			header := &EmixHeader{FileInfo: FileInfo{Name: name}}
+			assert.ErrorIs(t, bw.Add(header, bytes.NewReader(nil)), ErrUnsafePath, name)
+		}
+	})
+	t.Run("hard link", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		bw, err := NewBundleWriter(buf)
+		assert.Nil(t, err)
+		content := bytes.Repeat([]byte("linked"), 1000)
+		header := &EmixHeader{EncryptInfo: true, EncryptData: true, Password: password, FileInfo: FileInfo{Name: "a.txt", Mode: 0644}}
+		assert.Nil(t, bw.Add(header, bytes.NewReader(content)))
+		assert.Nil(t, bw.AddDir(&EmixHeader{FileInfo: FileInfo{Name: "d", Mode: uint32(0755 | fs.ModeDir)}}))
+		assert.NotNil(t, bw.AddLink(&EmixHeader{FileInfo: FileInfo{Name: "b.txt"}}, "missing.txt"))
+		assert.NotNil(t, bw.AddLink(&EmixHeader{FileInfo: FileInfo{Name: "b.txt"}}, "d"))
+		link := &EmixHeader{EncryptInfo: true, EncryptData: true, Password: password, FileInfo: FileInfo{Name: "d/b.txt", Mode: 0644}}
+		assert.Nil(t, bw.AddLink(link, "a.txt"))
+		assert.NotNil(t, bw.AddLink(&EmixHeader{FileInfo: FileInfo{Name: "c.txt"}}, "d/b.txt"))
+		assert.Nil(t, bw.Close())
+		// content is stored once
+		assert.Less(t, buf.Len(), 2*len(content))
+
+		br, err := NewBundleReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), password)
+		assert.Nil(t, err)
+		entries := br.Entries()
+		assert.Len(t, entries, 3)
+		assert.True(t, entries[2].IsLink())
+		assert.Equal(t, int64(0), entries[2].Length)
+		assert.Equal(t, "a.txt", entries[2].Header.FileInfo.LinkTarget)
+		assert.Equal(t, uint64(len(content)), entries[2].Header.FileInfo.Size)
+		target, err := br.LinkTarget(entries[2])
+		assert.Nil(t, err)
+		assert.Equal(t, "a.txt", target.Header.FileInfo.Name)
+		_, err = br.LinkTarget(entries[0])
+		assert.NotNil(t, err)
+		out := bytes.NewBuffer(nil)
+		assert.Nil(t, br.Extract(entries[2], out))
+		assert.True(t, bytes.Equal(content, out.Bytes()))
+	})
+}
@@ -0,0 +1,344 @@
+package emix
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+// content defined chunks extension of file info
+// [4-byte chunk size] [32-byte sha256 of chunk] ...
+// chunks are split at content defined boundaries by a gear rolling hash, so data inserted or removed
+// only changes the chunks around it and identical data across files produces the same chunks,
+// the chunk sizes add up to Size
+
+const (
+	// DefaultCDCMinSize, DefaultCDCAvgSize and DefaultCDCMaxSize are the default bounds of CDCChunker
+	DefaultCDCMinSize = 256 * 1024
+	DefaultCDCAvgSize = 1024 * 1024
+	DefaultCDCMaxSize = 4 * 1024 * 1024
+	// MaxCDCChunks is the max number of content defined chunks in file info
+	MaxCDCChunks = 1024
+
+	cdcChunkEncodedLength = 4 + 32
+)
+
+var (
+	ErrInvalidCDCOptions = errors.New("invalid content defined chunking options")
+	ErrInvalidCDCChunks  = errors.New("invalid content defined chunks")
+	ErrChunkNotFound     = errors.New("chunk not found")
+)
+
+// gearTable is the random value of each byte of the gear hash, derived from sha256 so it is stable
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// CDCOptions are the chunk size bounds of CDCChunker, zero fields use the defaults
+type CDCOptions struct {
+	MinSize int
+	// AvgSize is the expected chunk size after MinSize, it must be a power of two
+	AvgSize int
+	MaxSize int
+}
+
+func (o CDCOptions) withDefaults() (CDCOptions, error) {
+	if o.MinSize == 0 {
+		o.MinSize = DefaultCDCMinSize
+	}
+	if o.AvgSize == 0 {
+		o.AvgSize = DefaultCDCAvgSize
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultCDCMaxSize
+	}
+	if o.MinSize <= 0 || o.AvgSize&(o.AvgSize-1) != 0 || o.MinSize > o.AvgSize || o.AvgSize > o.MaxSize || o.MaxSize > 0xffffffff {
+		return o, fmt.Errorf("%w: min %d, avg %d, max %d", ErrInvalidCDCOptions, o.MinSize, o.AvgSize, o.MaxSize)
+	}
+	return o, nil
+}
+
+// CDCChunker split content read from r into content defined chunks
+type CDCChunker struct {
+	r    *bufio.Reader
+	opts CDCOptions
+	mask uint64
+	buf  []byte
+}
+
+// NewCDCChunker return a CDCChunker of r
+func NewCDCChunker(r io.Reader, opts CDCOptions) (*CDCChunker, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &CDCChunker{
+		r:    bufio.NewReaderSize(r, 64*1024),
+		opts: opts,
+		// the high bits of gear hash are the most mixed
+		mask: (uint64(opts.AvgSize) - 1) << (64 - bits.TrailingZeros(uint(opts.AvgSize))),
+		buf:  make([]byte, 0, opts.MaxSize),
+	}, nil
+}
+
+// Next return the next chunk, it is valid until the next call, io.EOF is returned after the last chunk
+func (c *CDCChunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < c.opts.MaxSize {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(c.buf) > 0 {
+				return c.buf, nil
+			}
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.opts.MinSize && hash&c.mask == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
+
+// ContentChunk is a content defined chunk of plain content
+type ContentChunk struct {
+	Size uint32
+	Hash [32]byte
+}
+
+// ChunkStore is a backend storing chunks by their hash, e.g. a block level dedup storage
+type ChunkStore interface {
+	Has(hash [32]byte) (bool, error)
+	Put(hash [32]byte, data []byte) error
+	// Get return ErrChunkNotFound if the chunk is not stored
+	Get(hash [32]byte) ([]byte, error)
+}
+
+// WriteChunks split content read from r into content defined chunks and put the chunks not in store yet,
+// return the chunk list of content and the number of chunks put
+func WriteChunks(store ChunkStore, r io.Reader, opts CDCOptions) ([]ContentChunk, int, error) {
+	chunker, err := NewCDCChunker(r, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	var chunks []ContentChunk
+	put := 0
+	for {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks, put, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		chunk := ContentChunk{Size: uint32(len(data)), Hash: sha256.Sum256(data)}
+		ok, err := store.Has(chunk.Hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			if err := store.Put(chunk.Hash, data); err != nil {
+				return nil, 0, err
+			}
+			put++
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// chunkReader reassemble content from the chunks of a store
+type chunkReader struct {
+	store  ChunkStore
+	chunks []ContentChunk
+	data   []byte
+}
+
+// NewChunkReader return a reader of the content of chunks in store, each chunk is checked against its size and hash
+func NewChunkReader(store ChunkStore, chunks []ContentChunk) io.Reader {
+	return &chunkReader{store: store, chunks: chunks}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.data) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := c.chunks[0]
+		data, err := c.store.Get(chunk.Hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != int(chunk.Size) || sha256.Sum256(data) != chunk.Hash {
+			return 0, fmt.Errorf("%w: chunk %x", ErrChunkHashMismatch, chunk.Hash)
+		}
+		c.chunks = c.chunks[1:]
+		c.data = data
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// DirChunkStore store each chunk in a file of dir named by its hex hash
+type DirChunkStore struct {
+	dir string
+}
+
+// NewDirChunkStore return a DirChunkStore of dir, dir is created if it does not exist
+func NewDirChunkStore(dir string) (*DirChunkStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirChunkStore{dir: dir}, nil
+}
+
+func (s *DirChunkStore) path(hash [32]byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:]))
+}
+
+func (s *DirChunkStore) Has(hash [32]byte) (bool, error) {
+	_, err := os.Stat(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put write the chunk to a temporary file and rename it, so a chunk file is always complete
+func (s *DirChunkStore) Put(hash [32]byte, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, ".chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(hash))
+}
+
+func (s *DirChunkStore) Get(hash [32]byte) ([]byte, error) {
+	data, err := os.ReadFile(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %x", ErrChunkNotFound, hash)
+	}
+	return data, err
+}
+
+// encryptedChunkStore encrypt chunks before they reach the backend store
+type encryptedChunkStore struct {
+	store ChunkStore
+	idKey []byte
+	aead  cipher.AEAD
+}
+
+// NewEncryptedChunkStore wrap store so it only sees encrypted chunks, chunks are sealed with AES-GCM keyed by
+// password and stored by the HMAC-SHA256 of their hash, so the backend can not confirm known content by its hash.
+// Chunks of the same content and password still have the same id, they are deduplicated
+func NewEncryptedChunkStore(store ChunkStore, password [16]byte) (ChunkStore, error) {
+	aead, err := newAESGCM(password, []byte("chunk store"))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedChunkStore{
+		store: store,
+		idKey: HKDF(password[:], nil, []byte("chunk id"), 32),
+		aead:  aead,
+	}, nil
+}
+
+func (s *encryptedChunkStore) id(hash [32]byte) [32]byte {
+	mac := hmac.New(sha256.New, s.idKey)
+	mac.Write(hash[:])
+	var id [32]byte
+	mac.Sum(id[:0])
+	return id
+}
+
+func (s *encryptedChunkStore) Has(hash [32]byte) (bool, error) {
+	return s.store.Has(s.id(hash))
+}
+
+func (s *encryptedChunkStore) Put(hash [32]byte, data []byte) error {
+	id := s.id(hash)
+	sealed, err := aesgcmEncrypt(s.aead, data, id[:])
+	if err != nil {
+		return err
+	}
+	return s.store.Put(id, sealed)
+}
+
+func (s *encryptedChunkStore) Get(hash [32]byte) ([]byte, error) {
+	id := s.id(hash)
+	sealed, err := s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aesgcmDecrypt(s.aead, sealed, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %x: %w", ErrWrongPassword, hash, err)
+	}
+	return data, nil
+}
+
+// validCDCChunks check the chunk sizes add up to Size
+func (f *FileInfo) validCDCChunks() error {
+	if len(f.CDCChunks) > MaxCDCChunks {
+		return ErrInvalidCDCChunks
+	}
+	var size uint64
+	for _, chunk := range f.CDCChunks {
+		if chunk.Size == 0 {
+			return ErrInvalidCDCChunks
+		}
+		size += uint64(chunk.Size)
+	}
+	if size != f.Size {
+		return ErrInvalidCDCChunks
+	}
+	return nil
+}
+
+func marshalCDCChunks(chunks []ContentChunk) []byte {
+	buf := make([]byte, 0, cdcChunkEncodedLength*len(chunks))
+	for _, chunk := range chunks {
+		buf = binary.LittleEndian.AppendUint32(buf, chunk.Size)
+		buf = append(buf, chunk.Hash[:]...)
+	}
+	return buf
+}
+
+func unmarshalCDCChunks(value []byte) ([]ContentChunk, error) {
+	if len(value)%cdcChunkEncodedLength != 0 || len(value)/cdcChunkEncodedLength > MaxCDCChunks {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	chunks := make([]ContentChunk, 0, len(value)/cdcChunkEncodedLength)
+	for r := bytes.NewReader(value); r.Len() > 0; {
+		var chunk ContentChunk
+		binary.Read(r, binary.LittleEndian, &chunk.Size)
+		r.Read(chunk.Hash[:])
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
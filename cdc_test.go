@@ -0,0 +1,160 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var testCDCOptions = CDCOptions{MinSize: 1024, AvgSize: 4096, MaxSize: 16 * 1024}
+
+func TestCDCChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	chunker, err := NewCDCChunker(bytes.NewReader(data), testCDCOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []byte
+	count := 0
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > testCDCOptions.MaxSize || len(chunk) < testCDCOptions.MinSize && len(joined)+len(chunk) != len(data) {
+			t.Fatalf("chunk size %d out of bounds", len(chunk))
+		}
+		joined = append(joined, chunk...)
+		count++
+	}
+	if !bytes.Equal(data, joined) {
+		t.Fatal("chunks do not add up to data")
+	}
+	// expected chunk size is about MinSize + AvgSize
+	if count < len(data)/testCDCOptions.MaxSize || count > len(data)/testCDCOptions.MinSize {
+		t.Fatalf("unexpected chunk count %d", count)
+	}
+
+	for _, opts := range []CDCOptions{{AvgSize: 3000}, {MinSize: 8192, AvgSize: 4096}, {AvgSize: 8192, MaxSize: 4096}} {
+		if _, err := NewCDCChunker(bytes.NewReader(data), opts); !errors.Is(err, ErrInvalidCDCOptions) {
+			t.Fatalf("options %+v should be invalid", opts)
+		}
+	}
+}
+
+func TestWriteChunksDedup(t *testing.T) {
+	shared := make([]byte, 512*1024)
+	rand.Read(shared)
+	a := append([]byte("header of file a"), shared...)
+	b := append(bytes.Repeat([]byte("another longer header of file b "), 100), shared...)
+
+	password := [16]byte{1, 2, 3}
+	dir, err := NewDirChunkStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewEncryptedChunkStore(dir, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunksA, putA, err := WriteChunks(store, bytes.NewReader(a), testCDCOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunksB, putB, err := WriteChunks(store, bytes.NewReader(b), testCDCOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if putA != len(chunksA) {
+		t.Fatalf("all chunks of a should be put, put %d of %d", putA, len(chunksA))
+	}
+	hashesA := map[[32]byte]bool{}
+	for _, chunk := range chunksA {
+		hashesA[chunk.Hash] = true
+	}
+	common := 0
+	for _, chunk := range chunksB {
+		if hashesA[chunk.Hash] {
+			common++
+		}
+	}
+	// only the chunks around the different headers differ
+	if common < len(chunksB)-3 || putB != len(chunksB)-common {
+		t.Fatalf("expected overlapping chunks, %d of %d common, %d put", common, len(chunksB), putB)
+	}
+
+	// the backend only sees encrypted chunks by keyed ids
+	entries, err := os.ReadDir(dir.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != putA+putB {
+		t.Fatalf("expected %d chunk files, got %d", putA+putB, len(entries))
+	}
+	if ok, _ := dir.Has(chunksA[0].Hash); ok {
+		t.Fatal("chunk should not be stored by its plain hash")
+	}
+
+	for _, tt := range []struct {
+		data   []byte
+		chunks []ContentChunk
+	}{{a, chunksA}, {b, chunksB}} {
+		content, err := io.ReadAll(NewChunkReader(store, tt.chunks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tt.data, content) {
+			t.Fatal("reassembled content not equal")
+		}
+	}
+
+	// wrong password
+	other, err := NewEncryptedChunkStore(dir, [16]byte{4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(NewChunkReader(other, chunksA)); !errors.Is(err, ErrChunkNotFound) {
+		t.Fatalf("expected chunk not found, got %v", err)
+	}
+	// corrupted chunk
+	corrupted := append([]ContentChunk{}, chunksA...)
+	corrupted[0].Size++
+	if _, err := io.ReadAll(NewChunkReader(store, corrupted)); !errors.Is(err, ErrChunkHashMismatch) {
+		t.Fatalf("expected chunk hash mismatch, got %v", err)
+	}
+}
+
+func TestFileInfoCDCChunks(t *testing.T) {
+	info := FileInfo{
+		Name:      "a.txt",
+		Size:      300,
+		CDCChunks: []ContentChunk{{Size: 100, Hash: [32]byte{1}}, {Size: 200, Hash: [32]byte{2}}},
+	}
+	buf, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != info.EncodedLength() {
+		t.Fatal("EncodedLength not equal")
+	}
+	var info2 FileInfo
+	if err := info2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, info2) {
+		t.Fatal("not equal")
+	}
+
+	info.Size = 301
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrInvalidCDCChunks) {
+		t.Fatal("chunk sizes must add up to size")
+	}
+}
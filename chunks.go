@@ -0,0 +1,208 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+// chunk hashes extension of file info
+// [1-byte chunk size shift] [32-byte merkle root] [32-byte sha256 of each chunk]
+// chunks are ChunkSize bytes of plain content, the last chunk may be shorter,
+// merkle leaves are sha256(0x00 || chunk) and nodes are sha256(0x01 || left || right),
+// the last node of an odd level is promoted
+
+const (
+	// DefaultChunkSize is the min chunk size selected by ChunkSizeFor
+	DefaultChunkSize = 1 << 20
+	// MaxChunkHashes is the max number of chunk hashes in file info
+	MaxChunkHashes = 256
+
+	chunkHashesMinLength = 1 + 32
+	maxChunkSizeShift    = 63
+)
+
+var (
+	ErrInvalidChunkHashes = errors.New("invalid chunk hashes")
+	ErrNoChunkHashes      = errors.New("no chunk hashes")
+	ErrChunkHashMismatch  = errors.New("chunk hash mismatch")
+)
+
+// ChunkSizeFor return the chunk size of a file of size bytes, the smallest power of two
+// from DefaultChunkSize with at most MaxChunkHashes chunks
+func ChunkSizeFor(size uint64) uint64 {
+	chunkSize := uint64(DefaultChunkSize)
+	for chunkCount(size, chunkSize) > MaxChunkHashes {
+		chunkSize <<= 1
+	}
+	return chunkSize
+}
+
+// chunkCount return the number of chunks of size bytes
+func chunkCount(size, chunkSize uint64) uint64 {
+	return size/chunkSize + min(size%chunkSize, 1)
+}
+
+// ChunkHasher compute the hashes of chunks of content written to it
+type ChunkHasher struct {
+	chunkSize uint64
+	hash      hash.Hash
+	written   uint64
+	hashes    [][32]byte
+}
+
+// NewChunkHasher return a ChunkHasher of chunkSize, it must be a power of two
+func NewChunkHasher(chunkSize uint64) *ChunkHasher {
+	return &ChunkHasher{
+		chunkSize: chunkSize,
+		hash:      newChunkLeafHash(),
+	}
+}
+
+func newChunkLeafHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	return h
+}
+
+func (c *ChunkHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := min(uint64(len(p)), c.chunkSize-c.written)
+		c.hash.Write(p[:m])
+		c.written += m
+		p = p[m:]
+		if c.written == c.chunkSize {
+			c.sumChunk()
+		}
+	}
+	return n, nil
+}
+
+func (c *ChunkHasher) sumChunk() {
+	var sum [32]byte
+	c.hash.Sum(sum[:0])
+	c.hashes = append(c.hashes, sum)
+	c.hash = newChunkLeafHash()
+	c.written = 0
+}
+
+// Sum return the hashes of chunks written, including the last partial chunk
+func (c *ChunkHasher) Sum() [][32]byte {
+	if c.written > 0 {
+		c.sumChunk()
+	}
+	return c.hashes
+}
+
+// MerkleRoot return the merkle root of chunk hashes, zero if there is no chunk
+func MerkleRoot(hashes [][32]byte) [32]byte {
+	if len(hashes) == 0 {
+		return [32]byte{}
+	}
+	level := append([][32]byte(nil), hashes...)
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{0x01})
+			h.Write(level[i][:])
+			h.Write(level[i+1][:])
+			var sum [32]byte
+			h.Sum(sum[:0])
+			next = append(next, sum)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// validChunkHashes check there is a hash of each chunk
+func (f *FileInfo) validChunkHashes() error {
+	if bits.OnesCount64(f.ChunkSize) != 1 || len(f.ChunkHashes) > MaxChunkHashes || uint64(len(f.ChunkHashes)) != chunkCount(f.Size, f.ChunkSize) {
+		return ErrInvalidChunkHashes
+	}
+	return nil
+}
+
+// marshalChunkHashes encode the chunk hashes extension
+func (f *FileInfo) marshalChunkHashes() []byte {
+	root := MerkleRoot(f.ChunkHashes)
+	buf := make([]byte, 0, chunkHashesMinLength+32*len(f.ChunkHashes))
+	buf = append(buf, byte(bits.TrailingZeros64(f.ChunkSize)))
+	buf = append(buf, root[:]...)
+	for _, sum := range f.ChunkHashes {
+		buf = append(buf, sum[:]...)
+	}
+	return buf
+}
+
+// unmarshalChunkHashes decode the chunk hashes extension and check its merkle root
+func (f *FileInfo) unmarshalChunkHashes(value []byte) error {
+	if len(value) < chunkHashesMinLength || (len(value)-chunkHashesMinLength)%32 != 0 || value[0] > maxChunkSizeShift {
+		return ErrInvalidEncodedFileInfo
+	}
+	chunkSize := uint64(1) << value[0]
+	hashes := make([][32]byte, (len(value)-chunkHashesMinLength)/32)
+	for i := range hashes {
+		copy(hashes[i][:], value[chunkHashesMinLength+32*i:])
+	}
+	if root := MerkleRoot(hashes); !bytes.Equal(root[:], value[1:chunkHashesMinLength]) {
+		return ErrInvalidEncodedFileInfo
+	}
+	f.ChunkSize = chunkSize
+	f.ChunkHashes = hashes
+	return nil
+}
+
+// chunkHashesEncodedLength return the length of the chunk hashes extension value by Size,
+// so the content offset is known before content is hashed
+func (f *FileInfo) chunkHashesEncodedLength() int {
+	return chunkHashesMinLength + 32*int(chunkCount(f.Size, f.ChunkSize))
+}
+
+// VerifyContentRange check the chunks of plain content covering length bytes from offset against
+// the chunk hashes of header, r is the whole emix file and the password of header is used to decrypt
+// content, only the covering chunks are read
+func VerifyContentRange(r io.ReaderAt, header *EmixHeader, offset, length int64) error {
+	info := &header.FileInfo
+	if info.ChunkSize == 0 {
+		return ErrNoChunkHashes
+	}
+	if offset < 0 || length < 0 || uint64(offset)+uint64(length) > info.Size {
+		return fmt.Errorf("invalid range %d+%d of %d bytes", offset, length, info.Size)
+	}
+	if uint64(len(info.ChunkHashes)) != chunkCount(info.Size, info.ChunkSize) {
+		return ErrInvalidChunkHashes
+	}
+	if length == 0 {
+		return nil
+	}
+	content, err := OpenContent(r, header)
+	if err != nil {
+		return err
+	}
+	first := uint64(offset) / info.ChunkSize
+	last := (uint64(offset) + uint64(length) - 1) / info.ChunkSize
+	if _, err := content.Seek(int64(first*info.ChunkSize), io.SeekStart); err != nil {
+		return err
+	}
+	for i := first; i <= last; i++ {
+		hasher := NewChunkHasher(info.ChunkSize)
+		if _, err := io.CopyN(hasher, content, int64(min(info.ChunkSize, info.Size-i*info.ChunkSize))); err != nil {
+			return err
+		}
+		if hasher.Sum()[0] != info.ChunkHashes[i] {
+			return fmt.Errorf("%w: chunk %d at offset %d", ErrChunkHashMismatch, i, i*info.ChunkSize)
+		}
+	}
+	return nil
+}
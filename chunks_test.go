@@ -0,0 +1,153 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkSizeFor(t *testing.T) {
+	tests := map[uint64]uint64{
+		0:                      DefaultChunkSize,
+		1:                      DefaultChunkSize,
+		MaxChunkHashes << 20:   DefaultChunkSize,
+		MaxChunkHashes<<20 + 1: DefaultChunkSize << 1,
+		MaxChunkHashes << 30:   1 << 30,
+		MaxChunkHashes << 40:   1 << 40,
+	}
+	for size, expected := range tests {
+		if chunkSize := ChunkSizeFor(size); chunkSize != expected {
+			t.Fatalf("chunk size of %d expected %d, got %d", size, expected, chunkSize)
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	hashes := [][32]byte{{1}, {2}, {3}}
+	root := MerkleRoot(hashes)
+	if root != MerkleRoot([][32]byte{{1}, {2}, {3}}) {
+		t.Fatal("merkle root is not stable")
+	}
+	for _, other := range [][][32]byte{{{1}, {2}}, {{2}, {1}, {3}}, {{1}, {2}, {3}, {3}}} {
+		if MerkleRoot(other) == root {
+			t.Fatalf("merkle root of %v collides", other)
+		}
+	}
+	if MerkleRoot([][32]byte{{1}}) != [32]byte{1} {
+		t.Fatal("merkle root of one chunk should be its hash")
+	}
+}
+
+// writeChunkedFile return an emix file of content with chunk hashes
+func writeChunkedFile(t *testing.T, header *EmixHeader, content []byte) []byte {
+	t.Helper()
+	hasher := NewChunkHasher(header.FileInfo.ChunkSize)
+	hasher.Write(content)
+	header.FileInfo.ChunkHashes = hasher.Sum()
+	header.FileInfo.Size = uint64(len(content))
+	header.FileMAC = header.FileMAC || header.needsFileMAC()
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(ZipHeader())
+	buf.Write(encodedHeader)
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := EncryptContent(cipher, bytes.NewReader(content), buf); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		buf.Write(content)
+	}
+	return withFileMAC(t, header, buf.Bytes())
+}
+
+func TestVerifyContentRange(t *testing.T) {
+	chunkSize := uint64(2 * XTSSectorSize)
+	content := make([]byte, 5*chunkSize+100)
+	rand.Read(content)
+
+	for _, encryptData := range []bool{false, true} {
+		header := &EmixHeader{
+			EncryptInfo: true,
+			EncryptData: encryptData,
+			Password:    [16]byte{1, 2, 3},
+			SaltedKeys:  true,
+			BindHeader:  true,
+			FileInfo:    FileInfo{Name: "chunks.txt", ChunkSize: chunkSize},
+		}
+		data := writeChunkedFile(t, header, content)
+		read, err := ReadHeader(bytes.NewReader(data), header.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.FileInfo.ChunkSize != chunkSize || len(read.FileInfo.ChunkHashes) != 6 {
+			t.Fatalf("unexpected chunks %d x %d", len(read.FileInfo.ChunkHashes), read.FileInfo.ChunkSize)
+		}
+
+		// a single chunk, a range across chunks and the short last chunk
+		for _, r := range [][2]int64{{0, 1}, {int64(chunkSize) + 10, 20}, {int64(chunkSize) - 1, 2}, {int64(len(content)) - 1, 1}, {0, int64(len(content))}, {3, 0}} {
+			if err := VerifyContentRange(bytes.NewReader(data), read, r[0], r[1]); err != nil {
+				t.Fatalf("verify range %v error: %v", r, err)
+			}
+		}
+		if err := VerifyContentRange(bytes.NewReader(data), read, int64(len(content)), 1); err == nil {
+			t.Fatal("range out of content should fail")
+		}
+
+		// corrupt the third chunk
+		corrupted := bytes.Clone(data)
+		corrupted[read.ContentOffset()+2*int64(chunkSize)+5] ^= 0xff
+		err = VerifyContentRange(bytes.NewReader(corrupted), read, 2*int64(chunkSize)+100, 10)
+		if !errors.Is(err, ErrChunkHashMismatch) {
+			t.Fatalf("expected ErrChunkHashMismatch, got %v", err)
+		}
+		if err := VerifyContentRange(bytes.NewReader(corrupted), read, 0, int64(chunkSize)); err != nil {
+			t.Fatalf("other chunks should pass, got %v", err)
+		}
+	}
+
+	// files without chunk hashes
+	header := &EmixHeader{FileInfo: FileInfo{Name: "plain.txt"}}
+	if err := VerifyContentRange(bytes.NewReader(nil), header, 0, 0); !errors.Is(err, ErrNoChunkHashes) {
+		t.Fatalf("expected ErrNoChunkHashes, got %v", err)
+	}
+	// a hash of each chunk is required
+	header.FileInfo = FileInfo{Name: "chunks.txt", Size: chunkSize + 1, ChunkSize: chunkSize, ChunkHashes: [][32]byte{{}}}
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrInvalidChunkHashes) {
+		t.Fatalf("expected ErrInvalidChunkHashes, got %v", err)
+	}
+	header.FileInfo.ChunkSize = chunkSize + 1
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrInvalidChunkHashes) {
+		t.Fatalf("expected ErrInvalidChunkHashes, got %v", err)
+	}
+}
+
+func TestFileInfoChunkHashes(t *testing.T) {
+	info := &FileInfo{Name: "a", Size: 3, ChunkSize: 2, ChunkHashes: [][32]byte{{1}, {2}}}
+	data, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != info.EncodedLength() {
+		t.Fatalf("encoded length %d, expected %d", len(data), info.EncodedLength())
+	}
+	decoded := &FileInfo{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ChunkSize != 2 || len(decoded.ChunkHashes) != 2 || decoded.ChunkHashes[1] != [32]byte{2} {
+		t.Fatalf("unexpected chunks %+v", decoded)
+	}
+
+	// a tampered hash does not match the merkle root
+	data[len(data)-1] ^= 0xff
+	if err := decoded.UnmarshalBinary(data); !errors.Is(err, ErrInvalidEncodedFileInfo) {
+		t.Fatalf("expected ErrInvalidEncodedFileInfo, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "github.com/icefed/emix"
+
+const (
+	// xattrs of POSIX ACLs on linux, the access ACL also sets the permission bits
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+	// xattr of linux file capabilities, chown and content writes clear it
+	xattrCapability = "security.capability"
+)
+
+// isACLXattr report if name is a POSIX ACL or file capabilities xattr, they are skipped by --no-acls
+func isACLXattr(name string) bool {
+	return name == xattrACLAccess || name == xattrACLDefault || name == xattrCapability
+}
+
+// withoutACLXattrs return xattrs without POSIX ACLs and file capabilities
+func withoutACLXattrs(xattrs []emix.Xattr) []emix.Xattr {
+	var kept []emix.Xattr
+	for _, x := range xattrs {
+		if !isACLXattr(x.Name) {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
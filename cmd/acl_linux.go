@@ -0,0 +1,24 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/icefed/emix"
+)
+
+// restorableXattrs return xattrs in the order to set them, the access ACL is set first since it rewrites the
+// permission bits, and file capabilities last so nothing clears them after
+func restorableXattrs(xattrs []emix.Xattr) []emix.Xattr {
+	rank := func(name string) int {
+		switch name {
+		case xattrACLAccess:
+			return 0
+		case xattrCapability:
+			return 2
+		}
+		return 1
+	}
+	ordered := append([]emix.Xattr{}, xattrs...)
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i].Name) < rank(ordered[j].Name) })
+	return ordered
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "github.com/icefed/emix"
+
+// restorableXattrs return xattrs to set, POSIX ACLs and file capabilities are linux only and skipped
+func restorableXattrs(xattrs []emix.Xattr) []emix.Xattr {
+	for _, x := range xattrs {
+		if isACLXattr(x.Name) {
+			debugf("skip linux only xattr %s", x.Name)
+		}
+	}
+	return withoutACLXattrs(xattrs)
+}
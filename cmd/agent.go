@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+// agentSocketEnv override the default socket path of agent
+const agentSocketEnv = "EMIX_AGENT_SOCK"
+
+// agentSocketPath return the socket path used by agent and --use-agent, by default in the private directory
+// of agentSocketDir
+func agentSocketPath() string {
+	if path := os.Getenv(agentSocketEnv); path != "" {
+		return path
+	}
+	return filepath.Join(agentSocketDir(), "emix-agent.sock")
+}
+
+// agentSocketDir return $XDG_RUNTIME_DIR, or the directory emix-<uid> in the temp directory created by agent
+func agentSocketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("emix-%d", os.Getuid()))
+}
+
+// checkSocketDir check that only the current user can create files in dir, so a socket in it
+// is not replaced by another user
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if err := checkOwned(dir, info); err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by other users", dir)
+	}
+	return nil
+}
+
+// removeStaleSocket remove the socket left by an agent which is not running, a file which is
+// not a socket of the current user is never removed
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := checkOwned(path, info); err != nil {
+		return err
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("an agent is already running on %s", path)
+	}
+	return os.Remove(path)
+}
+
+type AgentOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	TTL            time.Duration
+	Socket         string
+
+	password [16]byte
+}
+
+func newCmdAgent() *cobra.Command {
+	o := &AgentOptions{}
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "hold the password in memory for commands using --use-agent",
+		Long: `Hold the password in memory and serve it over a unix socket until the ttl expires, like ssh-agent.
+The password is never written to disk. The socket is in $XDG_RUNTIME_DIR, or in a private directory emix-<uid>
+in the temp directory. Set EMIX_AGENT_SOCK to use a different socket path, its directory must not be writable by other users.`,
+		GroupID: "additional",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate())
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", true, "Read password from stdin. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password.")
+	cmd.Flags().DurationVar(&o.TTL, "ttl", 15*time.Minute, "Wipe the password and exit after the duration.")
+	cmd.Flags().StringVar(&o.Socket, "socket", agentSocketPath(), "Unix socket path.")
+	return cmd
+}
+
+func (o *AgentOptions) Validate() error {
+	if o.TTL <= 0 {
+		return errors.New("invalid --ttl, must be positive")
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+		return nil
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+		return nil
+	}
+	return errors.New("need password or credential-file")
+}
+
+func (o *AgentOptions) Run() error {
+	dir := filepath.Dir(o.Socket)
+	if dir == agentSocketDir() && os.Getenv("XDG_RUNTIME_DIR") == "" {
+		if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return err
+	}
+	if err := removeStaleSocket(o.Socket); err != nil {
+		return err
+	}
+	l, err := listenAgent(o.Socket)
+	if err != nil {
+		return err
+	}
+	a := newAgent(o.password, o.TTL, l)
+	clear(o.password[:])
+
+	// wipe on shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		a.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "%s=%s; export %s\n", agentSocketEnv, o.Socket, agentSocketEnv)
+	a.Serve()
+	return nil
+}
+
+// agent serve the password until it expires or is closed
+type agent struct {
+	mu       sync.Mutex
+	password [16]byte
+	closed   bool
+
+	listener net.Listener
+	timer    *time.Timer
+}
+
+func newAgent(password [16]byte, ttl time.Duration, l net.Listener) *agent {
+	a := &agent{
+		password: password,
+		listener: l,
+	}
+	a.timer = time.AfterFunc(ttl, a.Close)
+	return a
+}
+
+// Serve handle requests until the agent is closed
+func (a *agent) Serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+// handle reply the hex encoded password to a GET request
+func (a *agent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(request) != "GET" {
+		fmt.Fprint(conn, "ERR unknown request\n")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		fmt.Fprint(conn, "ERR agent is closed\n")
+		return
+	}
+	fmt.Fprintf(conn, "OK %s\n", hex.EncodeToString(a.password[:]))
+}
+
+// Close wipe the password and stop serving
+func (a *agent) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	a.timer.Stop()
+	clear(a.password[:])
+	a.listener.Close()
+}
+
+// agentPassword get the password from the agent
+func agentPassword() ([16]byte, error) {
+	var password [16]byte
+	// a socket of another user could serve a password known to them
+	path := agentSocketPath()
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return password, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return password, err
+	}
+	if err := checkOwned(path, info); err != nil {
+		return password, err
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return password, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprint(conn, "GET\n"); err != nil {
+		return password, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return password, err
+	}
+	reply = strings.TrimSpace(reply)
+	if msg, ok := strings.CutPrefix(reply, "ERR "); ok {
+		return password, errors.New(msg)
+	}
+	encoded, ok := strings.CutPrefix(reply, "OK ")
+	decoded, err := hex.DecodeString(encoded)
+	if !ok || err != nil || len(decoded) != len(password) {
+		return password, errors.New("invalid agent reply")
+	}
+	copy(password[:], decoded)
+	return password, nil
+}
+
+// useAgentPassword get the password from the agent, report false if the agent is unavailable
+// so the caller falls back to prompting
+func useAgentPassword(password *[16]byte) bool {
+	p, err := agentPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Agent unavailable: %v\n", err)
+		return false
+	}
+	*password = p
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestAgent serve password on a socket in a temp directory
+func startTestAgent(t *testing.T, password [16]byte, ttl time.Duration) *agent {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	t.Setenv(agentSocketEnv, socket)
+	a := newAgent(password, ttl, l)
+	go a.Serve()
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestAgent(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "aaaa",
+	})
+	password := [16]byte{'a', 'g', 'e', 'n', 't'}
+	startTestAgent(t, password, time.Minute)
+
+	got, err := agentPassword()
+	assert.Nil(t, err)
+	assert.Equal(t, password, got)
+
+	// domix and demix
+	mixed := filepath.Join(tmp, "mixed")
+	domix := &DomixOptions{
+		MixType:  1,
+		UseAgent: true,
+		Output:   mixed,
+		Silence:  true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Equal(t, password, domix.password)
+	assert.Nil(t, domix.Run())
+	entries, err := os.ReadDir(mixed)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	mixedFile := filepath.Join(mixed, entries[0].Name())
+
+	out := filepath.Join(tmp, "out")
+	demix := &DemixOptions{
+		UseAgent: true,
+		Output:   out,
+		Silence:  true,
+	}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.Nil(t, demix.Run())
+	data, err := os.ReadFile(filepath.Join(out, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaa", string(data))
+
+	// stat and ls decrypt the file info
+	stat := &StatOptions{UseAgent: true}
+	assert.Nil(t, stat.Validate(mixedFile))
+	buf := bytes.NewBuffer(nil)
+	stat.out = buf
+	assert.Nil(t, stat.Run())
+	assert.Contains(t, buf.String(), "a.txt")
+
+	ls := &LsOptions{UseAgent: true}
+	assert.Nil(t, ls.Validate(mixed))
+	buf.Reset()
+	ls.out = buf
+	assert.Nil(t, ls.Run())
+	assert.Contains(t, buf.String(), "a.txt")
+
+	// conflicts
+	assert.NotNil(t, (&DemixOptions{UseAgent: true, CredentialFile: "credential"}).Validate(mixed))
+	assert.NotNil(t, (&DomixOptions{MixType: 1, UseAgent: true, EmbedPassword: true}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{MixType: 0, UseAgent: true}).Validate(src))
+}
+
+func TestAgentExpire(t *testing.T) {
+	a := startTestAgent(t, [16]byte{'a', 'g', 'e', 'n', 't'}, 50*time.Millisecond)
+	_, err := agentPassword()
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.closed
+	}, 2*time.Second, 10*time.Millisecond)
+	a.mu.Lock()
+	assert.Equal(t, [16]byte{}, a.password)
+	a.mu.Unlock()
+	_, err = agentPassword()
+	assert.NotNil(t, err)
+}
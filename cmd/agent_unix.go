@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenAgent listen on the unix socket path, it is created with mode 0600 by umask so no other user
+// can connect before it is ready
+func listenAgent(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
+
+// checkOwned check the file of info is owned by the current user
+func checkOwned(path string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by the current user", path)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentSocket(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv(agentSocketEnv, "")
+	t.Setenv("XDG_RUNTIME_DIR", tmp)
+	assert.Equal(t, filepath.Join(tmp, "emix-agent.sock"), agentSocketPath())
+
+	// the socket is private once it is created
+	socket := filepath.Join(tmp, "agent.sock")
+	l, err := listenAgent(socket)
+	assert.Nil(t, err)
+	info, err := os.Lstat(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.ErrorContains(t, removeStaleSocket(socket), "already running")
+
+	// a stale socket is removed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	assert.Nil(t, removeStaleSocket(socket))
+	_, err = os.Lstat(socket)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, removeStaleSocket(socket))
+
+	// other files are kept
+	file := filepath.Join(tmp, "file")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0600))
+	assert.ErrorContains(t, removeStaleSocket(file), "not a socket")
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// a directory writable by others is refused by agent and client
+	shared := filepath.Join(tmp, "shared")
+	assert.Nil(t, os.Mkdir(shared, 0755))
+	assert.Nil(t, os.Chmod(shared, 0777))
+	o := &AgentOptions{Socket: filepath.Join(shared, "agent.sock"), TTL: time.Minute}
+	assert.ErrorContains(t, o.Run(), "writable by other users")
+	t.Setenv(agentSocketEnv, filepath.Join(shared, "agent.sock"))
+	_, err = agentPassword()
+	assert.ErrorContains(t, err, "writable by other users")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type BenchOptions struct {
+	// size of the synthetic content, e.g. 64MiB
+	Size string
+	// runs of each configuration
+	Count        int
+	SectorSizes  []int
+	CipherSuites []string
+
+	size   int64
+	suites []emix.CipherSuiteID
+	out    io.Writer
+}
+
+func newCmdBench() *cobra.Command {
+	o := &BenchOptions{}
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "benchmark content encryption and decryption on this machine",
+		Long: `Encrypt and decrypt a synthetic in-memory buffer with each cipher suite and sector size,
+and print the throughput in the go benchmark format, so the results can be compared by benchstat.`,
+		GroupID: "additional",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate())
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringVar(&o.Size, "size", "64MiB", "Size of the synthetic content, e.g. 16MB or 1GiB.")
+	cmd.Flags().IntVar(&o.Count, "count", 1, "Run each configuration N times, benchstat needs several runs to compute variance.")
+	cmd.Flags().IntSliceVar(&o.SectorSizes, "sector-size", []int{emix.MinSectorSize, emix.XTSSectorSize, 64 * 1024, emix.MaxSectorSize}, "Sector sizes to benchmark, see domix --sector-size. Multi sizes can be separated by comma.")
+	cmd.Flags().StringSliceVar(&o.CipherSuites, "cipher-suite", emix.CipherSuiteNames(), "Cipher suites to benchmark, see domix --cipher-suite. Multi suites can be separated by comma.")
+	return cmd
+}
+
+func (o *BenchOptions) Validate() error {
+	size, err := humanize.ParseBytes(o.Size)
+	if err != nil {
+		return fmt.Errorf("invalid --size: %v", err)
+	}
+	if size == 0 {
+		return errors.New("invalid --size, must be positive")
+	}
+	o.size = int64(size)
+	if o.Count < 1 {
+		return errors.New("invalid --count, must be positive")
+	}
+	for _, n := range o.SectorSizes {
+		if err := emix.ValidSectorSize(n); err != nil {
+			return fmt.Errorf("invalid --sector-size: %v", err)
+		}
+	}
+	o.suites = nil
+	for _, name := range o.CipherSuites {
+		suite, err := emix.ParseCipherSuite(name)
+		if err != nil {
+			return fmt.Errorf("invalid --cipher-suite: %v", err)
+		}
+		o.suites = append(o.suites, suite)
+	}
+	if o.out == nil {
+		o.out = os.Stdout
+	}
+	return nil
+}
+
+func (o *BenchOptions) Run() error {
+	plain := make([]byte, o.size)
+	if _, err := rand.Read(plain); err != nil {
+		return err
+	}
+	fmt.Fprintf(o.out, "goos: %s\ngoarch: %s\npkg: emix\n", runtime.GOOS, runtime.GOARCH)
+	for _, suite := range o.suites {
+		for _, sectorSize := range o.SectorSizes {
+			name := fmt.Sprintf("suite=%s/sector=%d", suite, sectorSize)
+			for range o.Count {
+				encrypt, decrypt, err := benchContent(plain, suite, sectorSize)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				o.printResult("Encrypt/"+name, encrypt)
+				o.printResult("Decrypt/"+name, decrypt)
+			}
+		}
+	}
+	return nil
+}
+
+// printResult print a line of go benchmark format, one iteration over the content
+func (o *BenchOptions) printResult(name string, d time.Duration) {
+	mbps := float64(o.size) / 1e6 / d.Seconds()
+	fmt.Fprintf(o.out, "Benchmark%s-%d\t1\t%d ns/op\t%.2f MB/s\n", name, runtime.GOMAXPROCS(0), d.Nanoseconds(), mbps)
+}
+
+// benchContent return the durations to encrypt and decrypt plain with the content hash like domix and demix
+func benchContent(plain []byte, suite emix.CipherSuiteID, sectorSize int) (time.Duration, time.Duration, error) {
+	header := &emix.EmixHeader{
+		EncryptData: true,
+		SaltedKeys:  true,
+		CipherSuite: suite,
+		SectorSize:  sectorSize,
+	}
+	if _, err := rand.Read(header.Password[:]); err != nil {
+		return 0, 0, err
+	}
+	cipher, err := header.NewContentCipher()
+	if err != nil {
+		return 0, 0, err
+	}
+	encrypted := bytes.NewBuffer(make([]byte, 0, emix.EncryptedContentSize(int64(len(plain)), sectorSize)))
+
+	start := time.Now()
+	hash := header.NewContentHash()
+	if err := emix.EncryptContentWithSectorSize(cipher, io.TeeReader(bytes.NewReader(plain), hash), encrypted, sectorSize); err != nil {
+		return 0, 0, err
+	}
+	sum := hash.Sum(nil)
+	encrypt := time.Since(start)
+
+	start = time.Now()
+	hash.Reset()
+	if err := emix.DecryptContentWithSectorSize(cipher, encrypted, hash, int64(len(plain)), sectorSize); err != nil {
+		return 0, 0, err
+	}
+	decrypt := time.Since(start)
+	if !bytes.Equal(sum, hash.Sum(nil)) {
+		return 0, 0, errors.New("decrypted content hash mismatch")
+	}
+	return encrypt, decrypt, nil
+}
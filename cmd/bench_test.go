@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestBench(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	bench := &BenchOptions{Size: "16KiB", Count: 2, SectorSizes: []int{512, 4096}, CipherSuites: emix.CipherSuiteNames(), out: buf}
+	assert.Nil(t, bench.Validate())
+	assert.Nil(t, bench.Run())
+
+	line := regexp.MustCompile(`^Benchmark(Encrypt|Decrypt)/suite=[^/\s]+/sector=\d+-\d+\t1\t\d+ ns/op\t\d+\.\d{2} MB/s$`)
+	results := 0
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(l, "Benchmark") {
+			assert.Regexp(t, line, l)
+			results++
+		}
+	}
+	assert.Equal(t, len(emix.CipherSuiteNames())*2*2*2, results)
+
+	for _, invalid := range []*BenchOptions{
+		{Size: "0", Count: 1},
+		{Size: "1MB", Count: 0},
+		{Size: "1MB", Count: 1, SectorSizes: []int{1000}},
+		{Size: "1MB", Count: 1, CipherSuites: []string{"rot13"}},
+	} {
+		assert.NotNil(t, invalid.Validate())
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dustin/go-humanize"
+	"github.com/icefed/emix"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+type BrowseOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Output         string
+
+	dir      string
+	password [16]byte
+	ciphers  *emix.CipherCache
+}
+
+func newCmdBrowse() *cobra.Command {
+	o := &BrowseOptions{}
+	cmd := &cobra.Command{
+		Use:     "browse <path>",
+		Short:   "browse the emix files of the directory interactively",
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", ".", "Output directory of extracted files.")
+	return cmd
+}
+
+func (o *BrowseOptions) Validate(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path %s is not a directory", dir)
+	}
+	o.dir = filepath.Clean(dir)
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("browse needs a terminal")
+	}
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	o.ciphers = emix.NewCipherCache()
+
+	return nil
+}
+
+func (o *BrowseOptions) Run() error {
+	b, err := newBrowser(o)
+	if err != nil {
+		return err
+	}
+
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, oldState)
+	// use alternate screen and hide cursor
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	keyBuf := make([]byte, 8)
+	for {
+		_, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return err
+		}
+		b.render(os.Stdout, height)
+
+		n, err := os.Stdin.Read(keyBuf)
+		if err != nil {
+			return err
+		}
+		if !b.handleKey(string(keyBuf[:n]), height) {
+			return nil
+		}
+	}
+}
+
+type browseEntry struct {
+	path   string
+	header *emix.EmixHeader
+	err    error
+}
+
+// browser lists emix files, headers are parsed lazily when they are displayed
+type browser struct {
+	o *BrowseOptions
+	// files not parsed yet
+	paths   []string
+	entries []browseEntry
+
+	cursor int
+	offset int
+	detail bool
+	status string
+}
+
+// newBrowser return a browser of the regular files in the directory of o
+func newBrowser(o *BrowseOptions) (*browser, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &browser{o: o}
+	for _, file := range files {
+		if file.Type().IsRegular() {
+			b.paths = append(b.paths, filepath.Join(o.dir, file.Name()))
+		}
+	}
+	return b, nil
+}
+
+// load parse files until n entries are loaded, non-emix files are skipped
+func (b *browser) load(n int) {
+	for len(b.entries) < n && len(b.paths) > 0 {
+		path := b.paths[0]
+		b.paths = b.paths[1:]
+		header, err := b.readHeader(path)
+		if errors.Is(err, emix.ErrInvalidEmixHeader) {
+			continue
+		}
+		b.entries = append(b.entries, browseEntry{path: path, header: header, err: err})
+	}
+}
+
+// readHeader read the header of path, the ciphers are shared so the password is stretched once
+func (b *browser) readHeader(path string) (*emix.EmixHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := &emix.EmixHeader{
+		Password: b.o.password,
+		Ciphers:  b.o.ciphers,
+	}
+	if err := header.UnmarshalFromFile(f); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// browseAction is what a key does in the browser
+type browseAction int
+
+const (
+	browseNone browseAction = iota
+	browseQuit
+	// return from the details to the list
+	browseBack
+	browseDown
+	browseUp
+	browsePageDown
+	browsePageUp
+	browseTop
+	browseBottom
+	browseDetail
+	browseExtract
+)
+
+// browseKeyAction return the action of key, any key returns from the details
+func browseKeyAction(key string, detail bool) browseAction {
+	if detail {
+		if key == "q" || key == "\x03" {
+			return browseQuit
+		}
+		return browseBack
+	}
+	switch key {
+	case "q", "\x03", "\x1b":
+		return browseQuit
+	case "j", "\x1b[B":
+		return browseDown
+	case "k", "\x1b[A":
+		return browseUp
+	case "\x06", "\x1b[6~", " ":
+		return browsePageDown
+	case "\x02", "\x1b[5~":
+		return browsePageUp
+	case "g", "\x1b[H":
+		return browseTop
+	case "G", "\x1b[F":
+		return browseBottom
+	case "\r", "\n":
+		return browseDetail
+	case "x":
+		return browseExtract
+	}
+	return browseNone
+}
+
+// listRows return the number of entries shown in a screen of height lines, the title and status take a line each
+func listRows(height int) int {
+	return max(height-2, 1)
+}
+
+// handleKey return false if browser should quit
+func (b *browser) handleKey(key string, height int) bool {
+	rows := listRows(height)
+	b.status = ""
+	switch browseKeyAction(key, b.detail) {
+	case browseQuit:
+		return false
+	case browseBack:
+		b.detail = false
+	case browseDown:
+		b.move(1, rows)
+	case browseUp:
+		b.move(-1, rows)
+	case browsePageDown:
+		b.move(rows, rows)
+	case browsePageUp:
+		b.move(-rows, rows)
+	case browseTop:
+		b.move(-len(b.entries), rows)
+	case browseBottom:
+		b.load(len(b.entries) + len(b.paths))
+		b.move(len(b.entries), rows)
+	case browseDetail:
+		if b.cursor < len(b.entries) && b.entries[b.cursor].err == nil {
+			b.detail = true
+		}
+	case browseExtract:
+		b.extract()
+	}
+	return true
+}
+
+func (b *browser) move(delta int, rows int) {
+	b.load(b.cursor + delta + 1)
+	b.cursor, b.offset = scroll(b.cursor, b.offset, delta, rows, len(b.entries))
+}
+
+// scroll move cursor by delta within n entries and return it with the offset of the first shown entry,
+// so the cursor stays in the rows shown
+func scroll(cursor, offset, delta, rows, n int) (int, int) {
+	cursor = min(max(cursor+delta, 0), max(n-1, 0))
+	if cursor < offset {
+		offset = cursor
+	}
+	if cursor >= offset+rows {
+		offset = cursor - rows + 1
+	}
+	return cursor, offset
+}
+
+func (b *browser) extract() {
+	if b.cursor >= len(b.entries) {
+		return
+	}
+	entry := b.entries[b.cursor]
+	if entry.err != nil {
+		b.status = fmt.Sprintf("can not extract %s: %v", filepath.Base(entry.path), entry.err)
+		return
+	}
+	// an existing file is not overwritten
+	demix := &DemixOptions{
+		Output:        b.o.Output,
+		Silence:       true,
+		SanitizeNames: defaultSanitizeNames(),
+		source:        entry.path,
+		password:      b.o.password,
+		ciphers:       b.o.ciphers,
+		root:          b.o.Output,
+		restored:      make(map[string]bool),
+		links:         make(map[string]bool),
+		noOverwrite:   true,
+	}
+	dest, err := demix.decryptFile(entry.path, b.o.Output, false)
+	if err != nil {
+		b.status = printable(fmt.Sprintf("extract %s error: %v", filepath.Base(entry.path), err))
+		return
+	}
+	b.status = printable(fmt.Sprintf("extracted %s -> %s", filepath.Base(entry.path), dest))
+}
+
+func (b *browser) render(out io.Writer, height int) {
+	rows := listRows(height)
+	b.load(b.offset + rows)
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	// clear screen
+	fmt.Fprint(w, "\x1b[H\x1b[2J")
+	if b.detail {
+		fmt.Fprint(w, strings.Join(detailLines(b.entries[b.cursor]), "\r\n"), "\r\n\r\n", "press any key to return")
+		return
+	}
+	renderList(w, b.o.dir, b.entries, b.offset, b.cursor, rows)
+	// status line
+	fmt.Fprintf(w, "\x1b[%d;1H", height)
+	if b.status != "" {
+		fmt.Fprint(w, b.status)
+	} else {
+		fmt.Fprint(w, "j/k: move  enter: details  x: extract  q: quit")
+	}
+}
+
+// renderList write the title dir and rows entries from offset, the entry at cursor is highlighted
+func renderList(w io.Writer, dir string, entries []browseEntry, offset, cursor, rows int) {
+	fmt.Fprintf(w, "\x1b[1m%s\x1b[0m\r\n", printable(dir))
+	if len(entries) == 0 {
+		fmt.Fprint(w, "no emix files\r\n")
+	}
+	for i := offset; i < min(offset+rows, len(entries)); i++ {
+		line := listLine(entries[i])
+		if i == cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		fmt.Fprint(w, line, "\r\n")
+	}
+}
+
+// listLine return the line of entry in the list, the name and size of a file which can not be read are unknown
+func listLine(entry browseEntry) string {
+	if entry.err != nil {
+		return printable(fmt.Sprintf("%-40s  %8s  %s", "?", "-", filepath.Base(entry.path)+" ("+entry.err.Error()+")"))
+	}
+	return printable(fmt.Sprintf("%-40s  %8s  %s", entry.header.FileInfo.Name,
+		strings.ReplaceAll(humanize.Bytes(entry.header.FileInfo.Size), " ", ""),
+		filepath.Base(entry.path)))
+}
+
+// printable replace the control characters of s with '?', names of headers are not trusted
+// and could move the cursor or change the terminal
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return '?'
+	}, s)
+}
+
+// detailLines return the details of entry like stat
+func detailLines(entry browseEntry) []string {
+	info := entry.header.FileInfo
+	lines := []string{
+		fmt.Sprintf("%11s: %s", "File", printable(entry.path)),
+		fmt.Sprintf("%11s: %s", "Name", printable(info.Name)),
+		fmt.Sprintf("%11s: %s (%d)", "Size", humanize.Bytes(info.Size), info.Size),
+		fmt.Sprintf("%11s: %s", "Mode", fs.FileMode(info.Mode)),
+		fmt.Sprintf("%11s: %s", "Create Time", time.Unix(0, int64(info.CreateTime))),
+		fmt.Sprintf("%11s: %s", "Modify Time", time.Unix(0, int64(info.ModifyTime))),
+		fmt.Sprintf("%11s: %x", hashName(entry.header.CipherSuite), info.FileContentHash),
+		fmt.Sprintf("%11s: %t", "Encrypted", entry.header.EncryptData),
+	}
+	if len(info.Preview) > 0 {
+		lines = append(lines, fmt.Sprintf("%11s: %s", "Preview", humanize.Bytes(uint64(len(info.Preview)))))
+	}
+	if info.ToolVersion != "" {
+		lines = append(lines, fmt.Sprintf("%11s: emix %s", "Written By", printable(info.ToolVersion)))
+	}
+	return lines
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icefed/emix"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrowseKeyAction(t *testing.T) {
+	for key, action := range map[string]browseAction{
+		"q": browseQuit, "\x03": browseQuit, "\x1b": browseQuit,
+		"j": browseDown, "\x1b[B": browseDown,
+		"k": browseUp, "\x1b[A": browseUp,
+		" ": browsePageDown, "\x06": browsePageDown, "\x1b[6~": browsePageDown,
+		"\x02": browsePageUp, "\x1b[5~": browsePageUp,
+		"g": browseTop, "\x1b[H": browseTop,
+		"G": browseBottom, "\x1b[F": browseBottom,
+		"\r": browseDetail, "\n": browseDetail,
+		"x": browseExtract,
+		"z": browseNone,
+	} {
+		assert.Equal(t, action, browseKeyAction(key, false), "%q", key)
+	}
+	// any key returns from the details
+	assert.Equal(t, browseQuit, browseKeyAction("q", true))
+	assert.Equal(t, browseBack, browseKeyAction("j", true))
+	assert.Equal(t, browseBack, browseKeyAction("\x1b", true))
+}
+
+func TestBrowseScroll(t *testing.T) {
+	for _, test := range []struct {
+		cursor, offset, delta, rows, n int
+		wantCursor, wantOffset         int
+	}{
+		{0, 0, 1, 5, 10, 1, 0},
+		{4, 0, 1, 5, 10, 5, 1},
+		{5, 1, -1, 5, 10, 4, 1},
+		{1, 1, -1, 5, 10, 0, 0},
+		{0, 0, 5, 5, 10, 5, 1},
+		{9, 5, 5, 5, 10, 9, 5},
+		{3, 0, -10, 5, 10, 0, 0},
+		{0, 0, 1, 5, 0, 0, 0},
+	} {
+		cursor, offset := scroll(test.cursor, test.offset, test.delta, test.rows, test.n)
+		assert.Equal(t, []int{test.wantCursor, test.wantOffset}, []int{cursor, offset}, test)
+	}
+	assert.Equal(t, 1, listRows(2))
+	assert.Equal(t, 22, listRows(24))
+}
+
+func TestBrowseRender(t *testing.T) {
+	header := &emix.EmixHeader{EncryptData: true, FileInfo: emix.FileInfo{Name: "a.txt", Size: 2048, ToolVersion: "v1.2.3"}}
+	entries := []browseEntry{
+		{path: "/emix/1.zip", header: header},
+		{path: "/emix/2.zip", err: errors.New("wrong password")},
+		{path: "/emix/3.zip", header: header},
+	}
+	assert.Equal(t, fmt.Sprintf("%-40s  %8s  %s", "a.txt", "2.0kB", "1.zip"), listLine(entries[0]))
+	assert.Equal(t, fmt.Sprintf("%-40s  %8s  %s", "?", "-", "2.zip (wrong password)"), listLine(entries[1]))
+
+	// rows entries from offset, the cursor is highlighted
+	buf := bytes.NewBuffer(nil)
+	renderList(buf, "/emix", entries, 1, 1, 2)
+	lines := strings.Split(buf.String(), "\r\n")
+	assert.Equal(t, []string{"\x1b[1m/emix\x1b[0m", "\x1b[7m" + listLine(entries[1]) + "\x1b[0m", listLine(entries[2]), ""}, lines)
+	buf.Reset()
+	renderList(buf, "/emix", nil, 0, 0, 2)
+	assert.Equal(t, "\x1b[1m/emix\x1b[0m\r\nno emix files\r\n", buf.String())
+
+	lines = detailLines(entries[0])
+	assert.Contains(t, lines, "       Name: a.txt")
+	assert.Contains(t, lines, "       Size: 2.0 kB (2048)")
+	assert.Contains(t, lines, "  Encrypted: true")
+	assert.Contains(t, lines, " Written By: emix v1.2.3")
+	assert.Contains(t, lines, fmt.Sprintf("     SHA256: %x", header.FileInfo.FileContentHash))
+
+	// the hash is named by the cipher suite
+	chacha := &emix.EmixHeader{CipherSuite: emix.CipherSuiteChaCha20, FileInfo: emix.FileInfo{Name: "a.txt"}}
+	assert.Contains(t, detailLines(browseEntry{path: "/emix/4.zip", header: chacha}), fmt.Sprintf("    BLAKE2B: %x", chacha.FileInfo.FileContentHash))
+
+	// control characters of names are not written to the terminal
+	escaped := &emix.EmixHeader{FileInfo: emix.FileInfo{Name: "a\x1b[2J\x07.txt"}}
+	entry := browseEntry{path: "/emix/5.zip", header: escaped}
+	assert.Equal(t, fmt.Sprintf("%-40s  %8s  %s", "a?[2J?.txt", "0B", "5.zip"), listLine(entry))
+	assert.Contains(t, detailLines(entry), "       Name: a?[2J?.txt")
+}
+
+func TestBrowser(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	files := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("%02d.txt", i)] = "content"
+	}
+	writeTestTree(t, src, files)
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	// not an emix file, it is skipped
+	assert.Nil(t, os.WriteFile(filepath.Join(out, "plain.txt"), []byte("plain"), 0644))
+
+	extracted := filepath.Join(tmp, "extracted")
+	assert.Nil(t, os.Mkdir(extracted, 0755))
+	b, err := newBrowser(&BrowseOptions{Output: extracted, dir: out, ciphers: emix.NewCipherCache()})
+	assert.Nil(t, err)
+	// headers are parsed lazily
+	buf := bytes.NewBuffer(nil)
+	b.render(buf, 5)
+	assert.Len(t, b.entries, 3)
+	assert.Contains(t, buf.String(), "00.txt")
+	assert.NotContains(t, buf.String(), "03.txt")
+	assert.Contains(t, buf.String(), "j/k: move")
+
+	for _, key := range []string{"j", "j", "j"} {
+		assert.True(t, b.handleKey(key, 5))
+	}
+	assert.Equal(t, 3, b.cursor)
+	assert.Equal(t, 1, b.offset)
+	assert.True(t, b.handleKey("G", 5))
+	assert.Equal(t, 9, b.cursor)
+	assert.Len(t, b.entries, 10)
+	assert.True(t, b.handleKey("g", 5))
+	assert.Equal(t, 0, b.cursor)
+
+	// details, any key returns
+	assert.True(t, b.handleKey("\r", 5))
+	assert.True(t, b.detail)
+	buf.Reset()
+	b.render(buf, 5)
+	assert.Contains(t, buf.String(), "Name: 00.txt")
+	assert.True(t, b.handleKey("j", 5))
+	assert.False(t, b.detail)
+	assert.Equal(t, 0, b.cursor)
+
+	assert.True(t, b.handleKey("x", 5))
+	assert.Contains(t, b.status, "extracted")
+	data, err := os.ReadFile(filepath.Join(extracted, "00.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "content", string(data))
+	assert.Contains(t, b.status, filepath.Join(extracted, "00.txt"))
+	buf.Reset()
+	b.render(buf, 5)
+	assert.Contains(t, buf.String(), b.status)
+
+	// an existing file is not overwritten
+	assert.Nil(t, os.WriteFile(filepath.Join(extracted, "00.txt"), []byte("mine"), 0644))
+	assert.True(t, b.handleKey("x", 5))
+	assert.Contains(t, b.status, "already exists")
+	data, err = os.ReadFile(filepath.Join(extracted, "00.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mine", string(data))
+
+	assert.False(t, b.handleKey("q", 5))
+}
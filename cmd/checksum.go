@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarChecksumExt is appended to an output to name its checksum sidecar
+const sidecarChecksumExt = ".sha256"
+
+// sha256sumLine format a line of sha256sum output, names with a backslash or newline are escaped like sha256sum
+func sha256sumLine(hash []byte, name string) string {
+	prefix := ""
+	if strings.ContainsAny(name, "\\\n") {
+		prefix = "\\"
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+	}
+	return fmt.Sprintf("%s%s  %s\n", prefix, hex.EncodeToString(hash), name)
+}
+
+// writeSidecarChecksum write the checksum sidecar of output dest, the content hash of the original name
+// or the sha256 of dest itself if ciphertext is set
+func writeSidecarChecksum(dest, name string, contentHash []byte, ciphertext bool) error {
+	if ciphertext {
+		f, err := os.Open(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+		contentHash = hash.Sum(nil)
+		name = filepath.Base(dest)
+	}
+	return os.WriteFile(dest+sidecarChecksumExt, []byte(sha256sumLine(contentHash, name)), 0644)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type CompareOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	// password of the second file, default is the password of the first file
+	PasswordB       bool
+	CredentialFileB string
+
+	paths     [2]string
+	passwords [2][16]byte
+
+	out io.Writer
+}
+
+func newCmdCompare() *cobra.Command {
+	o := &CompareOptions{}
+	cmd := &cobra.Command{
+		Use:   "compare <path> <path>",
+		Short: "check if two emix files hold the same original content.",
+		Long: `Check if two emix files hold the same original content by the content hash of headers, and if name, size and times match.
+Content is not decrypted, files mixed with different passwords or settings can be compared. Exit with error if content differs.`,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0], args[1]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().BoolVar(&o.PasswordB, "password-b", false, "Use another password to decrypt the second file. Default is the password of the first file. Conflicts with --credential-file-b.")
+	cmd.Flags().StringVar(&o.CredentialFileB, "credential-file-b", "", "Use another credential file as password of the second file. Conflicts with --password-b.")
+	return cmd
+}
+
+func (o *CompareOptions) Validate(a, b string) error {
+	for i, path := range []string{a, b} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("path %s is not a regular file", path)
+		}
+		o.paths[i] = filepath.Clean(path)
+	}
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.PasswordB && o.CredentialFileB != "" {
+		return errors.New("can not set both --password-b and --credential-file-b")
+	}
+	var err error
+	if o.passwords[0], err = comparePassword(o.Password, o.CredentialFile, a); err != nil {
+		return err
+	}
+	o.passwords[1] = o.passwords[0]
+	if o.PasswordB || o.CredentialFileB != "" {
+		if o.passwords[1], err = comparePassword(o.PasswordB, o.CredentialFileB, b); err != nil {
+			return err
+		}
+	}
+	o.out = os.Stdout
+	return nil
+}
+
+// comparePassword input password of path or generate it from credentialFile
+func comparePassword(input bool, credentialFile, path string) ([16]byte, error) {
+	var key [16]byte
+	if input {
+		fmt.Fprintf(os.Stderr, "Password of %s\n", path)
+		password, err := inputPassword()
+		if err != nil {
+			return key, err
+		}
+		key = emix.PasswordKey(password)
+	}
+	if credentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(credentialFile)
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], password)
+	}
+	return key, nil
+}
+
+func (o *CompareOptions) Run() error {
+	var headers [2]*emix.EmixHeader
+	for i, path := range o.paths {
+		header, err := compareHeader(path, o.passwords[i])
+		if err != nil {
+			return err
+		}
+		headers[i] = header
+	}
+	a, b := &headers[0].FileInfo, &headers[1].FileInfo
+
+	// content hashes of different suites are computed by different algorithms
+	content := "same"
+	var err error
+	switch {
+	case headers[0].CipherSuite != headers[1].CipherSuite:
+		content = fmt.Sprintf("unknown, content is hashed by %s and %s", headers[0].CipherSuite, headers[1].CipherSuite)
+		err = errors.New("can not compare content of different cipher suites")
+	case a.Size != b.Size || a.FileContentHash != b.FileContentHash:
+		content = "different"
+		err = errors.New("content differs")
+	}
+
+	tw := tabwriter.NewWriter(o.out, 0, 0, 1, ' ', tabwriter.TabIndent)
+	fmt.Fprintf(tw, "%11s:\t%s\n", "Content", content)
+	fmt.Fprintf(tw, "%11s:\t%s\n", "Name", compareField(a.Name, b.Name))
+	fmt.Fprintf(tw, "%11s:\t%s\n", "Size", compareField(a.Size, b.Size))
+	fmt.Fprintf(tw, "%11s:\t%s\n", "Create Time", compareField(time.Unix(0, int64(a.CreateTime)), time.Unix(0, int64(b.CreateTime))))
+	fmt.Fprintf(tw, "%11s:\t%s\n", "Modify Time", compareField(time.Unix(0, int64(a.ModifyTime)), time.Unix(0, int64(b.ModifyTime))))
+	tw.Flush()
+	return err
+}
+
+// compareHeader read the emix header of path, the password is required if file info is encrypted
+func compareHeader(path string, password [16]byte) (*emix.EmixHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ok, err := emix.IsEmixFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("not emix file: %s", path)
+	}
+	header := &emix.EmixHeader{Password: password}
+	if err := header.UnmarshalFromFile(f); err != nil {
+		if header.EncryptInfo && !header.EmbedPassword {
+			return nil, fmt.Errorf("read header of %s error: %v, file info is encrypted, check the password", path, err)
+		}
+		return nil, fmt.Errorf("read header of %s error: %v", path, err)
+	}
+	return header, nil
+}
+
+// compareField return same if a equals b, otherwise both values
+func compareField[T comparable](a, b T) string {
+	if a == b {
+		return "same"
+	}
+	return fmt.Sprintf("%v != %v", a, b)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "same content",
+		"b.txt": "other content",
+	})
+	credentialA := filepath.Join(tmp, "credential-a")
+	assert.Nil(t, os.WriteFile(credentialA, []byte("a"), 0600))
+	credentialB := filepath.Join(tmp, "credential-b")
+	assert.Nil(t, os.WriteFile(credentialB, []byte("b"), 0600))
+
+	mix := func(out, credentialFile string, mixType int, name string) string {
+		t.Helper()
+		domix := &DomixOptions{
+			MixType:        mixType,
+			CredentialFile: credentialFile,
+			KeepName:       true,
+			Output:         filepath.Join(tmp, out),
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(filepath.Join(src, name)))
+		assert.Nil(t, domix.Run())
+		return filepath.Join(tmp, out, name)
+	}
+	a := mix("a", credentialA, 2, "a.txt")
+	b := mix("b", credentialB, 1, "a.txt")
+	other := mix("c", credentialA, 2, "b.txt")
+
+	buf := bytes.NewBuffer(nil)
+	compare := &CompareOptions{CredentialFile: credentialA, CredentialFileB: credentialB}
+	assert.Nil(t, compare.Validate(a, b))
+	compare.out = buf
+	assert.Nil(t, compare.Run())
+	assert.Regexp(t, `Content: +same\n`, buf.String())
+	assert.Regexp(t, `Name: +same\n`, buf.String())
+	assert.Regexp(t, `Modify Time: +same\n`, buf.String())
+
+	// the second file needs its own password
+	compare = &CompareOptions{CredentialFile: credentialA}
+	assert.Nil(t, compare.Validate(a, b))
+	compare.out = buf
+	err := compare.Run()
+	assert.ErrorContains(t, err, "file info is encrypted")
+
+	buf.Reset()
+	compare = &CompareOptions{CredentialFile: credentialA}
+	assert.Nil(t, compare.Validate(a, other))
+	compare.out = buf
+	assert.ErrorContains(t, compare.Run(), "content differs")
+	assert.Regexp(t, `Content: +different\n`, buf.String())
+	assert.Regexp(t, `Name: +a.txt != b.txt\n`, buf.String())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is the config file of flag defaults, read from the working directory or home.
+// It is YAML or JSON with a section of flags by command name, e.g.
+//
+//	domix:
+//	  type: 2
+//	  excludes: [".*", "*.log"]
+//	  credential-file: /path/to/credential
+const configFileName = ".emixrc"
+
+// envFlags are flags whose defaults come from environment variables, which take precedence over config
+var envFlags = map[string]string{
+	"excludes": excludesEnv,
+}
+
+// findConfig return the path of config file in the working directory or home, empty if there is none
+func findConfig() (string, error) {
+	dirs := []string{"."}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, home)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// readConfig parse the flag values by command name of config file
+func readConfig(path string) (map[string]map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]map[string]any{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse config %s error: %v", path, err)
+	}
+	return config, nil
+}
+
+// loadConfig apply the config file to the flag defaults of cmd
+func loadConfig(cmd *cobra.Command) error {
+	path, err := findConfig()
+	if err != nil || path == "" {
+		return err
+	}
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(cmd, config[cmd.Name()]); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return nil
+}
+
+// applyConfig set flags of cmd from values, precedence is flag, environment variable, config, built-in default
+func applyConfig(cmd *cobra.Command, values map[string]any) error {
+	for name, value := range values {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("unknown flag %q of %s", name, cmd.Name())
+		}
+		if flag.Changed {
+			continue
+		}
+		if env, ok := envFlags[name]; ok && os.Getenv(env) != "" {
+			continue
+		}
+		if err := setFlag(flag, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setFlag set flag from a config value, a list replaces the default of a slice flag
+func setFlag(flag *pflag.Flag, value any) error {
+	list, isList := value.([]any)
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if !isList {
+			list = []any{value}
+		}
+		values := make([]string, 0, len(list))
+		for _, v := range list {
+			values = append(values, fmt.Sprint(v))
+		}
+		return slice.Replace(values)
+	}
+	if isList {
+		return errors.New("a list is only allowed for list flags")
+	}
+	return flag.Value.Set(fmt.Sprint(value))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyConfig(t *testing.T) {
+	config := map[string]any{
+		"type":      2,
+		"keep-name": true,
+		"excludes":  []any{"*.log"},
+	}
+
+	t.Setenv(excludesEnv, "*.tmp")
+	cmd := newCmdDomix()
+	assert.Nil(t, cmd.ParseFlags([]string{"--type", "1"}))
+	assert.Nil(t, applyConfig(cmd, config))
+	// flag
+	mixType, _ := cmd.Flags().GetInt("type")
+	assert.Equal(t, 1, mixType)
+	// environment variable
+	excludes, _ := cmd.Flags().GetStringSlice("excludes")
+	assert.Equal(t, []string{".*", "*.tmp"}, excludes)
+	// config
+	keepName, _ := cmd.Flags().GetBool("keep-name")
+	assert.True(t, keepName)
+	// built-in default
+	sectorSize, _ := cmd.Flags().GetInt("sector-size")
+	assert.Equal(t, 0, sectorSize)
+
+	t.Setenv(excludesEnv, "")
+	cmd = newCmdDomix()
+	assert.Nil(t, cmd.ParseFlags(nil))
+	assert.Nil(t, applyConfig(cmd, config))
+	mixType, _ = cmd.Flags().GetInt("type")
+	assert.Equal(t, 2, mixType)
+	excludes, _ = cmd.Flags().GetStringSlice("excludes")
+	assert.Equal(t, []string{"*.log"}, excludes)
+
+	cmd = newCmdDomix()
+	assert.ErrorContains(t, applyConfig(cmd, map[string]any{"no-such-flag": 1}), "unknown flag")
+	assert.NotNil(t, applyConfig(cmd, map[string]any{"type": "two"}))
+	assert.NotNil(t, applyConfig(cmd, map[string]any{"type": []any{1, 2}}))
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmp := t.TempDir()
+	home := filepath.Join(tmp, "home")
+	work := filepath.Join(tmp, "work")
+	assert.Nil(t, os.MkdirAll(home, 0755))
+	assert.Nil(t, os.MkdirAll(work, 0755))
+	t.Setenv("HOME", home)
+	t.Setenv(excludesEnv, "")
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(work))
+	defer os.Chdir(wd)
+
+	// no config
+	cmd := newCmdDemix()
+	assert.Nil(t, loadConfig(cmd))
+
+	// yaml in home
+	assert.Nil(t, os.WriteFile(filepath.Join(home, configFileName), []byte("demix:\n  output: restored\n  mmap: never\n"), 0644))
+	cmd = newCmdDemix()
+	assert.Nil(t, loadConfig(cmd))
+	output, _ := cmd.Flags().GetString("output")
+	assert.Equal(t, "restored", output)
+
+	// json in the working directory is used first, sections of other commands are ignored
+	assert.Nil(t, os.WriteFile(configFileName, []byte(`{"demix": {"output": "here"}, "domix": {"type": 2}}`), 0644))
+	cmd = newCmdDemix()
+	assert.Nil(t, loadConfig(cmd))
+	output, _ = cmd.Flags().GetString("output")
+	assert.Equal(t, "here", output)
+	mmap, _ := cmd.Flags().GetString("mmap")
+	assert.Equal(t, "auto", mmap)
+
+	assert.Nil(t, os.WriteFile(configFileName, []byte("demix: [1"), 0644))
+	assert.ErrorContains(t, loadConfig(newCmdDemix()), "parse config")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/icefed/emix"
+)
+
+const (
+	// credentialCommandMaxOutput is the max stdout length of --credential-command
+	credentialCommandMaxOutput = 1 << 20
+	// credentialStrengthSampleLength is the bytes of credential file checked by --verify-password-strength,
+	// a longer file is strong enough
+	credentialStrengthSampleLength = 4096
+	// strongPasswordBits is the min estimated entropy of --verify-password-strength
+	strongPasswordBits = 50
+)
+
+// readCredential generate password from the credential file, or the stdout of the credential command
+func readCredential(credentialFile, credentialCommand string) ([]byte, error) {
+	if credentialFile != "" {
+		return emix.GeneratePasswordFromFile(credentialFile)
+	}
+	return runCredentialCommand(credentialCommand)
+}
+
+// runCredentialCommand run command by the shell and generate password from its stdout, hashed like a
+// credential file with the same content, output is used as is including a trailing newline.
+// The command runs with the privileges of user, stdin and stderr are inherited so it may prompt,
+// e.g. for the passphrase of a secret manager. It fails if the command exits with error or prints nothing.
+func runCredentialCommand(command string) ([]byte, error) {
+	if command == "" {
+		return nil, errors.New("empty credential command")
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Run credential command error: %v", err)
+	}
+	// read one more byte to detect output over the limit
+	credential, err := io.ReadAll(io.LimitReader(stdout, credentialCommandMaxOutput+1))
+	// drain the rest so the command is not blocked on a full pipe
+	io.Copy(io.Discard, stdout)
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return nil, fmt.Errorf("Run credential command error: %v", waitErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Read credential command output error: %v", err)
+	}
+	if len(credential) == 0 {
+		return nil, errors.New("credential command printed nothing")
+	}
+	if len(credential) > credentialCommandMaxOutput {
+		return nil, fmt.Errorf("credential command output is larger than %d bytes", credentialCommandMaxOutput)
+	}
+	return emix.GeneratePasswordFromReader(bytes.NewReader(credential))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestCredentialCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake command uses sh")
+	}
+	tmp := t.TempDir()
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential\n"), 0600))
+	expected, err := emix.GeneratePasswordFromFile(credentialFile)
+	assert.Nil(t, err)
+
+	// the output is hashed like a file with the same content
+	password, err := runCredentialCommand("echo credential")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, password)
+
+	_, err = runCredentialCommand("echo credential; exit 3")
+	assert.ErrorContains(t, err, "exit status 3")
+	_, err = runCredentialCommand("true")
+	assert.ErrorContains(t, err, "printed nothing")
+	_, err = runCredentialCommand("head -c 1048577 /dev/zero")
+	assert.ErrorContains(t, err, "larger than")
+
+	// mixed by command, de-mixed by the file
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "a"})
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, CredentialCommand: "echo credential", Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	assert.NotNil(t, (&DemixOptions{CredentialFile: credentialFile, CredentialCommand: "echo credential", Output: demixOut}).Validate(out))
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, CredentialCommand: "echo credential", Output: out}).Validate(src))
+}
+
+func TestDomixRequireStrong(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+	weak := filepath.Join(tmp, "weak")
+	assert.Nil(t, os.WriteFile(weak, []byte("password1"), 0600))
+	strong := filepath.Join(tmp, "strong")
+	assert.Nil(t, os.WriteFile(strong, []byte("x7#Kq9!vL2@mZp4w"), 0600))
+	out := filepath.Join(tmp, "out")
+
+	// a weak credential only warns
+	assert.Nil(t, (&DomixOptions{MixType: 2, CredentialFile: weak, VerifyPasswordStrength: true, Output: out}).Validate(src))
+	assert.ErrorContains(t, (&DomixOptions{MixType: 2, CredentialFile: weak, RequireStrong: true, Output: out}).Validate(src), "too weak")
+	assert.Nil(t, (&DomixOptions{MixType: 2, CredentialFile: strong, RequireStrong: true, Output: out}).Validate(src))
+	// embed password is generated
+	assert.Nil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, RequireStrong: true, Output: out}).Validate(src))
+}
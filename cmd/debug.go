@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// debugEnv enable debug logs to stderr if it is not empty
+const debugEnv = "EMIX_DEBUG"
+
+var debugOut io.Writer = os.Stderr
+
+// debugf log a debug message if EMIX_DEBUG is set
+func debugf(format string, args ...any) {
+	if os.Getenv(debugEnv) == "" {
+		return
+	}
+	fmt.Fprintf(debugOut, "debug: "+format+"\n", args...)
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"text/template"
 	"time"
 
 	ignore "github.com/sabhiram/go-gitignore"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
 
 	"github.com/icefed/emix"
 )
@@ -22,52 +26,262 @@ type DemixOptions struct {
 	// read password from stdin if Password is true
 	Password       bool
 	CredentialFile string
-	Output         string
-	Excludes       []string
-	Silence        bool
+	// run the command and use its stdout as credential file
+	CredentialCommand string
+	// get password from agent before prompting
+	UseAgent bool
+	// read password from the OS keyring under the service name
+	Keyring string
+	// recovery code printed by domix --recovery-code
+	RecoveryCode string
+	Output       string
+	Excludes     []string
+	Silence      bool
+	// off, reject or rename names invalid on windows
+	SanitizeNames string
+	// auto, always or never decrypt content over mapped files
+	Mmap string
+	// retry a file or a content write failed with a temporary error
+	Retry int
+	// max bytes per second of content writes, e.g. 10MB
+	RateLimit string
+	// put outputs of a directory under its base name in Output
+	PreserveRootName bool
+	// flush outputs and their directories to disk
+	Fsync bool
+	// octal permission bits of created files, default is 0666 before umask
+	Mode string
+	// de-mix outputs again while they are emix files
+	RecurseNested bool
+	// only restore files whose relative path in source tree is under the prefix
+	PathPrefix string
+	// restore the emix entries of a real zip archive instead of a path
+	FromZip string
+	// do not restore xattrs recorded in header
+	NoXattrs bool
+	// do not restore POSIX ACLs and file capabilities recorded in header
+	NoACLs bool
+	// restore the owner recorded in header, names are resolved to local ids unless NumericOwner is set
+	SameOwner    bool
+	NumericOwner bool
+	// write restored files with their recorded metadata to a gzip-compressed tar instead of Output
+	ToTarGz string
+	// text/template of the restored path relative to Output, see destTemplateData
+	DestTemplate string
+	// restore all files directly in Output without the directories of source
+	Flatten bool
+	// replace emix files with their restored files, keep the emix files as <path>.bak if Backup is set
+	InPlace bool
+	Backup  bool
+	// prompt for the password of a file failed with the password, entered passwords are tried for later files
+	PromptOnce bool
+	// only restore the files of source directory listed in the file, "-" is stdin
+	FilesFrom string
+	// listed files are separated by NUL instead of newline
+	Null bool
+	// accept kdf params over the read limit of emix
+	AllowLargeKDF bool
 
 	source      string
 	sourceIsDir bool
+	// source is an emix bundle, its files are restored like unpack
+	bundle bool
+	// files of FilesFrom relative to source
+	files []string
+	// output directory of files in source directory
+	root string
+	mode fs.FileMode
+	// limiter of RateLimit shared by all files
+	limiter *rate.Limiter
 
 	password      [16]byte
 	ignoreMatcher *ignore.GitIgnore
+	ciphers       *emix.CipherCache
+	// lower case paths of restored files
+	restored map[string]bool
+	// paths of restored symlinks, once one is restored a directory of Output could be a symlink
+	links map[string]bool
+	// archive of ToTarGz, files are restored to a temporary Output first
+	tarWriter *tar.Writer
+	// parsed DestTemplate
+	destTemplate *template.Template
+	// passwords entered by PromptOnce
+	passwords [][16]byte
+	// fail instead of replacing an existing file, set if Output defaults to the current directory
+	noOverwrite bool
+}
+
+// readFilePassword prompt for the password of path, it is replaced in tests
+var readFilePassword = func(path string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%s needs another password\n", path)
+	return inputPassword()
 }
 
 func newCmdDemix() *cobra.Command {
 	o := &DemixOptions{}
 	cmd := &cobra.Command{
-		Use:     "demix <path>",
+		Use:     "demix <path> | --from-zip <archive>",
 		Short:   "de-mix the files of the path.",
 		Long:    ``,
 		GroupID: "general",
-		Args:    cobra.ExactArgs(1),
+		Args:    cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			cobra.CheckErr(o.Validate(args[0]))
+			source := ""
+			if len(args) > 0 {
+				source = args[0]
+			}
+			cobra.CheckErr(o.Validate(source))
 			cobra.CheckErr(o.Run())
 		},
 	}
 	cmd.Flags().SortFlags = false
-	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt, max length is 16 bytes. Conflicts with --credential-file.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
 	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
-	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output directory, default is emix_%datetime(format: 2006-01-02 15.04.05).")
-	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", []string{".*"}, "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files. Multi patterns can be separated by comma.")
+	cmd.Flags().StringVar(&o.CredentialCommand, "credential-command", "", "Run COMMAND by the shell and use its stdout as a credential file, e.g. 'pass show emix'. The command runs as you with the terminal as stdin, only use commands you trust. Conflicts with --credential-file, same conflicts as --credential-file otherwise.")
+	cmd.Flags().BoolVar(&o.UseAgent, "use-agent", false, "Get password from emix agent, prompt if the agent is unavailable. Conflicts with --password, --credential-file and --keyring.")
+	cmd.Flags().StringVar(&o.RecoveryCode, "recovery-code", "", "Use the recovery code printed by domix --recovery-code as password. Conflicts with --password, --credential-file, --use-agent and --keyring.")
+	cmd.Flags().StringVar(&o.Keyring, "keyring", "", "Read password from the OS keyring under SERVICE, prompt if the entry is missing. Conflicts with --password and --credential-file.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output directory, default is emix_%datetime(format: 2006-01-02 15.04.05) if <path> is directory, the current directory if <path> is a file, an existing file is not overwritten then.")
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	cmd.Flags().StringVar(&o.SanitizeNames, "sanitize-names", defaultSanitizeNames(), "Check names invalid on windows, e.g. CON, aux.txt, trailing dots or `:`. off: no check, reject: fail with error, rename: append or replace with `_`. Default is rename on windows, off on others.")
+	cmd.Flags().StringVar(&o.Mmap, "mmap", "auto", "Decrypt content over memory mapped files. auto: only files larger than 64MB, always, never. Fall back to read and write if the file can not be mapped.")
+	cmd.Flags().IntVar(&o.Retry, "retry", 0, "Retry a file or a content write up to N times with exponential backoff if it fails with a temporary error, e.g. on network storage.")
+	cmd.Flags().StringVar(&o.RateLimit, "rate-limit", "", "Limit content writes of all files to RATE bytes per second, e.g. 512KiB or 10MB, so a network share is not saturated. Files are not memory mapped if it is set.")
+	cmd.Flags().BoolVar(&o.PreserveRootName, "preserve-root-name", false, "Put outputs under a directory named as <path> in output directory, e.g. <output>/docs/... for docs, like tar. Only if <path> is directory.")
+	cmd.Flags().BoolVar(&o.Fsync, "fsync", false, "Flush each output and its directory to disk after it is written, so outputs survive a power loss.")
+	cmd.Flags().StringVar(&o.Mode, "mode", "", "Octal permission bits of restored files, e.g. 0600, umask is not applied. Default is 0666 before umask, demix does not restore the original mode recorded in header, unpack does.")
+	cmd.Flags().StringVar(&o.PathPrefix, "path-prefix", "", "Only restore files whose path in the tree of <path> is or is under PREFIX, e.g. photos/2023, other files are skipped. Applied with --excludes.")
+	cmd.Flags().StringVar(&o.FromZip, "from-zip", "", "Restore the emix files in a real zip archive, e.g. emix files zipped to be emailed, instead of <path>. Other entries are skipped, directories of entries are kept. Applied with --excludes and --path-prefix.")
+	cmd.Flags().BoolVar(&o.NoXattrs, "no-xattrs", false, "Do not restore extended attributes recorded by domix. An attribute which can not be set is ignored with a notice, e.g. security.* without privileges.")
+	cmd.Flags().BoolVar(&o.NoACLs, "no-acls", false, "Do not restore POSIX ACLs and file capabilities recorded by domix. On linux the access ACL is set before other xattrs and capabilities after the owner and content, they are skipped on other systems.")
+	cmd.Flags().BoolVar(&o.SameOwner, "same-owner", os.Geteuid() == 0, "Restore the owner recorded by domix --record-owner, the user and group names are mapped to local ids, the recorded ids are used if a name is unknown. Default is true for root, like tar.")
+	cmd.Flags().BoolVar(&o.NumericOwner, "numeric-owner", false, "Restore the recorded uid and gid as is, ignore the user and group names, like tar.")
+	cmd.Flags().StringVar(&o.ToTarGz, "to-tar-gz", "", "Write restored files to a gzip-compressed tar archive instead of a directory, with the mode, modify time, owner and xattrs recorded in header as PAX records. Each file is staged in a temporary directory. Conflicts with --output and --recurse-nested.")
+	cmd.Flags().StringVar(&o.DestTemplate, "dest-template", "", "Go text/template of the restored path under output instead of the path in <path>, e.g. '{{.ModifyTime.Year}}/{{.Name}}'. Fields: Name, RelPath, ModifyTime, Hash, Size. The path must stay in output, directories of <path> are not created.")
+	cmd.Flags().BoolVar(&o.Flatten, "flatten", false, "Restore all files directly in output without the directories of <path>. A file with the same name as a restored file is renamed with a number, e.g. a_1.txt. Applied after --path-prefix. Conflicts with --dest-template and --in-place.")
+	cmd.Flags().BoolVar(&o.InPlace, "in-place", false, "Replace each emix file with its restored file, e.g. to unlock a file locked by domix --in-place. The restored file is written to a temporary file and renamed over the emix file, it keeps the permission of the emix file unless --mode is set, the recorded name is not used. Conflicts with --output, --to-tar-gz, --from-zip, --dest-template, --preserve-root-name and --recurse-nested.")
+	cmd.Flags().BoolVar(&o.Backup, "backup", false, "Keep an emix file replaced by --in-place as <path>.bak, fail if the backup exists.")
+	cmd.Flags().BoolVar(&o.PromptOnce, "prompt-once", false, "Prompt for the password of a file which fails with the password instead of failing, e.g. a directory of files mixed with different passwords. Each entered password is prompted once, it is tried for later files before prompting again. Only wrong passwords of encrypted file info and content hash mismatches of encrypted content trigger the prompt.")
+	cmd.Flags().BoolVar(&o.RecurseNested, "recurse-nested", false, fmt.Sprintf("De-mix an output again if it is an emix file, e.g. a file mixed twice, up to %d levels. The same password is tried first, prompt for the password of nested file if it fails.", maxNestedDepth))
+	cmd.Flags().StringVar(&o.FilesFrom, "files-from", "", "Only restore the emix files listed in FILE instead of walking <path>, one path per line, - reads stdin. Paths are relative to the current directory or absolute and must be in <path>, restored files keep their structure under <path>. --excludes is not applied. Conflicts with --from-zip, and with --password if FILE is -.")
+	cmd.Flags().BoolVar(&o.Null, "null", false, "Paths of --files-from are separated by NUL instead of newline, e.g. find -print0.")
+	cmd.Flags().BoolVar(&o.AllowLargeKDF, "allow-large-kdf", false, fmt.Sprintf("Accept argon2id params over %d MiB of memory or %d passes in header, e.g. files mixed with a large --kdf-memory. Only for files of a trusted source, a crafted header could take a lot of memory and time.", emix.MaxReadKDFMemory/1024, emix.MaxReadKDFTime))
 	cmd.Flags().BoolVar(&o.Silence, "silence", false, "Silence all output")
 	return cmd
 }
 
+// hasCredential report if password is generated from a credential file or command
+func (o *DemixOptions) hasCredential() bool {
+	return o.CredentialFile != "" || o.CredentialCommand != ""
+}
+
 func (o *DemixOptions) Validate(source string) error {
+	if o.FromZip != "" {
+		if source != "" {
+			return errors.New("can not set both <path> and --from-zip")
+		}
+		source = o.FromZip
+	} else if source == "" {
+		return errors.New("need <path> or --from-zip")
+	}
 	info, err := os.Stat(source)
 	if err != nil {
 		return err
 	}
+	if o.FromZip != "" {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("--from-zip %s is not a regular file", source)
+		}
+		if err := checkZip(source); err != nil {
+			return err
+		}
+	}
 	o.source = filepath.Clean(source)
 	if info.IsDir() {
 		o.sourceIsDir = true
 	}
+	if !o.sourceIsDir && o.FromZip == "" {
+		if o.bundle, err = isBundleFile(o.source); err != nil {
+			return err
+		}
+	}
+	if o.bundle && (o.ToTarGz != "" || o.InPlace || o.DestTemplate != "" || o.Flatten || o.RecurseNested) {
+		return errors.New("can not set --to-tar-gz, --in-place, --dest-template, --flatten or --recurse-nested with a bundle")
+	}
+
+	if o.FilesFrom != "" && o.FromZip != "" {
+		return errors.New("can not set both --files-from and --from-zip")
+	}
+	if err := validateFilesFrom(o.FilesFrom, o.Null, o.sourceIsDir, o.Password); err != nil {
+		return err
+	}
+	if o.FilesFrom != "" {
+		if o.files, err = readFilesFrom(o.FilesFrom, o.Null, o.source); err != nil {
+			return err
+		}
+	}
 
-	if o.Password && o.CredentialFile != "" {
+	switch o.SanitizeNames {
+	case "", sanitizeNamesOff, sanitizeNamesReject, sanitizeNamesRename:
+	default:
+		return errors.New("invalid --sanitize-names, only support off, reject, rename")
+	}
+	if err := validateMmap(o.Mmap); err != nil {
+		return err
+	}
+	if o.Mode != "" {
+		mode, err := parseMode(o.Mode)
+		if err != nil {
+			return err
+		}
+		o.mode = mode
+	}
+	if o.Retry < 0 {
+		return errors.New("invalid --retry, must not be negative")
+	}
+	if o.RateLimit != "" {
+		limiter, err := parseRateLimit(o.RateLimit)
+		if err != nil {
+			return err
+		}
+		o.limiter = limiter
+	}
+	if o.CredentialFile != "" && o.CredentialCommand != "" {
+		return errors.New("can not set both --credential-file and --credential-command")
+	}
+	if o.Password && o.hasCredential() {
 		return errors.New("can not set both --password and --credential-file")
 	}
+	if o.Keyring != "" && (o.Password || o.hasCredential()) {
+		return errors.New("can not set both --keyring and --password or --credential-file")
+	}
+	if o.Keyring != "" {
+		password, ok, err := keyringGet(o.Keyring)
+		if err != nil {
+			return err
+		}
+		if ok {
+			o.password = password
+		} else {
+			o.Password = true
+		}
+	}
+	if o.UseAgent && (o.Password || o.hasCredential() || o.Keyring != "") {
+		return errors.New("can not set both --use-agent and --password, --credential-file or --keyring")
+	}
+	if o.RecoveryCode != "" {
+		if o.Password || o.hasCredential() || o.Keyring != "" || o.UseAgent {
+			return errors.New("can not set both --recovery-code and --password, --credential-file, --keyring or --use-agent")
+		}
+		key, err := emix.DecodeRecoveryCode(o.RecoveryCode)
+		if err != nil {
+			return fmt.Errorf("invalid --recovery-code: %w, check for typos", err)
+		}
+		o.password = key
+	}
+	if o.UseAgent && !useAgentPassword(&o.password) {
+		o.Password = true
+	}
 	if o.Password {
 		// input password
 		password, err := inputPassword()
@@ -75,41 +289,120 @@ func (o *DemixOptions) Validate(source string) error {
 			return err
 		}
 
-		copy(o.password[:], password)
+		o.password = emix.PasswordKey(password)
 	}
-	if o.CredentialFile != "" {
-		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+	if o.hasCredential() {
+		password, err := readCredential(o.CredentialFile, o.CredentialCommand)
 		if err != nil {
 			return err
 		}
 		copy(o.password[:], password)
 	}
-	// check output
-	if o.Output == "" {
-		o.Output = fmt.Sprintf("emix_%s", time.Now().Format("2006-01-02 15.04.05"))
+	if o.ToTarGz != "" {
+		if o.Output != "" || o.RecurseNested {
+			return errors.New("can not set --to-tar-gz with --output or --recurse-nested")
+		}
+		if _, err := os.Stat(o.ToTarGz); err == nil {
+			return fmt.Errorf("output %s already exists", o.ToTarGz)
+		}
 	}
-	o.Output = filepath.Clean(o.Output)
-	outDirStat, err := os.Stat(o.Output)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+	if o.Backup && !o.InPlace {
+		return errors.New("--backup needs --in-place")
+	}
+	if o.Flatten && (o.DestTemplate != "" || o.InPlace) {
+		return errors.New("can not set --flatten with --dest-template or --in-place")
+	}
+	// restored files of in place replace their emix files
+	if o.InPlace {
+		if o.Output != "" || o.ToTarGz != "" || o.FromZip != "" || o.DestTemplate != "" || o.PreserveRootName || o.RecurseNested {
+			return errors.New("can not set --in-place with --output, --to-tar-gz, --from-zip, --dest-template, --preserve-root-name or --recurse-nested")
+		}
+		o.Output = o.source
+		if !o.sourceIsDir {
+			o.Output = filepath.Dir(o.source)
+		}
+	}
+	// check output, the temporary output of ToTarGz is created by Run
+	if o.ToTarGz == "" {
+		if o.Output == "" {
+			o.Output = fmt.Sprintf("emix_%s", time.Now().Format("2006-01-02 15.04.05"))
+			// a single file is restored to the current directory by its recorded name
+			if !o.sourceIsDir && o.FromZip == "" && !o.bundle {
+				o.Output = "."
+				o.noOverwrite = true
+			}
+		}
+		o.Output = filepath.Clean(o.Output)
+		outDirStat, err := os.Stat(o.Output)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			// create output directory
+			if err = os.MkdirAll(o.Output, 0755); err != nil {
+				return fmt.Errorf("create output directory error: %v", err)
+			}
+		} else if !outDirStat.Mode().IsDir() {
+			return fmt.Errorf("output should be a directory")
+		}
+		if err := o.setRoot(); err != nil {
 			return err
 		}
-		// create output directory
-		if err = os.MkdirAll(o.Output, 0755); err != nil {
-			return fmt.Errorf("create output directory error: %v", err)
+	}
+
+	if o.DestTemplate != "" {
+		tmpl, err := parseDestTemplate(o.DestTemplate)
+		if err != nil {
+			return err
 		}
-	} else if !outDirStat.Mode().IsDir() {
-		return fmt.Errorf("output should be a directory")
+		o.destTemplate = tmpl
 	}
 
+	o.ciphers = emix.NewCipherCache()
+	o.restored = make(map[string]bool)
+	o.links = make(map[string]bool)
+
 	// ignore
 	if len(o.Excludes) != 0 {
-		o.ignoreMatcher = ignore.CompileIgnoreLines(o.Excludes...)
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	return nil
+}
+
+// setRoot set the output directory of files in source directory
+func (o *DemixOptions) setRoot() error {
+	o.root = o.Output
+	if o.PreserveRootName && o.sourceIsDir {
+		name, err := rootName(o.source)
+		if err != nil {
+			return err
+		}
+		o.root = filepath.Join(o.Output, name)
 	}
 	return nil
 }
 
 func (o *DemixOptions) Run() error {
+	if o.ToTarGz != "" {
+		return o.demixTarGz()
+	}
+	return o.run()
+}
+
+func (o *DemixOptions) run() error {
+	if o.bundle {
+		return o.unpackBundle()
+	}
+	if o.FromZip != "" {
+		return o.demixZip()
+	}
+	if o.FilesFrom != "" {
+		return o.runFiles()
+	}
 	if o.sourceIsDir {
 		return filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
 			if err != nil {
@@ -122,93 +415,533 @@ func (o *DemixOptions) Run() error {
 				}
 				return nil
 			}
-			// skip directory path
+			// skip directory path, and directories out of the prefix
 			if info.IsDir() {
+				if rel, err := filepath.Rel(o.source, path); err == nil && rel != "." && !isPathOnPrefix(filepath.ToSlash(rel), o.PathPrefix) {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			// nonsupport file type: symlink, device...
 			if !info.Mode().IsRegular() {
 				return fmt.Errorf("not a regular file: %v", info.Name())
 			}
-			// output
-			outDir := filepath.Join(o.Output, strings.TrimPrefix(filepath.Dir(path), o.source))
-			err = os.MkdirAll(outDir, 0755)
-			if err != nil {
+			// output, directories of DestTemplate are created for each file, Flatten has none
+			outDir := filepath.Join(o.root, strings.TrimPrefix(filepath.Dir(path), o.source))
+			if o.destTemplate == nil && !o.Flatten {
+				if err := o.checkOutDir(outDir); err != nil {
+					return err
+				}
+				if err := os.MkdirAll(outDir, 0755); err != nil {
+					return err
+				}
+			}
+			return emix.Retry(o.Retry, retryBackoff, func() error {
+				return o.DecryptFile(path, outDir)
+			})
+		})
+	}
+
+	return emix.Retry(o.Retry, retryBackoff, func() error {
+		return o.DecryptFile(o.source, o.Output)
+	})
+}
+
+// unpackBundle restore the files of the bundle source to Output like unpack
+func (o *DemixOptions) unpackBundle() error {
+	unpack := &UnpackOptions{
+		Output:     o.Output,
+		PathPrefix: o.PathPrefix,
+		Silence:    o.Silence,
+		source:     o.source,
+		password:   o.password,
+	}
+	return unpack.Run()
+}
+
+// isBundleFile report if the file path is an emix bundle
+func isBundleFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return emix.IsBundle(f)
+}
+
+// runFiles restore the files of FilesFrom, restored files are in the same structure as walking source
+func (o *DemixOptions) runFiles() error {
+	for _, rel := range o.files {
+		path := filepath.Join(o.source, rel)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("not a regular file: %v", path)
+		}
+		outDir := filepath.Join(o.root, filepath.Dir(rel))
+		if o.destTemplate == nil && !o.Flatten {
+			if err := o.checkOutDir(outDir); err != nil {
 				return err
 			}
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				return err
+			}
+		}
+		err = emix.Retry(o.Retry, retryBackoff, func() error {
 			return o.DecryptFile(path, outDir)
 		})
+		if err != nil {
+			return err
+		}
 	}
-
-	return o.DecryptFile(o.source, o.Output)
+	return nil
 }
 
+// maxNestedDepth is the max levels of nested emix files de-mixed by --recurse-nested
+const maxNestedDepth = 8
+
 func (o *DemixOptions) DecryptFile(src string, outDir string) error {
+	dest, err := o.decryptFile(src, outDir, false)
+	if err != nil && o.PromptOnce && errors.Is(err, emix.ErrWrongPassword) {
+		debugf("de-mix %s error: %v, try other passwords", src, err)
+		dest, err = o.decryptWithOtherPasswords(src, outDir)
+	}
+	if err != nil || dest == "" {
+		return err
+	}
+	// the target of a restored symlink is not de-mixed
+	if info, err := os.Lstat(dest); err != nil || info.Mode()&fs.ModeSymlink != 0 {
+		return err
+	}
+	return o.demixNested(src, dest, filepath.Dir(dest))
+}
+
+// demixNested de-mix dest again while it is an emix file, e.g. src was mixed twice,
+// only a notice is printed unless RecurseNested is set
+func (o *DemixOptions) demixNested(src, dest, outDir string) error {
+	for depth := 1; ; depth++ {
+		ok, err := emix.IsEmixFileByPath(dest)
+		if err != nil || !ok {
+			return err
+		}
+		if !o.RecurseNested {
+			fmt.Fprintf(os.Stderr, "Restored %s of %s is an emix file, de-mix it again or use --recurse-nested\n", dest, src)
+			return nil
+		}
+		if depth > maxNestedDepth {
+			return fmt.Errorf("%s is nested more than %d levels", src, maxNestedDepth)
+		}
+
+		// the nested file is replaced by its content, which may have the same name
+		nested := dest + ".nested"
+		if err := os.Rename(dest, nested); err != nil {
+			return err
+		}
+		delete(o.restored, strings.ToLower(dest))
+		inner, err := o.decryptNested(nested, outDir)
+		if err != nil || inner == "" {
+			os.Rename(nested, dest)
+			o.restored[strings.ToLower(dest)] = true
+			return err
+		}
+		if err := os.Remove(nested); err != nil {
+			return err
+		}
+		dest = inner
+	}
+}
+
+// decryptWithOtherPasswords restore src failed with the password by the passwords entered for previous files,
+// prompt for its own password if none of them works, the entered password is remembered if it works
+func (o *DemixOptions) decryptWithOtherPasswords(src, outDir string) (string, error) {
+	first := o.password
+	defer func() { o.password = first }()
+	for _, password := range o.passwords {
+		o.password = password
+		dest, err := o.decryptFile(src, outDir, false)
+		if !errors.Is(err, emix.ErrWrongPassword) {
+			return dest, err
+		}
+	}
+	password, err := readFilePassword(src)
+	if err != nil {
+		return "", err
+	}
+	o.password = emix.PasswordKey(password)
+	dest, err := o.decryptFile(src, outDir, false)
+	if err == nil {
+		o.passwords = append(o.passwords, o.password)
+	}
+	return dest, err
+}
+
+// decryptNested restore a nested emix file with the same password,
+// prompt for its own password if it fails and stdin is a terminal
+func (o *DemixOptions) decryptNested(path, outDir string) (string, error) {
+	dest, err := o.decryptFile(path, outDir, true)
+	if err == nil || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return dest, err
+	}
+	fmt.Fprintf(os.Stderr, "De-mix nested emix file %s error: %v\n", path, err)
+	password, err := inputPassword()
+	if err != nil {
+		return "", err
+	}
+	outer := o.password
+	defer func() { o.password = outer }()
+	o.password = emix.PasswordKey(password)
+	return o.decryptFile(path, outDir, true)
+}
+
+// decryptFile restore src to outDir and return the path of restored file, the path is empty
+// if src is not a valid emix file or out of PathPrefix, a nested file is selected by its outer file
+func (o *DemixOptions) decryptFile(src string, outDir string, nested bool) (string, error) {
 	f, err := os.Open(src)
 	if err != nil {
-		return fmt.Errorf("Open source file error: %v", err)
+		return "", fmt.Errorf("Open source file error: %w", err)
 	}
 	defer f.Close()
 
 	ok, err := emix.IsEmixFile((f))
 	if err != nil {
-		return err
+		return "", err
 	}
 	if !ok {
+		// read with the header file beside it
+		if strings.HasSuffix(src, emix.DetachedContentExt) {
+			return "", nil
+		}
 		fmt.Fprintf(os.Stderr, fmt.Sprintf("Ignore invalid emix file %s\n", src))
-		return nil
+		return "", nil
 	}
 
 	// unmarshal header
 	emixHeader := &emix.EmixHeader{
-		Password: o.password,
+		Password:      o.password,
+		Ciphers:       o.ciphers,
+		AllowLargeKDF: o.AllowLargeKDF,
 	}
-	f.Seek(int64(emix.ZipHeaderLength()), io.SeekStart)
-	err = emixHeader.UnmarshalBinaryFromReader(f)
+	err = emixHeader.UnmarshalFromFile(f)
 	if err != nil {
 		if errors.Is(err, emix.ErrInvalidEmixHeader) {
 			fmt.Fprintf(os.Stderr, fmt.Sprintf("Ignore invalid emix file %s\n", src))
-			return nil
+			return "", nil
 		}
-		return err
+		return "", err
 	}
 
-	dest := filepath.Join(outDir, emixHeader.FileInfo.Name)
+	name := emixHeader.FileInfo.Name
+	// the file is restored in outDir, a path could follow a symlinked directory out of it
+	if strings.Contains(name, "/") || filepath.Base(name) != name {
+		return "", fmt.Errorf("%w %q of %s", emix.ErrUnsafeFileName, name, src)
+	}
+	// the ciphertext is authenticated before anything is decrypted from it
+	if emixHeader.FileMAC {
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if err := emix.VerifyFileMAC(f, info.Size(), emixHeader); err != nil {
+			// the password is not checked before without encrypted file info
+			if errors.Is(err, emix.ErrFileMACMismatch) && !emixHeader.EncryptInfo {
+				return "", fmt.Errorf("%w of %s: %w, %w or tampered file", emix.ErrContentAuthFailed, src, err, emix.ErrWrongPassword)
+			}
+			if errors.Is(err, emix.ErrFileMACMismatch) {
+				return "", fmt.Errorf("%w of %s: %w", emix.ErrContentAuthFailed, src, err)
+			}
+			return "", err
+		}
+	}
+	if o.SanitizeNames == sanitizeNamesReject || o.SanitizeNames == sanitizeNamesRename {
+		if problem := windowsNameProblem(name); problem != "" {
+			if o.SanitizeNames == sanitizeNamesReject {
+				return "", fmt.Errorf("invalid name %q of %s: %s", name, src, problem)
+			}
+			name = sanitizeWindowsName(name)
+			fmt.Fprintf(os.Stderr, "Rename %q to %q of %s: %s\n", emixHeader.FileInfo.Name, name, src, problem)
+		}
+	}
+	if (o.PathPrefix != "" || o.destTemplate != nil) && !nested {
+		rel, err := filepath.Rel(o.root, filepath.Join(outDir, name))
+		if err != nil {
+			return "", err
+		}
+		if !hasPathPrefix(filepath.ToSlash(rel), o.PathPrefix) {
+			return "", nil
+		}
+		// a nested file is restored beside its outer file
+		if o.destTemplate != nil {
+			p, err := executeDestTemplate(o.destTemplate, filepath.ToSlash(rel), name, &emixHeader.FileInfo)
+			if err != nil {
+				return "", err
+			}
+			outDir = filepath.Join(o.root, filepath.Dir(filepath.FromSlash(p)))
+			name = path.Base(p)
+			if err := o.checkOutDir(outDir); err != nil {
+				return "", err
+			}
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				return "", err
+			}
+		}
+	}
+	if o.Flatten && !nested {
+		outDir = o.root
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return "", err
+		}
+	}
+	// names differing only in case clobber each other on case-insensitive filesystems, as same names do with Flatten
+	dest := filepath.Join(outDir, name)
+	if o.InPlace {
+		dest = src
+	}
+	for i := 1; !o.InPlace && o.restored[strings.ToLower(dest)]; i++ {
+		dest = filepath.Join(outDir, numberedName(name, i))
+	}
+	if err := o.checkDest(dest); err != nil {
+		return "", err
+	}
+	if o.noOverwrite {
+		exists, err := pathExists(dest)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("%s already exists, remove it or set --output", dest)
+		}
+	}
+	if !o.InPlace && dest != filepath.Join(outDir, name) {
+		reason := "a restored file has the same name ignoring case"
+		if o.Flatten {
+			reason = "a restored file has the same name"
+		}
+		fmt.Fprintf(os.Stderr, "Rename %q to %q of %s: %s\n", name, filepath.Base(dest), src, reason)
+	}
+	// a failed file may be retried with the same name
+	o.restored[strings.ToLower(dest)] = true
+	restored := false
+	defer func() {
+		if !restored {
+			delete(o.restored, strings.ToLower(dest))
+		}
+	}()
 	if !o.Silence {
 		fmt.Fprint(os.Stdout, o.source, " -> ", dest, "\n")
 	}
-	targetFile, err := os.Create(dest)
+	// the restored file is written to a temporary file and renamed to dest once its content hash is verified,
+	// so a file at dest is always complete, in place dest is src
+	mode := o.mode
+	if o.InPlace {
+		if emixHeader.FileInfo.Detached {
+			return "", fmt.Errorf("can not restore split file %s in place", src)
+		}
+		if o.Backup {
+			if err := checkBackup(src); err != nil {
+				return "", err
+			}
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if o.Mode == "" {
+			mode = info.Mode().Perm()
+		}
+	}
+	targetFile, err := createTemp(dest)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer func() {
+		if !restored {
+			os.Remove(targetFile.Name())
+		}
+	}()
 	defer targetFile.Close()
+	if o.Mode != "" || o.InPlace {
+		if err := targetFile.Chmod(mode); err != nil {
+			return "", err
+		}
+	}
+	opts := emix.DecryptOptions{
+		Password: o.password,
+		Header:   emixHeader,
+		Mmap:     o.limiter == nil && useMmap(o.Mmap, int64(emixHeader.FileInfo.Size)),
+		WrapWriter: func(w io.Writer) io.Writer {
+			if o.Retry > 0 {
+				w = emix.NewRetryWriter(w, o.Retry, retryBackoff)
+			}
+			if o.limiter != nil {
+				w = emix.NewRateLimitWriter(w, o.limiter)
+			}
+			return w
+		},
+	}
+	// content of a split file is in the content file beside it
+	if emixHeader.FileInfo.Detached {
+		contentFile, err := emix.OpenDetachedContent(src, emixHeader)
+		if err != nil {
+			return "", fmt.Errorf("Open content file error: %w", err)
+		}
+		defer contentFile.Close()
+		opts.Content = contentFile
+	}
+	if err := emix.DecryptFile(f, targetFile, opts); err != nil {
+		return "", fmt.Errorf("Write file content error: %w", err)
+	}
+	if err := o.restoreMetadata(targetFile, dest, emixHeader); err != nil {
+		return "", err
+	}
+	if err := o.sync(targetFile); err != nil {
+		return "", err
+	}
+	if err := o.commit(f, targetFile, dest, emixHeader); err != nil {
+		return "", err
+	}
+	restored = true
+	return dest, nil
+}
 
-	// hash file
-	hash := sha256.New()
-	mf := io.MultiWriter(targetFile, hash)
-
-	// reset file position
-	f.Seek(int64(emix.ZipHeaderLength()+emixHeader.EncodedLength()), io.SeekStart)
+// commit rename the verified restored file to dest, or over the emix file src if InPlace is set,
+// both are closed first, an open file can not be replaced on windows. A symlink is created at dest instead
+// if header is of a symlink
+func (o *DemixOptions) commit(src, restored *os.File, dest string, header *emix.EmixHeader) error {
+	if fs.FileMode(header.FileInfo.Mode)&fs.ModeSymlink != 0 && o.tarWriter == nil {
+		return o.commitLink(src, restored, dest)
+	}
+	if err := restored.Close(); err != nil {
+		return err
+	}
+	if o.InPlace {
+		src.Close()
+		if err := replaceInPlace(restored.Name(), dest, o.Backup); err != nil {
+			return err
+		}
+	} else if err := os.Rename(restored.Name(), dest); err != nil {
+		return err
+	}
+	if o.Fsync && o.tarWriter == nil {
+		if err := syncDir(filepath.Dir(dest)); err != nil {
+			return fmt.Errorf("Sync directory error: %w", err)
+		}
+	}
+	return nil
+}
 
-	// write file content
-	if emixHeader.EncryptData {
-		cipher, err := emix.NewAESXTS(o.password)
-		if err != nil {
+// commitLink replace the restored file by a symlink at dest to its content, an existing file at dest
+// is replaced like by rename but not a directory
+func (o *DemixOptions) commitLink(src, restored *os.File, dest string) error {
+	if o.InPlace {
+		return fmt.Errorf("can not restore symlink %s in place", src.Name())
+	}
+	target, err := readLinkTarget(restored)
+	if err != nil {
+		return err
+	}
+	if err := restored.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(restored.Name()); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dest); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("can not restore symlink %s over a directory", dest)
+		}
+		if err := os.Remove(dest); err != nil {
 			return err
 		}
-		err = emix.DecryptContent(cipher, f, mf, int64(emixHeader.FileInfo.Size))
-		if err != nil {
-			return fmt.Errorf("Write decrypted file content error: %v", err)
+	}
+	if err := os.Symlink(target, dest); err != nil {
+		return err
+	}
+	o.links[dest] = true
+	if o.Fsync {
+		if err := syncDir(filepath.Dir(dest)); err != nil {
+			return fmt.Errorf("Sync directory error: %w", err)
 		}
-	} else {
-		if _, err := io.Copy(mf, f); err != nil {
-			return fmt.Errorf("Write file content error: %v", err)
+	}
+	return nil
+}
+
+// readLinkTarget read the target of a restored symlink from its content
+func readLinkTarget(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	target, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	if len(target) == 0 || bytes.IndexByte(target, 0) >= 0 {
+		return "", fmt.Errorf("invalid symlink target %q", target)
+	}
+	return string(target), nil
+}
+
+// checkOutDir check that no directory of outDir under root is a symlink once a symlink is restored in this run,
+// which could redirect the restored files out of root, it is checked before outDir is created
+func (o *DemixOptions) checkOutDir(outDir string) error {
+	if len(o.links) == 0 {
+		return nil
+	}
+	dir, err := symlinkDir(o.root, outDir)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		return fmt.Errorf("%w: directory %s is a restored symlink", emix.ErrUnsafeFileName, dir)
+	}
+	return nil
+}
+
+// checkDest check that dest is not a symlink restored in this run and not under one, so a restored file
+// is never written through a symlink of the archive
+func (o *DemixOptions) checkDest(dest string) error {
+	for p := dest; ; p = filepath.Dir(p) {
+		if o.links[p] {
+			return fmt.Errorf("%w: restored symlink %s in path %s", emix.ErrUnsafeFileName, p, dest)
+		}
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	return o.checkOutDir(filepath.Dir(dest))
+}
+
+// restoreMetadata set the owner of restored file if SameOwner is set, and its xattrs unless NoXattrs is set,
+// ACLs and capabilities are skipped if NoACLs is set. xattrs are set after the owner, chown clears
+// security.capability. With ToTarGz the file is added to the archive as dest instead
+func (o *DemixOptions) restoreMetadata(f *os.File, dest string, header *emix.EmixHeader) error {
+	if o.tarWriter != nil {
+		return o.addTarEntry(f, dest, header)
+	}
+	if o.SameOwner {
+		if err := chownFile(f, header.FileInfo.Owner, o.NumericOwner); err != nil {
+			return err
+		}
+	}
+	if !o.NoXattrs {
+		xattrs := header.FileInfo.Xattrs
+		if o.NoACLs {
+			xattrs = withoutACLXattrs(xattrs)
 		}
+		restoreXattrs(f.Name(), xattrs)
 	}
-	fileHash := hash.Sum(nil)
+	return nil
+}
 
-	if !bytes.Equal(emixHeader.FileInfo.FileContentHash[:], fileHash) {
-		return fmt.Errorf("File content hash mismatch")
+// sync flush the restored file to disk before it is renamed if Fsync is set, commit flush its directory after.
+// With ToTarGz only the archive is flushed
+func (o *DemixOptions) sync(f *os.File) error {
+	if !o.Fsync || o.tarWriter != nil {
+		return nil
+	}
+	if err := syncFile(f); err != nil {
+		return fmt.Errorf("Sync file error: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/icefed/emix"
+)
+
+// demixTarGz restore the files to a temporary directory and write each of them to ToTarGz once restored
+func (o *DemixOptions) demixTarGz() (err error) {
+	tmp, err := os.MkdirTemp("", "emix-tar-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	o.Output = tmp
+	if err := o.setRoot(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.ToTarGz, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(o.ToTarGz)
+		}
+	}()
+	gw := gzip.NewWriter(f)
+	o.tarWriter = tar.NewWriter(gw)
+	defer func() { o.tarWriter = nil }()
+	if err := o.run(); err != nil {
+		return err
+	}
+	if err := o.tarWriter.Close(); err != nil {
+		return fmt.Errorf("Write tar error: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("Write gzip error: %w", err)
+	}
+	if o.Fsync {
+		if err := syncFile(f); err != nil {
+			return fmt.Errorf("Sync file error: %w", err)
+		}
+	}
+	return nil
+}
+
+// addTarEntry write the restored file f to the archive as dest with the metadata recorded in header,
+// f is truncated after so the staged copy does not keep its space
+func (o *DemixOptions) addTarEntry(f *os.File, dest string, header *emix.EmixHeader) error {
+	rel, err := filepath.Rel(o.Output, dest)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := tarHeader(filepath.ToSlash(rel), &header.FileInfo, info.Size())
+	// content of a symlink is its target
+	link := fs.FileMode(header.FileInfo.Mode)&fs.ModeSymlink != 0
+	if link {
+		target, err := readLinkTarget(f)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+		hdr.Size = 0
+	}
+	if o.Mode != "" {
+		hdr.Mode = int64(o.mode.Perm())
+	}
+	if o.NoXattrs {
+		hdr.PAXRecords = nil
+	} else if o.NoACLs {
+		for name := range hdr.PAXRecords {
+			if isACLXattr(strings.TrimPrefix(name, "SCHILY.xattr.")) {
+				delete(hdr.PAXRecords, name)
+			}
+		}
+	}
+	if err := o.tarWriter.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Write tar header error: %w", err)
+	}
+	if link {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(o.tarWriter, f); err != nil {
+		return fmt.Errorf("Write tar entry error: %w", err)
+	}
+	return f.Truncate(0)
+}
+
+// tarHeader return the PAX tar header of a regular file of size bytes described by info,
+// xattrs are SCHILY.xattr records like GNU tar
+func tarHeader(name string, info *emix.FileInfo, size int64) *tar.Header {
+	mode := fs.FileMode(info.Mode)
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(mode.Perm()),
+		ModTime:  time.Unix(0, int64(info.ModifyTime)),
+		Format:   tar.FormatPAX,
+	}
+	if mode&fs.ModeSetuid != 0 {
+		hdr.Mode |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		hdr.Mode |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		hdr.Mode |= 01000
+	}
+	if owner := info.Owner; owner != nil {
+		hdr.Uid = int(owner.UID)
+		hdr.Gid = int(owner.GID)
+		hdr.Uname = owner.User
+		hdr.Gname = owner.Group
+	}
+	if len(info.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(info.Xattrs))
+		for _, x := range info.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+x.Name] = string(x.Value)
+		}
+	}
+	return hdr
+}
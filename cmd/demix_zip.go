@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/icefed/emix"
+)
+
+// checkZip return an error if the file is not a real zip archive, e.g. an emix file with zip header only
+func checkZip(name string) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return fmt.Errorf("--from-zip %s is not a zip archive: %v", name, err)
+	}
+	return zr.Close()
+}
+
+// demixZip restore the emix entries of FromZip, an entry is restored to the directory of its path in archive
+func (o *DemixOptions) demixZip() error {
+	zr, err := zip.OpenReader(o.FromZip)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	entries, err := emix.ZipEmixEntries(&zr.Reader)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Name)) {
+			return fmt.Errorf("invalid entry %q in zip archive", entry.Name)
+		}
+		name := path.Clean(entry.Name)
+		if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(name) {
+			continue
+		}
+		dir := path.Dir(name)
+		if dir != "." && !isPathOnPrefix(dir, o.PathPrefix) {
+			continue
+		}
+		outDir := filepath.Join(o.root, filepath.FromSlash(dir))
+		if o.destTemplate == nil && !o.Flatten {
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				return err
+			}
+		}
+		err := emix.Retry(o.Retry, retryBackoff, func() error {
+			return o.decryptZipEntry(entry, outDir)
+		})
+		if err != nil {
+			return fmt.Errorf("zip entry %s: %w", entry.Name, err)
+		}
+	}
+	return nil
+}
+
+// decryptZipEntry restore a zip entry by a temporary copy, content of compressed entries can not be seeked
+func (o *DemixOptions) decryptZipEntry(entry *zip.File, outDir string) error {
+	rc, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp("", "emix-zip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, rc)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Extract zip entry error: %w", err)
+	}
+	return o.DecryptFile(tmp.Name(), outDir)
+}
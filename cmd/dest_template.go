@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/icefed/emix"
+)
+
+// destTemplateData is the data of --dest-template
+type destTemplateData struct {
+	// name of the restored file
+	Name string
+	// slash-separated path of the restored file in the tree of source
+	RelPath    string
+	ModifyTime time.Time
+	// hex encoded content hash
+	Hash string
+	Size uint64
+}
+
+// parseDestTemplate parse text and check it yields a path for sample data, so unknown fields fail early
+func parseDestTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("dest").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dest-template: %v", err)
+	}
+	sample := destTemplateData{Name: "a.txt", RelPath: "a.txt", ModifyTime: time.Now(), Hash: hex.EncodeToString(make([]byte, 32))}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, fmt.Errorf("invalid --dest-template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// executeDestTemplate return the slash-separated path of the restored file relative to the output root,
+// a path out of the root is an error
+func executeDestTemplate(tmpl *template.Template, relPath, name string, info *emix.FileInfo) (string, error) {
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, destTemplateData{
+		Name:       name,
+		RelPath:    relPath,
+		ModifyTime: time.Unix(0, int64(info.ModifyTime)),
+		Hash:       hex.EncodeToString(info.FileContentHash[:]),
+		Size:       info.Size,
+	})
+	if err != nil {
+		return "", fmt.Errorf("execute --dest-template error: %v", err)
+	}
+	p := buf.String()
+	if !filepath.IsLocal(filepath.FromSlash(p)) || path.Clean(p) == "." {
+		return "", fmt.Errorf("--dest-template yields %q of %s, which is not a path in output", p, relPath)
+	}
+	return path.Clean(p), nil
+}
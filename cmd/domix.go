@@ -2,44 +2,163 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	ignore "github.com/sabhiram/go-gitignore"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
+	"golang.org/x/time/rate"
 
 	"github.com/icefed/emix"
+	"github.com/icefed/emix/version"
 )
 
 type DomixOptions struct {
 	// read password from stdin if Password is true
 	Password       bool
 	CredentialFile string
-	EmbedPassword  bool
+	// run the command and use its stdout as credential file
+	CredentialCommand string
+	// get password from agent before prompting
+	UseAgent      bool
+	EmbedPassword bool
+	// store password in the OS keyring under the service name
+	Keyring string
 	// 0: standard, no encryption
 	// 1: encrypt file info
 	// 2: encrypt file info and content
-	MixType  int
-	KeepName bool
-	Output   string
-	Excludes []string
-	Silence  bool
+	MixType int
+	// AES-XTS sector size of content, 0 means auto select by file size
+	SectorSize int
+	// name of the cipher suite, e.g. aes-gcm+aes-xts+sha256
+	CipherSuite string
+	// select the cipher suite encrypting fastest on this machine
+	AutoCipher bool
+	// argon2id or none, stretch the password before keys are derived
+	KDF string
+	// argon2id passes, memory in MiB and threads
+	KDFTime    int
+	KDFMemory  int
+	KDFThreads int
+	KeepName   bool
+	// name output by the keyed hash of original name
+	HashedName bool
+	Output     string
+	Excludes   []string
+	Silence    bool
+	// embed the thumbnail file as preview, only for single file
+	Thumbnail string
+	// only mix the files of source directory listed in the file, "-" is stdin
+	FilesFrom string
+	// listed files are separated by NUL instead of newline
+	Null bool
+	// omit the zip header
+	NoDisguise bool
+	// files matching the patterns use mix type 2, others use MixType
+	EncryptPatterns []string
+	// write a json manifest of outputs
+	Manifest string
+	// only mix files changed since the manifest of a previous run to the same output
+	SinceManifest string
+	// record the emix version in file info
+	RecordVersion bool
+	// record uid, gid and their names of source files
+	RecordOwner bool
+	// names of content transforms applied before encryption in order, e.g. gzip
+	Transforms []string
+	// compression algorithm applied before Transforms, only gzip
+	Compress string
+	// only store the data extents of sparse files
+	Sparse bool
+	// do not record xattrs of source files
+	NoXattrs bool
+	// do not record POSIX ACLs and file capabilities of source files
+	NoACLs bool
+	// warn if the typed password or credential file is weak, fail if RequireStrong is set
+	VerifyPasswordStrength bool
+	RequireStrong          bool
+	// auto, always or never encrypt content over mapped files
+	Mmap string
+	// append a HMAC-SHA256 of the whole file
+	FileMAC bool
+	// retry a file or a content write failed with a temporary error
+	Retry int
+	// max bytes per second of content writes, e.g. 10MB
+	RateLimit string
+	// put outputs of a directory under its base name in Output
+	PreserveRootName bool
+	// flush outputs and their directories to disk
+	Fsync bool
+	// octal permission bits of created files, default is 0666 before umask
+	Mode string
+	// overwrite, error, skip or rename if an output already exists
+	OnCollision string
+	// record sha256 of content chunks for verify --range
+	ChunkHashes bool
+	// encrypt with a random key printed as a recovery code
+	RecoveryCode bool
+	// record a file id, random or derived from content, no id if empty
+	IDMode string
+	// write the header to <output>.emixh and the content to <output>.emixc
+	Split bool
+	// write a sha256sum compatible <output>.sha256 of the content hash, or of the output if Ciphertext is set
+	SidecarChecksum bool
+	Ciphertext      bool
+	// record mixed source files to the state file, skip them when resuming an interrupted run
+	State string
+	// replace source files with their outputs, keep the originals as <path>.bak if Backup is set
+	InPlace bool
+	Backup  bool
+	// mix the files symlinks point to instead of the links
+	FollowSymlinks bool
+	// pack the files of source directory into one emix bundle instead of an emix file per file, see pack
+	Archive string
 
 	source      string
 	sourceIsDir bool
+	// files of FilesFrom relative to source
+	files []string
+	// output directory of files in source directory
+	root string
+	mode fs.FileMode
+	// limiter of RateLimit shared by all files
+	limiter *rate.Limiter
 
-	password      [16]byte
-	ignoreMatcher *ignore.GitIgnore
+	password       [16]byte
+	cipherSuite    emix.CipherSuiteID
+	kdf            *emix.KDFParams
+	ignoreMatcher  *ignore.GitIgnore
+	encryptMatcher *ignore.GitIgnore
+	ciphers        *emix.CipherCache
+	preview        []byte
+	manifest       *Manifest
+	// entries of SinceManifest by source
+	previous map[string]ManifestEntry
+	// file system of source, os paths are used if not set
+	fsys fs.FS
+	// recovery code of password if RecoveryCode is set
+	recoveryCode string
+	// source files mixed by previous runs of State
+	state *domixState
+	// pack of Archive
+	pack *PackOptions
 }
 
+// testHookBeforeHeader is called after content is written and before the header is written
+var testHookBeforeHeader func() error
+
+// retryBackoff is the delay before the first retry of --retry, doubled after each retry
+var retryBackoff = 100 * time.Millisecond
+
 func newCmdDomix() *cobra.Command {
 	o := &DomixOptions{}
 	cmd := &cobra.Command{
@@ -56,18 +175,87 @@ func newCmdDomix() *cobra.Command {
 
 	cmd.Flags().SortFlags = false
 	cmd.Flags().IntVarP(&o.MixType, "type", "t", 0, "Mix type. 0: standard, 1: encrypt file info, 2: encrypt file info and content.")
+	cmd.Flags().IntVar(&o.SectorSize, "sector-size", 0, "Sector size used to encrypt content, power of two between 512 and 1048576. Default 0 selects it by file size.")
+	cmd.Flags().StringVar(&o.CipherSuite, "cipher-suite", emix.DefaultCipherSuite.String(), "Cipher suite of file info encryption, content encryption and content hash. Supported: "+strings.Join(emix.CipherSuiteNames(), ", ")+".")
+	cmd.Flags().BoolVar(&o.AutoCipher, "auto-cipher", false, "Benchmark the cipher suites on a small buffer and use the fastest on this machine, e.g. chacha20 without AES instructions. Only sha256 suites are candidates with --manifest or --sidecar-checksum. Conflicts with --cipher-suite.")
+	cmd.Flags().StringVar(&o.KDF, "kdf", "argon2id", "Stretch the password before keys are derived, so guessing it is expensive. argon2id, none: derive keys from the password directly. Not used with --embed-password or --recovery-code.")
+	cmd.Flags().IntVar(&o.KDFTime, "kdf-time", int(emix.DefaultKDFParams.Time), "Passes of argon2id over memory.")
+	cmd.Flags().IntVar(&o.KDFMemory, "kdf-memory", int(emix.DefaultKDFParams.Memory/1024), "Memory of argon2id in MiB, power of two. Each encrypted file needs it once to be mixed or de-mixed.")
+	cmd.Flags().IntVar(&o.KDFThreads, "kdf-threads", int(emix.DefaultKDFParams.Threads), "Threads of argon2id.")
 	cmd.Flags().BoolVarP(&o.KeepName, "keep-name", "k", false, "Keep original name. Default is false.")
-	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to encrypt, max length is 16 bytes. Conflicts with --credential-file and --embed-password.")
+	cmd.Flags().BoolVar(&o.HashedName, "hashed-name", false, "Name output by the keyed hash of original name, the same name always yields the same output name. Conflicts with --keep-name and --embed-password.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to encrypt. Conflicts with --credential-file and --embed-password.")
 	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password and --embed-password.")
+	cmd.Flags().StringVar(&o.CredentialCommand, "credential-command", "", "Run COMMAND by the shell and use its stdout as a credential file, e.g. 'pass show emix'. The command runs as you with the terminal as stdin, only use commands you trust. Conflicts with --credential-file, same conflicts as --credential-file otherwise.")
+	cmd.Flags().BoolVar(&o.UseAgent, "use-agent", false, "Get password from emix agent, prompt if the agent is unavailable. Conflicts with --password, --credential-file, --keyring and --embed-password.")
+	cmd.Flags().BoolVar(&o.RecoveryCode, "recovery-code", false, "Encrypt with a random key printed as a recovery code to write down, the key is not stored anywhere, demix --recovery-code reads it. Conflicts with --password, --credential-file, --keyring, --use-agent and --embed-password.")
+	cmd.Flags().BoolVar(&o.VerifyPasswordStrength, "verify-password-strength", false, fmt.Sprintf("Estimate the strength of the typed password or credential file, warn if it is below %d bits. Not applied to embed password, keyring entries, agent and credential command.", strongPasswordBits))
+	cmd.Flags().BoolVar(&o.RequireStrong, "require-strong", false, "Refuse a weak password or credential file instead of warning, implies --verify-password-strength.")
 	cmd.Flags().BoolVar(&o.EmbedPassword, "embed-password", false, "Embed password to file header, password will be generated. Conflicts with --password and --credential-file.")
+	cmd.Flags().StringVar(&o.Keyring, "keyring", "", "Store password in the OS keyring under SERVICE, password of the existing entry is used if neither --password nor --credential-file is set, prompt if the entry is missing. Conflicts with --embed-password.")
 	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output directory. Default use emix_%datetime(format: 2006-01-02_15-04-05).")
-	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", []string{".*"}, "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files. Multi patterns can be separated by comma.")
+	cmd.Flags().StringVar(&o.Archive, "archive", "", "Pack the files of <path> directory into one emix bundle FILE instead of an emix file per file, like pack, demix and unpack restore it. Only --type, --password, --credential-file, --embed-password, --excludes and --silence apply.")
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	cmd.Flags().StringSliceVar(&o.EncryptPatterns, "encrypt-pattern", nil, "Encrypt file info and content of files matching PATTERN, gitignore style, other files use --type. Multi patterns can be separated by comma.")
+	cmd.Flags().StringVar(&o.Manifest, "manifest", "", "Write a json manifest of output files with their sizes and hashes, can be checked by verify-manifest.")
+	cmd.Flags().BoolVar(&o.RecordVersion, "record-version", false, "Record the emix version which wrote the file in file header, shown by stat.")
+	cmd.Flags().StringVar(&o.Compress, "compress", "", "Compress content by ALGO before encryption, only gzip, it is applied before --transform. The original size is recorded, ls and stat show it and verify checks it. Same conflicts as --transform.")
+	cmd.Flags().StringSliceVar(&o.Transforms, "transform", nil, "Process content by the registered transforms in order before encryption, e.g. gzip, demix applies the inverses. Size and hash in header are of the transformed content. Conflicts with --chunk-hashes and --since-manifest. Multi transforms can be separated by comma.")
+	cmd.Flags().BoolVar(&o.Sparse, "sparse", false, fmt.Sprintf("Find holes of sparse files, e.g. VM images, and only store their data extents, demix recreates the holes. Files with more than %d extents or on systems without SEEK_HOLE are stored dense. Conflicts with --since-manifest.", emix.MaxSparseExtents))
+	cmd.Flags().BoolVar(&o.NoXattrs, "no-xattrs", false, "Do not record extended attributes of source files, e.g. user.* or com.apple.quarantine. They are recorded by default on linux and macOS and encrypted with file info.")
+	cmd.Flags().BoolVar(&o.NoACLs, "no-acls", false, "Do not record POSIX ACLs and file capabilities of source files, the system.posix_acl_* and security.capability xattrs on linux. Other xattrs are still recorded.")
+	cmd.Flags().BoolVar(&o.RecordOwner, "record-owner", false, "Record the uid, gid and their user and group names of source files in file header, restored by demix --same-owner.")
+	cmd.Flags().StringVar(&o.Mmap, "mmap", "auto", "Encrypt content over memory mapped files. auto: only files larger than 64MB, always, never. Fall back to read and write if the file can not be mapped.")
+	cmd.Flags().StringVar(&o.SinceManifest, "since-manifest", "", "Only mix files whose size or modify time differ from the manifest of a previous run to the same --output, outputs of changed files are replaced. The updated manifest is written to --manifest, default is the same path.")
+	cmd.Flags().BoolVar(&o.FileMAC, "file-mac", false, "Append a HMAC-SHA256 of the whole file keyed by password, checked by demix before decrypting and by verify --full-mac. It is always appended to encrypted content of --type 2 with password. Conflicts with --embed-password.")
+	cmd.Flags().IntVar(&o.Retry, "retry", 0, "Retry a file or a content write up to N times with exponential backoff if it fails with a temporary error, e.g. on network storage.")
+	cmd.Flags().StringVar(&o.RateLimit, "rate-limit", "", "Limit content writes of all files to RATE bytes per second, e.g. 512KiB or 10MB, so a network share is not saturated. Files are not memory mapped if it is set.")
+	cmd.Flags().BoolVar(&o.PreserveRootName, "preserve-root-name", false, "Put outputs under a directory named as <path> in output directory, e.g. <output>/docs/... for docs, like tar. Only if <path> is directory.")
+	cmd.Flags().BoolVar(&o.Fsync, "fsync", false, "Flush each output to disk before it is renamed into place, and its directory after, so outputs survive a power loss.")
+	cmd.Flags().StringVar(&o.OnCollision, "on-collision", onCollisionOverwrite, "Policy if an output already exists, e.g. with --keep-name. overwrite: replace it, error: fail, skip: skip the source file, rename: append a number to the name like a_1.txt. Outputs replaced by --since-manifest are not collisions.")
+	cmd.Flags().BoolVar(&o.ChunkHashes, "chunk-hashes", false, fmt.Sprintf("Record the sha256 of each content chunk and their merkle root in header, so verify --range checks a byte range without reading the whole content. Chunks are 1MB or larger to keep within %d hashes.", emix.MaxChunkHashes))
+	cmd.Flags().StringVar(&o.IDMode, "id-mode", "", "Record a 16-byte file id in header, shown by stat, ls --id and the manifest. random: a random UUID, unique for each mix. content: derived from the content hash, files with the same content and cipher suite get the same id, e.g. to dedup a backup catalog. Default records no id.")
+	cmd.Flags().StringVar(&o.State, "state", "", "Record each source file to the state file once it is mixed, by its path, size and modify time. A resumed run with the same state file skips recorded files, e.g. to restart an interrupted backup of a large tree. Keep the state file out of the source directory. Conflicts with --manifest and --since-manifest.")
+	cmd.Flags().BoolVar(&o.InPlace, "in-place", false, "Replace each source file with its output of the same name, e.g. to lock a file and unlock it by demix --in-place. The output is written to a temporary file and renamed over the source, it keeps the permission of the source unless --mode is set. Emix files in <path> are skipped. Needs a password, conflicts with --output, --keep-name, --hashed-name, --preserve-root-name, --split, --manifest, --since-manifest, --on-collision and --embed-password.")
+	cmd.Flags().BoolVar(&o.Backup, "backup", false, "Keep the original of a file replaced by --in-place as <path>.bak, fail if the backup exists.")
+	cmd.Flags().BoolVar(&o.FollowSymlinks, "follow-symlinks", false, "Mix the files symlinks in <path> point to. By default a symlink is mixed as a link with its target as content, and demix recreates it. Symlinks to directories are not followed.")
+	cmd.Flags().BoolVar(&o.Split, "split", false, "Write the header of each file to <output>.emixh and its content to <output>.emixc, e.g. to index headers in a database and keep content in object storage. They are linked by the file id, a random one is recorded without --id-mode. demix takes the .emixh file and opens the .emixc beside it. Conflicts with --manifest, --since-manifest, --file-mac and --ciphertext.")
+	cmd.Flags().BoolVar(&o.SidecarChecksum, "sidecar-checksum", false, "Write <output>.sha256 beside each output in sha256sum format, the hash of original content with the original name, so sha256sum -c checks the files de-mixed into its directory. Only support cipher suites using sha256. Conflicts with --transform and --sparse without --ciphertext.")
+	cmd.Flags().BoolVar(&o.Ciphertext, "ciphertext", false, "With --sidecar-checksum, hash the output file itself with its output name, so sha256sum -c checks the outputs as stored.")
+	cmd.Flags().StringVar(&o.Mode, "mode", "", "Octal permission bits of outputs, e.g. 0600, umask is not applied. Default is 0666 before umask. The mode of source file is recorded in header regardless.")
+	cmd.Flags().BoolVar(&o.NoDisguise, "no-disguise", false, "Do not disguise output as zip file, omit the zip header and use .emix extension.")
+	cmd.Flags().StringVar(&o.FilesFrom, "files-from", "", "Only mix the files listed in FILE instead of walking <path>, one path per line, - reads stdin, e.g. find src -name '*.doc' | emix domix src --files-from -. Paths are relative to the current directory or absolute and must be in <path>, outputs keep their structure under <path>. --excludes is not applied. Conflicts with --password if FILE is -.")
+	cmd.Flags().BoolVar(&o.Null, "null", false, "Paths of --files-from are separated by NUL instead of newline, e.g. find -print0.")
 	cmd.Flags().BoolVar(&o.Silence, "silence", false, "Silence all output.")
+	cmd.Flags().StringVar(&o.Thumbnail, "thumbnail", "", "Embed a thumbnail file (e.g. JPEG) in file header as preview, max size is 48KB. Only for single file <path>.")
 	return cmd
 }
 
+// hasCredential report if password is generated from a credential file or command
+func (o *DomixOptions) hasCredential() bool {
+	return o.CredentialFile != "" || o.CredentialCommand != ""
+}
+
 func (o *DomixOptions) Validate(source string) error {
-	info, err := os.Stat(source)
+	if o.Archive != "" {
+		if o.Output != "" {
+			return errors.New("can not set both --archive and --output")
+		}
+		o.pack = &PackOptions{
+			Password:       o.Password,
+			CredentialFile: o.CredentialFile,
+			EmbedPassword:  o.EmbedPassword,
+			MixType:        o.MixType,
+			Output:         o.Archive,
+			Excludes:       o.Excludes,
+			Silence:        o.Silence,
+		}
+		return o.pack.Validate(source)
+	}
+	if o.fsys == nil {
+		o.fsys = osFS{}
+	}
+	info, err := fs.Stat(o.fsys, source)
 	if err != nil {
 		return err
 	}
@@ -76,24 +264,190 @@ func (o *DomixOptions) Validate(source string) error {
 		o.sourceIsDir = true
 	}
 
-	if o.Password && o.CredentialFile != "" {
+	if o.CredentialFile != "" && o.CredentialCommand != "" {
+		return errors.New("can not set both --credential-file and --credential-command")
+	}
+	if o.Password && o.hasCredential() {
 		return errors.New("can not set both --password and --credential-file")
 	}
-	if (o.Password || o.CredentialFile != "") && o.EmbedPassword {
-		return errors.New("can not set both --password, --credential-file and --embed-password")
+	if (o.Password || o.hasCredential() || o.Keyring != "" || o.UseAgent) && o.EmbedPassword {
+		return errors.New("can not set both --password, --credential-file, --keyring, --use-agent and --embed-password")
+	}
+	if o.UseAgent && (o.Password || o.hasCredential() || o.Keyring != "") {
+		return errors.New("can not set both --use-agent and --password, --credential-file or --keyring")
+	}
+	if o.RecoveryCode && (o.Password || o.hasCredential() || o.Keyring != "" || o.UseAgent || o.EmbedPassword) {
+		return errors.New("can not set both --recovery-code and --password, --credential-file, --keyring, --use-agent or --embed-password")
+	}
+	if err := validateFilesFrom(o.FilesFrom, o.Null, o.sourceIsDir, o.Password); err != nil {
+		return err
+	}
+	if o.FilesFrom != "" {
+		if o.files, err = readFilesFrom(o.FilesFrom, o.Null, o.source); err != nil {
+			return err
+		}
 	}
 	if o.MixType > 2 {
 		return errors.New("invalid --type, only support 0, 1, 2, see help for details")
 	}
-	if o.MixType == 0 {
-		if o.Password || o.EmbedPassword || o.CredentialFile != "" {
+	if o.HashedName {
+		if o.KeepName {
+			return errors.New("can not set both --hashed-name and --keep-name")
+		}
+		if o.EmbedPassword {
+			return errors.New("can not set both --hashed-name and --embed-password")
+		}
+		if !o.Password && !o.hasCredential() && o.Keyring == "" && !o.UseAgent && !o.RecoveryCode {
+			return errors.New("--hashed-name needs password or credential-file or keyring or agent or recovery-code")
+		}
+	}
+	if o.CipherSuite != "" {
+		suite, err := emix.ParseCipherSuite(o.CipherSuite)
+		if err != nil {
+			return fmt.Errorf("invalid --cipher-suite: %v", err)
+		}
+		o.cipherSuite = suite
+	}
+	if o.AutoCipher {
+		if o.cipherSuite != emix.DefaultCipherSuite {
+			return errors.New("can not set both --auto-cipher and --cipher-suite")
+		}
+		o.cipherSuite = emix.FastestCipherSuite(o.autoCipherCandidates()...)
+		debugf("auto cipher selects %s", o.cipherSuite)
+	}
+	if o.SinceManifest != "" {
+		if o.Output == "" {
+			return errors.New("--since-manifest needs --output of the previous run")
+		}
+		previous, err := readManifest(o.SinceManifest)
+		if err != nil {
+			return fmt.Errorf("Read manifest error: %v", err)
+		}
+		o.previous = make(map[string]ManifestEntry, len(previous.Entries))
+		for _, entry := range previous.Entries {
+			if !filepath.IsLocal(filepath.FromSlash(entry.Output)) {
+				return fmt.Errorf("invalid output %q in manifest", entry.Output)
+			}
+			o.previous[entry.Source] = entry
+		}
+		if o.Manifest == "" {
+			o.Manifest = o.SinceManifest
+		}
+	}
+	if o.Manifest != "" && !strings.HasSuffix(o.cipherSuite.String(), "+sha256") {
+		return errors.New("--manifest records sha256 hashes, only support cipher suites using sha256")
+	}
+	if err := validateMmap(o.Mmap); err != nil {
+		return err
+	}
+	switch o.OnCollision {
+	case "", onCollisionOverwrite, onCollisionError, onCollisionSkip, onCollisionRename:
+	default:
+		return errors.New("invalid --on-collision, only support overwrite, error, skip, rename")
+	}
+	if o.Mode != "" {
+		mode, err := parseMode(o.Mode)
+		if err != nil {
+			return err
+		}
+		o.mode = mode
+	}
+	if o.Retry < 0 {
+		return errors.New("invalid --retry, must not be negative")
+	}
+	switch o.IDMode {
+	case "", "random", "content":
+	default:
+		return errors.New("invalid --id-mode, only support random, content")
+	}
+	// compression is the first transform
+	if o.Compress != "" {
+		if o.Compress != "gzip" {
+			return fmt.Errorf("invalid --compress %s, only support gzip", o.Compress)
+		}
+		if !slices.Contains(o.Transforms, o.Compress) {
+			o.Transforms = append([]string{o.Compress}, o.Transforms...)
+		}
+	}
+	if len(o.Transforms) > 0 {
+		if o.ChunkHashes || o.SinceManifest != "" {
+			return errors.New("can not set --transform with --chunk-hashes or --since-manifest")
+		}
+		for _, name := range o.Transforms {
+			if _, err := emix.LookupContentTransform(name); err != nil {
+				return fmt.Errorf("invalid --transform: %v", err)
+			}
+		}
+	}
+	if o.Sparse && o.SinceManifest != "" {
+		return errors.New("can not set both --sparse and --since-manifest")
+	}
+	if o.Split && (o.Manifest != "" || o.SinceManifest != "" || o.FileMAC || o.Ciphertext) {
+		return errors.New("can not set --split with --manifest, --since-manifest, --file-mac or --ciphertext")
+	}
+	if o.State != "" && (o.Manifest != "" || o.SinceManifest != "") {
+		return errors.New("can not set --state with --manifest or --since-manifest")
+	}
+	if o.Ciphertext && !o.SidecarChecksum {
+		return errors.New("--ciphertext needs --sidecar-checksum")
+	}
+	if o.SidecarChecksum && !o.Ciphertext {
+		// the content hash is of the stored content, not the original
+		if len(o.Transforms) > 0 || o.Sparse {
+			return errors.New("can not set --sidecar-checksum with --transform or --sparse, use --ciphertext")
+		}
+		if !strings.HasSuffix(o.cipherSuite.String(), "+sha256") {
+			return errors.New("--sidecar-checksum records sha256 hashes, only support cipher suites using sha256")
+		}
+	}
+	if o.RateLimit != "" {
+		limiter, err := parseRateLimit(o.RateLimit)
+		if err != nil {
+			return err
+		}
+		o.limiter = limiter
+	}
+	if o.FileMAC {
+		if o.EmbedPassword {
+			return errors.New("can not set both --file-mac and --embed-password")
+		}
+		if !o.Password && !o.hasCredential() && o.Keyring == "" && !o.UseAgent && !o.RecoveryCode {
+			return errors.New("--file-mac needs password or credential-file or keyring or agent or recovery-code")
+		}
+	}
+	if o.SectorSize != 0 {
+		if err := emix.ValidSectorSize(o.SectorSize); err != nil {
+			return fmt.Errorf("invalid --sector-size: %v", err)
+		}
+	}
+	switch o.KDF {
+	case "", "none":
+	case "argon2id":
+		if o.KDFTime < 1 || o.KDFTime > 0xff || o.KDFThreads < 1 || o.KDFThreads > 0xff || o.KDFMemory < 1 || o.KDFMemory > emix.MaxKDFMemory/1024 {
+			return errors.New("invalid --kdf-time, --kdf-memory or --kdf-threads")
+		}
+		o.kdf = &emix.KDFParams{Time: uint8(o.KDFTime), Memory: uint32(o.KDFMemory) * 1024, Threads: uint8(o.KDFThreads)}
+		if err := o.kdf.Valid(); err != nil {
+			return fmt.Errorf("invalid --kdf-memory: %v", err)
+		}
+		if o.kdf.OverReadLimit() {
+			fmt.Fprintf(os.Stderr, "Argon2id params %s are over the read limit, de-mix the outputs with --allow-large-kdf\n", o.kdf)
+		}
+	default:
+		return errors.New("invalid --kdf, only support argon2id, none")
+	}
+	if o.MixType == 0 && len(o.EncryptPatterns) == 0 {
+		if o.Password || o.EmbedPassword || o.hasCredential() || o.Keyring != "" || o.UseAgent || o.RecoveryCode {
 			return errors.New("invalid --type 0, can not set password or embed-password")
 		}
 	} else {
-		if !o.Password && !o.EmbedPassword && o.CredentialFile == "" {
-			return errors.New("invalid --type, need password or embed-password or credential-file")
+		if !o.Password && !o.EmbedPassword && !o.hasCredential() && o.Keyring == "" && !o.UseAgent && !o.RecoveryCode {
+			return errors.New("invalid --type, need password or embed-password or credential-file or keyring or agent or recovery-code")
 		}
 	}
+	if o.UseAgent && !useAgentPassword(&o.password) {
+		o.Password = true
+	}
 	if o.Password {
 		// input password
 		password, err := inputPassword()
@@ -105,20 +459,99 @@ func (o *DomixOptions) Validate(source string) error {
 		if err = inputPasswordAgain(password); err != nil {
 			return err
 		}
+		if err := o.checkPasswordStrength(password); err != nil {
+			return err
+		}
 
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" && (o.VerifyPasswordStrength || o.RequireStrong) {
+		if err := o.checkCredentialStrength(); err != nil {
+			return err
+		}
+	}
+	if o.hasCredential() {
+		password, err := readCredential(o.CredentialFile, o.CredentialCommand)
+		if err != nil {
+			return err
+		}
 		copy(o.password[:], password)
 	}
-	if o.CredentialFile != "" {
-		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+	if o.Keyring != "" {
+		if !o.Password && !o.hasCredential() {
+			password, ok, err := keyringGet(o.Keyring)
+			if err != nil {
+				return err
+			}
+			if ok {
+				o.password = password
+			} else {
+				// input password
+				password, err := inputPassword()
+				if err != nil {
+					return err
+				}
+				if err = inputPasswordAgain(password); err != nil {
+					return err
+				}
+				if err := o.checkPasswordStrength(password); err != nil {
+					return err
+				}
+				o.password = emix.PasswordKey(password)
+			}
+		}
+		if err := keyringSet(o.Keyring, o.password); err != nil {
+			return err
+		}
+	}
+	if o.RecoveryCode {
+		password, err := emix.GenerateRandomPassword(16)
 		if err != nil {
 			return err
 		}
 		copy(o.password[:], password)
+		o.recoveryCode = emix.EncodeRecoveryCode(o.password)
 	}
 	if o.EmbedPassword {
 		// no nothing
 		// will generate a new password for each file
 	}
+	if o.Thumbnail != "" {
+		if o.sourceIsDir {
+			return errors.New("can not set --thumbnail if <path> is directory")
+		}
+		preview, err := os.ReadFile(o.Thumbnail)
+		if err != nil {
+			return fmt.Errorf("read thumbnail error: %v", err)
+		}
+		if len(preview) > emix.PreviewMaxLength {
+			return fmt.Errorf("thumbnail is too large, max size is %d bytes", emix.PreviewMaxLength)
+		}
+		o.preview = preview
+	}
+	if o.Backup && !o.InPlace {
+		return errors.New("--backup needs --in-place")
+	}
+	// outputs of in place are beside their sources with the same names
+	if o.InPlace {
+		if o.Output != "" || o.KeepName || o.HashedName || o.PreserveRootName || o.Split || o.Manifest != "" || o.SinceManifest != "" {
+			return errors.New("can not set --in-place with --output, --keep-name, --hashed-name, --preserve-root-name, --split, --manifest or --since-manifest")
+		}
+		if o.OnCollision != "" && o.OnCollision != onCollisionOverwrite {
+			return errors.New("can not set both --in-place and --on-collision")
+		}
+		if o.EmbedPassword {
+			return errInPlaceEmbedPassword
+		}
+		if _, ok := o.fsys.(osFS); !ok {
+			return errors.New("--in-place only supports files on disk")
+		}
+		o.KeepName = true
+		o.Output = o.source
+		if !o.sourceIsDir {
+			o.Output = filepath.Dir(o.source)
+		}
+	}
 	// check output
 	if o.Output == "" {
 		o.Output = fmt.Sprintf("emix_%s", time.Now().Format("2006-01-02_15-04-05"))
@@ -136,80 +569,347 @@ func (o *DomixOptions) Validate(source string) error {
 	} else if !outDirStat.Mode().IsDir() {
 		return fmt.Errorf("output should be a directory")
 	}
+	o.root = o.Output
+	if o.PreserveRootName && o.sourceIsDir {
+		name, err := rootName(o.source)
+		if err != nil {
+			return err
+		}
+		o.root = filepath.Join(o.Output, name)
+	}
+
+	o.ciphers = emix.NewCipherCache()
 
 	// ignore
 	if len(o.Excludes) != 0 {
-		o.ignoreMatcher = ignore.CompileIgnoreLines(o.Excludes...)
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	if len(o.EncryptPatterns) != 0 {
+		matcher, err := compilePatterns(o.EncryptPatterns)
+		if err != nil {
+			return fmt.Errorf("invalid --encrypt-pattern: %v", err)
+		}
+		o.encryptMatcher = matcher
+	}
+	if o.Manifest != "" {
+		o.manifest = &Manifest{}
 	}
 	return nil
 }
 
 func (o *DomixOptions) Run() error {
+	if o.pack != nil {
+		return o.pack.Run()
+	}
+	// printed even if silenced, outputs can not be de-mixed without it
+	if o.recoveryCode != "" {
+		fmt.Fprintf(os.Stderr, "Recovery code: %s\nWrite it down and keep it offline, it is the only way to de-mix the outputs.\n", o.recoveryCode)
+	}
+	if o.State != "" {
+		state, err := openDomixState(o.State, o.Fsync)
+		if err != nil {
+			return fmt.Errorf("Open state file error: %v", err)
+		}
+		defer state.Close()
+		o.state = state
+		defer func() {
+			o.state = nil
+		}()
+	}
+	if err := o.run(); err != nil {
+		return err
+	}
+	if o.manifest != nil {
+		if err := writeManifest(o.Manifest, o.manifest, o.password); err != nil {
+			return fmt.Errorf("Write manifest error: %v", err)
+		}
+	}
+	return nil
+}
+
+func (o *DomixOptions) run() error {
+	if o.FilesFrom != "" {
+		return o.runFiles()
+	}
 	if o.sourceIsDir {
-		return filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
+		return fs.WalkDir(o.fsys, o.source, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
 			// check exclude pattern
 			if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(path) {
-				if info.IsDir() {
+				if d.IsDir() {
 					return filepath.SkipDir
 				}
 				return nil
 			}
 			// skip directory path
-			if info.IsDir() {
+			if d.IsDir() {
 				return nil
 			}
-			// nonsupport file type: symlink, device...
-			if !info.Mode().IsRegular() {
-				return fmt.Errorf("not a regular file: %v", info.Name())
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				if info, err = o.symlinkInfo(path, info); err != nil {
+					return err
+				}
+			}
+			// nonsupport file type: device, socket...
+			if !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+				return fmt.Errorf("not a regular file: %v", d.Name())
 			}
 			// output
-			outDir := filepath.Join(o.Output, strings.TrimPrefix(filepath.Dir(path), o.source))
+			outDir := filepath.Join(o.root, strings.TrimPrefix(filepath.Dir(path), o.source))
 			err = os.MkdirAll(outDir, 0755)
 			if err != nil {
 				return err
 			}
-			return o.EncryptFile(path, info, outDir)
+			return o.encryptFile(path, info, outDir)
 		})
 	}
 
-	info, err := os.Stat(o.source)
+	info, err := fs.Stat(o.fsys, o.source)
+	if err != nil {
+		return err
+	}
+	return o.encryptFile(o.source, info, o.Output)
+}
+
+// symlinkInfo return the info of the file symlink path points to if FollowSymlinks is set, or info of the link
+func (o *DomixOptions) symlinkInfo(path string, info fs.FileInfo) (fs.FileInfo, error) {
+	if o.FollowSymlinks {
+		return fs.Stat(o.fsys, path)
+	}
+	if o.InPlace {
+		return nil, fmt.Errorf("can not mix symlink %s in place, use --follow-symlinks", path)
+	}
+	return info, nil
+}
+
+// runFiles mix the files of FilesFrom, outputs are in the same structure as walking source
+func (o *DomixOptions) runFiles() error {
+	for _, rel := range o.files {
+		path := filepath.Join(o.source, rel)
+		info, err := fs.Stat(o.fsys, path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("not a regular file: %v", path)
+		}
+		outDir := filepath.Join(o.root, filepath.Dir(rel))
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+		if err := o.encryptFile(path, info, outDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptFile encrypt src with retries, skip and record it if State is set
+func (o *DomixOptions) encryptFile(src string, srcInfo os.FileInfo, outDir string) error {
+	if o.state == nil {
+		return emix.Retry(o.Retry, retryBackoff, func() error {
+			return o.EncryptFile(src, srcInfo, outDir)
+		})
+	}
+	source, err := o.manifestSource(src)
 	if err != nil {
 		return err
 	}
-	return o.EncryptFile(o.source, info, o.Output)
+	if o.state.Done(source, srcInfo) {
+		if !o.Silence {
+			fmt.Fprint(os.Stdout, src, " mixed by a previous run, skip\n")
+		}
+		return nil
+	}
+	err = emix.Retry(o.Retry, retryBackoff, func() error {
+		return o.EncryptFile(src, srcInfo, outDir)
+	})
+	if err != nil {
+		return err
+	}
+	return o.state.Add(source, srcInfo)
 }
 
 func (o *DomixOptions) EncryptFile(src string, srcInfo os.FileInfo, outDir string) error {
-	dest := filepath.Join(outDir, time.Now().Format("2006-01-02_15-04-05.000000")+".zip")
+	ext := ".zip"
+	if o.NoDisguise {
+		ext = ".emix"
+	}
+	if o.Split {
+		ext = emix.DetachedHeaderExt
+	}
+	// skip files unchanged since the previous run, the output of a changed file is replaced
+	stale := ""
+	if o.previous != nil {
+		source, err := o.manifestSource(src)
+		if err != nil {
+			return err
+		}
+		if entry, ok := o.previous[source]; ok {
+			output := filepath.Join(o.Output, filepath.FromSlash(entry.Output))
+			_, err := os.Stat(output)
+			if err == nil && entry.Size == uint64(srcInfo.Size()) && entry.ModifyTime == uint64(srcInfo.ModTime().UnixNano()) {
+				if !o.Silence {
+					fmt.Fprint(os.Stdout, src, " unchanged, skip\n")
+				}
+				o.manifest.Entries = append(o.manifest.Entries, entry)
+				return nil
+			}
+			stale = output
+		}
+	}
+
+	dest := filepath.Join(outDir, time.Now().Format("2006-01-02_15-04-05.000000")+ext)
 	if o.KeepName {
 		dest = filepath.Join(outDir, srcInfo.Name())
+		if o.Split {
+			dest += ext
+		}
+	}
+	if o.HashedName {
+		dest = filepath.Join(outDir, emix.HashedFileName(o.password, srcInfo.Name())+ext)
+	}
+	// the stale output of a changed file is replaced on purpose
+	if dest != stale && o.OnCollision != "" && o.OnCollision != onCollisionOverwrite {
+		exists, err := pathExists(dest)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !exists:
+		case o.OnCollision == onCollisionError:
+			return fmt.Errorf("output %s of %s already exists", dest, src)
+		case o.OnCollision == onCollisionSkip:
+			if !o.Silence {
+				fmt.Fprint(os.Stdout, src, " output ", dest, " exists, skip\n")
+			}
+			return nil
+		case o.OnCollision == onCollisionRename:
+			name := filepath.Base(dest)
+			for i := 1; exists; i++ {
+				dest = filepath.Join(outDir, numberedName(name, i))
+				if exists, err = pathExists(dest); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	if !o.Silence {
 		fmt.Fprint(os.Stdout, o.source, " -> ", dest, "\n")
 	}
+	mixType := o.MixType
+	if o.encryptMatcher != nil && o.encryptMatcher.MatchesPath(src) {
+		mixType = 2
+	}
+	// a symlink is mixed with its target as content
+	link := srcInfo.Mode()&fs.ModeSymlink != 0
+	linkTarget := ""
+	if link {
+		target, err := readLink(o.fsys, src)
+		if err != nil {
+			return err
+		}
+		linkTarget = target
+	}
+	// the birth time is read by os path
+	statPath := ""
+	if _, ok := o.fsys.(osFS); ok {
+		statPath = src
+	}
 	efi := &emix.FileInfo{
 		Name:       srcInfo.Name(),
 		Size:       uint64(srcInfo.Size()),
 		Mode:       uint32(srcInfo.Mode()),
-		CreateTime: uint64(getFileCreateTime(srcInfo).UnixNano()),
+		CreateTime: uint64(getFileCreateTime(statPath, srcInfo).UnixNano()),
 		ModifyTime: uint64(srcInfo.ModTime().UnixNano()),
+		Preview:    o.preview,
+	}
+	if o.RecordVersion {
+		efi.ToolVersion = version.Version
+	}
+	if o.RecordOwner {
+		efi.Owner = getFileOwner(srcInfo)
+	}
+	if link {
+		efi.Size = uint64(len(linkTarget))
+	}
+	// xattrs are read by os path, those of a symlink are of its target
+	if _, ok := o.fsys.(osFS); ok && !o.NoXattrs && !link {
+		efi.Xattrs = readSourceXattrs(src)
+		if o.NoACLs {
+			efi.Xattrs = withoutACLXattrs(efi.Xattrs)
+		}
+	}
+	switch o.IDMode {
+	case "random":
+		id, err := emix.NewRandomFileID()
+		if err != nil {
+			return err
+		}
+		efi.ID = id
+	case "content":
+		// set after content is hashed, a placeholder keeps the content offset
+		efi.ID = make([]byte, emix.FileIDLength)
+	}
+	if o.Split {
+		if efi.ID == nil {
+			id, err := emix.NewRandomFileID()
+			if err != nil {
+				return err
+			}
+			efi.ID = id
+		}
+		efi.Detached = true
+	}
+	if o.InPlace {
+		ok, err := emix.IsEmixFileByPath(src)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if !o.Silence {
+				fmt.Fprint(os.Stdout, src, " is an emix file, skip\n")
+			}
+			return nil
+		}
+		if o.Backup {
+			if err := checkBackup(src); err != nil {
+				return err
+			}
+		}
 	}
 	// header
 	emixHeader := &emix.EmixHeader{
-		EmbedPassword: o.EmbedPassword,
+		EmbedPassword: o.EmbedPassword && mixType != 0,
+		NoDisguise:    o.NoDisguise,
+		SaltedKeys:    true,
+		BindHeader:    true,
+		CipherSuite:   o.cipherSuite,
+		FileMAC:       o.FileMAC,
 		FileInfo:      *efi,
 	}
-	switch o.MixType {
+	switch mixType {
 	case 0:
 	case 1:
 		emixHeader.EncryptInfo = true
 	case 2:
 		emixHeader.EncryptData = true
 	}
-	if o.EmbedPassword {
+	sectorSize := o.SectorSize
+	if sectorSize == 0 {
+		sectorSize = emix.RecommendSectorSize(srcInfo.Size())
+	}
+	if emixHeader.EmbedPassword {
 		password, err := emix.GenerateRandomPassword(16)
 		if err != nil {
 			return err
@@ -217,66 +917,246 @@ func (o *DomixOptions) EncryptFile(src string, srcInfo os.FileInfo, outDir strin
 		copy(emixHeader.Password[:], password)
 	} else {
 		copy(emixHeader.Password[:], o.password[:])
+		emixHeader.Ciphers = o.ciphers
+		// a random recovery key is not guessable
+		if mixType != 0 && !o.RecoveryCode {
+			emixHeader.KDF = o.kdf
+		}
 	}
 
-	targetFile, err := os.Create(dest)
+	// write to a temporary file and rename it after the header is written,
+	// so an interrupted mix never leaves a half-valid emix file
+	targetFile, err := createTemp(dest)
 	if err != nil {
 		return err
 	}
-	defer targetFile.Close()
-
-	f, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("Open source file error: %v", err)
+	tmpDest := targetFile.Name()
+	done := false
+	defer func() {
+		if !done {
+			targetFile.Close()
+			os.Remove(tmpDest)
+		}
+	}()
+	mode := o.mode
+	if o.InPlace && o.Mode == "" {
+		mode = srcInfo.Mode().Perm()
+	}
+	if o.Mode != "" || o.InPlace {
+		if err := targetFile.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	// content of Split is written to its own file
+	var contentFile *os.File
+	contentDest := ""
+	if o.Split {
+		contentDest = emix.DetachedContentPath(dest)
+		if contentFile, err = createTemp(contentDest); err != nil {
+			return err
+		}
+		tmpContentDest := contentFile.Name()
+		defer func() {
+			if !done {
+				contentFile.Close()
+				os.Remove(tmpContentDest)
+			}
+		}()
+		if o.Mode != "" {
+			if err := contentFile.Chmod(o.mode); err != nil {
+				return err
+			}
+		}
 	}
-	defer f.Close()
-
-	// hash source file
-	hash := sha256.New()
-	// use tee reader
-	teef := io.TeeReader(f, hash)
 
-	// set file position to target file data
-	targetFile.Seek(int64(emix.ZipHeaderLength()+emixHeader.EncodedLength()), io.SeekStart)
+	var f fs.File
+	content := io.Reader(strings.NewReader(linkTarget))
+	if !link {
+		if f, err = o.fsys.Open(src); err != nil {
+			return fmt.Errorf("Open source file error: %w", err)
+		}
+		defer f.Close()
+		content = f
+	}
+	opts := emix.EncryptOptions{
+		Header:      emixHeader,
+		SectorSize:  sectorSize,
+		Transforms:  o.Transforms,
+		Sparse:      o.Sparse && !link,
+		ChunkHashes: o.ChunkHashes,
+		Mmap:        o.limiter == nil && useMmap(o.Mmap, srcInfo.Size()),
+		WrapWriter: func(w io.Writer) io.Writer {
+			if o.Retry > 0 {
+				w = emix.NewRetryWriter(w, o.Retry, retryBackoff)
+			}
+			if o.limiter != nil {
+				w = emix.NewRateLimitWriter(w, o.limiter)
+			}
+			return w
+		},
+		BeforeHeader: func(header *emix.EmixHeader) error {
+			if testHookBeforeHeader != nil {
+				if err := testHookBeforeHeader(); err != nil {
+					return err
+				}
+			}
+			if o.IDMode == "content" {
+				header.FileInfo.ID = emix.ContentFileID(header.FileInfo.FileContentHash[:])
+			}
+			return nil
+		},
+	}
+	if o.Split {
+		opts.Content = contentFile
+	}
+	if err := emix.EncryptFile(content, targetFile, opts); err != nil {
+		return fmt.Errorf("Write emix file error: %w", err)
+	}
+	fileHash := emixHeader.FileInfo.FileContentHash[:]
 
-	// write file content first
-	if emixHeader.EncryptData {
-		cipher, err := emix.NewAESXTS(o.password)
-		if err != nil {
+	// the content is renamed into place first, so a header never refers to missing content
+	if o.Split {
+		if o.Fsync {
+			if err := syncFile(contentFile); err != nil {
+				return fmt.Errorf("Sync file error: %w", err)
+			}
+		}
+		if err := contentFile.Close(); err != nil {
 			return err
 		}
-		err = emix.EncryptContent(cipher, teef, targetFile)
-		if err != nil {
-			return fmt.Errorf("Write encrypted file content error: %v", err)
+		if err := os.Rename(contentFile.Name(), contentDest); err != nil {
+			return err
 		}
-	} else {
-		if _, err := io.Copy(targetFile, teef); err != nil {
-			return fmt.Errorf("Write file content error: %v", err)
+	}
+	if o.Fsync {
+		if err := syncFile(targetFile); err != nil {
+			return fmt.Errorf("Sync file error: %w", err)
+		}
+	}
+	if err := targetFile.Close(); err != nil {
+		return err
+	}
+	if o.InPlace {
+		// the source is closed first, an open file can not be replaced on windows
+		f.Close()
+		if err := replaceInPlace(tmpDest, dest, o.Backup); err != nil {
+			return err
 		}
+	} else if err := os.Rename(tmpDest, dest); err != nil {
+		return err
 	}
+	done = true
+	if o.Fsync {
+		if err := syncDir(outDir); err != nil {
+			return fmt.Errorf("Sync directory error: %w", err)
+		}
+	}
+	if stale != "" && stale != dest {
+		if err := os.Remove(stale); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(stale + sidecarChecksumExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if o.SidecarChecksum {
+		if err := writeSidecarChecksum(dest, emixHeader.FileInfo.Name, fileHash, o.Ciphertext); err != nil {
+			return fmt.Errorf("Write sidecar checksum error: %w", err)
+		}
+	}
+
+	if o.manifest != nil {
+		return o.addManifestEntry(src, dest, &emixHeader.FileInfo)
+	}
+	return nil
+}
 
-	// reset file position
-	targetFile.Seek(0, io.SeekStart)
-	// write zip header
-	_, err = targetFile.Write(emix.ZipHeader())
+// manifestSource return the slash-separated source path of src recorded in manifest
+func (o *DomixOptions) manifestSource(src string) (string, error) {
+	if !o.sourceIsDir {
+		return filepath.Base(src), nil
+	}
+	rel, err := filepath.Rel(o.source, src)
 	if err != nil {
-		return fmt.Errorf("Write zip header error: %v", err)
+		return "", err
 	}
-	// write emix header
-	fileHash := hash.Sum(nil)
-	copy(emixHeader.FileInfo.FileContentHash[:], fileHash)
-	encodedHeader, err := emixHeader.MarshalBinary()
+	return filepath.ToSlash(rel), nil
+}
+
+func (o *DomixOptions) addManifestEntry(src, dest string, info *emix.FileInfo) error {
+	source, err := o.manifestSource(src)
 	if err != nil {
-		return fmt.Errorf("Encode emix header error: %v", err)
+		return err
 	}
-	_, err = targetFile.Write(encodedHeader)
+	output, err := filepath.Rel(o.Output, dest)
 	if err != nil {
-		return fmt.Errorf("Write emix header error: %v", err)
+		return err
+	}
+	o.manifest.Entries = append(o.manifest.Entries, ManifestEntry{
+		Source:     source,
+		Output:     filepath.ToSlash(output),
+		Name:       info.Name,
+		Size:       info.Size,
+		ModifyTime: info.ModifyTime,
+		SHA256:     hex.EncodeToString(info.FileContentHash[:]),
+		ID:         fileIDString(info.ID),
+	})
+	return nil
+}
+
+// fileIDString format id as a UUID string, empty if there is no id
+func fileIDString(id []byte) string {
+	if len(id) == 0 {
+		return ""
 	}
+	return emix.FormatFileID(id)
+}
 
+// autoCipherCandidates return the suites --auto-cipher selects from, --manifest and --sidecar-checksum record sha256 hashes
+func (o *DomixOptions) autoCipherCandidates() []emix.CipherSuiteID {
+	if o.Manifest == "" && o.SinceManifest == "" && (!o.SidecarChecksum || o.Ciphertext) {
+		return nil
+	}
+	var candidates []emix.CipherSuiteID
+	for _, name := range emix.CipherSuiteNames() {
+		if strings.HasSuffix(name, "+sha256") {
+			id, _ := emix.ParseCipherSuite(name)
+			candidates = append(candidates, id)
+		}
+	}
+	return candidates
+}
+
+// checkPasswordStrength warn or fail if password is estimated weaker than strongPasswordBits
+func (o *DomixOptions) checkPasswordStrength(password []byte) error {
+	if !o.VerifyPasswordStrength && !o.RequireStrong {
+		return nil
+	}
+	bits := emix.EstimatePasswordStrength(password)
+	if bits >= strongPasswordBits {
+		return nil
+	}
+	if o.RequireStrong {
+		return fmt.Errorf("password is too weak, estimated %d bits, need %d bits. Use more characters of more kinds, avoid common words and sequences", bits, strongPasswordBits)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: password is weak, estimated %d bits, suggest %d bits at least\n", bits, strongPasswordBits)
 	return nil
 }
 
+// checkCredentialStrength check the strength of the first credentialStrengthSampleLength bytes of credential file
+func (o *DomixOptions) checkCredentialStrength() error {
+	f, err := os.Open(o.CredentialFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sample, err := io.ReadAll(io.LimitReader(f, credentialStrengthSampleLength))
+	if err != nil {
+		return err
+	}
+	return o.checkPasswordStrength(sample)
+}
+
 func inputPassword() ([]byte, error) {
 	fmt.Fprint(os.Stderr, "Enter password: ")
 	password, err := term.ReadPassword(int(os.Stdin.Fd()))
@@ -284,8 +1164,8 @@ func inputPassword() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Read password error: %v", err)
 	}
-	if len(password) == 0 || len(password) > 16 {
-		return nil, errors.New("password length must be between 1 and 16")
+	if len(password) == 0 {
+		return nil, errors.New("password can not be empty")
 	}
 	return password, nil
 }
@@ -0,0 +1,1714 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+
+	"github.com/icefed/emix"
+)
+
+func TestDomixEncryptPattern(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.key":     "secret a",
+		"b.txt":     "public b",
+		"c/d.key":   "secret d",
+		"c/e.txt":   "public e",
+		"c/f.key.x": "public f",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	password, err := emix.GeneratePasswordFromFile(credentialFile)
+	assert.Nil(t, err)
+	var key [16]byte
+	copy(key[:], password)
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		CredentialFile:  credentialFile,
+		EncryptPatterns: []string{"*.key"},
+		KeepName:        true,
+		Output:          out,
+		Silence:         true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	for name, encrypted := range map[string]bool{
+		"a.key":     true,
+		"b.txt":     false,
+		"c/d.key":   true,
+		"c/e.txt":   false,
+		"c/f.key.x": false,
+	} {
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, filepath.FromSlash(name)), key)
+		assert.Nil(t, err, name)
+		assert.Equal(t, encrypted, header.EncryptData, name)
+	}
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		CredentialFile: credentialFile,
+		Output:         demixOut,
+		Silence:        true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	// password is required by the encrypted subset
+	assert.NotNil(t, (&DomixOptions{
+		EncryptPatterns: []string{"*.key"},
+		Output:          filepath.Join(tmp, "out2"),
+	}).Validate(src))
+}
+
+func TestDomixInterrupted(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+
+	testHookBeforeHeader = func() error {
+		return errors.New("crash")
+	}
+	defer func() {
+		testHookBeforeHeader = nil
+	}()
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		KeepName: true,
+		Output:   out,
+		Silence:  true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.NotNil(t, domix.Run())
+	entries, err := os.ReadDir(out)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	testHookBeforeHeader = nil
+	assert.Nil(t, domix.Run())
+	ok, err := emix.IsEmixFileByPath(filepath.Join(out, "a.txt"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.txt"}, dirNames(t, out))
+}
+
+// dirNames return the sorted names in dir, temporary files left behind show up here
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestDemixHashMismatch(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("content of a"), 0644))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	// corrupt the last byte of content
+	mixed := filepath.Join(out, "a.txt")
+	data, err := os.ReadFile(mixed)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(mixed, data, 0644))
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.ErrorContains(t, demix.Run(), "hash mismatch")
+	entries, err := os.ReadDir(demixOut)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDemixSingleFileToCwd(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("content of a"), 0644))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	entries, err := os.ReadDir(out)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	mixed := filepath.Join(out, entries[0].Name())
+
+	// a file of the user beside dest is never used as the temporary file
+	work := filepath.Join(tmp, "work")
+	assert.Nil(t, os.Mkdir(work, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(work, "a.txt.tmp"), []byte("mine"), 0644))
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(work))
+	defer os.Chdir(wd)
+
+	demix := &DemixOptions{Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.Nil(t, demix.Run())
+	content, err := os.ReadFile(filepath.Join(work, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "content of a", string(content))
+	assert.Equal(t, []string{"a.txt", "a.txt.tmp"}, dirNames(t, work))
+	content, err = os.ReadFile(filepath.Join(work, "a.txt.tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mine", string(content))
+
+	// an existing file is not overwritten
+	assert.Nil(t, os.WriteFile(filepath.Join(work, "a.txt"), []byte("mine"), 0644))
+	demix = &DemixOptions{Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.ErrorContains(t, demix.Run(), "already exists")
+	content, err = os.ReadFile(filepath.Join(work, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mine", string(content))
+}
+
+func TestDomixHashedName(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"secret-plan.txt":     "a",
+		"sub/secret-plan.txt": "b",
+		"other.txt":           "c",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	outputs := make([]map[string][32]byte, 2)
+	for i := range outputs {
+		out := filepath.Join(tmp, fmt.Sprintf("out%d", i))
+		domix := &DomixOptions{
+			MixType:        1,
+			CredentialFile: credentialFile,
+			HashedName:     true,
+			Output:         out,
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		outputs[i] = readTestTree(t, out)
+	}
+	// same names in both runs
+	names := make([]string, 0)
+	for name := range outputs[0] {
+		names = append(names, name)
+		_, ok := outputs[1][name]
+		assert.True(t, ok, name)
+		assert.NotContains(t, name, "secret")
+		assert.NotContains(t, name, "other")
+	}
+	assert.Len(t, names, 3)
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		CredentialFile: credentialFile,
+		Output:         demixOut,
+		Silence:        true,
+	}
+	assert.Nil(t, demix.Validate(filepath.Join(tmp, "out0")))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	// depends on password
+	assert.NotEqual(t, emix.HashedFileName([16]byte{1}, "a.txt"), emix.HashedFileName([16]byte{2}, "a.txt"))
+	assert.NotNil(t, (&DomixOptions{
+		MixType:       1,
+		EmbedPassword: true,
+		HashedName:    true,
+		Output:        filepath.Join(tmp, "out2"),
+	}).Validate(src))
+}
+
+func TestDemixStream(t *testing.T) {
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	assert.Nil(t, os.MkdirAll(out, 0755))
+	content := bytes.Repeat([]byte("stream"), 1000)
+
+	f, err := os.Create(filepath.Join(out, "a.zip"))
+	assert.Nil(t, err)
+	sw, err := emix.NewStreamWriter(f, &emix.EmixHeader{
+		EmbedPassword: true,
+		EncryptData:   true,
+		Password:      [16]byte{1},
+		SaltedKeys:    true,
+		FileInfo:      emix.FileInfo{Name: "a.txt", Mode: 0644},
+	})
+	assert.Nil(t, err)
+	_, err = sw.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, sw.Close())
+	assert.Nil(t, f.Close())
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		Output:  demixOut,
+		Silence: true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	data, err := os.ReadFile(filepath.Join(demixOut, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDomixCipherSuite(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "aaaa",
+		"c/d.txt": string(bytes.Repeat([]byte("d"), 10000)),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, suite := range emix.CipherSuiteNames() {
+		for _, mixType := range []int{1, 2} {
+			out := filepath.Join(tmp, "out")
+			os.RemoveAll(out)
+			domix := &DomixOptions{
+				CredentialFile: credentialFile,
+				MixType:        mixType,
+				CipherSuite:    suite,
+				KeepName:       true,
+				Output:         out,
+				Silence:        true,
+			}
+			assert.Nil(t, domix.Validate(src))
+			assert.Nil(t, domix.Run())
+
+			demixOut := filepath.Join(tmp, "demix")
+			os.RemoveAll(demixOut)
+			demix := &DemixOptions{
+				CredentialFile: credentialFile,
+				Output:         demixOut,
+				Silence:        true,
+			}
+			assert.Nil(t, demix.Validate(out))
+			assert.Nil(t, demix.Run())
+			assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut), suite)
+
+			verify := &VerifyOptions{CredentialFile: credentialFile}
+			assert.Nil(t, verify.Validate(out))
+			verify.out = bytes.NewBuffer(nil)
+			assert.Nil(t, verify.Run(), suite)
+		}
+	}
+
+	assert.NotNil(t, (&DomixOptions{
+		CredentialFile: credentialFile,
+		MixType:        2,
+		CipherSuite:    "aes-gcm+aes-xts+md5",
+		Output:         filepath.Join(tmp, "out2"),
+	}).Validate(src))
+}
+
+func TestDomixAutoCipher(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, bytes.Repeat([]byte("a"), 10000), 0644))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, manifest := range []string{"", filepath.Join(tmp, "manifest.json")} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, AutoCipher: true, KeepName: true, Manifest: manifest, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), domix.password)
+		assert.Nil(t, err)
+		if manifest == "" {
+			assert.Equal(t, emix.FastestCipherSuite(), header.CipherSuite)
+		} else {
+			assert.True(t, strings.HasSuffix(header.CipherSuite.String(), "+sha256"), header.CipherSuite)
+		}
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, filepath.Dir(src))["a.txt"], readTestTree(t, demixOut)["a.txt"])
+	}
+
+	assert.NotNil(t, (&DomixOptions{CredentialFile: credentialFile, MixType: 2, AutoCipher: true, CipherSuite: "chacha20+chacha20+blake2b", Output: tmp}).Validate(src))
+}
+
+func TestDomixMmap(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"empty.txt": "",
+		"a.txt":     "aaaa",
+		"c/d.txt":   string(bytes.Repeat([]byte("d"), 10000)),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mode := range []string{"always", "never"} {
+		out := filepath.Join(tmp, "out-"+mode)
+		domix := &DomixOptions{
+			CredentialFile: credentialFile,
+			MixType:        2,
+			KeepName:       true,
+			Mmap:           mode,
+			Output:         out,
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+
+		// decrypt with the other mode
+		demixOut := filepath.Join(tmp, "demix-"+mode)
+		demix := &DemixOptions{
+			CredentialFile: credentialFile,
+			Mmap:           map[string]string{"always": "never", "never": "always"}[mode],
+			Output:         demixOut,
+			Silence:        true,
+		}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut), mode)
+	}
+
+	assert.NotNil(t, (&DomixOptions{MixType: 2, CredentialFile: credentialFile, Mmap: "sometimes"}).Validate(src))
+}
+
+func TestDomixSinceManifest(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "aaaa",
+		"b.txt":   "bbbb",
+		"c/d.txt": "dddd",
+	})
+	out := filepath.Join(tmp, "out")
+	manifestPath := filepath.Join(tmp, "manifest.json")
+
+	domix := &DomixOptions{
+		Manifest: manifestPath,
+		Output:   out,
+		Silence:  true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	first := readTestTree(t, out)
+	assert.Len(t, first, 3)
+
+	// change one file, keep its modify time different
+	bPath := filepath.Join(src, "b.txt")
+	assert.Nil(t, os.WriteFile(bPath, []byte("changed b"), 0644))
+	mtime := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(bPath, mtime, mtime))
+
+	domix = &DomixOptions{
+		SinceManifest: manifestPath,
+		Output:        out,
+		Silence:       true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	second := readTestTree(t, out)
+	assert.Len(t, second, 3)
+
+	// only the output of b.txt is replaced
+	m, err := readManifest(manifestPath)
+	assert.Nil(t, err)
+	assert.Len(t, m.Entries, 3)
+	for _, entry := range m.Entries {
+		_, unchanged := first[entry.Output]
+		assert.Equal(t, entry.Source != "b.txt", unchanged, entry.Source)
+		if entry.Source == "b.txt" {
+			assert.Equal(t, uint64(len("changed b")), entry.Size)
+			assert.Equal(t, uint64(mtime.UnixNano()), entry.ModifyTime)
+		} else {
+			assert.Equal(t, first[entry.Output], second[entry.Output], entry.Source)
+		}
+	}
+
+	// the updated manifest verifies
+	verify := &VerifyManifestOptions{}
+	assert.Nil(t, verify.Validate(manifestPath, out))
+	verify.out = bytes.NewBuffer(nil)
+	assert.Nil(t, verify.Run())
+
+	assert.NotNil(t, (&DomixOptions{SinceManifest: manifestPath}).Validate(src))
+}
+
+func TestDomixRetry(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+	failures := 0
+	testHookBeforeHeader = func() error {
+		if failures > 0 {
+			failures--
+			return &os.PathError{Op: "write", Path: src, Err: syscall.EAGAIN}
+		}
+		return nil
+	}
+	defer func() {
+		testHookBeforeHeader = nil
+	}()
+
+	for _, retry := range []int{0, 1, 2} {
+		out := filepath.Join(tmp, fmt.Sprint("out", retry))
+		domix := &DomixOptions{
+			KeepName: true,
+			Retry:    retry,
+			Output:   out,
+			Silence:  true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		failures = 2
+		err := domix.Run()
+		assert.Equal(t, retry == 2, err == nil, retry)
+		_, err = os.Stat(filepath.Join(out, "a.txt"))
+		assert.Equal(t, retry == 2, err == nil, retry)
+	}
+
+	// permanent errors are not retried
+	failures = 0
+	testHookBeforeHeader = func() error {
+		failures++
+		return errors.New("crash")
+	}
+	domix := &DomixOptions{KeepName: true, Retry: 2, Output: filepath.Join(tmp, "out"), Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.NotNil(t, domix.Run())
+	assert.Equal(t, 1, failures)
+}
+
+func TestDomixPreserveRootName(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "docs")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+	})
+	tree := readTestTree(t, src)
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		KeepName:         true,
+		PreserveRootName: true,
+		Output:           out,
+		Silence:          true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	_, err := emix.ReadHeaderFromPath(filepath.Join(out, "docs", "b", "c.txt"), [16]byte{})
+	assert.Nil(t, err)
+
+	// the root folder is recreated by the layout of outputs
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		Output:  demixOut,
+		Silence: true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, tree, readTestTree(t, filepath.Join(demixOut, "docs")))
+
+	// demix of the root folder itself keeps its name
+	demixOut = filepath.Join(tmp, "demix2")
+	demix = &DemixOptions{
+		PreserveRootName: true,
+		Output:           demixOut,
+		Silence:          true,
+	}
+	assert.Nil(t, demix.Validate(filepath.Join(out, "docs")))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, tree, readTestTree(t, filepath.Join(demixOut, "docs")))
+}
+
+func TestDomixFsync(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+	})
+	// temporary files have random names, they are recorded as dir/*
+	var synced []string
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	syncFile = func(f *os.File) error {
+		name := f.Name()
+		if strings.HasPrefix(filepath.Base(name), tempPrefix) {
+			name = filepath.Join(filepath.Dir(name), "*")
+		}
+		synced = append(synced, name)
+		return f.Sync()
+	}
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, KeepName: true, EmbedPassword: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	assert.Empty(t, synced)
+
+	domix = &DomixOptions{MixType: 2, KeepName: true, EmbedPassword: true, Fsync: true, Output: filepath.Join(tmp, "out2"), Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	// files are synced before rename, directories after
+	assert.Equal(t, []string{
+		filepath.Join(tmp, "out2", "*"),
+		filepath.Join(tmp, "out2"),
+		filepath.Join(tmp, "out2", "b", "*"),
+		filepath.Join(tmp, "out2", "b"),
+	}, synced)
+	assert.Equal(t, []string{"a.txt", "b"}, dirNames(t, filepath.Join(tmp, "out2")))
+	assert.Equal(t, []string{"c.txt"}, dirNames(t, filepath.Join(tmp, "out2", "b")))
+
+	synced = nil
+	demix := &DemixOptions{Fsync: true, Output: filepath.Join(tmp, "demix"), Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{
+		filepath.Join(tmp, "demix", "*"),
+		filepath.Join(tmp, "demix"),
+		filepath.Join(tmp, "demix", "b", "*"),
+		filepath.Join(tmp, "demix", "b"),
+	}, synced)
+	assert.Equal(t, []string{"a.txt", "b"}, dirNames(t, filepath.Join(tmp, "demix")))
+	assert.Equal(t, []string{"c.txt"}, dirNames(t, filepath.Join(tmp, "demix", "b")))
+
+	// a failed sync fails the file
+	syncFile = func(*os.File) error { return syscall.EIO }
+	demix = &DemixOptions{Fsync: true, Output: filepath.Join(tmp, "demix2"), Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.ErrorIs(t, demix.Run(), syscall.EIO)
+}
+
+func TestDomixRecoveryCode(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+	})
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, RecoveryCode: true, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	code := domix.recoveryCode
+	assert.NotEmpty(t, code)
+	// the key is not embedded
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), domix.password)
+	assert.Nil(t, err)
+	assert.False(t, header.EmbedPassword)
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{RecoveryCode: strings.ToLower(code), Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	// a mistyped code
+	mistyped := []byte(code)
+	if mistyped[0] == 'A' {
+		mistyped[0] = 'B'
+	} else {
+		mistyped[0] = 'A'
+	}
+	demix = &DemixOptions{RecoveryCode: string(mistyped), Output: filepath.Join(tmp, "demix2")}
+	assert.ErrorIs(t, demix.Validate(out), emix.ErrInvalidRecoveryCode)
+
+	// the key comes from the code only
+	assert.NotNil(t, (&DomixOptions{MixType: 2, RecoveryCode: true, EmbedPassword: true, Output: filepath.Join(tmp, "out2")}).Validate(src))
+}
+
+func TestDemixRecurseNested(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("mixed twice"), 0644))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	// an embed-password file of a password file of the same name
+	once := filepath.Join(tmp, "once")
+	domix := &DomixOptions{MixType: 2, CredentialFile: credentialFile, KeepName: true, Output: once, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	twice := filepath.Join(tmp, "twice")
+	domix = &DomixOptions{MixType: 2, EmbedPassword: true, KeepName: true, Output: twice, Silence: true}
+	assert.Nil(t, domix.Validate(filepath.Join(once, "a.txt")))
+	assert.Nil(t, domix.Run())
+
+	// de-mixed once without the flag
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(twice))
+	assert.Nil(t, demix.Run())
+	ok, err := emix.IsEmixFileByPath(filepath.Join(demixOut, "a.txt"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	demixOut = filepath.Join(tmp, "demix2")
+	demix = &DemixOptions{CredentialFile: credentialFile, RecurseNested: true, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(twice))
+	assert.Nil(t, demix.Run())
+	entries, err := os.ReadDir(demixOut)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	data, err := os.ReadFile(filepath.Join(demixOut, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mixed twice", string(data))
+
+	// the nested file is kept if its password is unknown
+	demixOut = filepath.Join(tmp, "demix3")
+	demix = &DemixOptions{RecurseNested: true, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(twice))
+	assert.NotNil(t, demix.Run())
+	ok, err = emix.IsEmixFileByPath(filepath.Join(demixOut, "a.txt"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestDomixMode(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, EmbedPassword: true, KeepName: true, Mode: "0600", Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	info, err := os.Stat(filepath.Join(out, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the original mode is recorded regardless
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), os.FileMode(header.FileInfo.Mode).Perm())
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Mode: "440", Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	info, err = os.Stat(filepath.Join(demixOut, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0440), info.Mode().Perm())
+
+	for _, mode := range []string{"rw", "0800", "10000"} {
+		assert.NotNil(t, (&DemixOptions{Mode: mode, Output: demixOut}).Validate(out), mode)
+	}
+}
+
+func TestDomixRateLimit(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": strings.Repeat("a", 64*1024),
+		"b.txt": strings.Repeat("b", 64*1024),
+	})
+
+	// the first 64KiB are the burst, the limit is shared by files
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, EmbedPassword: true, KeepName: true, RateLimit: "128KiB", Mmap: "always", Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	domix.limiter = rate.NewLimiter(128*1024, 64*1024)
+	start := time.Now()
+	assert.Nil(t, domix.Run())
+	assert.Greater(t, time.Since(start), 400*time.Millisecond)
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{RateLimit: "128KiB", Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	demix.limiter = rate.NewLimiter(128*1024, 64*1024)
+	start = time.Now()
+	assert.Nil(t, demix.Run())
+	assert.Greater(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	for _, limit := range []string{"fast", "0", "-1MB"} {
+		assert.NotNil(t, (&DemixOptions{RateLimit: limit, Output: demixOut}).Validate(out), limit)
+	}
+}
+
+func TestDomixTransform(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   strings.Repeat("a", 100000),
+		"b/c.txt": "c",
+	})
+
+	for _, mixType := range []int{0, 1, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: mixType, EmbedPassword: mixType != 0, KeepName: true, Transforms: []string{"gzip"}, Mmap: "always", Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"gzip"}, header.FileInfo.Transforms)
+		assert.Less(t, header.FileInfo.Size, uint64(1000), "content is compressed")
+
+		// size and hash of the transformed content are checked as is
+		verify := &VerifyOptions{}
+		assert.Nil(t, verify.Validate(out))
+		verify.out = io.Discard
+		assert.Nil(t, verify.Run())
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut), mixType)
+	}
+
+	out := filepath.Join(tmp, "out")
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, Transforms: []string{"unknown"}, Output: out}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, Transforms: []string{"gzip"}, ChunkHashes: true, Output: out}).Validate(src))
+}
+
+func TestDomixCompress(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.log": strings.Repeat("GET /index.html 200\n", 5000),
+	})
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, EmbedPassword: true, KeepName: true, Compress: "gzip", Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Validate(src))
+	assert.Equal(t, []string{"gzip"}, domix.Transforms)
+	assert.Nil(t, domix.Run())
+	mixed := filepath.Join(out, "a.log")
+	info, err := os.Stat(mixed)
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(10000), "content is compressed")
+	header, err := emix.ReadHeaderFromPath(mixed, [16]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100000), header.FileInfo.OriginalSize)
+	assert.Equal(t, uint64(100000), header.FileInfo.RestoredSize())
+
+	// ls and stat show the original size
+	ls := &LsOptions{LongFormat: true}
+	assert.Nil(t, ls.Validate(out))
+	buf := bytes.NewBuffer(nil)
+	ls.out = buf
+	assert.Nil(t, ls.Run())
+	assert.Contains(t, buf.String(), " 100kB ")
+	stat := &StatOptions{}
+	assert.Nil(t, stat.Validate(mixed))
+	buf = bytes.NewBuffer(nil)
+	stat.out = buf
+	assert.Nil(t, stat.Run())
+	assert.Contains(t, buf.String(), "Orig Size: 100 kB (100000)")
+
+	verify := &VerifyOptions{}
+	assert.Nil(t, verify.Validate(out))
+	buf = bytes.NewBuffer(nil)
+	verify.out = buf
+	assert.Nil(t, verify.Run())
+	assert.Contains(t, buf.String(), "OK "+mixed)
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, Compress: "zstd", Output: out}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, Compress: "gzip", ChunkHashes: true, Output: out}).Validate(src))
+}
+
+func TestDomixSparse(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	assert.Nil(t, os.MkdirAll(src, 0755))
+	// a 256MB file with 8 bytes of data
+	f, err := os.Create(filepath.Join(src, "disk.img"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("head"))
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("tail"), 128<<20)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Truncate(256<<20))
+	f.Close()
+	if info, _ := os.Stat(filepath.Join(src, "disk.img")); info.Sys().(*syscall.Stat_t).Blocks*512 >= 1<<20 {
+		t.Skip("filesystem does not support holes")
+	}
+
+	for _, transforms := range [][]string{nil, {"gzip"}} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: 2, EmbedPassword: true, KeepName: true, Sparse: true, Transforms: transforms, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, "disk.img"), [16]byte{})
+		assert.Nil(t, err)
+		assert.NotNil(t, header.FileInfo.Sparse)
+		assert.Equal(t, uint64(256<<20), header.FileInfo.Sparse.Size)
+		info, err := os.Stat(filepath.Join(out, "disk.img"))
+		assert.Nil(t, err)
+		assert.Less(t, info.Size(), int64(1<<20), "holes are not stored")
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+		info, err = os.Stat(filepath.Join(demixOut, "disk.img"))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(256<<20), info.Size())
+		assert.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(1<<20), "holes are recreated")
+	}
+
+	assert.NotNil(t, (&DomixOptions{MixType: 2, EmbedPassword: true, Sparse: true, SinceManifest: "manifest.json", Output: tmp}).Validate(src))
+}
+
+func TestDemixFromZip(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": strings.Repeat("c", 10000),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, CredentialFile: credentialFile, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	// two emix files, compressed and stored, and an ordinary file
+	writeZip := func(name string, entries map[string]string) string {
+		archive := filepath.Join(tmp, name)
+		f, err := os.Create(archive)
+		assert.Nil(t, err)
+		defer f.Close()
+		zw := zip.NewWriter(f)
+		for _, entry := range testTreePaths(entries) {
+			method := zip.Deflate
+			if strings.HasPrefix(entry, "b/") {
+				method = zip.Store
+			}
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: entry, Method: method})
+			assert.Nil(t, err)
+			data := []byte(entries[entry])
+			if entries[entry] == "" {
+				data, err = os.ReadFile(filepath.Join(out, filepath.FromSlash(entry)))
+				assert.Nil(t, err)
+			}
+			_, err = w.Write(data)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, zw.Close())
+		return archive
+	}
+	archive := writeZip("mail.zip", map[string]string{"a.txt": "", "b/c.txt": "", "readme.txt": "not emix"})
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{CredentialFile: credentialFile, FromZip: archive, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(""))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	// path prefix is applied to paths in archive
+	prefixOut := filepath.Join(tmp, "prefix")
+	demix = &DemixOptions{CredentialFile: credentialFile, FromZip: archive, PathPrefix: "b", Output: prefixOut, Silence: true}
+	assert.Nil(t, demix.Validate(""))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"b/c.txt"}, testTreePaths(readTestTree(t, prefixOut)))
+
+	assert.NotNil(t, (&DemixOptions{FromZip: archive, Output: demixOut}).Validate(out))
+	assert.NotNil(t, (&DemixOptions{Output: demixOut}).Validate(""))
+	// an emix file is not a real zip archive
+	assert.NotNil(t, (&DemixOptions{FromZip: filepath.Join(out, "a.txt"), Output: demixOut}).Validate(""))
+	// entries out of output
+	archive = writeZip("evil.zip", map[string]string{"a.txt": ""})
+	data, err := os.ReadFile(archive)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(archive, bytes.ReplaceAll(data, []byte("a.txt"), []byte("../at")), 0644))
+	demix = &DemixOptions{CredentialFile: credentialFile, FromZip: archive, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(""))
+	assert.ErrorContains(t, demix.Run(), "invalid entry")
+}
+
+func TestDomixFS(t *testing.T) {
+	modifyTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"src/a.txt":         {Data: []byte("a"), Mode: 0644, ModTime: modifyTime},
+		"src/.hidden":       {Data: []byte("hidden")},
+		"src/b/c.txt":       {Data: []byte("c"), Mode: 0600},
+		"src/b/d/e.txt":     {Data: []byte("e")},
+		"src/b/d/e.log":     {Data: []byte("log")},
+		"src/.git/config":   {Data: []byte("config")},
+		"src/skip/f.txt":    {Data: []byte("f")},
+		"other/outside.txt": {Data: []byte("outside")},
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	domix := &DomixOptions{
+		MixType:       2,
+		EmbedPassword: true,
+		KeepName:      true,
+		Excludes:      []string{".*", "*.log", "skip/"},
+		Output:        out,
+		Silence:       true,
+		fsys:          fsys,
+	}
+	assert.Nil(t, domix.Validate("src"))
+	assert.Nil(t, domix.Run())
+
+	var outputs []string
+	assert.Nil(t, filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(out, path)
+		outputs = append(outputs, filepath.ToSlash(rel))
+		return nil
+	}))
+	assert.Equal(t, []string{"a.txt", "b/c.txt", "b/d/e.txt"}, outputs)
+
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0644, header.FileInfo.Mode)
+	assert.EqualValues(t, 1, header.FileInfo.Size)
+	assert.EqualValues(t, modifyTime.UnixNano(), header.FileInfo.ModifyTime)
+	header, err = emix.ReadHeaderFromPath(filepath.Join(out, "b", "c.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0600, header.FileInfo.Mode)
+
+	demixOut := filepath.Join(t.TempDir(), "demix")
+	demix := &DemixOptions{Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	data, err := os.ReadFile(filepath.Join(demixOut, "b", "d", "e.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "e", string(data))
+
+	// single file
+	out = filepath.Join(t.TempDir(), "single")
+	domix = &DomixOptions{KeepName: true, Output: out, Silence: true, fsys: fsys}
+	assert.Nil(t, domix.Validate("src/b/c.txt"))
+	assert.Nil(t, domix.Run())
+	header, err = emix.ReadHeaderFromPath(filepath.Join(out, "c.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, "c.txt", header.FileInfo.Name)
+
+	// missing source
+	assert.ErrorIs(t, (&DomixOptions{Output: out, fsys: fsys}).Validate("missing"), fs.ErrNotExist)
+}
+
+func TestDomixIDMode(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":      "same",
+		"copy/a.txt": "same",
+		"b.txt":      "other",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	// ids by source of a run
+	mixIDs := func(idMode string, run int) map[string]string {
+		out := filepath.Join(tmp, fmt.Sprintf("%s%d", idMode, run))
+		manifestPath := out + ".json"
+		domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, IDMode: idMode, KeepName: true, Manifest: manifestPath, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		m, err := readManifest(manifestPath)
+		assert.Nil(t, err)
+		ids := make(map[string]string)
+		for _, entry := range m.Entries {
+			header, err := emix.ReadHeaderFromPath(filepath.Join(out, filepath.FromSlash(entry.Output)), domix.password)
+			assert.Nil(t, err)
+			assert.Equal(t, emix.FormatFileID(header.FileInfo.ID), entry.ID)
+			ids[entry.Source] = entry.ID
+		}
+		return ids
+	}
+
+	// the same content always yields the same id
+	content1, content2 := mixIDs("content", 1), mixIDs("content", 2)
+	assert.Equal(t, content1, content2)
+	assert.Equal(t, content1["a.txt"], content1["copy/a.txt"])
+	assert.NotEqual(t, content1["a.txt"], content1["b.txt"])
+
+	// random ids are unique for each mix
+	random1, random2 := mixIDs("random", 1), mixIDs("random", 2)
+	seen := make(map[string]bool)
+	for _, ids := range []map[string]string{random1, random2} {
+		for _, id := range ids {
+			assert.False(t, seen[id], id)
+			seen[id] = true
+		}
+	}
+
+	// no id by default
+	assert.Empty(t, mixIDs("", 1)["a.txt"])
+
+	// stat and ls show the ids
+	stat := &StatOptions{CredentialFile: credentialFile}
+	assert.Nil(t, stat.Validate(filepath.Join(tmp, "content1", "b.txt")))
+	buf := bytes.NewBuffer(nil)
+	stat.out = buf
+	assert.Nil(t, stat.Run())
+	assert.Contains(t, buf.String(), content1["b.txt"])
+	ls := &LsOptions{CredentialFile: credentialFile, ShowID: true}
+	assert.Nil(t, ls.Validate(filepath.Join(tmp, "content1", "copy")))
+	buf.Reset()
+	ls.out = buf
+	assert.Nil(t, ls.Run())
+	assert.Equal(t, content1["copy/a.txt"]+"  a.txt\n", buf.String())
+
+	assert.NotNil(t, (&DomixOptions{IDMode: "serial"}).Validate(src))
+}
+
+func TestDomixSidecarChecksum(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   strings.Repeat("a", 10000),
+		"c/b.txt": "b",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	line := regexp.MustCompile(`^[0-9a-f]{64}  [^/\n]+\n$`)
+	sha256sum, lookErr := exec.LookPath("sha256sum")
+
+	for _, ciphertext := range []bool{false, true} {
+		out := filepath.Join(tmp, fmt.Sprintf("out-%v", ciphertext))
+		domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, SidecarChecksum: true, Ciphertext: ciphertext, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+
+		// checked in the directory of outputs, or of de-mixed files with the original names
+		checkDir := out
+		if !ciphertext {
+			checkDir = filepath.Join(tmp, fmt.Sprintf("demix-%v", ciphertext))
+			demix := &DemixOptions{CredentialFile: credentialFile, Output: checkDir, Silence: true}
+			assert.Nil(t, demix.Validate(out))
+			assert.Nil(t, demix.Run())
+		}
+		sidecars, err := filepath.Glob(filepath.Join(out, "*", "*"+sidecarChecksumExt))
+		assert.Nil(t, err)
+		top, err := filepath.Glob(filepath.Join(out, "*"+sidecarChecksumExt))
+		assert.Nil(t, err)
+		sidecars = append(sidecars, top...)
+		assert.Len(t, sidecars, 2)
+		for _, sidecar := range sidecars {
+			data, err := os.ReadFile(sidecar)
+			assert.Nil(t, err)
+			assert.Regexp(t, line, string(data))
+			hash, name, _ := strings.Cut(strings.TrimSuffix(string(data), "\n"), "  ")
+			rel, err := filepath.Rel(out, filepath.Dir(sidecar))
+			assert.Nil(t, err)
+			dir := filepath.Join(checkDir, rel)
+			if ciphertext {
+				assert.Equal(t, strings.TrimSuffix(filepath.Base(sidecar), sidecarChecksumExt), name)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), hash)
+			if lookErr == nil {
+				cmd := exec.Command(sha256sum, "-c", sidecar)
+				cmd.Dir = dir
+				output, err := cmd.CombinedOutput()
+				assert.Nil(t, err, string(output))
+			}
+		}
+	}
+
+	assert.Equal(t, "\\"+strings.Repeat("00", 32)+"  a\\\\b\\nc\n", sha256sumLine(make([]byte, 32), "a\\b\nc"))
+	assert.NotNil(t, (&DomixOptions{Ciphertext: true}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{SidecarChecksum: true, Sparse: true}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{SidecarChecksum: true, CipherSuite: "chacha20+chacha20+blake2b"}).Validate(src))
+}
+
+func TestDemixToTarGz(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":     strings.Repeat("a", 10000),
+		"b/c.sh":    "#!/bin/sh",
+		"b/d/e.txt": "",
+	})
+	assert.Nil(t, os.Chmod(filepath.Join(src, "b", "c.sh"), 0750))
+	mtime := time.Date(2023, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	assert.Nil(t, os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, RecordOwner: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	archive := filepath.Join(tmp, "out.tar.gz")
+	demix := &DemixOptions{CredentialFile: credentialFile, ToTarGz: archive, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+
+	f, err := os.Open(archive)
+	assert.Nil(t, err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	tr := tar.NewReader(gr)
+	headers := make(map[string]*tar.Header)
+	hashes := make(map[string][32]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		content, err := io.ReadAll(tr)
+		assert.Nil(t, err)
+		headers[hdr.Name] = hdr
+		hashes[hdr.Name] = sha256.Sum256(content)
+	}
+	assert.Equal(t, readTestTree(t, src), hashes)
+	assert.Equal(t, int64(0750), headers["b/c.sh"].Mode)
+	assert.Equal(t, int64(0644), headers["a.txt"].Mode)
+	assert.True(t, mtime.Equal(headers["a.txt"].ModTime), headers["a.txt"].ModTime)
+	info, err := os.Stat(filepath.Join(src, "a.txt"))
+	assert.Nil(t, err)
+	if owner := getFileOwner(info); owner != nil {
+		assert.Equal(t, int(owner.UID), headers["a.txt"].Uid)
+		assert.Equal(t, owner.User, headers["a.txt"].Uname)
+	}
+
+	// xattrs are PAX records
+	hdr := tarHeader("a.txt", &emix.FileInfo{Mode: uint32(0755 | fs.ModeSetuid), Xattrs: []emix.Xattr{{Name: "user.comment", Value: []byte("keep me")}}}, 1)
+	assert.Equal(t, int64(04755), hdr.Mode)
+	assert.Equal(t, map[string]string{"SCHILY.xattr.user.comment": "keep me"}, hdr.PAXRecords)
+
+	assert.NotNil(t, (&DemixOptions{ToTarGz: archive}).Validate(out))
+	assert.NotNil(t, (&DemixOptions{ToTarGz: filepath.Join(tmp, "new.tar.gz"), Output: tmp}).Validate(out))
+}
+
+func TestDomixSplit(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   strings.Repeat("a", 10000),
+		"c/b.txt": "b",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, keepName := range []bool{false, true} {
+		out := filepath.Join(tmp, fmt.Sprintf("out-%v", keepName))
+		domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, Split: true, KeepName: keepName, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		headers, err := filepath.Glob(filepath.Join(out, "*"+emix.DetachedHeaderExt))
+		assert.Nil(t, err)
+		assert.Len(t, headers, 1)
+		if keepName {
+			assert.Equal(t, filepath.Join(out, "a.txt"+emix.DetachedHeaderExt), headers[0])
+		}
+		contentInfo, err := os.Stat(emix.DetachedContentPath(headers[0]))
+		assert.Nil(t, err)
+		header, err := emix.ReadHeaderFromPath(headers[0], domix.password)
+		assert.Nil(t, err)
+		assert.True(t, header.FileInfo.Detached)
+		assert.Len(t, header.FileInfo.ID, emix.FileIDLength)
+		headerInfo, err := os.Stat(headers[0])
+		assert.Nil(t, err)
+		assert.Equal(t, header.ContentOffset(), headerInfo.Size())
+		assert.Greater(t, contentInfo.Size(), int64(10000))
+
+		demixOut := filepath.Join(tmp, fmt.Sprintf("demix-%v", keepName))
+		demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+		stat := &StatOptions{CredentialFile: credentialFile}
+		assert.Nil(t, stat.Validate(headers[0]))
+		buf := bytes.NewBuffer(nil)
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		assert.Contains(t, buf.String(), filepath.Base(emix.DetachedContentPath(headers[0])))
+		assert.NotContains(t, buf.String(), "Warning")
+		verify := &VerifyOptions{CredentialFile: credentialFile}
+		assert.Nil(t, verify.Validate(out))
+		buf.Reset()
+		verify.out = buf
+		assert.Nil(t, verify.Run())
+		assert.Contains(t, buf.String(), "2 files, 2 ok, 0 failed")
+	}
+
+	// the content file of another header is refused
+	out := filepath.Join(tmp, "out-true")
+	assert.Nil(t, os.Rename(filepath.Join(out, "c", "b.txt"+emix.DetachedContentExt), filepath.Join(out, "a.txt"+emix.DetachedContentExt)))
+	demix := &DemixOptions{CredentialFile: credentialFile, Output: filepath.Join(tmp, "demix-mismatch"), Silence: true}
+	assert.Nil(t, demix.Validate(filepath.Join(out, "a.txt"+emix.DetachedHeaderExt)))
+	assert.ErrorIs(t, demix.Run(), emix.ErrDetachedContentMismatch)
+
+	assert.NotNil(t, (&DomixOptions{Split: true, Manifest: filepath.Join(tmp, "m.json")}).Validate(src))
+}
+
+func TestDemixDestTemplate(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"photos/a.jpg":  "a",
+		"photos/b.jpg":  "b",
+		"docs/c/d.txt":  "d",
+		"docs/nochange": "n",
+	})
+	for name, year := range map[string]int{"photos/a.jpg": 2021, "photos/b.jpg": 2023, "docs/c/d.txt": 2023, "docs/nochange": 2024} {
+		mtime := time.Date(year, 6, 1, 12, 0, 0, 0, time.Local)
+		assert.Nil(t, os.Chtimes(filepath.Join(src, filepath.FromSlash(name)), mtime, mtime))
+	}
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{DestTemplate: "{{.ModifyTime.Year}}/{{.RelPath}}", PathPrefix: "photos", Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"2021/photos/a.jpg", "2023/photos/b.jpg"}, testTreePaths(readTestTree(t, demixOut)))
+	// directories of the source tree are not created
+	entries, err := os.ReadDir(demixOut)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	demixOut = filepath.Join(tmp, "demix-hash")
+	demix = &DemixOptions{DestTemplate: "{{slice .Hash 0 2}}/{{.Name}}", Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	hash := sha256.Sum256([]byte("d"))
+	data, err := os.ReadFile(filepath.Join(demixOut, fmt.Sprintf("%x", hash[:1]), "d.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "d", string(data))
+
+	// paths out of output are refused
+	for _, tmpl := range []string{"../{{.Name}}", "/{{.Name}}", "{{if false}}x{{end}}"} {
+		demix = &DemixOptions{DestTemplate: tmpl, Output: filepath.Join(tmp, "escape"), Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.NotNil(t, demix.Run(), tmpl)
+	}
+	for _, tmpl := range []string{"{{.Name", "{{.Owner}}/{{.Name}}"} {
+		assert.NotNil(t, (&DemixOptions{DestTemplate: tmpl, Output: filepath.Join(tmp, "invalid")}).Validate(out), tmpl)
+	}
+	_, err = os.Stat(filepath.Join(tmp, "a.jpg"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDomixState(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	files := map[string]string{
+		"a.txt":     "a",
+		"b.txt":     "b",
+		"sub/c.txt": "c",
+	}
+	writeTestTree(t, src, files)
+	state := filepath.Join(tmp, "state")
+	out := filepath.Join(tmp, "out")
+
+	// the run crashes at the second file
+	mixed := 0
+	testHookBeforeHeader = func() error {
+		mixed++
+		if mixed == 2 {
+			return errors.New("crash")
+		}
+		return nil
+	}
+	defer func() {
+		testHookBeforeHeader = nil
+	}()
+	domix := &DomixOptions{
+		KeepName: true,
+		Output:   out,
+		Silence:  true,
+		State:    state,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.NotNil(t, domix.Run())
+	data, err := os.ReadFile(state)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+	assert.Contains(t, string(data), `"source":"a.txt"`)
+
+	// the resumed run only mixes the remaining files
+	mixed = 0
+	testHookBeforeHeader = func() error {
+		mixed++
+		return nil
+	}
+	assert.Nil(t, domix.Run())
+	assert.Equal(t, 2, mixed)
+	demix := &DemixOptions{Output: filepath.Join(tmp, "restored"), Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, filepath.Join(tmp, "restored")))
+
+	// nothing left, a changed file is mixed again
+	mixed = 0
+	assert.Nil(t, domix.Run())
+	assert.Equal(t, 0, mixed)
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "b.txt"), []byte("bb"), 0644))
+	assert.Nil(t, domix.Run())
+	assert.Equal(t, 1, mixed)
+
+	// a line cut by an interruption is ignored
+	f, err := os.OpenFile(state, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"source":"sub/c`)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	mixed = 0
+	assert.Nil(t, domix.Run())
+	assert.Equal(t, 0, mixed)
+
+	assert.NotNil(t, (&DomixOptions{
+		State:    state,
+		Manifest: filepath.Join(tmp, "manifest.json"),
+		Output:   out,
+	}).Validate(src))
+}
+
+func TestDomixInPlace(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"secret.doc":   "secret",
+		"sub/note.txt": "note",
+	})
+	assert.Nil(t, os.Chmod(filepath.Join(src, "secret.doc"), 0600))
+	original := readTestTree(t, src)
+	credential := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credential, []byte("a"), 0600))
+
+	// lock
+	domix := &DomixOptions{
+		MixType:        2,
+		CredentialFile: credential,
+		InPlace:        true,
+		Backup:         true,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	for _, name := range []string{"secret.doc", "sub/note.txt"} {
+		ok, err := emix.IsEmixFileByPath(filepath.Join(src, name))
+		assert.Nil(t, err)
+		assert.True(t, ok, name)
+		data, err := os.ReadFile(filepath.Join(src, name+backupExt))
+		assert.Nil(t, err)
+		assert.Equal(t, original[name], sha256.Sum256(data))
+	}
+	assert.Equal(t, []string{"secret.doc", "secret.doc" + backupExt, "sub"}, dirNames(t, src))
+	assert.Equal(t, []string{"note.txt", "note.txt" + backupExt}, dirNames(t, filepath.Join(src, "sub")))
+	info, err := os.Stat(filepath.Join(src, "secret.doc"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode().Perm())
+	for _, name := range []string{"secret.doc", "sub/note.txt"} {
+		assert.Nil(t, os.Remove(filepath.Join(src, name+backupExt)))
+	}
+
+	// mixed files are not mixed again
+	domix = &DomixOptions{MixType: 2, CredentialFile: credential, InPlace: true, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	locked := readTestTree(t, src)
+	assert.Nil(t, domix.Run())
+	assert.Equal(t, locked, readTestTree(t, src))
+
+	// unlock
+	demix := &DemixOptions{CredentialFile: credential, InPlace: true, Silence: true}
+	assert.Nil(t, demix.Validate(filepath.Join(src, "secret.doc")))
+	assert.Nil(t, demix.Run())
+	demix = &DemixOptions{CredentialFile: credential, InPlace: true, Silence: true}
+	assert.Nil(t, demix.Validate(src))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, original, readTestTree(t, src))
+	info, err = os.Stat(filepath.Join(src, "secret.doc"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode().Perm())
+
+	// a wrong password keeps the emix file
+	domix = &DomixOptions{MixType: 2, CredentialFile: credential, InPlace: true, Silence: true}
+	assert.Nil(t, domix.Validate(filepath.Join(src, "secret.doc")))
+	assert.Nil(t, domix.Run())
+	locked = readTestTree(t, src)
+	other := filepath.Join(tmp, "other")
+	assert.Nil(t, os.WriteFile(other, []byte("b"), 0600))
+	demix = &DemixOptions{CredentialFile: other, InPlace: true, Silence: true}
+	assert.Nil(t, demix.Validate(filepath.Join(src, "secret.doc")))
+	assert.NotNil(t, demix.Run())
+	assert.Equal(t, locked, readTestTree(t, src))
+
+	assert.ErrorIs(t, (&DomixOptions{MixType: 2, EmbedPassword: true, InPlace: true}).Validate(src), errInPlaceEmbedPassword)
+	assert.NotNil(t, (&DomixOptions{MixType: 2, CredentialFile: credential, InPlace: true, Output: filepath.Join(tmp, "out")}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{MixType: 2, CredentialFile: credential, Backup: true}).Validate(src))
+	assert.NotNil(t, (&DemixOptions{InPlace: true, Output: filepath.Join(tmp, "out")}).Validate(src))
+}
+
+func TestDemixPromptOnce(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a/1.txt": "a1",
+		"b/1.txt": "b1",
+		"b/2.txt": "b2",
+	})
+	credentialA := filepath.Join(tmp, "credential-a")
+	assert.Nil(t, os.WriteFile(credentialA, []byte("a"), 0600))
+	credentialB := filepath.Join(tmp, "credential-b")
+	assert.Nil(t, os.WriteFile(credentialB, []byte("b"), 0600))
+	passwordB, err := emix.GeneratePasswordFromFile(credentialB)
+	assert.Nil(t, err)
+
+	out := filepath.Join(tmp, "out")
+	for _, c := range []struct {
+		name, credential string
+		mixType          int
+	}{
+		{"a/1.txt", credentialA, 1},
+		{"b/1.txt", credentialB, 1},
+		{"b/2.txt", credentialB, 2},
+	} {
+		domix := &DomixOptions{
+			MixType:        c.mixType,
+			CredentialFile: c.credential,
+			KeepName:       true,
+			Output:         filepath.Join(out, filepath.Dir(c.name)),
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(filepath.Join(src, c.name)))
+		assert.Nil(t, domix.Run())
+	}
+
+	prompted := 0
+	defer func(read func(string) ([]byte, error)) {
+		readFilePassword = read
+	}(readFilePassword)
+	readFilePassword = func(path string) ([]byte, error) {
+		prompted++
+		return passwordB, nil
+	}
+
+	// fails without prompting
+	demix := &DemixOptions{CredentialFile: credentialA, Output: filepath.Join(tmp, "restored-1"), Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	err = demix.Run()
+	assert.ErrorIs(t, err, emix.ErrWrongPassword)
+	assert.Equal(t, 0, prompted)
+
+	// the password of b is prompted once for both files
+	restored := filepath.Join(tmp, "restored-2")
+	demix = &DemixOptions{CredentialFile: credentialA, Output: restored, PromptOnce: true, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, 1, prompted)
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, restored))
+
+	// a wrong entered password fails
+	readFilePassword = func(path string) ([]byte, error) {
+		return []byte("c"), nil
+	}
+	demix = &DemixOptions{CredentialFile: credentialA, Output: filepath.Join(tmp, "restored-3"), PromptOnce: true, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.ErrorIs(t, demix.Run(), emix.ErrWrongPassword)
+}
+
+func TestDemixUnsafeName(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "sub/evil.txt"} {
+		tmp := t.TempDir()
+		// craft the name by patching a source name of the same length and recomputing the header hash
+		placeholder := strings.ReplaceAll(name, "/", "_")
+		src := filepath.Join(tmp, placeholder)
+		assert.Nil(t, os.WriteFile(src, []byte("evil"), 0644))
+		out := filepath.Join(tmp, "out")
+		domix := &DomixOptions{KeepName: true, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		mixed := filepath.Join(out, placeholder)
+		header, err := emix.ReadHeaderFromPath(mixed, [16]byte{})
+		assert.Nil(t, err)
+		data, err := os.ReadFile(mixed)
+		assert.Nil(t, err)
+		headerEnd := int(header.ContentOffset())
+		i := bytes.Index(data[:headerEnd], []byte(placeholder))
+		assert.True(t, i > 0)
+		copy(data[i:], name)
+		hash := sha256.Sum256(data[emix.ZipHeaderLength() : headerEnd-32])
+		copy(data[headerEnd-32:], hash[:])
+		assert.Nil(t, os.WriteFile(mixed, data, 0644))
+
+		demixOut := filepath.Join(tmp, "demix")
+		assert.Nil(t, os.MkdirAll(filepath.Join(demixOut, "sub"), 0755))
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(mixed))
+		assert.ErrorIs(t, demix.Run(), emix.ErrUnsafeFileName)
+		for _, p := range []string{filepath.Join(tmp, "evil.txt"), filepath.Join(demixOut, "sub", "evil.txt")} {
+			_, err := os.Stat(p)
+			assert.True(t, os.IsNotExist(err), p)
+		}
+	}
+}
+
+func TestDemixContentAuthFailed(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, bytes.Repeat([]byte("content of a"), 1000), 0644))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	password, err := emix.GeneratePasswordFromFile(credentialFile)
+	assert.Nil(t, err)
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 2, CredentialFile: credentialFile, FileMAC: true, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	mixed := filepath.Join(out, "a.txt")
+	header, err := emix.ReadHeaderFromPath(mixed, emix.PasswordKey(password))
+	assert.Nil(t, err)
+	data, err := os.ReadFile(mixed)
+	assert.Nil(t, err)
+	data[header.ContentOffset()+100] ^= 0x01
+	assert.Nil(t, os.WriteFile(mixed, data, 0644))
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.ErrorIs(t, demix.Run(), emix.ErrContentAuthFailed)
+	entries, err := os.ReadDir(demixOut)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDomixKDF(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("content of a"), 0644))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	password, err := emix.GeneratePasswordFromFile(credentialFile)
+	assert.Nil(t, err)
+
+	for _, kdf := range []string{"argon2id", "none"} {
+		out := filepath.Join(tmp, "out-"+kdf)
+		domix := &DomixOptions{
+			MixType:        2,
+			CredentialFile: credentialFile,
+			KDF:            kdf,
+			KDFTime:        1,
+			KDFMemory:      1,
+			KDFThreads:     2,
+			KeepName:       true,
+			Output:         out,
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		mixed := filepath.Join(out, "a.txt")
+		header, err := emix.ReadHeaderFromPath(mixed, [16]byte(password))
+		assert.Nil(t, err)
+		if kdf == "none" {
+			assert.Nil(t, header.KDF)
+		} else {
+			assert.Equal(t, &emix.KDFParams{Time: 1, Memory: 1024, Threads: 2}, header.KDF)
+		}
+
+		demixOut := filepath.Join(tmp, "demix-"+kdf)
+		demix := &DemixOptions{CredentialFile: credentialFile, Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(mixed))
+		assert.Nil(t, demix.Run())
+		content, err := os.ReadFile(filepath.Join(demixOut, "a.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "content of a", string(content))
+	}
+
+	domix := &DomixOptions{MixType: 2, CredentialFile: credentialFile, KDF: "argon2id", KDFTime: 1, KDFMemory: 3, KDFThreads: 1}
+	assert.ErrorContains(t, domix.Validate(src), "invalid --kdf-memory")
+	domix = &DomixOptions{MixType: 2, CredentialFile: credentialFile, KDF: "scrypt"}
+	assert.ErrorContains(t, domix.Validate(src), "invalid --kdf")
+}
+
+func TestDomixArchive(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":     "content of a",
+		"b/c.txt":   "content of c",
+		"b/d/e.txt": strings.Repeat("content of e", 1000),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mixType := range []int{0, 1, 2} {
+		archive := filepath.Join(tmp, fmt.Sprintf("archive%d.zip", mixType))
+		domix := &DomixOptions{MixType: mixType, Archive: archive, Silence: true}
+		demix := &DemixOptions{Output: filepath.Join(tmp, fmt.Sprintf("out%d", mixType)), Silence: true}
+		if mixType != 0 {
+			domix.CredentialFile = credentialFile
+			demix.CredentialFile = credentialFile
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		assert.Nil(t, demix.Validate(archive))
+		// one bundle of all files
+		f, err := os.Open(archive)
+		assert.Nil(t, err)
+		info, err := f.Stat()
+		assert.Nil(t, err)
+		br, err := emix.NewBundleReader(f, info.Size(), demix.password)
+		assert.Nil(t, err)
+		assert.Len(t, br.Entries(), 5)
+		f.Close()
+
+		// demix detects the bundle and restores its files with verified hashes
+		assert.True(t, demix.bundle)
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demix.Output), mixType)
+	}
+
+	assert.NotNil(t, (&DomixOptions{Archive: filepath.Join(tmp, "archive.zip"), Output: tmp}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{Archive: filepath.Join(tmp, "archive0.zip")}).Validate(src), "archive exists")
+	assert.NotNil(t, (&DemixOptions{InPlace: true}).Validate(filepath.Join(tmp, "archive0.zip")))
+}
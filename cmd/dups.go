@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+	"github.com/icefed/emix"
+	"github.com/spf13/cobra"
+)
+
+type DupsOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	// get password from agent before prompting
+	UseAgent bool
+
+	dir      string
+	password [16]byte
+	ciphers  *emix.CipherCache
+
+	out io.Writer
+}
+
+// dupKey identify the original content of emix files, content hashes of different suites are not comparable,
+// and a hash of sparse or transformed content is only comparable with the same layout
+type dupKey struct {
+	suite  emix.CipherSuiteID
+	hash   [32]byte
+	layout string
+}
+
+// dupFile is a member of a duplicate group
+type dupFile struct {
+	path string
+	name string
+	size uint64
+}
+
+func newCmdDups() *cobra.Command {
+	o := &DupsOptions{}
+	cmd := &cobra.Command{
+		Use:   "dups <dir>",
+		Short: "find emix files holding the same original content.",
+		Long: `Find emix files under the directory holding the same original content by the content hash of headers,
+and print each group of duplicates with their paths and original names. Content is not decrypted,
+the password is only needed to read encrypted file info, files which can not be read are skipped with a notice.`,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt file info. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().BoolVar(&o.UseAgent, "use-agent", false, "Get password from emix agent, prompt if the agent is unavailable. Conflicts with --password and --credential-file.")
+	return cmd
+}
+
+func (o *DupsOptions) Validate(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path %s is not a directory", dir)
+	}
+	o.dir = filepath.Clean(dir)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.UseAgent && (o.Password || o.CredentialFile != "") {
+		return errors.New("can not set both --use-agent and --password or --credential-file")
+	}
+	if o.UseAgent && !useAgentPassword(&o.password) {
+		o.Password = true
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	o.ciphers = emix.NewCipherCache()
+	o.out = os.Stdout
+	return nil
+}
+
+func (o *DupsOptions) Run() error {
+	groups := make(map[dupKey][]dupFile)
+	err := filepath.WalkDir(o.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		header, err := o.readHeader(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignore %s: %v\n", path, err)
+			return nil
+		}
+		if header == nil {
+			return nil
+		}
+		info := &header.FileInfo
+		key := dupKey{suite: header.CipherSuite, hash: info.FileContentHash}
+		if info.Sparse != nil || len(info.Transforms) > 0 {
+			key.layout = fmt.Sprint(info.Sparse, info.Transforms)
+		}
+		groups[key] = append(groups[key], dupFile{path: path, name: info.Name, size: info.Size})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// groups are ordered by the first path, paths are walked in lexical order
+	var keys []dupKey
+	for key, files := range groups {
+		if len(files) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return groups[keys[i]][0].path < groups[keys[j]][0].path })
+	dups := make([][]dupFile, len(keys))
+	for i, key := range keys {
+		dups[i] = groups[key]
+	}
+	var duplicated uint64
+	for i, files := range dups {
+		key := keys[i]
+		fmt.Fprintf(o.out, "%x %d files, %s each\n", key.hash, len(files), humanize.Bytes(files[0].size))
+		for _, f := range files {
+			fmt.Fprintf(o.out, "\t%s\t%s\n", f.path, f.name)
+		}
+		duplicated += uint64(len(files)-1) * files[0].size
+	}
+	fmt.Fprintf(o.out, "%d groups of duplicates, %s duplicated\n", len(dups), humanize.Bytes(duplicated))
+	return nil
+}
+
+// readHeader read the emix header of path, return nil if it's not an emix file
+func (o *DupsOptions) readHeader(path string) (*emix.EmixHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ok, err := emix.IsEmixFile(f)
+	if err != nil || !ok {
+		return nil, err
+	}
+	header := &emix.EmixHeader{
+		Password: o.password,
+		Ciphers:  o.ciphers,
+	}
+	if err := header.UnmarshalFromFile(f); err != nil {
+		if header.EncryptInfo && !header.EmbedPassword {
+			return nil, fmt.Errorf("read header error: %v, file info is encrypted, check the password", err)
+		}
+		return nil, fmt.Errorf("read header error: %v", err)
+	}
+	return header, nil
+}
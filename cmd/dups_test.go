@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDups(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":     "same content",
+		"sub/b.txt": "same content",
+		"c.txt":     "unique content",
+	})
+	credential := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credential, []byte("a"), 0600))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		MixType:        2,
+		CredentialFile: credential,
+		Output:         out,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	// non emix files are ignored
+	assert.Nil(t, os.WriteFile(filepath.Join(out, "plain.txt"), []byte("same content"), 0644))
+
+	buf := bytes.NewBuffer(nil)
+	dups := &DupsOptions{CredentialFile: credential}
+	assert.Nil(t, dups.Validate(out))
+	dups.out = buf
+	assert.Nil(t, dups.Run())
+	assert.Regexp(t, `2 files, 12 B each\n\t.+\ta.txt\n\t.+\tb.txt\n`, buf.String())
+	assert.NotContains(t, buf.String(), "c.txt")
+	assert.NotContains(t, buf.String(), "plain.txt")
+	assert.True(t, strings.HasSuffix(buf.String(), "1 groups of duplicates, 12 B duplicated\n"))
+
+}
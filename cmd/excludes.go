@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// excludesEnv supplies extra default exclude patterns, separated by comma
+const excludesEnv = "EMIX_EXCLUDES"
+
+// defaultExcludes return the default of --excludes, the built-in `.*` merged with patterns of EMIX_EXCLUDES
+func defaultExcludes() []string {
+	excludes := []string{".*"}
+	for _, pattern := range strings.Split(os.Getenv(excludesEnv), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || pattern == ".*" {
+			continue
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes
+}
+
+// compilePatterns validate the gitignore style patterns and compile them to a matcher,
+// go-gitignore drops invalid patterns silently, so check them first
+func compilePatterns(patterns []string) (*ignore.GitIgnore, error) {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("invalid pattern %q: empty pattern", pattern)
+		}
+		if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return ignore.CompileIgnoreLines(patterns...), nil
+}
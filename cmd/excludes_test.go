@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultExcludes(t *testing.T) {
+	t.Setenv(excludesEnv, "*.log, tmp/,,.*")
+	assert.Equal(t, []string{".*", "*.log", "tmp/"}, defaultExcludes())
+
+	cmd := newCmdDomix()
+	excludes, err := cmd.Flags().GetStringSlice("excludes")
+	assert.Nil(t, err)
+	matcher, err := compilePatterns(excludes)
+	assert.Nil(t, err)
+	assert.True(t, matcher.MatchesPath("a/b.log"))
+	assert.True(t, matcher.MatchesPath("tmp/a.txt"))
+	assert.True(t, matcher.MatchesPath(".hidden"))
+	assert.False(t, matcher.MatchesPath("a/b.txt"))
+
+	// flag overrides the default
+	assert.Nil(t, cmd.Flags().Set("excludes", "*.txt"))
+	excludes, err = cmd.Flags().GetStringSlice("excludes")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*.txt"}, excludes)
+
+	t.Setenv(excludesEnv, "")
+	assert.Equal(t, []string{".*"}, defaultExcludes())
+
+	_, err = compilePatterns([]string{"[a-"})
+	assert.NotNil(t, err)
+	_, err = compilePatterns([]string{" "})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type ExportKeyOptions struct {
+	Excludes []string
+
+	source      string
+	sourceIsDir bool
+
+	ignoreMatcher *ignore.GitIgnore
+
+	out io.Writer
+}
+
+func newCmdExportKey() *cobra.Command {
+	o := &ExportKeyOptions{}
+	cmd := &cobra.Command{
+		Use:     "export-key <path>",
+		Short:   "print the embedded keys of embed-password emix files.",
+		Long:    `Print the hex encoded embedded key and path of embed-password emix files, one file per line, e.g. to keep them in an escrow file. Files of a directory without embedded key are skipped.`,
+		GroupID: "additional",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	return cmd
+}
+
+func (o *ExportKeyOptions) Validate(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	o.source = filepath.Clean(source)
+	if info.IsDir() {
+		o.sourceIsDir = true
+	}
+
+	// ignore
+	if len(o.Excludes) != 0 {
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	o.out = os.Stdout
+	return nil
+}
+
+func (o *ExportKeyOptions) Run() error {
+	if !o.sourceIsDir {
+		ok, err := o.exportKey(o.source)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("file has no embedded key")
+		}
+		return nil
+	}
+	return filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// check exclude pattern
+		if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// skip directory path and nonsupport file type
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		ok, err := emix.IsEmixFileByPath(path)
+		if err != nil || !ok {
+			return err
+		}
+		// headers of files with embedded key are always readable, others need the password
+		if _, err := o.exportKey(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignore %v\n", err)
+		}
+		return nil
+	})
+}
+
+// exportKey print the embedded key of emix file, report false if the key is not embedded
+func (o *ExportKeyOptions) exportKey(path string) (bool, error) {
+	emixHeader, err := emix.ReadHeaderFromPath(path, [16]byte{})
+	if err != nil {
+		return false, fmt.Errorf("Read emix header of %s error: %v", path, err)
+	}
+	if !emixHeader.EmbedPassword {
+		return false, nil
+	}
+	fmt.Fprintf(o.out, "%s  %s\n", hex.EncodeToString(emixHeader.Password[:]), path)
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// filesFromStdin is the --files-from value reading the list from stdin
+const filesFromStdin = "-"
+
+// readFilesFrom read the paths listed in path, stdin if path is "-", they are separated by newline,
+// or by NUL if null is set, e.g. by find -print0. Each path must be in source, the paths relative to source
+// are returned, empty entries are skipped
+func readFilesFrom(path string, null bool, source string) ([]string, error) {
+	var data []byte
+	var err error
+	if path == filesFromStdin {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read --files-from error: %v", err)
+	}
+	sep := byte('\n')
+	if null {
+		sep = 0
+	}
+	var files []string
+	for _, entry := range bytes.Split(data, []byte{sep}) {
+		name := string(entry)
+		if !null {
+			name = string(bytes.TrimSuffix(entry, []byte{'\r'}))
+		}
+		if name == "" {
+			continue
+		}
+		rel, err := relToSource(source, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rel)
+	}
+	return files, nil
+}
+
+// relToSource return path relative to source, path must be in source
+func relToSource(source, path string) (string, error) {
+	if filepath.IsAbs(path) != filepath.IsAbs(source) {
+		var err error
+		if source, err = filepath.Abs(source); err != nil {
+			return "", err
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel(source, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("listed file %s is not in %s", path, source)
+	}
+	return rel, nil
+}
+
+// validateFilesFrom check the --files-from and --null flags, the list needs a directory <path>
+// and stdin can not be both the list and the password prompt
+func validateFilesFrom(filesFrom string, null, sourceIsDir, password bool) error {
+	if filesFrom == "" {
+		if null {
+			return errors.New("--null needs --files-from")
+		}
+		return nil
+	}
+	if !sourceIsDir {
+		return errors.New("--files-from needs a directory <path>, listed files are in it")
+	}
+	if filesFrom == filesFromStdin && password {
+		return errors.New("can not set both --files-from - and --password, stdin is the file list")
+	}
+	return nil
+}
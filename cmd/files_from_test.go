@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFilesFrom(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	list := filepath.Join(tmp, "list")
+
+	assert.Nil(t, os.WriteFile(list, []byte(src+"/a.txt\n\n"+src+"/b/c d.txt\r\n"), 0644))
+	files, err := readFilesFrom(list, false, src)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", filepath.Join("b", "c d.txt")}, files)
+
+	// names may contain newlines with NUL separators
+	assert.Nil(t, os.WriteFile(list, []byte(src+"/a\nb.txt\x00"+src+"/c.txt\x00"), 0644))
+	files, err = readFilesFrom(list, true, src)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a\nb.txt", "c.txt"}, files)
+
+	// relative paths are relative to the current directory
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(tmp))
+	defer os.Chdir(wd)
+	assert.Nil(t, os.WriteFile(list, []byte("./src/a.txt\n"), 0644))
+	files, err = readFilesFrom(list, false, src)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt"}, files)
+
+	// files out of source are rejected
+	for _, name := range []string{"src/../other.txt", tmp + "/other.txt"} {
+		assert.Nil(t, os.WriteFile(list, []byte(name+"\n"), 0644))
+		_, err = readFilesFrom(list, false, src)
+		assert.ErrorContains(t, err, "is not in", name)
+	}
+}
+
+func TestDomixFilesFrom(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "c",
+		"b/d.txt":     "d",
+		"e f\ng.txt":  "g",
+		".hidden.txt": "h",
+	})
+	list := filepath.Join(tmp, "list")
+	listed := []string{"b/c.txt", "e f\ng.txt", ".hidden.txt"}
+	var paths []string
+	for _, name := range listed {
+		paths = append(paths, filepath.Join(src, name))
+	}
+	assert.Nil(t, os.WriteFile(list, []byte(strings.Join(paths, "\x00")+"\x00"), 0644))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{FilesFrom: list, Null: true, KeepName: true, Excludes: defaultExcludes(), Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	mixed := readTestTree(t, out)
+	assert.Len(t, mixed, 3)
+	for _, name := range listed {
+		assert.Contains(t, mixed, name)
+	}
+
+	// demix only the listed outputs
+	paths = []string{filepath.Join(out, "b/c.txt"), filepath.Join(out, ".hidden.txt")}
+	assert.Nil(t, os.WriteFile(list, []byte(strings.Join(paths, "\x00")), 0644))
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{FilesFrom: list, Null: true, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	restored := readTestTree(t, demixOut)
+	assert.Len(t, restored, 2)
+	assert.Equal(t, readTestTree(t, src)["b/c.txt"], restored["b/c.txt"])
+	assert.Equal(t, readTestTree(t, src)[".hidden.txt"], restored[".hidden.txt"])
+
+	assert.NotNil(t, (&DomixOptions{FilesFrom: list}).Validate(filepath.Join(src, "a.txt")))
+	assert.NotNil(t, (&DomixOptions{Null: true}).Validate(src))
+	assert.NotNil(t, (&DomixOptions{FilesFrom: "-", Password: true}).Validate(src))
+}
@@ -0,0 +1,7 @@
+package main
+
+// fileID identify a file on a device, files with the same id are hard links of each other
+type fileID struct {
+	dev uint64
+	ino uint64
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+)
+
+func getHardlinkID(fileinfo fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// getHardlinkID return the id of a regular file with more than one link
+func getHardlinkID(fileinfo fs.FileInfo) (fileID, bool) {
+	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink <= 1 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
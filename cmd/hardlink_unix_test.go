@@ -0,0 +1,79 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestPackUnpackHardlinks(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	content := strings.Repeat("hardlink", 10000)
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   content,
+		"c.txt":   "c",
+		"d/x.txt": "x",
+	})
+	assert.Nil(t, os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")))
+	assert.Nil(t, os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "d", "a.txt")))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	archive := filepath.Join(tmp, "archive.zip")
+	pack := &PackOptions{CredentialFile: credentialFile, MixType: 2, Output: archive, Silence: true}
+	assert.Nil(t, pack.Validate(src))
+	assert.Nil(t, pack.Run())
+
+	// the content of the links is stored once
+	info, err := os.Stat(archive)
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(2*len(content)))
+	f, err := os.Open(archive)
+	assert.Nil(t, err)
+	defer f.Close()
+	br, err := emix.NewBundleReader(f, info.Size(), pack.password)
+	assert.Nil(t, err)
+	links := make(map[string]string)
+	for _, entry := range br.Entries() {
+		if entry.IsLink() {
+			links[entry.Header.FileInfo.Name] = entry.Header.FileInfo.LinkTarget
+			assert.Equal(t, int64(0), entry.Length)
+		}
+	}
+	assert.Equal(t, map[string]string{"b.txt": "a.txt", "d/a.txt": "a.txt"}, links)
+
+	for _, noHardlinks := range []bool{false, true} {
+		out := filepath.Join(tmp, "unpack")
+		os.RemoveAll(out)
+		unpack := &UnpackOptions{CredentialFile: credentialFile, NoHardlinks: noHardlinks, Output: out, Silence: true}
+		assert.Nil(t, unpack.Validate(archive))
+		assert.Nil(t, unpack.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, out))
+
+		a, err := os.Stat(filepath.Join(out, "a.txt"))
+		assert.Nil(t, err)
+		for _, name := range []string{"b.txt", "d/a.txt"} {
+			link, err := os.Stat(filepath.Join(out, filepath.FromSlash(name)))
+			assert.Nil(t, err)
+			assert.Equal(t, !noHardlinks, os.SameFile(a, link), name)
+		}
+	}
+
+	// the target is not extracted, the link is restored as an independent file
+	out := filepath.Join(tmp, "prefix")
+	unpack := &UnpackOptions{CredentialFile: credentialFile, PathPrefix: "d", Output: out, Silence: true}
+	assert.Nil(t, unpack.Validate(archive))
+	assert.Nil(t, unpack.Run())
+	assert.Equal(t, []string{"d/a.txt", "d/x.txt"}, testTreePaths(readTestTree(t, out)))
+	data, err := os.ReadFile(filepath.Join(out, "d", "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type ImportKeyOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	// hex encoded 16-byte key to embed, default is the current password
+	Key string
+
+	emixFilePath string
+	password     [16]byte
+	key          [16]byte
+}
+
+func newCmdImportKey() *cobra.Command {
+	o := &ImportKeyOptions{}
+	cmd := &cobra.Command{
+		Use:   "import-key <path>",
+		Short: "convert a password emix file to embed-password mode.",
+		Long: `Convert a password emix file to embed-password mode, the key is embedded in the header so the file can be read without password.
+Only the header is rewritten if the key is the current password, content is re-encrypted with a different key.`,
+		GroupID: "additional",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVar(&o.Key, "key", "", "Hex encoded 16-byte key to embed, e.g. printed by export-key. Default is the current password.")
+	return cmd
+}
+
+func (o *ImportKeyOptions) Validate(emixFilePath string) error {
+	info, err := os.Stat(emixFilePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("path %s is not a regular file", emixFilePath)
+	}
+	o.emixFilePath = filepath.Clean(emixFilePath)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if !o.Password && o.CredentialFile == "" {
+		return errors.New("need password or credential-file of the file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+
+	o.key = o.password
+	if o.Key != "" {
+		key, err := hex.DecodeString(o.Key)
+		if err != nil || len(key) != len(o.key) {
+			return errors.New("invalid --key, must be 32 hex characters")
+		}
+		copy(o.key[:], key)
+	}
+	return nil
+}
+
+func (o *ImportKeyOptions) Run() error {
+	f, err := os.OpenFile(o.emixFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	emixHeader, err := emix.ReadHeader(f, o.password)
+	if err != nil {
+		return err
+	}
+	switch {
+	case emixHeader.EmbedPassword:
+		return errors.New("file already has embedded key")
+	case !emixHeader.EncryptInfo && !emixHeader.EncryptData:
+		return errors.New("file is not encrypted")
+	}
+	rewrapped := *emixHeader
+	rewrapped.EmbedPassword = true
+	rewrapped.Password = o.key
+	// the file mac can not be keyed by an embedded key, the content key is bound to it so content is re-encrypted
+	rewrapped.FileMAC = false
+
+	// the content key is kept, only the header is rewritten
+	if !emixHeader.FileMAC && (!emixHeader.EncryptData || (o.key == o.password && emixHeader.SaltedKeys)) {
+		if err := emix.RewrapHeader(f, o.password, &rewrapped); err != nil {
+			return fmt.Errorf("Rewrite emix header error: %v", err)
+		}
+		return nil
+	}
+	if emixHeader.Streamed {
+		return errors.New("can not re-encrypt the content of emix stream")
+	}
+	rewrapped.SaltedKeys = true
+	return o.reencrypt(f, emixHeader, &rewrapped)
+}
+
+// reencrypt write the content of f with the content key of header to a temporary file and rename it
+func (o *ImportKeyOptions) reencrypt(f *os.File, current, header *emix.EmixHeader) error {
+	if current.FileMAC {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := emix.VerifyFileMAC(f, info.Size(), current); err != nil {
+			return err
+		}
+	}
+	content, err := emix.OpenContent(f, current)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := createTemp(o.emixFilePath)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	err = emix.EncryptFile(io.LimitReader(content, int64(header.FileInfo.Size)), tmp, emix.EncryptOptions{Header: header})
+	if err != nil {
+		return fmt.Errorf("Write emix file error: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		os.Chmod(tmpPath, info.Mode().Perm())
+	}
+	if err := os.Rename(tmpPath, o.emixFilePath); err != nil {
+		return err
+	}
+	done = true
+	return nil
+}
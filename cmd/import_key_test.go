@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestExportKey(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bbbb",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	// a password file is skipped
+	domix = &DomixOptions{MixType: 1, CredentialFile: credentialFile, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(filepath.Join(src, "a.txt")))
+	assert.Nil(t, domix.Run())
+
+	export := &ExportKeyOptions{}
+	assert.Nil(t, export.Validate(out))
+	buf := bytes.NewBuffer(nil)
+	export.out = buf
+	assert.Nil(t, export.Run())
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		key, path, ok := strings.Cut(line, "  ")
+		assert.True(t, ok)
+		header, err := emix.ReadHeaderFromPath(path, [16]byte{})
+		assert.Nil(t, err)
+		assert.Equal(t, hex.EncodeToString(header.Password[:]), key)
+	}
+
+	// single file
+	export = &ExportKeyOptions{}
+	assert.Nil(t, export.Validate(filepath.Join(out, "a.txt")))
+	buf.Reset()
+	export.out = buf
+	assert.Nil(t, export.Run())
+	assert.Contains(t, buf.String(), filepath.Join(out, "a.txt"))
+}
+
+func TestImportKey(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": strings.Repeat("a", 10000),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	key := "00112233445566778899aabbccddeeff"
+
+	for _, test := range []struct {
+		mixType int
+		key     string
+	}{
+		{1, ""}, {1, key}, {2, ""}, {2, key},
+	} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: test.mixType, CredentialFile: credentialFile, KeepName: true, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		path := filepath.Join(out, "a.txt")
+
+		// the current password is required
+		assert.NotNil(t, (&ImportKeyOptions{Key: test.key}).Validate(path))
+		importKey := &ImportKeyOptions{CredentialFile: credentialFile, Key: test.key}
+		assert.Nil(t, importKey.Validate(path))
+		assert.Nil(t, importKey.Run())
+		assert.NotNil(t, importKey.Run(), "already embedded")
+
+		// the key is embedded and the file is readable without password
+		export := &ExportKeyOptions{}
+		assert.Nil(t, export.Validate(path))
+		buf := bytes.NewBuffer(nil)
+		export.out = buf
+		assert.Nil(t, export.Run())
+		if test.key != "" {
+			assert.True(t, strings.HasPrefix(buf.String(), test.key), test)
+		}
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut), test)
+		assert.Equal(t, []string{"a.txt"}, dirNames(t, out))
+	}
+
+	assert.NotNil(t, (&ImportKeyOptions{CredentialFile: credentialFile, Key: "abc"}).Validate(filepath.Join(src, "a.txt")))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// backupExt is appended to the original of a file replaced by --in-place --backup
+const backupExt = ".bak"
+
+// checkBackup return an error if the backup of path already exists, an older backup is never replaced
+func checkBackup(path string) error {
+	exists, err := pathExists(path + backupExt)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("backup %s already exists", path+backupExt)
+	}
+	return nil
+}
+
+// replaceInPlace rename tmp over path atomically, the original is hard linked as path.bak first if backup is set
+func replaceInPlace(tmp, path string, backup bool) error {
+	if backup {
+		if err := os.Link(path, path+backupExt); err != nil {
+			return fmt.Errorf("Backup error: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		if backup {
+			os.Remove(path + backupExt)
+		}
+		return err
+	}
+	return nil
+}
+
+// errInPlaceEmbedPassword is returned if a file is mixed in place with an embedded password, it would not be locked
+var errInPlaceEmbedPassword = errors.New("--in-place needs a password, a file mixed with --embed-password can be de-mixed by anyone")
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/zalando/go-keyring"
+)
+
+// keyringUser is the account name of password in the OS keyring
+const keyringUser = "emix"
+
+// keyringGet return the password stored under service, ok is false if the entry is missing
+func keyringGet(service string) (password [16]byte, ok bool, err error) {
+	secret, err := keyring.Get(service, keyringUser)
+	if err != nil {
+		if errors.Is(err, keyring.ErrNotFound) {
+			return password, false, nil
+		}
+		return password, false, fmt.Errorf("Read keyring error: %v", err)
+	}
+	decoded, err := hex.DecodeString(secret)
+	if err != nil || len(decoded) != len(password) {
+		return password, false, fmt.Errorf("invalid password in keyring service %s", service)
+	}
+	copy(password[:], decoded)
+	return password, true, nil
+}
+
+// keyringSet store the password under service
+func keyringSet(service string, password [16]byte) error {
+	if err := keyring.Set(service, keyringUser, hex.EncodeToString(password[:])); err != nil {
+		return fmt.Errorf("Write keyring error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zalando/go-keyring"
+)
+
+func TestKeyring(t *testing.T) {
+	keyring.MockInit()
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	_, ok, err := keyringGet("emix-test")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// store password on mix
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		MixType:        2,
+		CredentialFile: credentialFile,
+		Keyring:        "emix-test",
+		Output:         out,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	password, ok, err := keyringGet("emix-test")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, domix.password, password)
+
+	// retrieve password on demix
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		Keyring: "emix-test",
+		Output:  demixOut,
+		Silence: true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+
+	// existing entry is used for mix
+	out2 := filepath.Join(tmp, "out2")
+	domix = &DomixOptions{
+		MixType: 2,
+		Keyring: "emix-test",
+		Output:  out2,
+		Silence: true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Equal(t, password, domix.password)
+
+	assert.NotNil(t, (&DomixOptions{
+		MixType:       2,
+		EmbedPassword: true,
+		Keyring:       "emix-test",
+		Output:        out2,
+	}).Validate(src))
+	assert.NotNil(t, (&DemixOptions{
+		CredentialFile: credentialFile,
+		Keyring:        "emix-test",
+		Output:         demixOut,
+	}).Validate(out))
+}
@@ -8,22 +8,32 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"text/tabwriter"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/icefed/emix"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 type LsOptions struct {
 	// read password from stdin if Password is true
 	Password       bool
 	CredentialFile string
-	LongFormat     bool
+	// get password from agent before prompting
+	UseAgent   bool
+	LongFormat bool
+	// print the file id before each file
+	ShowID bool
+	// auto, always or never
+	Color string
 
 	dir      string
 	password [16]byte
+	ciphers  *emix.CipherCache
+
+	out   io.Writer
+	color bool
 }
 
 func newCmdLs() *cobra.Command {
@@ -39,9 +49,12 @@ func newCmdLs() *cobra.Command {
 		},
 	}
 	cmd.Flags().SortFlags = false
-	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt, max length is 16 bytes. Conflicts with --credential-file.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
 	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().BoolVar(&o.UseAgent, "use-agent", false, "Get password from emix agent, prompt if the agent is unavailable. Conflicts with --password and --credential-file.")
 	cmd.Flags().BoolVarP(&o.LongFormat, "long", "l", false, "Use a long listing format.")
+	cmd.Flags().BoolVarP(&o.ShowID, "id", "i", false, "Print the file id recorded by domix --id-mode before each file, - if there is none.")
+	cmd.Flags().StringVar(&o.Color, "color", "auto", "Color names of long listing format by mode. auto: only if stdout is a terminal and NO_COLOR is not set, always, never.")
 	return cmd
 }
 
@@ -58,6 +71,12 @@ func (o *LsOptions) Validate(dir string) error {
 	if o.Password && o.CredentialFile != "" {
 		return errors.New("can not set both --password and --credential-file")
 	}
+	if o.UseAgent && (o.Password || o.CredentialFile != "") {
+		return errors.New("can not set both --use-agent and --password or --credential-file")
+	}
+	if o.UseAgent && !useAgentPassword(&o.password) {
+		o.Password = true
+	}
 	if o.Password {
 		// input password
 		password, err := inputPassword()
@@ -65,7 +84,7 @@ func (o *LsOptions) Validate(dir string) error {
 			return err
 		}
 
-		copy(o.password[:], password)
+		o.password = emix.PasswordKey(password)
 	}
 	if o.CredentialFile != "" {
 		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
@@ -74,6 +93,18 @@ func (o *LsOptions) Validate(dir string) error {
 		}
 		copy(o.password[:], password)
 	}
+	o.ciphers = emix.NewCipherCache()
+	o.out = os.Stdout
+	switch o.Color {
+	case "", "auto":
+		o.color = os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stdout.Fd()))
+	case "always":
+		o.color = true
+	case "never":
+		o.color = false
+	default:
+		return errors.New("invalid --color, only support auto, always, never")
+	}
 
 	return nil
 }
@@ -84,57 +115,87 @@ func (o *LsOptions) Run() error {
 		return err
 	}
 
-	emixFilesInfo := make([]*emix.EmixHeader, 0)
+	// print each file once its header is read, so only one file is open at a time
 	for _, file := range files {
 		if !file.Type().IsRegular() {
 			continue
 		}
-
-		f, err := os.Open(filepath.Join(o.dir, file.Name()))
+		emixHeader, err := o.readHeader(file.Name())
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-
-		ok, err := emix.IsEmixFile(f)
-		if err != nil {
-			return fmt.Errorf("check %s error: %v", file.Name(), err)
-		}
-		if !ok {
+		if emixHeader == nil {
 			continue
 		}
+		o.print(emixHeader)
+	}
+	return nil
+}
 
-		f.Seek(int64(emix.ZipHeaderLength()), io.SeekStart)
+// readHeader read the emix header of file in dir, return nil if it's not an emix file
+func (o *LsOptions) readHeader(name string) (*emix.EmixHeader, error) {
+	f, err := os.Open(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		emixHeader := &emix.EmixHeader{}
-		copy(emixHeader.Password[:], o.password[:])
-		err = emixHeader.UnmarshalBinaryFromReader(f)
-		if err != nil {
-			return fmt.Errorf("parse %s emix header error: %v", file.Name(), err)
-		}
-		emixFilesInfo = append(emixFilesInfo, emixHeader)
+	ok, err := emix.IsEmixFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("check %s error: %v", name, err)
+	}
+	if !ok {
+		return nil, nil
 	}
 
-	// print emix files
-	if len(emixFilesInfo) == 0 {
-		return nil
+	emixHeader := &emix.EmixHeader{
+		Ciphers: o.ciphers,
 	}
-	if o.LongFormat {
-		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		for _, info := range emixFilesInfo {
-			fmt.Fprintf(tw, "%s\t%6s\t%s\t%s\n", fs.FileMode(info.FileInfo.Mode),
-				strings.ReplaceAll(humanize.Bytes(uint64(info.FileInfo.Size)), " ", ""),
-				time.Unix(0, int64(info.FileInfo.ModifyTime)).Format("Jan _2 15:04 MST 2006"),
-				info.FileInfo.Name,
-			)
+	copy(emixHeader.Password[:], o.password[:])
+	err = emixHeader.UnmarshalFromFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s emix header error: %v", name, err)
+	}
+	return emixHeader, nil
+}
+
+func (o *LsOptions) print(info *emix.EmixHeader) {
+	if o.ShowID {
+		id := fileIDString(info.FileInfo.ID)
+		if id == "" {
+			// keep names aligned with the UUID column
+			id = fmt.Sprintf("%-36s", "-")
 		}
-		tw.Flush()
+		fmt.Fprintf(o.out, "%s  ", id)
+	}
+	if o.LongFormat {
+		// fixed width columns instead of tabwriter, which buffers all lines
+		fmt.Fprintf(o.out, "%s  %6s  %s  %s\n", fs.FileMode(info.FileInfo.Mode),
+			strings.ReplaceAll(humanize.Bytes(info.FileInfo.RestoredSize()), " ", ""),
+			time.Unix(0, int64(info.FileInfo.ModifyTime)).Format("Jan _2 15:04 MST 2006"),
+			o.colorName(info.FileInfo.Name, fs.FileMode(info.FileInfo.Mode)),
+		)
 	} else {
-		names := make([]string, 0, len(emixFilesInfo))
-		for _, info := range emixFilesInfo {
-			names = append(names, info.FileInfo.Name)
-		}
-		fmt.Fprintf(os.Stdout, "%s\n", strings.Join(names, "\n"))
+		fmt.Fprintf(o.out, "%s\n", info.FileInfo.Name)
 	}
-	return nil
+}
+
+// colorName color name by mode with ANSI codes like ls, directories are blue,
+// symlinks are cyan and executables are green
+func (o *LsOptions) colorName(name string, mode fs.FileMode) string {
+	if !o.color {
+		return name
+	}
+	code := ""
+	switch {
+	case mode.IsDir():
+		code = "01;34"
+	case mode&fs.ModeSymlink != 0:
+		code = "01;36"
+	case mode.IsRegular() && mode&0111 != 0:
+		code = "01;32"
+	default:
+		return name
+	}
+	return "\x1b[" + code + "m" + name + "\x1b[0m"
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fdCountWriter record the max count of open descriptors when a line is written
+type fdCountWriter struct {
+	t     *testing.T
+	lines []string
+	maxFd int
+}
+
+func (w *fdCountWriter) Write(p []byte) (int, error) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	assert.Nil(w.t, err)
+	w.maxFd = max(w.maxFd, len(fds))
+	w.lines = append(w.lines, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func TestLsReleaseDescriptors(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	files := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("%02d.txt", i)] = "content"
+	}
+	writeTestTree(t, src, files)
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		KeepName: true,
+		Output:   out,
+		Silence:  true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	for _, long := range []bool{false, true} {
+		ls := &LsOptions{LongFormat: long}
+		assert.Nil(t, ls.Validate(out))
+		fds, err := os.ReadDir("/proc/self/fd")
+		assert.Nil(t, err)
+		w := &fdCountWriter{t: t}
+		ls.out = w
+		assert.Nil(t, ls.Run())
+
+		// output is streamed per file and files are closed before the next one is opened
+		assert.Len(t, w.lines, 50)
+		assert.True(t, strings.HasSuffix(w.lines[49], "49.txt"))
+		assert.LessOrEqual(t, w.maxFd, len(fds)+2)
+	}
+}
+
+func TestLsColor(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "a",
+		"b.sh":  "b",
+	})
+	assert.Nil(t, os.Chmod(filepath.Join(src, "b.sh"), 0755))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		KeepName: true,
+		Output:   out,
+		Silence:  true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	run := func(color string) string {
+		ls := &LsOptions{LongFormat: true, Color: color}
+		assert.Nil(t, ls.Validate(out))
+		buf := bytes.NewBuffer(nil)
+		ls.out = buf
+		assert.Nil(t, ls.Run())
+		return buf.String()
+	}
+	// stdout is not a terminal in tests
+	assert.NotContains(t, run("auto"), "\x1b[")
+	assert.NotContains(t, run("never"), "\x1b[")
+	output := run("always")
+	assert.Contains(t, output, "\x1b[01;32mb.sh\x1b[0m")
+	assert.Contains(t, output, " a.txt\n")
+
+	t.Setenv("NO_COLOR", "1")
+	assert.NotContains(t, run("auto"), "\x1b[")
+	assert.NotNil(t, (&LsOptions{Color: "sometimes"}).Validate(out))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/icefed/emix"
+)
+
+const (
+	// checksum prefixes of manifest, a keyed checksum binds the manifest to the password of the run
+	manifestChecksumHMAC   = "hmac-sha256:"
+	manifestChecksumSHA256 = "sha256:"
+)
+
+var (
+	errManifestChecksumMismatch = errors.New("manifest checksum mismatch, the manifest is corrupted, tampered or the password is wrong")
+	errManifestNoChecksum       = errors.New("manifest has no checksum")
+)
+
+// Manifest records the outputs of a domix run
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+	// Checksum is the HMAC-SHA256 of entries keyed by the password of the run, or their SHA256 without
+	// a password, see manifestChecksum
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ManifestEntry is an output file of domix
+type ManifestEntry struct {
+	// slash-separated source path relative to the source directory
+	Source string `json:"source"`
+	// slash-separated output path relative to the output directory
+	Output     string `json:"output"`
+	Name       string `json:"name"`
+	Size       uint64 `json:"size"`
+	ModifyTime uint64 `json:"modify_time"`
+	// hex encoded sha256 of content
+	SHA256 string `json:"sha256"`
+	// file id of --id-mode, empty if not recorded
+	ID string `json:"id,omitempty"`
+}
+
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Decode manifest error: %v", err)
+	}
+	return m, nil
+}
+
+// manifestChecksum return the checksum of entries, keyed by a subkey of password unless it is all zero
+func manifestChecksum(entries []ManifestEntry, password [16]byte) (string, error) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", fmt.Errorf("Encode manifest error: %v", err)
+	}
+	if password == [16]byte{} {
+		sum := sha256.Sum256(data)
+		return manifestChecksumSHA256 + hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, emix.HKDF(password[:], nil, []byte("manifest mac"), 32))
+	mac.Write(data)
+	return manifestChecksumHMAC + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify check the checksum of manifest with password, errManifestNoChecksum is returned for manifests of
+// older versions. A plain checksum is rejected with a password, otherwise a keyed one could be replaced
+func (m *Manifest) verify(password [16]byte) error {
+	if m.Checksum == "" {
+		return errManifestNoChecksum
+	}
+	checksum, err := manifestChecksum(m.Entries, password)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(checksum), []byte(m.Checksum)) {
+		return errManifestChecksumMismatch
+	}
+	return nil
+}
+
+// writeManifest write m with its checksum keyed by password
+func writeManifest(path string, m *Manifest, password [16]byte) error {
+	checksum, err := manifestChecksum(m.Entries, password)
+	if err != nil {
+		return err
+	}
+	m.Checksum = checksum
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Encode manifest error: %v", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
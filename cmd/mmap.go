@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/icefed/emix"
+)
+
+// validateMmap check the --mmap mode
+func validateMmap(mode string) error {
+	switch mode {
+	case "", "auto", "always", "never":
+		return nil
+	}
+	return errors.New("invalid --mmap, only support auto, always, never")
+}
+
+// useMmap report if content of size bytes should be processed over mapped files,
+// auto maps files from emix.MmapMinSize
+func useMmap(mode string, size int64) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return size >= emix.MmapMinSize
+}
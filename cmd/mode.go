@@ -0,0 +1,16 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+)
+
+// parseMode parse the octal permission bits of --mode, e.g. 600 or 0640
+func parseMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > uint64(fs.ModePerm) {
+		return 0, errors.New("invalid --mode, must be octal permission bits, e.g. 0600")
+	}
+	return fs.FileMode(mode), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// modes of --sanitize-names
+const (
+	sanitizeNamesOff    = "off"
+	sanitizeNamesReject = "reject"
+	sanitizeNamesRename = "rename"
+)
+
+// policies of --on-collision
+const (
+	onCollisionOverwrite = "overwrite"
+	onCollisionError     = "error"
+	onCollisionSkip      = "skip"
+	onCollisionRename    = "rename"
+)
+
+// windowsReservedNames are device names that can not be used as file name on windows, with or without extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// defaultSanitizeNames rename invalid names on windows only
+func defaultSanitizeNames() string {
+	if runtime.GOOS == "windows" {
+		return sanitizeNamesRename
+	}
+	return sanitizeNamesOff
+}
+
+// windowsNameProblem return why name is invalid on windows, empty if name is valid
+func windowsNameProblem(name string) string {
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`<>:"/\|?*`, c) {
+			return fmt.Sprintf("invalid character %q", c)
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "trailing dot or space"
+	}
+	if windowsReservedNames[reservedBase(name)] {
+		return "reserved name"
+	}
+	return ""
+}
+
+// reservedBase return the upper case name before the first dot, windows ignores the extension of device names
+func reservedBase(name string) string {
+	base, _, _ := strings.Cut(name, ".")
+	return strings.ToUpper(strings.TrimRight(base, " "))
+}
+
+// sanitizeWindowsName map name to a valid windows name by replacing invalid characters with `_`
+// and appending `_` to reserved names and trailing dots or spaces
+func sanitizeWindowsName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || strings.ContainsRune(`<>:"/\|?*`, c) {
+			return '_'
+		}
+		return c
+	}, name)
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		name += "_"
+	}
+	if windowsReservedNames[reservedBase(name)] {
+		base, ext, found := strings.Cut(name, ".")
+		name = base + "_"
+		if found {
+			name += "." + ext
+		}
+	}
+	return name
+}
+
+// numberedName insert `_n` before the extension of name, e.g. file_1.txt
+func numberedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// rootName return the base name of directory dir, e.g. docs for ~/docs or . in docs
+func rootName(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(abs)
+	if name == string(filepath.Separator) || name == "." {
+		return "", fmt.Errorf("directory %s has no base name for --preserve-root-name", dir)
+	}
+	return name, nil
+}
+
+// pathExists report if path exists, a symlink is not followed
+func pathExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// symlinkDir return the first directory of dir under root which is a symlink, empty if there is none,
+// directories not existing yet are not symlinks
+func symlinkDir(root, dir string) (string, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	p := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." {
+			break
+		}
+		p = filepath.Join(p, name)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+// tempPrefix starts the names of temporary files written next to a destination, they are hidden and
+// excluded by the default excludes
+const tempPrefix = ".emix-"
+
+// createTemp create a new temporary file in the directory of dest, it is renamed to dest once complete.
+// Like os.CreateTemp, an existing file or symlink is never opened, but the mode is 0666 before umask
+func createTemp(dest string) (*os.File, error) {
+	dir := filepath.Dir(dest)
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, tempPrefix+strconv.FormatUint(rand.Uint64(), 36))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, tempPrefix+"*"), Err: os.ErrExist}
+}
+
+// hasPathPrefix report if the slash-separated relative path is prefix or under it, an empty prefix matches all
+func hasPathPrefix(p, prefix string) bool {
+	prefix = path.Clean("/" + filepath.ToSlash(prefix))[1:]
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// isPathOnPrefix report if the directory p is an ancestor of prefix or under it, so files under prefix may be found in it
+func isPathOnPrefix(p, prefix string) bool {
+	return hasPathPrefix(p, prefix) || hasPathPrefix(path.Clean("/" + filepath.ToSlash(prefix))[1:], p)
+}
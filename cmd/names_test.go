@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestSanitizeWindowsName(t *testing.T) {
+	tests := map[string]string{
+		"a.txt":       "a.txt",
+		"CON":         "CON_",
+		"aux.txt":     "aux_.txt",
+		"Lpt1.tar.gz": "Lpt1_.tar.gz",
+		"a:b?.txt":    "a_b_.txt",
+		"b.":          "b._",
+		"c ":          "c _",
+		"nul .txt":    "nul _.txt",
+		"console":     "console",
+	}
+	for name, expected := range tests {
+		assert.Equal(t, expected, sanitizeWindowsName(name), name)
+		assert.Equal(t, name == expected, windowsNameProblem(name) == "", name)
+		assert.Empty(t, windowsNameProblem(sanitizeWindowsName(name)), name)
+	}
+}
+
+func TestDemixSanitizeNames(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"CON":     "con",
+		"aux.txt": "aux",
+		"a:b.txt": "ab",
+		"b.":      "b",
+		"ok.txt":  "ok",
+	})
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		Output:  out,
+		Silence: true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{
+		Output:        demixOut,
+		SanitizeNames: sanitizeNamesRename,
+		Silence:       true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	hashes := readTestTree(t, src)
+	assert.Equal(t, map[string][32]byte{
+		"CON_":     hashes["CON"],
+		"aux_.txt": hashes["aux.txt"],
+		"a_b.txt":  hashes["a:b.txt"],
+		"b._":      hashes["b."],
+		"ok.txt":   hashes["ok.txt"],
+	}, readTestTree(t, demixOut))
+
+	demix = &DemixOptions{
+		Output:        filepath.Join(tmp, "reject"),
+		SanitizeNames: sanitizeNamesReject,
+		Silence:       true,
+	}
+	assert.Nil(t, demix.Validate(out))
+	err := demix.Run()
+	assert.ErrorContains(t, err, "invalid name")
+
+	assert.NotNil(t, (&DemixOptions{SanitizeNames: "yes", Output: demixOut}).Validate(out))
+	_, err = os.Stat(filepath.Join(demixOut, "CON"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDemixCaseCollision(t *testing.T) {
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	for name, content := range map[string]string{"File.txt": "upper", "file.txt": "lower"} {
+		src := filepath.Join(tmp, content, name)
+		writeTestTree(t, filepath.Dir(src), map[string]string{name: content})
+		domix := &DomixOptions{Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+	}
+
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	entries, err := os.ReadDir(demixOut)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	contents := map[string]bool{}
+	for _, entry := range entries {
+		assert.Contains(t, []string{"File.txt", "file.txt", "File_1.txt", "file_1.txt"}, entry.Name())
+		data, err := os.ReadFile(filepath.Join(demixOut, entry.Name()))
+		assert.Nil(t, err)
+		contents[string(data)] = true
+	}
+	assert.Equal(t, map[string]bool{"upper": true, "lower": true}, contents)
+
+	assert.Equal(t, "a_1.txt", numberedName("a.txt", 1))
+	assert.Equal(t, "a.tar_2.gz", numberedName("a.tar.gz", 2))
+	assert.Equal(t, ".bashrc_1", numberedName(".bashrc", 1))
+	assert.Equal(t, "Makefile_3", numberedName("Makefile", 3))
+}
+
+func TestDemixFlatten(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a/b/c.txt":  "c",
+		"a/d.txt":    "d",
+		"x/d.txt":    "other d",
+		"x/y/z/e.md": "e",
+	})
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+
+	// files are restored in output without directories, the second d.txt is numbered
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Output: demixOut, Flatten: true, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"c.txt", "d.txt", "d_1.txt", "e.md"}, dirNames(t, demixOut))
+	contents := map[string]bool{}
+	for _, name := range []string{"d.txt", "d_1.txt"} {
+		data, err := os.ReadFile(filepath.Join(demixOut, name))
+		assert.Nil(t, err)
+		contents[string(data)] = true
+	}
+	assert.Equal(t, map[string]bool{"d": true, "other d": true}, contents)
+
+	// the path prefix is of the tree
+	demixOut = filepath.Join(tmp, "demix-prefix")
+	demix = &DemixOptions{Output: demixOut, Flatten: true, PathPrefix: "x", Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"d.txt", "e.md"}, dirNames(t, demixOut))
+
+	assert.NotNil(t, (&DemixOptions{Flatten: true, DestTemplate: "{{.Name}}"}).Validate(out))
+	assert.NotNil(t, (&DemixOptions{Flatten: true, InPlace: true}).Validate(out))
+}
+
+func TestDomixOnCollision(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"x/a.txt": "first",
+		"y/a.txt": "second",
+	})
+	// sources are told apart by size
+	contents := map[uint64]string{5: "first", 6: "second"}
+	// mix two same-named files into one directory, return the names of outputs and their sources
+	mix := func(policy string) ([]string, error) {
+		t.Helper()
+		out := filepath.Join(tmp, "out-"+policy)
+		for _, dir := range []string{"x", "y"} {
+			domix := &DomixOptions{KeepName: true, OnCollision: policy, Output: out, Silence: true}
+			assert.Nil(t, domix.Validate(filepath.Join(src, dir, "a.txt")))
+			if err := domix.Run(); err != nil {
+				return nil, err
+			}
+		}
+		entries, err := os.ReadDir(out)
+		assert.Nil(t, err)
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			header, err := emix.ReadHeaderFromPath(filepath.Join(out, entry.Name()), [16]byte{})
+			assert.Nil(t, err)
+			names = append(names, entry.Name()+":"+contents[header.FileInfo.Size])
+		}
+		return names, nil
+	}
+
+	names, err := mix(onCollisionOverwrite)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt:second"}, names)
+
+	_, err = mix(onCollisionError)
+	assert.ErrorContains(t, err, "already exists")
+
+	names, err = mix(onCollisionSkip)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt:first"}, names)
+
+	names, err = mix(onCollisionRename)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt:first", "a_1.txt:second"}, names)
+
+	assert.NotNil(t, (&DomixOptions{OnCollision: "keep", Output: filepath.Join(tmp, "out")}).Validate(src))
+}
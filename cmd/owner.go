@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+
+	"github.com/icefed/emix"
+)
+
+// lookupOwner return the owner of source file with user and group names, names are left empty if they can not be resolved
+func lookupOwner(uid, gid uint32) *emix.Owner {
+	owner := &emix.Owner{UID: uid, GID: gid}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil && len(u.Username) <= emix.OwnerNameMaxLength {
+		owner.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil && len(g.Name) <= emix.OwnerNameMaxLength {
+		owner.Group = g.Name
+	}
+	return owner
+}
+
+// ownerIDs return the local uid and gid of owner, names are resolved to local ids unless numeric is set,
+// the recorded id is used if a name is empty or unknown on this machine
+func ownerIDs(owner *emix.Owner, numeric bool) (int, int) {
+	uid, gid := int(owner.UID), int(owner.GID)
+	if numeric {
+		return uid, gid
+	}
+	if owner.User != "" {
+		if u, err := user.Lookup(owner.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		} else {
+			debugf("user %s is unknown, use uid %d", owner.User, uid)
+		}
+	}
+	if owner.Group != "" {
+		if g, err := user.LookupGroup(owner.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		} else {
+			debugf("group %s is unknown, use gid %d", owner.Group, gid)
+		}
+	}
+	return uid, gid
+}
+
+// chownFile set the owner of f to the recorded owner, nothing if no owner was recorded
+func chownFile(f *os.File, owner *emix.Owner, numeric bool) error {
+	// windows has no uid and gid
+	if owner == nil || runtime.GOOS == "windows" {
+		return nil
+	}
+	uid, gid := ownerIDs(owner, numeric)
+	if err := f.Chown(uid, gid); err != nil {
+		return fmt.Errorf("Restore owner error: %w", err)
+	}
+	return nil
+}
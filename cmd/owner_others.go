@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"io/fs"
+
+	"github.com/icefed/emix"
+)
+
+func getFileOwner(fileinfo fs.FileInfo) *emix.Owner {
+	debugf("owner of %s is unavailable", fileinfo.Name())
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/icefed/emix"
+)
+
+func getFileOwner(fileinfo fs.FileInfo) *emix.Owner {
+	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		debugf("owner of %s is unavailable", fileinfo.Name())
+		return nil
+	}
+	return lookupOwner(stat.Uid, stat.Gid)
+}
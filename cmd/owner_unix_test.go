@@ -0,0 +1,79 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestOwnerIDs(t *testing.T) {
+	u, err := user.Current()
+	assert.Nil(t, err)
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip("group of current user is unknown")
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(g.Gid)
+
+	// names of another machine where the ids differ
+	owner := &emix.Owner{UID: 54321, GID: 54322, User: u.Username, Group: g.Name}
+	restoredUID, restoredGID := ownerIDs(owner, false)
+	assert.Equal(t, uid, restoredUID)
+	assert.Equal(t, gid, restoredGID)
+	restoredUID, restoredGID = ownerIDs(owner, true)
+	assert.Equal(t, 54321, restoredUID)
+	assert.Equal(t, 54322, restoredGID)
+
+	// unknown names fall back to the recorded ids
+	owner = &emix.Owner{UID: 54321, GID: 54322, User: "emix-no-such-user", Group: "emix-no-such-group"}
+	restoredUID, restoredGID = ownerIDs(owner, false)
+	assert.Equal(t, 54321, restoredUID)
+	assert.Equal(t, 54322, restoredGID)
+}
+
+func TestDemixSameOwner(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+	uid, gid := os.Geteuid(), os.Getegid()
+	if uid == 0 {
+		// ids without names, restored as is
+		assert.Nil(t, os.Chown(filepath.Join(src, "a.txt"), 54321, 54322))
+	}
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, RecordOwner: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "b.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(uid), header.FileInfo.Owner.UID)
+	assert.Equal(t, uint32(gid), header.FileInfo.Owner.GID)
+
+	for _, numeric := range []bool{false, true} {
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{SameOwner: true, NumericOwner: numeric, Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+		for name, expected := range map[string][2]int{"a.txt": {54321, 54322}, "b.txt": {uid, gid}} {
+			if uid != 0 {
+				expected = [2]int{uid, gid}
+			}
+			info, err := os.Stat(filepath.Join(demixOut, name))
+			assert.Nil(t, err)
+			stat := info.Sys().(*syscall.Stat_t)
+			assert.Equal(t, expected, [2]int{int(stat.Uid), int(stat.Gid)}, name)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type PackOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	EmbedPassword  bool
+	// 0: standard, no encryption
+	// 1: encrypt file info
+	// 2: encrypt file info and content
+	MixType  int
+	Output   string
+	Excludes []string
+	Silence  bool
+
+	source string
+
+	password      [16]byte
+	ignoreMatcher *ignore.GitIgnore
+	// path in bundle of the first packed file of each hard linked file
+	hardlinks map[fileID]string
+}
+
+func newCmdPack() *cobra.Command {
+	o := &PackOptions{}
+	cmd := &cobra.Command{
+		Use:     "pack <path>",
+		Short:   "pack the files of the directory into one emix bundle.",
+		Long:    ``,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+
+	cmd.Flags().SortFlags = false
+	cmd.Flags().IntVarP(&o.MixType, "type", "t", 0, "Mix type. 0: standard, 1: encrypt file info, 2: encrypt file info and content.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to encrypt. Conflicts with --credential-file and --embed-password.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password and --embed-password.")
+	cmd.Flags().BoolVar(&o.EmbedPassword, "embed-password", false, "Embed password to file header, password will be generated. Conflicts with --password and --credential-file.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output bundle file. Default use emix_%datetime(format: 2006-01-02_15-04-05).zip.")
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	cmd.Flags().BoolVar(&o.Silence, "silence", false, "Silence all output.")
+	return cmd
+}
+
+func (o *PackOptions) Validate(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path %s is not a directory", source)
+	}
+	o.source = filepath.Clean(source)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if (o.Password || o.CredentialFile != "") && o.EmbedPassword {
+		return errors.New("can not set both --password, --credential-file and --embed-password")
+	}
+	if o.MixType > 2 {
+		return errors.New("invalid --type, only support 0, 1, 2, see help for details")
+	}
+	if o.MixType == 0 {
+		if o.Password || o.EmbedPassword || o.CredentialFile != "" {
+			return errors.New("invalid --type 0, can not set password or embed-password")
+		}
+	} else {
+		if !o.Password && !o.EmbedPassword && o.CredentialFile == "" {
+			return errors.New("invalid --type, need password or embed-password or credential-file")
+		}
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		// verify password
+		if err = inputPasswordAgain(password); err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	// check output
+	if o.Output == "" {
+		o.Output = fmt.Sprintf("emix_%s.zip", time.Now().Format("2006-01-02_15-04-05"))
+	}
+	o.Output = filepath.Clean(o.Output)
+	if _, err := os.Stat(o.Output); err == nil {
+		return fmt.Errorf("output %s already exists", o.Output)
+	}
+
+	// ignore
+	if len(o.Excludes) != 0 {
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	return nil
+}
+
+func (o *PackOptions) Run() error {
+	targetFile, err := os.Create(o.Output)
+	if err != nil {
+		return err
+	}
+	defer targetFile.Close()
+
+	bw, err := emix.NewBundleWriter(targetFile)
+	if err != nil {
+		return fmt.Errorf("Write bundle error: %v", err)
+	}
+	o.hardlinks = make(map[fileID]string)
+	err = filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// check exclude pattern
+		if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// directory entry, the root is not stored
+		if info.IsDir() {
+			if path == o.source {
+				return nil
+			}
+			return o.AddDir(bw, path, info)
+		}
+		// nonsupport file type: symlink, device...
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("not a regular file: %v", info.Name())
+		}
+		return o.AddFile(bw, path, info)
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.Close(); err != nil {
+		return fmt.Errorf("Write bundle toc error: %v", err)
+	}
+	return nil
+}
+
+// AddFile add a file entry, hard links of an already packed file are added as link entries so the content is stored once
+func (o *PackOptions) AddFile(bw *emix.BundleWriter, src string, srcInfo os.FileInfo) error {
+	emixHeader, err := o.newHeader(src, srcInfo)
+	if err != nil {
+		return err
+	}
+	id, linked := getHardlinkID(srcInfo)
+	if linked {
+		if target, ok := o.hardlinks[id]; ok {
+			if err := bw.AddLink(emixHeader, target); err != nil {
+				return fmt.Errorf("Write hard link entry error: %v", err)
+			}
+			return nil
+		}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Open source file error: %v", err)
+	}
+	defer f.Close()
+
+	if err := bw.Add(emixHeader, f); err != nil {
+		return fmt.Errorf("Write file content error: %v", err)
+	}
+	if linked {
+		o.hardlinks[id] = emixHeader.FileInfo.Name
+	}
+	return nil
+}
+
+// AddDir add a directory entry so empty directories and directory modes are restored
+func (o *PackOptions) AddDir(bw *emix.BundleWriter, src string, srcInfo os.FileInfo) error {
+	emixHeader, err := o.newHeader(src, srcInfo)
+	if err != nil {
+		return err
+	}
+	if err := bw.AddDir(emixHeader); err != nil {
+		return fmt.Errorf("Write directory entry error: %v", err)
+	}
+	return nil
+}
+
+// newHeader create the header of bundle entry with path relative to source
+func (o *PackOptions) newHeader(src string, srcInfo os.FileInfo) (*emix.EmixHeader, error) {
+	relPath, err := filepath.Rel(o.source, src)
+	if err != nil {
+		return nil, err
+	}
+	relPath = filepath.ToSlash(relPath)
+	if !o.Silence {
+		fmt.Fprint(os.Stdout, src, " -> ", o.Output, ":", relPath, "\n")
+	}
+	// header
+	emixHeader := &emix.EmixHeader{
+		EmbedPassword: o.EmbedPassword,
+		SaltedKeys:    true,
+		BindHeader:    true,
+		FileInfo: emix.FileInfo{
+			Name:       relPath,
+			Mode:       uint32(srcInfo.Mode()),
+			CreateTime: uint64(getFileCreateTime(src, srcInfo).UnixNano()),
+			ModifyTime: uint64(srcInfo.ModTime().UnixNano()),
+		},
+	}
+	switch o.MixType {
+	case 0:
+	case 1:
+		emixHeader.EncryptInfo = true
+	case 2:
+		emixHeader.EncryptData = true
+	}
+	if o.EmbedPassword {
+		password, err := emix.GenerateRandomPassword(16)
+		if err != nil {
+			return nil, err
+		}
+		copy(emixHeader.Password[:], password)
+	} else {
+		copy(emixHeader.Password[:], o.password[:])
+	}
+	return emixHeader, nil
+}
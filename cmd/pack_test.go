@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/icefed/emix"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestTree write files to dir, the map key is slash-separated relative path
+func writeTestTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+// readTestTree return the sha256 of regular files in dir
+func readTestTree(t *testing.T, dir string) map[string][32]byte {
+	t.Helper()
+	hashes := make(map[string][32]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hashes[filepath.ToSlash(rel)] = sha256.Sum256(content)
+		return nil
+	})
+	assert.Nil(t, err)
+	return hashes
+}
+
+func TestPackUnpack(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "c",
+		"b/d/e.txt":   "e",
+		"b/d/f.txt":   "",
+		"b/.hidden":   "hidden",
+		".git/config": "config",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mixType := range []int{0, 1, 2} {
+		archive := filepath.Join(tmp, "archive.zip")
+		out := filepath.Join(tmp, "out")
+		os.Remove(archive)
+		os.RemoveAll(out)
+
+		pack := &PackOptions{
+			MixType:  mixType,
+			Output:   archive,
+			Excludes: []string{".*"},
+			Silence:  true,
+		}
+		unpack := &UnpackOptions{
+			Output:  out,
+			Silence: true,
+		}
+		if mixType != 0 {
+			pack.CredentialFile = credentialFile
+			unpack.CredentialFile = credentialFile
+		}
+		assert.Nil(t, pack.Validate(src))
+		assert.Nil(t, pack.Run())
+		assert.Nil(t, unpack.Validate(archive))
+		assert.Nil(t, unpack.Run())
+
+		expected := readTestTree(t, src)
+		delete(expected, "b/.hidden")
+		delete(expected, ".git/config")
+		assert.Equal(t, expected, readTestTree(t, out), mixType)
+	}
+}
+
+func TestPackUnpackDirectory(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a/b.txt": "b",
+	})
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "empty", "nested"), 0755))
+	assert.Nil(t, os.Chmod(filepath.Join(src, "empty"), 0700))
+	modifyTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(filepath.Join(src, "a"), modifyTime, modifyTime))
+
+	archive := filepath.Join(tmp, "archive.zip")
+	out := filepath.Join(tmp, "out")
+	pack := &PackOptions{
+		Output:  archive,
+		Silence: true,
+	}
+	unpack := &UnpackOptions{
+		Output:  out,
+		Silence: true,
+	}
+	assert.Nil(t, pack.Validate(src))
+	assert.Nil(t, pack.Run())
+	assert.Nil(t, unpack.Validate(archive))
+	assert.Nil(t, unpack.Run())
+
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, out))
+	info, err := os.Stat(filepath.Join(out, "empty", "nested"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	info, err = os.Stat(filepath.Join(out, "empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(out, "a"))
+	assert.Nil(t, err)
+	assert.True(t, modifyTime.Equal(info.ModTime()))
+}
+
+func TestUnpackPathPrefix(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"photos/2023/a.jpg":   "a",
+		"photos/2023/b/c.jpg": "c",
+		"photos/20234.jpg":    "not a subtree",
+		"photos/2024/d.jpg":   "d",
+		"docs/e.txt":          "e",
+	})
+
+	archive := filepath.Join(tmp, "archive.zip")
+	pack := &PackOptions{Output: archive, Silence: true}
+	assert.Nil(t, pack.Validate(src))
+	assert.Nil(t, pack.Run())
+	out := filepath.Join(tmp, "unpack")
+	unpack := &UnpackOptions{PathPrefix: "photos/2023/", Output: out, Silence: true}
+	assert.Nil(t, unpack.Validate(archive))
+	assert.Nil(t, unpack.Run())
+	assert.Equal(t, []string{"photos/2023/a.jpg", "photos/2023/b/c.jpg"}, testTreePaths(readTestTree(t, out)))
+
+	// demix of the mixed tree, combined with excludes
+	mixed := filepath.Join(tmp, "mixed")
+	domix := &DomixOptions{KeepName: true, Output: mixed, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	out = filepath.Join(tmp, "demix")
+	demix := &DemixOptions{PathPrefix: "photos/2023", Excludes: []string{"b/"}, Output: out, Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"photos/2023/a.jpg"}, testTreePaths(readTestTree(t, out)))
+
+	// a single file
+	out = filepath.Join(tmp, "demix2")
+	demix = &DemixOptions{PathPrefix: "photos/2024/d.jpg", Output: out, Silence: true}
+	assert.Nil(t, demix.Validate(mixed))
+	assert.Nil(t, demix.Run())
+	assert.Equal(t, []string{"photos/2024/d.jpg"}, testTreePaths(readTestTree(t, out)))
+}
+
+// testTreePaths return the sorted slash-separated paths of tree
+func testTreePaths[V any](tree map[string]V) []string {
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestUnpackSafeWrite(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "content of a",
+		"b/c.txt": "content of c",
+	})
+	archive := filepath.Join(tmp, "archive.zip")
+	pack := &PackOptions{Output: archive, Silence: true}
+	assert.Nil(t, pack.Validate(src))
+	assert.Nil(t, pack.Run())
+	outside := filepath.Join(tmp, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+	victim := filepath.Join(outside, "victim")
+	assert.Nil(t, os.WriteFile(victim, []byte("victim"), 0644))
+
+	// an existing symlink at a file is replaced, not written through
+	out := filepath.Join(tmp, "out")
+	assert.Nil(t, os.Mkdir(out, 0755))
+	assert.Nil(t, os.Symlink(victim, filepath.Join(out, "a.txt")))
+	unpack := &UnpackOptions{Output: out, Silence: true}
+	assert.Nil(t, unpack.Validate(archive))
+	assert.Nil(t, unpack.Run())
+	assert.Equal(t, readTestTree(t, src), readTestTree(t, out))
+	data, err := os.ReadFile(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, "victim", string(data))
+
+	// nothing is written through a symlinked directory
+	out = filepath.Join(tmp, "out2")
+	assert.Nil(t, os.Mkdir(out, 0755))
+	assert.Nil(t, os.Symlink(outside, filepath.Join(out, "b")))
+	unpack = &UnpackOptions{Output: out, Silence: true}
+	assert.Nil(t, unpack.Validate(archive))
+	assert.ErrorIs(t, unpack.Run(), emix.ErrUnsafeFileName)
+	_, err = os.Stat(filepath.Join(outside, "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a file failing its content hash is not left at its path
+	raw, err := os.ReadFile(archive)
+	assert.Nil(t, err)
+	i := bytes.Index(raw, []byte("content of c"))
+	assert.True(t, i > 0)
+	raw[i] ^= 0x01
+	assert.Nil(t, os.WriteFile(archive, raw, 0644))
+	out = filepath.Join(tmp, "out3")
+	unpack = &UnpackOptions{Output: out, Silence: true}
+	assert.Nil(t, unpack.Validate(archive))
+	assert.NotNil(t, unpack.Run())
+	entries, err := os.ReadDir(filepath.Join(out, "b"))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
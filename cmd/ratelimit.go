@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitMaxBurst is the max bytes written at once by --rate-limit
+const rateLimitMaxBurst = 1 << 20
+
+// parseRateLimit parse the bytes per second of --rate-limit, e.g. 512KiB or 10MB
+func parseRateLimit(s string) (*rate.Limiter, error) {
+	limit, err := humanize.ParseBytes(s)
+	if err != nil || limit == 0 {
+		return nil, errors.New("invalid --rate-limit, must be bytes per second, e.g. 512KiB or 10MB")
+	}
+	return rate.NewLimiter(rate.Limit(limit), int(min(limit, rateLimitMaxBurst))), nil
+}
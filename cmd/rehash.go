@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type RehashOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Excludes       []string
+
+	source      string
+	sourceIsDir bool
+
+	password      [16]byte
+	ignoreMatcher *ignore.GitIgnore
+	ciphers       *emix.CipherCache
+
+	out io.Writer
+}
+
+func newCmdRehash() *cobra.Command {
+	o := &RehashOptions{}
+	cmd := &cobra.Command{
+		Use:     "rehash <path>",
+		Short:   "recompute and rewrite the content hash of emix files.",
+		Long:    `Recompute the content hash of emix files and rewrite the header if the stored hash is wrong, to recover files produced by buggy versions.`,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	return cmd
+}
+
+func (o *RehashOptions) Validate(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	o.source = filepath.Clean(source)
+	if info.IsDir() {
+		o.sourceIsDir = true
+	}
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	o.ciphers = emix.NewCipherCache()
+
+	// ignore
+	if len(o.Excludes) != 0 {
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	o.out = os.Stdout
+	return nil
+}
+
+func (o *RehashOptions) Run() error {
+	if !o.sourceIsDir {
+		return o.rehash(o.source)
+	}
+	return filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// check exclude pattern
+		if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// skip directory path and nonsupport file type
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return o.rehash(path)
+	})
+}
+
+// rehash report the result of file, non-emix files are ignored
+func (o *RehashOptions) rehash(path string) error {
+	ok, err := emix.IsEmixFileByPath(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	fixed, err := o.RehashFile(path)
+	if err != nil {
+		return fmt.Errorf("rehash %s error: %v", path, err)
+	}
+	if fixed {
+		fmt.Fprintf(o.out, "FIXED %s\n", path)
+	} else {
+		fmt.Fprintf(o.out, "OK %s\n", path)
+	}
+	return nil
+}
+
+// RehashFile compute the content hash of emix file and rewrite the header if the stored hash differs,
+// return true if the header is rewritten
+func (o *RehashOptions) RehashFile(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	emixHeader := &emix.EmixHeader{
+		Password: o.password,
+		Ciphers:  o.ciphers,
+	}
+	if err := emixHeader.UnmarshalFromFile(f); err != nil {
+		return false, fmt.Errorf("invalid header: %v", err)
+	}
+	if emixHeader.EncryptData && !emixHeader.EmbedPassword && o.password == [16]byte{} {
+		return false, errors.New("need password to decrypt content")
+	}
+
+	// content of a split file is in the content file beside it
+	content, contentOffset := f, emixHeader.ContentOffset()
+	if emixHeader.FileInfo.Detached {
+		if content, err = emix.OpenDetachedContent(path, emixHeader); err != nil {
+			return false, fmt.Errorf("invalid content file: %v", err)
+		}
+		defer content.Close()
+		contentOffset = emix.DetachedContentOffset
+	}
+
+	hash := emixHeader.NewContentHash()
+	content.Seek(contentOffset, io.SeekStart)
+	if emixHeader.EncryptData {
+		cipher, err := emixHeader.NewContentCipher()
+		if err != nil {
+			return false, err
+		}
+		err = emix.DecryptContentWithSectorSize(cipher, content, hash, int64(emixHeader.FileInfo.Size), emixHeader.ContentSectorSize())
+		if err != nil {
+			return false, err
+		}
+	} else {
+		if err := emix.CopyContent(hash, content, int64(emixHeader.FileInfo.Size)); err != nil {
+			return false, err
+		}
+	}
+	if bytes.Equal(emixHeader.FileInfo.FileContentHash[:], hash.Sum(nil)) {
+		return false, nil
+	}
+
+	copy(emixHeader.FileInfo.FileContentHash[:], hash.Sum(nil))
+	if err := emix.RewriteHeader(f, emixHeader); err != nil {
+		return false, fmt.Errorf("Rewrite emix header error: %v", err)
+	}
+	return true, nil
+}
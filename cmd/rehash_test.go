@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+// writeWrongHash rewrite the stored content hash of emix file with a wrong one
+func writeWrongHash(t *testing.T, path string, password [16]byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	defer f.Close()
+	header, err := emix.ReadHeader(f, password)
+	assert.Nil(t, err)
+	header.FileInfo.FileContentHash[0] ^= 0xff
+	assert.Nil(t, emix.RewriteHeader(f, header))
+}
+
+func TestRehash(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"good.txt":  "good",
+		"wrong.txt": "wrong",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	credential, err := emix.GeneratePasswordFromFile(credentialFile)
+	assert.Nil(t, err)
+
+	for _, mixType := range []int{0, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			MixType:  mixType,
+			KeepName: true,
+			Output:   out,
+			Silence:  true,
+		}
+		rehash := &RehashOptions{}
+		verify := &VerifyOptions{}
+		var password [16]byte
+		if mixType != 0 {
+			domix.CredentialFile = credentialFile
+			rehash.CredentialFile = credentialFile
+			verify.CredentialFile = credentialFile
+			copy(password[:], credential)
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		wrong := filepath.Join(out, "wrong.txt")
+		writeWrongHash(t, wrong, password)
+
+		buf := bytes.NewBuffer(nil)
+		assert.Nil(t, verify.Validate(out))
+		verify.out = buf
+		assert.NotNil(t, verify.Run())
+
+		assert.Nil(t, rehash.Validate(out))
+		buf.Reset()
+		rehash.out = buf
+		assert.Nil(t, rehash.Run())
+		assert.Contains(t, buf.String(), "OK "+filepath.Join(out, "good.txt"))
+		assert.Contains(t, buf.String(), "FIXED "+wrong)
+
+		assert.Nil(t, verify.Validate(out))
+		verify.out = buf
+		assert.Nil(t, verify.Run())
+
+		// fixed file is not rewritten again
+		buf.Reset()
+		assert.Nil(t, rehash.Run())
+		assert.Contains(t, buf.String(), "OK "+wrong)
+	}
+
+	// password is required for encrypted content
+	rehash := &RehashOptions{}
+	assert.Nil(t, rehash.Validate(filepath.Join(tmp, "out", "wrong.txt")))
+	assert.NotNil(t, rehash.Run())
+}
@@ -11,6 +11,10 @@ const (
 func newRootCommand() *cobra.Command {
 	command := &cobra.Command{
 		Use: rootCmdName,
+		// flags not set on command line default to the config file
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConfig(cmd)
+		},
 	}
 	// subcommand group
 	command.AddGroup(&cobra.Group{
@@ -28,10 +32,25 @@ func newRootCommand() *cobra.Command {
 	// Top Level Commands
 	command.AddCommand(newCmdDomix())
 	command.AddCommand(newCmdDemix())
+	command.AddCommand(newCmdPack())
+	command.AddCommand(newCmdUnpack())
 	command.AddCommand(newCmdLs())
 	command.AddCommand(newCmdStat())
+	command.AddCommand(newCmdVerify())
+	command.AddCommand(newCmdVerifyManifest())
+	command.AddCommand(newCmdCompare())
+	command.AddCommand(newCmdDups())
+	command.AddCommand(newCmdThumbnail())
+	command.AddCommand(newCmdTouch())
+	command.AddCommand(newCmdRehash())
+	command.AddCommand(newCmdBrowse())
+	command.AddCommand(newCmdServe())
 
 	// Other Commands
+	command.AddCommand(newCmdAgent())
+	command.AddCommand(newCmdExportKey())
+	command.AddCommand(newCmdImportKey())
+	command.AddCommand(newCmdBench())
 	command.AddCommand(newCmdVersion())
 
 	return command
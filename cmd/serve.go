@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icefed/emix"
+	"github.com/spf13/cobra"
+)
+
+// serveAuthEnv is the basic auth credential of serve in the form user:password
+const serveAuthEnv = "EMIX_SERVE_AUTH"
+
+type ServeOptions struct {
+	Addr string
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Keyring        string
+	// read password from the environment variable
+	PasswordEnv string
+
+	dir      string
+	password [16]byte
+	ciphers  *emix.CipherCache
+	// basic auth credential, no auth if user is empty
+	user     string
+	authPass string
+}
+
+func newCmdServe() *cobra.Command {
+	o := &ServeOptions{}
+	cmd := &cobra.Command{
+		Use:   "serve <dir>",
+		Short: "serve the decrypted content of emix files of the directory over HTTP",
+		Long: `Serve the decrypted content of emix files of the directory over HTTP.
+GET /<path> returns the content of the emix file at path relative to the directory, with the original
+name, size and modify time, range requests are supported. Compressed and sparse files are restored
+while served, without range requests. Set ` + serveAuthEnv + `=user:password to require basic auth.`,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringVar(&o.Addr, "addr", ":8080", "TCP address to listen on.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVar(&o.Keyring, "keyring", "", "Read password from the OS keyring under SERVICE, prompt if the entry is missing. Conflicts with --password and --credential-file.")
+	cmd.Flags().StringVar(&o.PasswordEnv, "password-env", "", "Read password from the environment variable NAME. Conflicts with --password, --credential-file and --keyring.")
+	return cmd
+}
+
+func (o *ServeOptions) Validate(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path %s is not a directory", dir)
+	}
+	o.dir = filepath.Clean(dir)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Keyring != "" && (o.Password || o.CredentialFile != "") {
+		return errors.New("can not set both --keyring and --password or --credential-file")
+	}
+	if o.PasswordEnv != "" {
+		if o.Password || o.CredentialFile != "" || o.Keyring != "" {
+			return errors.New("can not set both --password-env and --password, --credential-file or --keyring")
+		}
+		password := os.Getenv(o.PasswordEnv)
+		if password == "" {
+			return fmt.Errorf("environment variable %s of --password-env is not set", o.PasswordEnv)
+		}
+		o.password = emix.PasswordKey([]byte(password))
+	}
+	if o.Keyring != "" {
+		password, ok, err := keyringGet(o.Keyring)
+		if err != nil {
+			return err
+		}
+		if ok {
+			o.password = password
+		} else {
+			o.Password = true
+		}
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	o.ciphers = emix.NewCipherCache()
+
+	if auth := os.Getenv(serveAuthEnv); auth != "" {
+		user, pass, ok := strings.Cut(auth, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid %s, it must be user:password", serveAuthEnv)
+		}
+		o.user, o.authPass = user, pass
+	}
+
+	return nil
+}
+
+func (o *ServeOptions) Run() error {
+	if o.user == "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not set, content is served without auth\n", serveAuthEnv)
+	}
+	fmt.Fprintf(os.Stderr, "Serving %s on %s\n", o.dir, o.Addr)
+	server := &http.Server{
+		Addr:              o.Addr,
+		Handler:           o.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+// handler return the http handler serving the content of emix files under dir
+func (o *ServeOptions) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !o.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="emix"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			http.NotFound(w, r)
+			return
+		}
+		o.serveFile(w, r, filepath.Join(o.dir, filepath.FromSlash(name)))
+	})
+}
+
+// authorized check the basic auth credential of r, compared by their hashes in constant time
+func (o *ServeOptions) authorized(r *http.Request) bool {
+	if o.user == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userHash, expectedUserHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(o.user))
+	passHash, expectedPassHash := sha256.Sum256([]byte(pass)), sha256.Sum256([]byte(o.authPass))
+	userMatch := subtle.ConstantTimeCompare(userHash[:], expectedUserHash[:])
+	passMatch := subtle.ConstantTimeCompare(passHash[:], expectedPassHash[:])
+	return userMatch&passMatch == 1
+}
+
+// serveFile serve the plain content of the emix file path, range requests are served by seeking the content.
+// Transformed content is decoded and holes of sparse files are filled while copied, without range requests
+func (o *ServeOptions) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	header := &emix.EmixHeader{
+		Password: o.password,
+		Ciphers:  o.ciphers,
+	}
+	if err := header.UnmarshalFromFile(f); err != nil {
+		if errors.Is(err, emix.ErrInvalidEmixHeader) {
+			http.NotFound(w, r)
+			return
+		}
+		debugf("read header of %s: %v", path, err)
+		http.Error(w, "can not read emix header", http.StatusForbidden)
+		return
+	}
+	fileInfo := &header.FileInfo
+	if header.Streamed || fileInfo.Detached {
+		http.Error(w, "content of the emix file can not be served", http.StatusNotImplemented)
+		return
+	}
+	// the ciphertext is authenticated before anything is decrypted from it
+	if header.FileMAC {
+		if err := emix.VerifyFileMAC(f, info.Size(), header); err != nil {
+			debugf("verify file mac of %s: %v", path, err)
+			http.Error(w, "content authentication failed", http.StatusForbidden)
+			return
+		}
+	}
+	content, err := emix.OpenContent(f, header)
+	if err != nil {
+		debugf("open content of %s: %v", path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": fileInfo.Name}))
+	modTime := time.Unix(0, int64(fileInfo.ModifyTime))
+	if len(fileInfo.Transforms) == 0 && fileInfo.Sparse == nil {
+		http.ServeContent(w, r, fileInfo.Name, modTime, content)
+		return
+	}
+	restored := io.Reader(content)
+	if len(fileInfo.Transforms) > 0 {
+		if restored, err = emix.DecodeContent(restored, fileInfo.Transforms); err != nil {
+			debugf("decode content of %s: %v", path, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	if fileInfo.Sparse != nil {
+		restored = emix.NewSparseFileReader(restored, fileInfo.Sparse)
+	}
+	serveRestored(w, r, fileInfo, modTime, restored)
+}
+
+// serveRestored serve the restored file read from content as a whole, range requests are ignored
+func serveRestored(w http.ResponseWriter, r *http.Request, fileInfo *emix.FileInfo, modTime time.Time, content io.Reader) {
+	if ctype := mime.TypeByExtension(filepath.Ext(fileInfo.Name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "none")
+	// the restored size is not recorded for transformed content of old versions
+	if len(fileInfo.Transforms) == 0 || fileInfo.OriginalSize != 0 {
+		w.Header().Set("Content-Length", strconv.FormatUint(fileInfo.RestoredSize(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		// the status is sent, the connection is closed on a short body
+		debugf("serve %s: %v", fileInfo.Name, err)
+	}
+}
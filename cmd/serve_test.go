@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icefed/emix"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	content := strings.Repeat("0123456789", 1000)
+	writeTestTree(t, src, map[string]string{
+		"a.txt": content,
+	})
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(filepath.Join(src, "a.txt"), modTime, modTime))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		MixType:        2,
+		CredentialFile: credentialFile,
+		KeepName:       true,
+		Output:         out,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	assert.Nil(t, os.WriteFile(filepath.Join(out, "other.txt"), []byte("not emix"), 0644))
+
+	t.Setenv(serveAuthEnv, "user:secret")
+	serve := &ServeOptions{CredentialFile: credentialFile}
+	assert.Nil(t, serve.Validate(out))
+	server := httptest.NewServer(serve.handler())
+	defer server.Close()
+
+	get := func(path, rangeHeader string, auth bool) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		assert.Nil(t, err)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		if auth {
+			req.SetBasicAuth("user", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// basic auth is required
+	resp := get("/a.txt", "", false)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// whole content with name, size and modify time
+	resp = get("/a.txt", "", true)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, string(body))
+	assert.Equal(t, "10000", resp.Header.Get("Content-Length"))
+	assert.Equal(t, modTime.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+	assert.Equal(t, `inline; filename=a.txt`, resp.Header.Get("Content-Disposition"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	// a range across a sector boundary
+	resp = get("/a.txt", "bytes=4090-4109", true)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[4090:4110], string(body))
+	assert.Equal(t, "bytes 4090-4109/10000", resp.Header.Get("Content-Range"))
+
+	// non-emix files and paths out of the directory are not found
+	for _, path := range []string{"/other.txt", "/missing.txt", "/../src/a.txt"} {
+		resp = get(path, "", true)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func TestServeRestored(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	content := strings.Repeat("0123456789", 1000)
+	writeTestTree(t, src, map[string]string{
+		"a.txt": content,
+		"b.txt": content,
+	})
+	t.Setenv("TEST_SERVE_PASSWORD", "password")
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("password"), 0600))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{
+		MixType:        2,
+		CredentialFile: credentialFile,
+		KeepName:       true,
+		Compress:       "gzip",
+		Output:         out,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	// the password typed in
+	domix.password = emix.PasswordKey([]byte("password"))
+	assert.Nil(t, domix.Run())
+
+	assert.NotNil(t, (&ServeOptions{PasswordEnv: "TEST_SERVE_PASSWORD", CredentialFile: credentialFile}).Validate(out))
+	assert.NotNil(t, (&ServeOptions{PasswordEnv: "TEST_SERVE_MISSING"}).Validate(out))
+	serve := &ServeOptions{PasswordEnv: "TEST_SERVE_PASSWORD"}
+	assert.Nil(t, serve.Validate(out))
+	server := httptest.NewServer(serve.handler())
+	defer server.Close()
+
+	// compressed content is decoded, range requests are ignored
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/a.txt", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, string(body))
+	assert.Equal(t, "10000", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "none", resp.Header.Get("Accept-Ranges"))
+
+	// the file mac is verified before content is served
+	path := filepath.Join(out, "b.txt")
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	raw[len(raw)-emix.FileMACLength-1] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, raw, 0644))
+	resp, err = http.Get(server.URL + "/b.txt")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -19,9 +20,13 @@ type StatOptions struct {
 	// read password from stdin if Password is true
 	Password       bool
 	CredentialFile string
+	// get password from agent before prompting
+	UseAgent bool
 
 	emixFilePath string
 	password     [16]byte
+
+	out io.Writer
 }
 
 func newCmdStat() *cobra.Command {
@@ -37,8 +42,9 @@ func newCmdStat() *cobra.Command {
 		},
 	}
 	cmd.Flags().SortFlags = false
-	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt, max length is 16 bytes. Conflicts with --credential-file.")
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
 	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().BoolVar(&o.UseAgent, "use-agent", false, "Get password from emix agent, prompt if the agent is unavailable. Conflicts with --password and --credential-file.")
 	return cmd
 }
 
@@ -55,6 +61,12 @@ func (o *StatOptions) Validate(emixFilePath string) error {
 	if o.Password && o.CredentialFile != "" {
 		return errors.New("can not set both --password and --credential-file")
 	}
+	if o.UseAgent && (o.Password || o.CredentialFile != "") {
+		return errors.New("can not set both --use-agent and --password or --credential-file")
+	}
+	if o.UseAgent && !useAgentPassword(&o.password) {
+		o.Password = true
+	}
 	if o.Password {
 		// input password
 		password, err := inputPassword()
@@ -62,7 +74,7 @@ func (o *StatOptions) Validate(emixFilePath string) error {
 			return err
 		}
 
-		copy(o.password[:], password)
+		o.password = emix.PasswordKey(password)
 	}
 	if o.CredentialFile != "" {
 		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
@@ -71,6 +83,7 @@ func (o *StatOptions) Validate(emixFilePath string) error {
 		}
 		copy(o.password[:], password)
 	}
+	o.out = os.Stdout
 
 	return nil
 }
@@ -81,6 +94,10 @@ func (o *StatOptions) Run() error {
 		return err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
 	ok, err := emix.IsEmixFile(f)
 	if err != nil {
@@ -90,24 +107,119 @@ func (o *StatOptions) Run() error {
 		return errors.New("not emix file")
 	}
 
-	f.Seek(int64(emix.ZipHeaderLength()), io.SeekStart)
-
 	emixHeader := &emix.EmixHeader{}
 	copy(emixHeader.Password[:], o.password[:])
-	err = emixHeader.UnmarshalBinaryFromReader(f)
+	err = emixHeader.UnmarshalFromFile(f)
 	if err != nil {
 		return err
 	}
 
 	// print info as table
-	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.TabIndent)
+	tw := tabwriter.NewWriter(o.out, 0, 0, 1, ' ', tabwriter.TabIndent)
 	fmt.Fprintf(tw, "%11s:\t%s\n", "Name", emixHeader.FileInfo.Name)
 	fmt.Fprintf(tw, "%11s:\t%s (%d)\n", "Size", humanize.Bytes(emixHeader.FileInfo.Size), emixHeader.FileInfo.Size)
 	fmt.Fprintf(tw, "%11s:\t%s\n", "Mode", fs.FileMode(emixHeader.FileInfo.Mode))
+	if owner := emixHeader.FileInfo.Owner; owner != nil {
+		fmt.Fprintf(tw, "%11s:\t%s(%d) %s(%d)\n", "Owner", owner.User, owner.UID, owner.Group, owner.GID)
+	}
 	fmt.Fprintf(tw, "%11s:\t%s\n", "Create Time", time.Unix(0, int64(emixHeader.FileInfo.CreateTime)))
 	fmt.Fprintf(tw, "%11s:\t%s\n", "Modify Time", time.Unix(0, int64(emixHeader.FileInfo.ModifyTime)))
-	fmt.Fprintf(tw, "%11s:\t%s\n", "SHA256", fmt.Sprintf("%x", emixHeader.FileInfo.FileContentHash))
+	fmt.Fprintf(tw, "%11s:\t%s\n", hashName(emixHeader.CipherSuite), fmt.Sprintf("%x", emixHeader.FileInfo.FileContentHash))
+	if len(emixHeader.FileInfo.ID) > 0 {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "ID", emix.FormatFileID(emixHeader.FileInfo.ID))
+	}
+	if emixHeader.FileInfo.Detached {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Content", emix.DetachedContentPath(filepath.Base(o.emixFilePath)))
+	}
+	if len(emixHeader.FileInfo.Preview) > 0 {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Preview", humanize.Bytes(uint64(len(emixHeader.FileInfo.Preview))))
+	}
+	if emixHeader.FileInfo.ChunkSize != 0 {
+		fmt.Fprintf(tw, "%11s:\t%d x %s, root %x\n", "Chunks", len(emixHeader.FileInfo.ChunkHashes), humanize.IBytes(emixHeader.FileInfo.ChunkSize), emix.MerkleRoot(emixHeader.FileInfo.ChunkHashes))
+	}
+	if sparse := emixHeader.FileInfo.Sparse; sparse != nil {
+		fmt.Fprintf(tw, "%11s:\t%s (%d), %d data extents\n", "Sparse Size", humanize.Bytes(sparse.Size), sparse.Size, len(sparse.Extents))
+	}
+	if len(emixHeader.FileInfo.Xattrs) > 0 {
+		names := make([]string, 0, len(emixHeader.FileInfo.Xattrs))
+		for _, x := range emixHeader.FileInfo.Xattrs {
+			names = append(names, x.Name)
+		}
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Xattrs", strings.Join(names, ", "))
+	}
+	if len(emixHeader.FileInfo.Transforms) > 0 {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Transforms", strings.Join(emixHeader.FileInfo.Transforms, ", "))
+		if size := emixHeader.FileInfo.OriginalSize; size != 0 {
+			fmt.Fprintf(tw, "%11s:\t%s (%d)\n", "Orig Size", humanize.Bytes(size), size)
+		}
+	}
+	if emixHeader.CipherSuite != emix.DefaultCipherSuite {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Suite", emixHeader.CipherSuite)
+	}
+	if emixHeader.KDF != nil {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "KDF", emixHeader.KDF)
+	}
+	if emixHeader.FileInfo.ToolVersion != "" {
+		fmt.Fprintf(tw, "%11s:\t%s\n", "Written By", "emix "+emixHeader.FileInfo.ToolVersion)
+	}
 	tw.Flush()
 
+	// timestamps out of range often mean a corrupted or tampered header
+	for _, ts := range []struct {
+		name  string
+		value uint64
+	}{
+		{"create time", emixHeader.FileInfo.CreateTime},
+		{"modify time", emixHeader.FileInfo.ModifyTime},
+	} {
+		if problem := timestampProblem(time.Unix(0, int64(ts.value)), time.Now()); problem != "" {
+			fmt.Fprintf(o.out, "Warning: %s %s, the header may be corrupted or tampered\n", ts.name, problem)
+		}
+	}
+
+	// cheap integrity check, the header size should match the content region
+	contentSize := emixHeader.CiphertextSize()
+	if emixHeader.FileInfo.Detached {
+		// the header file has no content region, the content file has the preamble
+		if expected := emixHeader.ContentOffset() + emixHeader.TrailerLength(); expected != info.Size() {
+			fmt.Fprintf(o.out, "Warning: file size mismatch, expected %d bytes by header, got %d bytes\n", expected, info.Size())
+		}
+		contentPath := emix.DetachedContentPath(o.emixFilePath)
+		contentInfo, err := os.Stat(contentPath)
+		if err != nil {
+			fmt.Fprintf(o.out, "Warning: content file %s is unavailable: %v\n", contentPath, err)
+		} else if expected := emix.DetachedContentOffset + contentSize; expected != contentInfo.Size() {
+			fmt.Fprintf(o.out, "Warning: content file size mismatch, expected %d bytes by header, got %d bytes\n", expected, contentInfo.Size())
+		}
+	} else if expected := emixHeader.ContentOffset() + contentSize + emixHeader.TrailerLength(); expected != info.Size() {
+		fmt.Fprintf(o.out, "Warning: file size mismatch, expected %d bytes by header, got %d bytes\n", expected, info.Size())
+	}
+
 	return nil
 }
+
+// bounds of plausible timestamps, and the clock skew tolerated for future timestamps
+var (
+	minPlausibleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxPlausibleTime = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxClockSkew     = 24 * time.Hour
+)
+
+// timestampProblem return why t is implausible at now, empty if t is plausible
+func timestampProblem(t, now time.Time) string {
+	switch {
+	case t.Before(minPlausibleTime):
+		return fmt.Sprintf("%s is before %d", t.UTC().Format(time.RFC3339), minPlausibleTime.Year())
+	case !t.Before(maxPlausibleTime):
+		return fmt.Sprintf("%s is after %d", t.UTC().Format(time.RFC3339), maxPlausibleTime.Year())
+	case t.After(now.Add(maxClockSkew)):
+		return fmt.Sprintf("%s is in the future, the clock of the writer may be skewed", t.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// hashName return the name of content hash of suite, e.g. SHA256
+func hashName(suite emix.CipherSuiteID) string {
+	name := suite.String()
+	return strings.ToUpper(name[strings.LastIndex(name, "+")+1:])
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+	"github.com/icefed/emix/version"
+)
+
+func TestStatSizeMismatch(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "aaaa",
+		"b.txt": "bbbb",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mixType := range []int{0, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			MixType:  mixType,
+			KeepName: true,
+			Output:   out,
+			Silence:  true,
+		}
+		stat := &StatOptions{}
+		if mixType != 0 {
+			domix.CredentialFile = credentialFile
+			stat.CredentialFile = credentialFile
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+
+		// append content so the header size does not match the content region
+		f, err := os.OpenFile(filepath.Join(out, "b.txt"), os.O_APPEND|os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		_, err = f.Write([]byte("extra"))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		buf := bytes.NewBuffer(nil)
+		assert.Nil(t, stat.Validate(filepath.Join(out, "a.txt")))
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		assert.Contains(t, buf.String(), "a.txt")
+		assert.NotContains(t, buf.String(), "Warning")
+
+		buf.Reset()
+		assert.Nil(t, stat.Validate(filepath.Join(out, "b.txt")))
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		assert.Contains(t, buf.String(), "Warning: file size mismatch")
+	}
+}
+
+func TestStatToolVersion(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": "aaaa",
+	})
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "v9.8.7"
+
+	for _, recordVersion := range []bool{false, true} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			KeepName:      true,
+			RecordVersion: recordVersion,
+			Output:        out,
+			Silence:       true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+
+		stat := &StatOptions{}
+		assert.Nil(t, stat.Validate(filepath.Join(out, "a.txt")))
+		buf := bytes.NewBuffer(nil)
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		assert.Equal(t, recordVersion, strings.Contains(buf.String(), "Written By: emix v9.8.7"))
+	}
+}
+
+func TestStatImplausibleTime(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "aaaa"})
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	path := filepath.Join(out, "a.txt")
+
+	stat := &StatOptions{}
+	assert.Nil(t, stat.Validate(path))
+	buf := bytes.NewBuffer(nil)
+	stat.out = buf
+	assert.Nil(t, stat.Run())
+	assert.NotContains(t, buf.String(), "Warning")
+
+	// a bogus modify time of the same encoded length
+	header, err := emix.ReadHeaderFromPath(path, [16]byte{})
+	assert.Nil(t, err)
+	header.FileInfo.ModifyTime = math.MaxUint64 >> 1
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, emix.RewriteHeader(f, header))
+	assert.Nil(t, f.Close())
+	buf.Reset()
+	assert.Nil(t, stat.Run())
+	assert.Contains(t, buf.String(), "Warning: modify time 2262-04-11T23:47:16Z is after 2200")
+	assert.NotContains(t, buf.String(), "Warning: create time")
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Empty(t, timestampProblem(now.Add(time.Hour), now))
+	assert.Contains(t, timestampProblem(now.Add(48*time.Hour), now), "in the future")
+	assert.Contains(t, timestampProblem(time.Unix(0, 0), now), "before 1980")
+	// a uint64 timestamp over math.MaxInt64 is negative
+	overflowed := uint64(math.MaxUint64)
+	assert.Contains(t, timestampProblem(time.Unix(0, int64(overflowed)), now), "before 1980")
+}
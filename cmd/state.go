@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// domixState records the source files mixed by domix --state, a resumed run skips them.
+// The state file is json lines appended as files complete, so an interrupted run loses at most
+// the line being written.
+type domixState struct {
+	f    *os.File
+	done map[string]stateEntry
+	// flush each line to disk
+	sync bool
+}
+
+// stateEntry is a source file mixed successfully, it is done again if its size or modify time changed
+type stateEntry struct {
+	// slash-separated source path, the same as in manifest
+	Source     string `json:"source"`
+	Size       uint64 `json:"size"`
+	ModifyTime uint64 `json:"modify_time"`
+}
+
+// openDomixState read the entries of the state file at path and open it for appending, it is created if not exists
+func openDomixState(path string, sync bool) (*domixState, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &domixState{f: f, done: make(map[string]stateEntry), sync: sync}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var entry stateEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			// the last line may be cut by an interruption, the file is done again
+			debugf("ignore line %d of state file %s: %v", line, path, err)
+			continue
+		}
+		s.done[entry.Source] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Read state file error: %v", err)
+	}
+	// start a new line after a cut line
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Done report if source with info was mixed by a previous run
+func (s *domixState) Done(source string, info fs.FileInfo) bool {
+	entry, ok := s.done[source]
+	return ok && entry.Size == uint64(info.Size()) && entry.ModifyTime == uint64(info.ModTime().UnixNano())
+}
+
+// Add record source with info as mixed
+func (s *domixState) Add(source string, info fs.FileInfo) error {
+	entry := stateEntry{
+		Source:     source,
+		Size:       uint64(info.Size()),
+		ModifyTime: uint64(info.ModTime().UnixNano()),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("Write state file error: %v", err)
+	}
+	if s.sync {
+		if err := s.f.Sync(); err != nil {
+			return fmt.Errorf("Write state file error: %v", err)
+		}
+	}
+	s.done[source] = entry
+	return nil
+}
+
+func (s *domixState) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,136 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/icefed/emix"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomixSymlink(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+	})
+	assert.Nil(t, os.Symlink("a.txt", filepath.Join(src, "link.txt")))
+	assert.Nil(t, os.Symlink("../a.txt", filepath.Join(src, "b", "up.txt")))
+	assert.Nil(t, os.Symlink("missing", filepath.Join(src, "dangling")))
+
+	for _, mixType := range []int{0, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: mixType, EmbedPassword: mixType != 0, KeepName: true, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, "link.txt"), [16]byte{})
+		assert.Nil(t, err)
+		assert.NotZero(t, fs.FileMode(header.FileInfo.Mode)&fs.ModeSymlink)
+		assert.Equal(t, uint64(len("a.txt")), header.FileInfo.Size)
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		for name, target := range map[string]string{"link.txt": "a.txt", "b/up.txt": "../a.txt", "dangling": "missing"} {
+			link, err := os.Readlink(filepath.Join(demixOut, filepath.FromSlash(name)))
+			assert.Nil(t, err, name)
+			assert.Equal(t, target, link, name)
+		}
+		data, err := os.ReadFile(filepath.Join(demixOut, "b", "up.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "a", string(data))
+	}
+
+	// the targets are mixed instead of links
+	out := filepath.Join(tmp, "out-follow")
+	os.Remove(filepath.Join(src, "dangling"))
+	domix := &DomixOptions{KeepName: true, FollowSymlinks: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "link.txt"), [16]byte{})
+	assert.Nil(t, err)
+	assert.True(t, fs.FileMode(header.FileInfo.Mode).IsRegular())
+	assert.Equal(t, uint64(1), header.FileInfo.Size)
+}
+
+func TestDemixSymlinkDir(t *testing.T) {
+	tmp := t.TempDir()
+	outside := filepath.Join(tmp, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+	src := filepath.Join(tmp, "src")
+	assert.Nil(t, os.Mkdir(src, 0755))
+	assert.Nil(t, os.Symlink(outside, filepath.Join(src, "sub")))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	// a directory of the emix tree with the name of the restored link
+	writeTestTree(t, filepath.Join(tmp, "evil"), map[string]string{"evil.txt": "evil"})
+	domix = &DomixOptions{KeepName: true, Output: filepath.Join(out, "sub"), Silence: true}
+	assert.Nil(t, domix.Validate(filepath.Join(tmp, "evil", "evil.txt")))
+	assert.Nil(t, domix.Run())
+
+	demix := &DemixOptions{Output: filepath.Join(tmp, "demix"), Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.ErrorIs(t, demix.Run(), emix.ErrUnsafeFileName)
+	_, err := os.Stat(filepath.Join(outside, "evil.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDemixSymlinkDest(t *testing.T) {
+	tmp := t.TempDir()
+	victim := filepath.Join(tmp, "victim")
+	assert.Nil(t, os.WriteFile(victim, []byte("victim"), 0600))
+	outside := filepath.Join(tmp, "outside")
+	assert.Nil(t, os.Mkdir(outside, 0755))
+
+	// the link z.tmp is restored before the regular file z, which is not written through it
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"z": "evil"})
+	assert.Nil(t, os.Symlink(victim, filepath.Join(src, "z.tmp")))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	assert.Nil(t, os.Rename(filepath.Join(out, "z.tmp"), filepath.Join(out, "a")))
+	assert.Nil(t, os.Rename(filepath.Join(out, "z"), filepath.Join(out, "b")))
+	demixOut := filepath.Join(tmp, "demix")
+	demix := &DemixOptions{Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	data, err := os.ReadFile(filepath.Join(demixOut, "z"))
+	assert.Nil(t, err)
+	assert.Equal(t, "evil", string(data))
+	link, err := os.Readlink(filepath.Join(demixOut, "z.tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, victim, link)
+	data, err = os.ReadFile(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, "victim", string(data))
+	info, err := os.Stat(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode().Perm())
+
+	// a file put under a restored link by --dest-template is refused
+	src = filepath.Join(tmp, "src2")
+	writeTestTree(t, src, map[string]string{"x": "evil"})
+	assert.Nil(t, os.Symlink(outside, filepath.Join(src, "d")))
+	out = filepath.Join(tmp, "out2")
+	domix = &DomixOptions{KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	demix = &DemixOptions{Output: filepath.Join(tmp, "demix2"), DestTemplate: `{{if eq .Name "d"}}d{{else}}d/{{.Name}}{{end}}`, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.ErrorIs(t, demix.Run(), emix.ErrUnsafeFileName)
+	entries, err := os.ReadDir(outside)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// syncFile flush the file to disk, replaced in tests
+var syncFile = func(f *os.File) error {
+	return f.Sync()
+}
+
+// syncDir flush the entries of directory dir to disk, e.g. a created or renamed file
+func syncDir(dir string) error {
+	// directories can not be opened for sync on windows
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
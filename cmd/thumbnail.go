@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/icefed/emix"
+	"github.com/spf13/cobra"
+)
+
+type ThumbnailOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Output         string
+
+	emixFilePath string
+	password     [16]byte
+}
+
+func newCmdThumbnail() *cobra.Command {
+	o := &ThumbnailOptions{}
+	cmd := &cobra.Command{
+		Use:     "thumbnail <path>",
+		Short:   "extract the thumbnail of the emix file",
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output thumbnail file.")
+	cmd.MarkFlagRequired("output")
+	return cmd
+}
+
+func (o *ThumbnailOptions) Validate(emixFilePath string) error {
+	info, err := os.Stat(emixFilePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("path %s is not a regular file", emixFilePath)
+	}
+	o.emixFilePath = filepath.Clean(emixFilePath)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+
+	return nil
+}
+
+func (o *ThumbnailOptions) Run() error {
+	f, err := os.Open(o.emixFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ok, err := emix.IsEmixFile(f)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not emix file")
+	}
+
+	emixHeader := &emix.EmixHeader{}
+	copy(emixHeader.Password[:], o.password[:])
+	err = emixHeader.UnmarshalFromFile(f)
+	if err != nil {
+		return err
+	}
+	if len(emixHeader.FileInfo.Preview) == 0 {
+		return errors.New("no thumbnail in emix file")
+	}
+
+	return os.WriteFile(o.Output, emixHeader.FileInfo.Preview, 0644)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type TouchOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	// RFC3339 time or now
+	ModifyTime string
+	CreateTime string
+
+	emixFilePath string
+	password     [16]byte
+	modifyTime   time.Time
+	createTime   time.Time
+}
+
+func newCmdTouch() *cobra.Command {
+	o := &TouchOptions{}
+	cmd := &cobra.Command{
+		Use:     "touch <path>",
+		Short:   "update the stored times of the emix file without re-mixing",
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVar(&o.ModifyTime, "mtime", "", "Set modify time, RFC3339 format or now.")
+	cmd.Flags().StringVar(&o.CreateTime, "ctime", "", "Set create time, RFC3339 format or now.")
+	return cmd
+}
+
+func (o *TouchOptions) Validate(emixFilePath string) error {
+	info, err := os.Stat(emixFilePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("path %s is not a regular file", emixFilePath)
+	}
+	o.emixFilePath = filepath.Clean(emixFilePath)
+
+	if o.ModifyTime == "" && o.CreateTime == "" {
+		return errors.New("need --mtime or --ctime")
+	}
+	if o.ModifyTime != "" {
+		if o.modifyTime, err = parseTouchTime(o.ModifyTime); err != nil {
+			return fmt.Errorf("invalid --mtime: %v", err)
+		}
+	}
+	if o.CreateTime != "" {
+		if o.createTime, err = parseTouchTime(o.CreateTime); err != nil {
+			return fmt.Errorf("invalid --ctime: %v", err)
+		}
+	}
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+
+	return nil
+}
+
+// parseTouchTime parse RFC3339 time or now
+func parseTouchTime(s string) (time.Time, error) {
+	if s == "now" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (o *TouchOptions) Run() error {
+	f, err := os.OpenFile(o.emixFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	emixHeader, err := emix.ReadHeader(f, o.password)
+	if err != nil {
+		return err
+	}
+	if o.ModifyTime != "" {
+		emixHeader.FileInfo.ModifyTime = uint64(o.modifyTime.UnixNano())
+	}
+	if o.CreateTime != "" {
+		emixHeader.FileInfo.CreateTime = uint64(o.createTime.UnixNano())
+	}
+	if err := emix.RewriteHeader(f, emixHeader); err != nil {
+		return fmt.Errorf("Rewrite emix header error: %v", err)
+	}
+	return nil
+}
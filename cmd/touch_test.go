@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTouch(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mixType := range []int{0, 1, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			MixType:  mixType,
+			KeepName: true,
+			Output:   out,
+			Silence:  true,
+		}
+		touch := &TouchOptions{
+			ModifyTime: "2020-01-02T03:04:05Z",
+			CreateTime: "2019-01-02T03:04:05+08:00",
+		}
+		stat := &StatOptions{}
+		if mixType != 0 {
+			domix.CredentialFile = credentialFile
+			touch.CredentialFile = credentialFile
+			stat.CredentialFile = credentialFile
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		path := filepath.Join(out, "a.txt")
+		assert.Nil(t, touch.Validate(path))
+		assert.Nil(t, touch.Run())
+
+		buf := bytes.NewBuffer(nil)
+		assert.Nil(t, stat.Validate(path))
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		modifyTime, _ := time.Parse(time.RFC3339, "2020-01-02T03:04:05Z")
+		createTime, _ := time.Parse(time.RFC3339, "2019-01-02T03:04:05+08:00")
+		assert.Contains(t, buf.String(), time.Unix(0, modifyTime.UnixNano()).String())
+		assert.Contains(t, buf.String(), time.Unix(0, createTime.UnixNano()).String())
+		assert.NotContains(t, buf.String(), "Warning")
+
+		// content is intact
+		verify := &VerifyOptions{CredentialFile: touch.CredentialFile}
+		assert.Nil(t, verify.Validate(path))
+		verify.out = buf
+		assert.Nil(t, verify.Run())
+	}
+
+	assert.NotNil(t, (&TouchOptions{}).Validate(src))
+	assert.NotNil(t, (&TouchOptions{ModifyTime: "yesterday"}).Validate(src))
+}
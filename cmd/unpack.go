@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type UnpackOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Output         string
+	// only extract entries whose path is under the prefix
+	PathPrefix string
+	// write full content of hard link entries instead of recreating the links
+	NoHardlinks bool
+	Silence     bool
+
+	source   string
+	password [16]byte
+}
+
+func newCmdUnpack() *cobra.Command {
+	o := &UnpackOptions{}
+	cmd := &cobra.Command{
+		Use:     "unpack <path>",
+		Short:   "unpack the files of the emix bundle.",
+		Long:    ``,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output directory, default is emix_%datetime(format: 2006-01-02 15.04.05).")
+	cmd.Flags().StringVar(&o.PathPrefix, "path-prefix", "", "Only extract entries whose path in bundle is or is under PREFIX, e.g. photos/2023, other entries are skipped.")
+	cmd.Flags().BoolVar(&o.NoHardlinks, "no-hardlinks", false, "Restore hard link entries as independent files, the content stored once in bundle is decrypted again for each link. By default links are recreated, or fall back to independent files when the target is not extracted or linking fails.")
+	cmd.Flags().BoolVar(&o.Silence, "silence", false, "Silence all output")
+	return cmd
+}
+
+func (o *UnpackOptions) Validate(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("path %s is not a regular file", source)
+	}
+	o.source = filepath.Clean(source)
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	// check output
+	if o.Output == "" {
+		o.Output = fmt.Sprintf("emix_%s", time.Now().Format("2006-01-02 15.04.05"))
+	}
+	o.Output = filepath.Clean(o.Output)
+	outDirStat, err := os.Stat(o.Output)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// create output directory
+		if err = os.MkdirAll(o.Output, 0755); err != nil {
+			return fmt.Errorf("create output directory error: %v", err)
+		}
+	} else if !outDirStat.Mode().IsDir() {
+		return fmt.Errorf("output should be a directory")
+	}
+	return nil
+}
+
+func (o *UnpackOptions) Run() error {
+	f, err := os.Open(o.source)
+	if err != nil {
+		return fmt.Errorf("Open source file error: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	br, err := emix.NewBundleReader(f, info.Size(), o.password)
+	if err != nil {
+		return err
+	}
+	var dirs []emix.BundleEntry
+	// extracted files by name in bundle, the targets of hard link entries
+	extracted := make(map[string]string)
+	for _, entry := range br.Entries() {
+		if !hasPathPrefix(entry.Header.FileInfo.Name, o.PathPrefix) {
+			continue
+		}
+		if entry.IsDir() {
+			if err := o.ExtractDir(entry); err != nil {
+				return err
+			}
+			dirs = append(dirs, entry)
+			continue
+		}
+		if entry.IsLink() && !o.NoHardlinks {
+			if target, ok := extracted[entry.Header.FileInfo.LinkTarget]; ok {
+				err := o.ExtractLink(entry, target)
+				if err == nil {
+					continue
+				}
+				debugf("link %s error, extract content instead: %v", entry.Header.FileInfo.Name, err)
+			}
+		}
+		if err := o.ExtractFile(br, entry); err != nil {
+			return err
+		}
+		extracted[entry.Header.FileInfo.Name] = filepath.Join(o.Output, entry.Path())
+	}
+	// apply directory modes and times after files are written, children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info := dirs[i].Header.FileInfo
+		dest := filepath.Join(o.Output, dirs[i].Path())
+		if err := os.Chmod(dest, fs.FileMode(info.Mode).Perm()); err != nil {
+			return err
+		}
+		modifyTime := time.Unix(0, int64(info.ModifyTime))
+		if err := os.Chtimes(dest, modifyTime, modifyTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractDir create the directory of entry, mode and times are applied by Run
+func (o *UnpackOptions) ExtractDir(entry emix.BundleEntry) error {
+	dest := filepath.Join(o.Output, entry.Path())
+	if !o.Silence {
+		fmt.Fprint(os.Stdout, o.source, ":", entry.Header.FileInfo.Name, " -> ", dest, "\n")
+	}
+	if err := o.checkDir(dest); err != nil {
+		return err
+	}
+	return os.MkdirAll(dest, 0755)
+}
+
+// ExtractLink create dest of the hard link entry as a link of the extracted target
+func (o *UnpackOptions) ExtractLink(entry emix.BundleEntry, target string) error {
+	dest := filepath.Join(o.Output, entry.Path())
+	if !o.Silence {
+		fmt.Fprint(os.Stdout, o.source, ":", entry.Header.FileInfo.Name, " -> ", dest, " (link to ", target, ")\n")
+	}
+	if err := o.checkDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Link(target, dest)
+}
+
+// ExtractFile write the content of entry to a temporary file and rename it to dest once its content hash
+// is verified, so a file at dest is always complete and an existing symlink at dest is replaced, not followed
+func (o *UnpackOptions) ExtractFile(br *emix.BundleReader, entry emix.BundleEntry) error {
+	dest := filepath.Join(o.Output, entry.Path())
+	if !o.Silence {
+		fmt.Fprint(os.Stdout, o.source, ":", entry.Header.FileInfo.Name, " -> ", dest, "\n")
+	}
+	if err := o.checkDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	targetFile, err := createTemp(dest)
+	if err != nil {
+		return err
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			os.Remove(targetFile.Name())
+		}
+	}()
+	defer targetFile.Close()
+
+	if err := br.Extract(entry, targetFile); err != nil {
+		return fmt.Errorf("Write file content error: %w", err)
+	}
+	if err := targetFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(targetFile.Name(), dest); err != nil {
+		return err
+	}
+	restored = true
+	return nil
+}
+
+// checkDir check that dir and no directory of it under Output is a symlink, bundles have no symlink entries
+// so a symlink is not restored, and nothing is written through one out of Output
+func (o *UnpackOptions) checkDir(dir string) error {
+	dir, err := symlinkDir(o.Output, dir)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		return fmt.Errorf("%w: directory %s is a symlink", emix.ErrUnsafeFileName, dir)
+	}
+	return nil
+}
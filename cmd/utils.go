@@ -7,6 +7,7 @@ import (
 	"time"
 )
 
-func getFileCreateTime(fileinfo fs.FileInfo) time.Time {
+func getFileCreateTime(path string, fileinfo fs.FileInfo) time.Time {
+	debugf("create time of %s is unavailable, use modify time", fileinfo.Name())
 	return fileinfo.ModTime()
 }
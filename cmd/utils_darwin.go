@@ -8,9 +8,17 @@ import (
 	"time"
 )
 
-func getFileCreateTime(fileinfo fs.FileInfo) time.Time {
-	if stat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
-		return time.Unix(int64(stat.Ctimespec.Sec), int64(stat.Ctimespec.Nsec))
+// getFileCreateTime return the birth time of file, the modify time if it is unavailable, path is not used
+func getFileCreateTime(path string, fileinfo fs.FileInfo) time.Time {
+	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		debugf("create time of %s is unavailable, use modify time", fileinfo.Name())
+		return fileinfo.ModTime()
 	}
-	return fileinfo.ModTime()
+	// zero if the filesystem does not record it
+	if stat.Birthtimespec.Sec == 0 && stat.Birthtimespec.Nsec == 0 {
+		debugf("create time of %s is not recorded by filesystem, use modify time", fileinfo.Name())
+		return fileinfo.ModTime()
+	}
+	return time.Unix(int64(stat.Birthtimespec.Sec), int64(stat.Birthtimespec.Nsec))
 }
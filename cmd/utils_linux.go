@@ -4,13 +4,27 @@ package main
 
 import (
 	"io/fs"
-	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-func getFileCreateTime(fileinfo fs.FileInfo) time.Time {
-	if stat, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
-		return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+// getFileCreateTime return the birth time of the file at path by statx, the inode change time of stat is not
+// a create time. The modify time is returned if path is empty, e.g. a file of an fs.FS, or the birth time is unavailable
+func getFileCreateTime(path string, fileinfo fs.FileInfo) time.Time {
+	if path == "" {
+		debugf("create time of %s is unavailable, use modify time", fileinfo.Name())
+		return fileinfo.ModTime()
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		debugf("statx of %s error: %v, use modify time", path, err)
+		return fileinfo.ModTime()
+	}
+	// old kernels and some filesystems do not record it
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		debugf("create time of %s is not recorded by filesystem, use modify time", path)
+		return fileinfo.ModTime()
 	}
-	return fileinfo.ModTime()
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/icefed/emix"
+)
+
+func TestDomixBirthTime(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("a"), 0644))
+	// change the modify time, the birth time and inode change time stay close to now
+	modTime := time.Unix(1600000000, 0)
+	assert.Nil(t, os.Chtimes(src, modTime, modTime))
+
+	var stx unix.Statx_t
+	assert.Nil(t, unix.Statx(unix.AT_FDCWD, src, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME|unix.STATX_CTIME, &stx))
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{KeepName: true, EmbedPassword: true, MixType: 1, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+	assert.Nil(t, err)
+
+	createTime := time.Unix(0, int64(header.FileInfo.CreateTime))
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		// fall back to modify time, not the inode change time
+		assert.True(t, modTime.Equal(createTime), "create time %v", createTime)
+		return
+	}
+	assert.True(t, time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)).Equal(createTime), "create time %v", createTime)
+
+	// a file of fs.FS has no path to statx
+	info, err := os.Stat(src)
+	assert.Nil(t, err)
+	assert.True(t, modTime.Equal(getFileCreateTime("", info)))
+}
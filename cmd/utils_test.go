@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFileInfo is a fs.FileInfo with the given Sys
+type fakeFileInfo struct {
+	fs.FileInfo
+	modTime time.Time
+	sys     any
+}
+
+func (f fakeFileInfo) Name() string       { return "fake.txt" }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) Sys() any           { return f.sys }
+
+func TestGetFileCreateTimeFallback(t *testing.T) {
+	modTime := time.Unix(1700000000, 123)
+	buf := bytes.NewBuffer(nil)
+	defer func(w io.Writer) { debugOut = w }(debugOut)
+	debugOut = buf
+	t.Setenv(debugEnv, "1")
+
+	assert.True(t, modTime.Equal(getFileCreateTime("", fakeFileInfo{modTime: modTime})))
+	assert.Contains(t, buf.String(), "fake.txt")
+
+	// no log without EMIX_DEBUG
+	t.Setenv(debugEnv, "")
+	buf.Reset()
+	getFileCreateTime("", fakeFileInfo{modTime: modTime})
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFileCreateTimeZero(t *testing.T) {
+	modTime := time.Unix(1700000000, 123)
+	// the filesystem does not record create time
+	createTime := getFileCreateTime("", fakeFileInfo{modTime: modTime, sys: &syscall.Stat_t{}})
+	assert.True(t, modTime.Equal(createTime))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type VerifyOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+	Excludes       []string
+	// only check header and content size, do not read content
+	Quick bool
+	// check the mac of the whole file, files without it fail
+	FullMAC bool
+	// only check chunks covering the byte range OFFSET:LENGTH of content
+	Range string
+
+	source      string
+	sourceIsDir bool
+
+	password      [16]byte
+	ignoreMatcher *ignore.GitIgnore
+	ciphers       *emix.CipherCache
+	rangeOffset   int64
+	rangeLength   int64
+
+	out    io.Writer
+	total  int
+	failed int
+}
+
+func newCmdVerify() *cobra.Command {
+	o := &VerifyOptions{}
+	cmd := &cobra.Command{
+		Use:     "verify <path>",
+		Short:   "verify the integrity of emix files without extracting.",
+		Long:    ``,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	cmd.Flags().StringSliceVarP(&o.Excludes, "excludes", "e", defaultExcludes(), "Exclude files matching PATTERN if <path> is directory, gitignore style. default use `.*` to ignore hidden files, extra default patterns can be set by EMIX_EXCLUDES. Multi patterns can be separated by comma.")
+	cmd.Flags().BoolVar(&o.Quick, "quick", false, "Quick check, only verify the header hash and content size without reading content.")
+	cmd.Flags().StringVar(&o.Range, "range", "", "Only check the content chunks covering the byte range OFFSET:LENGTH by the chunk hashes recorded by domix --chunk-hashes, files without them fail.")
+	cmd.Flags().BoolVar(&o.FullMAC, "full-mac", false, "Check the HMAC-SHA256 of the whole file appended by domix --file-mac, files without it fail. Needs the password.")
+	return cmd
+}
+
+func (o *VerifyOptions) Validate(source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	o.source = filepath.Clean(source)
+	if info.IsDir() {
+		o.sourceIsDir = true
+	}
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Range != "" {
+		if o.Quick {
+			return errors.New("can not set both --range and --quick")
+		}
+		offset, length, ok := strings.Cut(o.Range, ":")
+		var err error
+		if ok {
+			o.rangeOffset, err = strconv.ParseInt(offset, 10, 64)
+		}
+		if ok && err == nil {
+			o.rangeLength, err = strconv.ParseInt(length, 10, 64)
+		}
+		if !ok || err != nil || o.rangeOffset < 0 || o.rangeLength < 0 {
+			return errors.New("invalid --range, must be OFFSET:LENGTH in bytes, e.g. 1048576:4096")
+		}
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	o.ciphers = emix.NewCipherCache()
+
+	// ignore
+	if len(o.Excludes) != 0 {
+		matcher, err := compilePatterns(o.Excludes)
+		if err != nil {
+			return err
+		}
+		o.ignoreMatcher = matcher
+	}
+	o.out = os.Stdout
+	return nil
+}
+
+func (o *VerifyOptions) Run() error {
+	o.total, o.failed = 0, 0
+	if o.Quick {
+		fmt.Fprintln(o.out, "Quick check: only header and content size are verified, content is not read.")
+	}
+	if o.sourceIsDir {
+		err := filepath.Walk(o.source, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// check exclude pattern
+			if o.ignoreMatcher != nil && o.ignoreMatcher.MatchesPath(path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// skip directory path and nonsupport file type
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			return o.verify(path)
+		})
+		if err != nil {
+			return err
+		}
+	} else if err := o.verify(o.source); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "%d files, %d ok, %d failed\n", o.total, o.total-o.failed, o.failed)
+	if o.failed > 0 {
+		return fmt.Errorf("%d files failed verification", o.failed)
+	}
+	return nil
+}
+
+// verify report the result of file, non-emix files are ignored
+func (o *VerifyOptions) verify(path string) error {
+	ok, err := emix.IsEmixFileByPath(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	o.total++
+	status := "OK"
+	if o.Quick {
+		status = "OK (quick)"
+	}
+	if o.Range != "" {
+		status = "OK (range " + o.Range + ")"
+	}
+	if err := o.VerifyFile(path); err != nil {
+		o.failed++
+		fmt.Fprintf(o.out, "FAIL %s: %v\n", path, err)
+		return nil
+	}
+	fmt.Fprintf(o.out, "%s %s\n", status, path)
+	return nil
+}
+
+// VerifyFile check header and content of emix file, content is decrypted to recompute
+// the content hash unless Quick is set
+func (o *VerifyOptions) VerifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	emixHeader := &emix.EmixHeader{
+		Password: o.password,
+		Ciphers:  o.ciphers,
+	}
+	if err := emixHeader.UnmarshalFromFile(f); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+
+	// content size
+	contentSize := emixHeader.CiphertextSize()
+	// content of a split file is in the content file beside it, which has no trailer
+	content, contentOffset, trailerLength := f, emixHeader.ContentOffset(), emixHeader.TrailerLength()
+	if emixHeader.FileInfo.Detached {
+		if content, err = emix.OpenDetachedContent(path, emixHeader); err != nil {
+			return fmt.Errorf("invalid content file: %v", err)
+		}
+		defer content.Close()
+		if info, err = content.Stat(); err != nil {
+			return err
+		}
+		contentOffset, trailerLength = emix.DetachedContentOffset, 0
+	}
+	if actual := info.Size() - contentOffset - trailerLength; actual != contentSize {
+		return fmt.Errorf("content size mismatch, expected %d bytes, got %d bytes", contentSize, actual)
+	}
+	if o.FullMAC {
+		if err := emix.VerifyFileMAC(f, info.Size(), emixHeader); err != nil {
+			return err
+		}
+	}
+	if o.Quick {
+		return nil
+	}
+	if o.Range != "" {
+		if emixHeader.FileInfo.Detached {
+			return errors.New("--range does not support split files")
+		}
+		return emix.VerifyContentRange(f, emixHeader, o.rangeOffset, o.rangeLength)
+	}
+
+	// content hash, transformed content is decoded to check its original size
+	hash := emixHeader.NewContentHash()
+	w := io.Writer(hash)
+	var decoder io.WriteCloser
+	decoded := &countWriter{}
+	if len(emixHeader.FileInfo.Transforms) > 0 && emixHeader.FileInfo.OriginalSize != 0 {
+		if decoder, err = emix.NewDecodeContentWriter(decoded, emixHeader.FileInfo.Transforms); err != nil {
+			return err
+		}
+		defer decoder.Close()
+		w = io.MultiWriter(hash, decoder)
+	}
+	content.Seek(contentOffset, io.SeekStart)
+	if emixHeader.EncryptData {
+		cipher, err := emixHeader.NewContentCipher()
+		if err != nil {
+			return err
+		}
+		err = emix.DecryptContentWithSectorSize(cipher, content, w, int64(emixHeader.FileInfo.Size), emixHeader.ContentSectorSize())
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := emix.CopyContent(w, content, int64(emixHeader.FileInfo.Size)); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(emixHeader.FileInfo.FileContentHash[:], hash.Sum(nil)) {
+		return errors.New("content hash mismatch")
+	}
+	if decoder != nil {
+		if err := decoder.Close(); err != nil {
+			return fmt.Errorf("decode content error: %v", err)
+		}
+		if uint64(decoded.n) != emixHeader.FileInfo.OriginalSize {
+			return fmt.Errorf("original size mismatch, expected %d bytes, got %d bytes", emixHeader.FileInfo.OriginalSize, decoded.n)
+		}
+	}
+	return nil
+}
+
+// countWriter count the bytes written and discard them
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+
+	"github.com/icefed/emix"
+)
+
+type VerifyManifestOptions struct {
+	// read password from stdin if Password is true
+	Password       bool
+	CredentialFile string
+
+	manifestPath string
+	dir          string
+	manifest     *Manifest
+
+	password [16]byte
+	ciphers  *emix.CipherCache
+
+	out io.Writer
+}
+
+func newCmdVerifyManifest() *cobra.Command {
+	o := &VerifyManifestOptions{}
+	cmd := &cobra.Command{
+		Use:     "verify-manifest <manifest> <dir>",
+		Short:   "verify the emix files of the directory against a domix manifest.",
+		Long:    ``,
+		GroupID: "general",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(o.Validate(args[0], args[1]))
+			cobra.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().BoolVarP(&o.Password, "password", "p", false, "Use password to decrypt file info and check the manifest checksum. Conflicts with --credential-file.")
+	cmd.Flags().StringVar(&o.CredentialFile, "credential-file", "", "Use a credential file as password. Conflicts with --password.")
+	return cmd
+}
+
+func (o *VerifyManifestOptions) Validate(manifestPath, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path %s is not a directory", dir)
+	}
+	o.dir = filepath.Clean(dir)
+	o.manifestPath = filepath.Clean(manifestPath)
+	o.manifest, err = readManifest(o.manifestPath)
+	if err != nil {
+		return err
+	}
+
+	if o.Password && o.CredentialFile != "" {
+		return errors.New("can not set both --password and --credential-file")
+	}
+	if o.Password {
+		// input password
+		password, err := inputPassword()
+		if err != nil {
+			return err
+		}
+
+		o.password = emix.PasswordKey(password)
+	}
+	if o.CredentialFile != "" {
+		password, err := emix.GeneratePasswordFromFile(o.CredentialFile)
+		if err != nil {
+			return err
+		}
+		copy(o.password[:], password)
+	}
+	// the checksum is checked before entries are trusted, manifests of older versions have none
+	if err := o.manifest.verify(o.password); err != nil {
+		if !errors.Is(err, errManifestNoChecksum) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s has no checksum, it may be written by an older version, its integrity is not verified\n", o.manifestPath)
+	}
+	o.ciphers = emix.NewCipherCache()
+	o.out = os.Stdout
+	return nil
+}
+
+func (o *VerifyManifestOptions) Run() error {
+	// files of directory
+	files := make(map[string]bool)
+	manifestAbs, _ := filepath.Abs(o.manifestPath)
+	err := filepath.WalkDir(o.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// skip the manifest if it is stored in the directory
+		if abs, _ := filepath.Abs(path); abs == manifestAbs {
+			return nil
+		}
+		rel, err := filepath.Rel(o.dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	missing, mismatched := 0, 0
+	for _, entry := range o.manifest.Entries {
+		if !files[entry.Output] {
+			missing++
+			fmt.Fprintf(o.out, "MISSING %s\n", entry.Output)
+			continue
+		}
+		delete(files, entry.Output)
+		if err := o.verifyEntry(entry); err != nil {
+			mismatched++
+			fmt.Fprintf(o.out, "MISMATCH %s: %v\n", entry.Output, err)
+			continue
+		}
+		fmt.Fprintf(o.out, "OK %s\n", entry.Output)
+	}
+	// sort extra files for stable output
+	extra := make([]string, 0, len(files))
+	for path := range files {
+		extra = append(extra, path)
+	}
+	slices.Sort(extra)
+	for _, path := range extra {
+		fmt.Fprintf(o.out, "EXTRA %s\n", path)
+	}
+
+	fmt.Fprintf(o.out, "%d entries, %d missing, %d mismatched, %d extra\n", len(o.manifest.Entries), missing, mismatched, len(extra))
+	if missing+mismatched+len(extra) > 0 {
+		return errors.New("directory does not match manifest")
+	}
+	return nil
+}
+
+// verifyEntry compare the header of output with manifest entry, content is not read
+func (o *VerifyManifestOptions) verifyEntry(entry ManifestEntry) error {
+	f, err := os.Open(filepath.Join(o.dir, filepath.FromSlash(entry.Output)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := &emix.EmixHeader{
+		Password: o.password,
+		Ciphers:  o.ciphers,
+	}
+	if err := header.UnmarshalFromFile(f); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+	info := header.FileInfo
+	if info.Name != entry.Name {
+		return fmt.Errorf("name mismatch, expected %s, got %s", entry.Name, info.Name)
+	}
+	if info.Size != entry.Size {
+		return fmt.Errorf("size mismatch, expected %d, got %d", entry.Size, info.Size)
+	}
+	if hash := hex.EncodeToString(info.FileContentHash[:]); hash != entry.SHA256 {
+		return fmt.Errorf("content hash mismatch, expected %s, got %s", entry.SHA256, hash)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt":   "a",
+		"b/c.txt": "c",
+		"b/d.txt": "d",
+		"e.txt":   "e",
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	out := filepath.Join(tmp, "out")
+	manifest := filepath.Join(tmp, "manifest.json")
+	domix := &DomixOptions{
+		MixType:        1,
+		CredentialFile: credentialFile,
+		KeepName:       true,
+		Output:         out,
+		Manifest:       manifest,
+		Silence:        true,
+	}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	m, err := readManifest(manifest)
+	assert.Nil(t, err)
+	assert.Len(t, m.Entries, 4)
+
+	verify := &VerifyManifestOptions{CredentialFile: credentialFile}
+	assert.Nil(t, verify.Validate(manifest, out))
+	buf := bytes.NewBuffer(nil)
+	verify.out = buf
+	assert.Nil(t, verify.Run())
+	assert.Contains(t, buf.String(), "4 entries, 0 missing, 0 mismatched, 0 extra")
+
+	// replace a file with another emix file, remove a file and add an unexpected file
+	data, err := os.ReadFile(filepath.Join(out, "b", "d.txt"))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(out, "b", "c.txt"), data, 0644))
+	assert.Nil(t, os.Remove(filepath.Join(out, "e.txt")))
+	assert.Nil(t, os.WriteFile(filepath.Join(out, "f.txt"), []byte("f"), 0644))
+
+	buf.Reset()
+	assert.NotNil(t, verify.Run())
+	assert.Contains(t, buf.String(), "OK a.txt")
+	assert.Contains(t, buf.String(), "MISMATCH b/c.txt: name mismatch")
+	assert.Contains(t, buf.String(), "MISSING e.txt")
+	assert.Contains(t, buf.String(), "EXTRA f.txt")
+	assert.Contains(t, buf.String(), "4 entries, 1 missing, 1 mismatched, 1 extra")
+
+	// without password the keyed checksum can not be checked
+	verify = &VerifyManifestOptions{}
+	assert.ErrorIs(t, verify.Validate(manifest, out), errManifestChecksumMismatch)
+}
+
+func TestVerifyManifestChecksum(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, keyed := range []bool{false, true} {
+		out := filepath.Join(tmp, fmt.Sprintf("out-%t", keyed))
+		manifest := filepath.Join(tmp, fmt.Sprintf("manifest-%t.json", keyed))
+		domix := &DomixOptions{KeepName: true, Output: out, Manifest: manifest, Silence: true}
+		if keyed {
+			domix.MixType = 1
+			domix.CredentialFile = credentialFile
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		m, err := readManifest(manifest)
+		assert.Nil(t, err)
+		prefix := manifestChecksumSHA256
+		if keyed {
+			prefix = manifestChecksumHMAC
+		}
+		assert.True(t, strings.HasPrefix(m.Checksum, prefix), m.Checksum)
+		verify := &VerifyManifestOptions{}
+		if keyed {
+			verify.CredentialFile = credentialFile
+		}
+		assert.Nil(t, verify.Validate(manifest, out))
+
+		// tamper with an entry and keep the json valid
+		m.Entries[0].Size++
+		data, err := json.Marshal(m)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(manifest, data, 0644))
+		assert.ErrorIs(t, verify.Validate(manifest, out), errManifestChecksumMismatch)
+
+		// a keyed checksum can not be replaced by a plain one
+		if keyed {
+			m.Checksum, err = manifestChecksum(m.Entries, [16]byte{})
+			assert.Nil(t, err)
+			data, err := json.Marshal(m)
+			assert.Nil(t, err)
+			assert.Nil(t, os.WriteFile(manifest, data, 0644))
+			assert.ErrorIs(t, verify.Validate(manifest, out), errManifestChecksumMismatch)
+		}
+	}
+}
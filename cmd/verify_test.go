@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/icefed/emix"
+)
+
+func TestVerify(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"good.txt":      strings.Repeat("good", 2000),
+		"corrupted.txt": strings.Repeat("corrupted", 2000),
+		"truncated.txt": strings.Repeat("truncated", 2000),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	for _, mixType := range []int{0, 2} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			MixType:  mixType,
+			KeepName: true,
+			Output:   out,
+			Silence:  true,
+		}
+		verify := &VerifyOptions{}
+		if mixType != 0 {
+			domix.CredentialFile = credentialFile
+			verify.CredentialFile = credentialFile
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		assert.Nil(t, os.WriteFile(filepath.Join(out, "other.txt"), []byte("not emix"), 0644))
+
+		// all files are intact
+		for _, quick := range []bool{false, true} {
+			verify.Quick = quick
+			assert.Nil(t, verify.Validate(out))
+			buf := bytes.NewBuffer(nil)
+			verify.out = buf
+			assert.Nil(t, verify.Run())
+			assert.Contains(t, buf.String(), "3 files, 3 ok, 0 failed")
+		}
+
+		// flip a content byte and truncate a file
+		corrupted := filepath.Join(out, "corrupted.txt")
+		data, err := os.ReadFile(corrupted)
+		assert.Nil(t, err)
+		data[len(data)-9000] ^= 0xff
+		assert.Nil(t, os.WriteFile(corrupted, data, 0644))
+		truncated := filepath.Join(out, "truncated.txt")
+		info, err := os.Stat(truncated)
+		assert.Nil(t, err)
+		assert.Nil(t, os.Truncate(truncated, info.Size()-100))
+
+		// full check detects both
+		verify.Quick = false
+		assert.Nil(t, verify.Validate(out))
+		buf := bytes.NewBuffer(nil)
+		verify.out = buf
+		assert.NotNil(t, verify.Run())
+		assert.Contains(t, buf.String(), "OK "+filepath.Join(out, "good.txt"))
+		// encrypted content is authenticated by the file mac before the content hash
+		if mixType == 2 {
+			assert.Contains(t, buf.String(), "FAIL "+corrupted+": content authentication failed")
+		} else {
+			assert.Contains(t, buf.String(), "FAIL "+corrupted+": content hash mismatch")
+		}
+		assert.Contains(t, buf.String(), "FAIL "+truncated+": content size mismatch")
+		assert.Contains(t, buf.String(), "3 files, 1 ok, 2 failed")
+
+		// quick check only detects the size mismatch
+		verify.Quick = true
+		assert.Nil(t, verify.Validate(out))
+		buf.Reset()
+		verify.out = buf
+		assert.NotNil(t, verify.Run())
+		assert.Contains(t, buf.String(), "Quick check")
+		assert.Contains(t, buf.String(), "OK (quick) "+corrupted)
+		assert.Contains(t, buf.String(), "FAIL "+truncated+": content size mismatch")
+		assert.Contains(t, buf.String(), "3 files, 2 ok, 1 failed")
+	}
+}
+
+func TestVerifyFullMAC(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": strings.Repeat("a", 10000),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	// encrypted content always has the file mac
+	for _, test := range []struct {
+		mixType int
+		fileMAC bool
+	}{
+		{1, false}, {1, true}, {2, false},
+	} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{
+			CredentialFile: credentialFile,
+			MixType:        test.mixType,
+			FileMAC:        test.fileMAC,
+			KeepName:       true,
+			Output:         out,
+			Silence:        true,
+		}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		path := filepath.Join(out, "a.txt")
+
+		// demix and the size check skip the mac trailer
+		stat := &StatOptions{CredentialFile: credentialFile}
+		assert.Nil(t, stat.Validate(path))
+		buf := bytes.NewBuffer(nil)
+		stat.out = buf
+		assert.Nil(t, stat.Run())
+		assert.NotContains(t, buf.String(), "Warning")
+		demix := &DemixOptions{CredentialFile: credentialFile, Output: filepath.Join(tmp, "demix"), Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, filepath.Join(tmp, "demix")))
+
+		verify := &VerifyOptions{CredentialFile: credentialFile, FullMAC: true}
+		assert.Nil(t, verify.Validate(out))
+		buf.Reset()
+		verify.out = buf
+		if !test.fileMAC && test.mixType != 2 {
+			assert.NotNil(t, verify.Run())
+			assert.Contains(t, buf.String(), "no file mac")
+			continue
+		}
+		assert.Nil(t, verify.Run())
+
+		// touch keeps the mac valid
+		touch := &TouchOptions{CredentialFile: credentialFile, ModifyTime: "now"}
+		assert.Nil(t, touch.Validate(path))
+		assert.Nil(t, touch.Run())
+		buf.Reset()
+		assert.Nil(t, verify.Run())
+
+		// a flipped byte of content is detected by the mac before the content hash
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		data[len(data)-emix.FileMACLength-1] ^= 0x01
+		assert.Nil(t, os.WriteFile(path, data, 0644))
+		verify.FullMAC = false
+		buf.Reset()
+		assert.NotNil(t, verify.Run())
+		if test.mixType == 2 {
+			assert.Contains(t, buf.String(), "content authentication failed")
+		} else {
+			assert.Contains(t, buf.String(), "content hash mismatch")
+		}
+		verify.FullMAC = true
+		buf.Reset()
+		assert.NotNil(t, verify.Run())
+		assert.Contains(t, buf.String(), "file mac mismatch")
+	}
+}
+
+func TestVerifyRange(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{
+		"a.txt": strings.Repeat("a", 3*emix.DefaultChunkSize+10),
+	})
+	credentialFile := filepath.Join(tmp, "credential")
+	assert.Nil(t, os.WriteFile(credentialFile, []byte("credential"), 0600))
+
+	out := filepath.Join(tmp, "out")
+	domix := &DomixOptions{CredentialFile: credentialFile, MixType: 2, ChunkHashes: true, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	path := filepath.Join(out, "a.txt")
+	header, err := emix.ReadHeaderFromPath(path, domix.password)
+	assert.Nil(t, err)
+	assert.Len(t, header.FileInfo.ChunkHashes, 4)
+
+	verifyRange := func(r string) (string, error) {
+		verify := &VerifyOptions{CredentialFile: credentialFile, Range: r}
+		assert.Nil(t, verify.Validate(path))
+		buf := bytes.NewBuffer(nil)
+		verify.out = buf
+		err := verify.Run()
+		return buf.String(), err
+	}
+	output, err := verifyRange(fmt.Sprintf("%d:100", 2*emix.DefaultChunkSize))
+	assert.Nil(t, err)
+	assert.Contains(t, output, "OK (range")
+
+	// corrupt the third chunk
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("corrupted"), header.ContentOffset()+2*emix.DefaultChunkSize+100)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	output, err = verifyRange(fmt.Sprintf("%d:100", 2*emix.DefaultChunkSize))
+	assert.NotNil(t, err)
+	assert.Contains(t, output, "chunk hash mismatch")
+	_, err = verifyRange("0:100")
+	assert.Nil(t, err)
+
+	for _, r := range []string{"100", "a:1", "-1:1", "1:-1"} {
+		assert.NotNil(t, (&VerifyOptions{Range: r}).Validate(path), r)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/icefed/emix"
+)
+
+// readSourceXattrs return the xattrs of source file to record, they are ignored if unavailable or too large
+func readSourceXattrs(path string) []emix.Xattr {
+	xattrs, err := emix.ReadXattrs(path)
+	if errors.Is(err, emix.ErrXattrsUnsupported) {
+		debugf("xattrs of %s are unavailable: %v", path, err)
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ignore xattrs of %s: %v\n", path, err)
+		return nil
+	}
+	if _, err := (&emix.FileInfo{Name: "xattrs", Xattrs: xattrs}).MarshalBinary(); err != nil {
+		fmt.Fprintf(os.Stderr, "Ignore xattrs of %s: %v\n", path, err)
+		return nil
+	}
+	return xattrs
+}
+
+// restoreXattrs set the recorded xattrs of restored file, an xattr which can not be set is ignored,
+// e.g. security.* without privileges or on a filesystem without xattrs, see restorableXattrs for the order
+func restoreXattrs(dest string, xattrs []emix.Xattr) {
+	for _, x := range restorableXattrs(xattrs) {
+		if err := emix.WriteXattr(dest, x); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignore xattr %s of %s: %v\n", x.Name, dest, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/icefed/emix"
+)
+
+func TestDomixXattrs(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+	err := unix.Setxattr(filepath.Join(src, "a.txt"), "user.comment", []byte("keep me"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem does not support user xattrs")
+	}
+	assert.Nil(t, err)
+
+	for _, noXattrs := range []bool{false, true} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, NoXattrs: noXattrs, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+		header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+		assert.Nil(t, err)
+		assert.Equal(t, noXattrs, len(header.FileInfo.Xattrs) == 0)
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		assert.Equal(t, readTestTree(t, src), readTestTree(t, demixOut))
+		value := make([]byte, 64)
+		n, err := unix.Getxattr(filepath.Join(demixOut, "a.txt"), "user.comment", value)
+		if noXattrs {
+			assert.ErrorIs(t, err, unix.ENODATA)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, "keep me", string(value[:n]))
+		}
+	}
+
+	// not restored with --no-xattrs
+	out := filepath.Join(tmp, "out")
+	demixOut := filepath.Join(tmp, "no-xattrs")
+	domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	demix := &DemixOptions{NoXattrs: true, Output: demixOut, Silence: true}
+	assert.Nil(t, demix.Validate(out))
+	assert.Nil(t, demix.Run())
+	_, err = unix.Getxattr(filepath.Join(demixOut, "a.txt"), "user.comment", make([]byte, 64))
+	assert.ErrorIs(t, err, unix.ENODATA)
+}
+
+// testACL return a POSIX ACL xattr value granting read to a named user
+func testACL() []byte {
+	acl := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{
+		{0x01, 6, 0xffffffff}, // user obj
+		{0x02, 4, 12345},      // named user
+		{0x04, 4, 0xffffffff}, // group obj
+		{0x10, 4, 0xffffffff}, // mask
+		{0x20, 4, 0xffffffff}, // other
+	} {
+		acl = binary.LittleEndian.AppendUint16(acl, entry.tag)
+		acl = binary.LittleEndian.AppendUint16(acl, entry.perm)
+		acl = binary.LittleEndian.AppendUint32(acl, entry.id)
+	}
+	return acl
+}
+
+func TestDomixACLs(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeTestTree(t, src, map[string]string{"a.txt": "a"})
+	acl := testACL()
+	err := unix.Setxattr(filepath.Join(src, "a.txt"), xattrACLAccess, acl, 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("filesystem does not support POSIX ACLs")
+	}
+	assert.Nil(t, err)
+
+	for _, noACLs := range []bool{false, true} {
+		out := filepath.Join(tmp, "out")
+		os.RemoveAll(out)
+		domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, Output: out, Silence: true}
+		assert.Nil(t, domix.Validate(src))
+		assert.Nil(t, domix.Run())
+
+		demixOut := filepath.Join(tmp, "demix")
+		os.RemoveAll(demixOut)
+		demix := &DemixOptions{NoACLs: noACLs, Output: demixOut, Silence: true}
+		assert.Nil(t, demix.Validate(out))
+		assert.Nil(t, demix.Run())
+		value := make([]byte, 256)
+		n, err := unix.Getxattr(filepath.Join(demixOut, "a.txt"), xattrACLAccess, value)
+		if noACLs {
+			assert.ErrorIs(t, err, unix.ENODATA)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, acl, value[:n])
+		}
+	}
+
+	// not recorded with domix --no-acls
+	out := filepath.Join(tmp, "no-acls")
+	domix := &DomixOptions{MixType: 1, EmbedPassword: true, KeepName: true, NoACLs: true, Output: out, Silence: true}
+	assert.Nil(t, domix.Validate(src))
+	assert.Nil(t, domix.Run())
+	header, err := emix.ReadHeaderFromPath(filepath.Join(out, "a.txt"), [16]byte{})
+	assert.Nil(t, err)
+	for _, x := range header.FileInfo.Xattrs {
+		assert.NotEqual(t, xattrACLAccess, x.Name)
+	}
+}
+
+func TestRestorableXattrs(t *testing.T) {
+	xattrs := []emix.Xattr{
+		{Name: xattrCapability},
+		{Name: "user.comment"},
+		{Name: xattrACLAccess},
+		{Name: "user.other"},
+	}
+	var names []string
+	for _, x := range restorableXattrs(xattrs) {
+		names = append(names, x.Name)
+	}
+	assert.Equal(t, []string{xattrACLAccess, "user.comment", "user.other", xattrCapability}, names)
+}
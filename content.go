@@ -1,10 +1,14 @@
 package emix
 
 import (
+	"bytes"
+	"crypto/aes"
 	"errors"
+	"fmt"
 	"io"
-
-	"golang.org/x/crypto/xts"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -13,16 +17,59 @@ const (
 
 	// SectorNumberStart as sector number for AES-XTS
 	SectorNumberStart = 1024
+
+	// MinSectorSize and MaxSectorSize bound the configurable sector size
+	MinSectorSize = 512
+	MaxSectorSize = 1024 * 1024
 )
 
-// EncryptContent encrypt file content using AES-XTS, read data from reader and write cipher data to writer
-func EncryptContent(cipher *xts.Cipher, reader io.Reader, writer io.Writer) error {
-	plainBuf := make([]byte, XTSSectorSize)
-	cipherBuf := make([]byte, XTSSectorSize)
+// ValidSectorSize check if n can be used as AES-XTS sector size,
+// n must be a power of two between MinSectorSize and MaxSectorSize
+func ValidSectorSize(n int) error {
+	if n < MinSectorSize || n > MaxSectorSize {
+		return fmt.Errorf("%w: %d, must be between %d and %d", ErrInvalidSectorSize, n, MinSectorSize, MaxSectorSize)
+	}
+	if n&(n-1) != 0 {
+		return fmt.Errorf("%w: %d, must be a power of two", ErrInvalidSectorSize, n)
+	}
+	return nil
+}
+
+// RecommendSectorSize pick a sector size by file size,
+// small files use 4K to limit padding, big files use larger sectors to reduce per-sector overhead
+func RecommendSectorSize(fileSize int64) int {
+	switch {
+	case fileSize < 16*1024*1024:
+		return XTSSectorSize
+	case fileSize < 1024*1024*1024:
+		return 64 * 1024
+	default:
+		return MaxSectorSize
+	}
+}
+
+// EncryptContent encrypt file content using AES-XTS or the content cipher of suite, read data from reader and write cipher data to writer
+func EncryptContent(cipher ContentCipher, reader io.Reader, writer io.Writer) error {
+	return EncryptContentWithSectorSize(cipher, reader, writer, XTSSectorSize)
+}
+
+// EncryptContentWithSectorSize is like EncryptContent but encrypt with the given sector size
+func EncryptContentWithSectorSize(cipher ContentCipher, reader io.Reader, writer io.Writer, sectorSize int) error {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return err
+	}
+	if stealsSectors(cipher) {
+		return encryptStolenContent(cipher, reader, writer, sectorSize)
+	}
+	plainBuf := make([]byte, sectorSize)
+	cipherBuf := make([]byte, sectorSize)
 	sectorNumber := uint64(SectorNumberStart)
 	for {
-		n, err := reader.Read(plainBuf)
+		// fill whole sectors even if reader returns short reads, sectors must stay aligned to content
+		n, err := io.ReadFull(reader, plainBuf)
 		if n > 0 {
+			// the last sector is padded with zero, so inputs shorter than an AES block are whole sectors too
+			clear(plainBuf[n:])
 			cipher.Encrypt(cipherBuf, plainBuf, sectorNumber)
 			_, e := writer.Write(cipherBuf)
 			if e != nil {
@@ -31,7 +78,7 @@ func EncryptContent(cipher *xts.Cipher, reader io.Reader, writer io.Writer) erro
 			sectorNumber++
 		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				break
 			}
 			return err
@@ -40,30 +87,355 @@ func EncryptContent(cipher *xts.Cipher, reader io.Reader, writer io.Writer) erro
 	return nil
 }
 
-// EncryptContent decrypt file content using AES-XTS, read cipher data from reader and write plain data to writer
-func DecryptContent(cipher *xts.Cipher, reader io.Reader, writer io.Writer, size int64) error {
-	plainBuf := make([]byte, XTSSectorSize)
-	cipherBuf := make([]byte, XTSSectorSize)
-	sectorNumber := uint64(SectorNumberStart)
-	for leftSize := size; leftSize > 0; leftSize = leftSize - XTSSectorSize {
-		n, err := reader.Read(cipherBuf)
-		if n > 0 && n < XTSSectorSize {
-			return ErrInvalidEmixFileContent
+// DecryptContent decrypt file content using AES-XTS, read cipher data from reader and write plain data to writer,
+// with the cipher of a file with file mac the trailer after content is read and ErrContentAuthFailed is returned
+// if the file is changed, nothing is written if reader is an io.Seeker, see NewContentCipher
+func DecryptContent(cipher ContentCipher, reader io.Reader, writer io.Writer, size int64) error {
+	return DecryptContentWithSectorSize(cipher, reader, writer, size, XTSSectorSize)
+}
+
+// DecryptContentWithSectorSize is like DecryptContent but decrypt with the given sector size
+func DecryptContentWithSectorSize(cipher ContentCipher, reader io.Reader, writer io.Writer, size int64, sectorSize int) error {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return err
+	}
+	if a, ok := cipher.(*authenticatedCipher); ok {
+		return a.decryptContent(reader, writer, size, sectorSize)
+	}
+	stolen := stealsSectors(cipher)
+	plainBuf := make([]byte, sectorSize+aes.BlockSize)
+	cipherBuf := make([]byte, sectorSize+aes.BlockSize)
+	sectors := sectorCount(stolen, size, sectorSize)
+	for sector := int64(0); sector < sectors; sector++ {
+		offset := sector * int64(sectorSize)
+		length := sectorLength(stolen, size, sectorSize, sector)
+		n, err := io.ReadFull(reader, cipherBuf[:length])
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// sectors before are fully read
+				return truncatedContentError(contentSize(stolen, size, sectorSize), offset+int64(n))
+			}
+			return err
 		}
-		if n == XTSSectorSize {
-			cipher.Decrypt(plainBuf, cipherBuf, sectorNumber)
-			_, e := writer.Write(plainBuf[:min(XTSSectorSize, leftSize)])
-			if e != nil {
-				return e
+		decryptSector(cipher, plainBuf[:length], cipherBuf[:length], uint64(SectorNumberStart+sector))
+		_, e := writer.Write(plainBuf[:min(int64(length), size-offset)])
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// DecryptContentParallel is like DecryptContent but decrypt sectors with workers concurrently, see
+// DecryptContentParallelWithSectorSize
+func DecryptContentParallel(cipher ContentCipher, r io.ReaderAt, w io.WriterAt, size int64, workers int) error {
+	return DecryptContentParallelWithSectorSize(cipher, r, w, size, workers, XTSSectorSize)
+}
+
+// DecryptContentParallelWithSectorSize decrypt size plain bytes of content from r to w, the sectors are split
+// into contiguous ranges decrypted by workers concurrently, GOMAXPROCS workers are used if workers is not positive.
+// Offsets of r are of the encrypted content and offsets of w are of the plain content, both start at 0,
+// use io.NewSectionReader and io.NewOffsetWriter for content in files. r and w must be safe for concurrent use,
+// e.g. *os.File. The last sector is written truncated to size.
+func DecryptContentParallelWithSectorSize(cipher ContentCipher, r io.ReaderAt, w io.WriterAt, size int64, workers int, sectorSize int) error {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	sectors := sectorCount(stealsSectors(cipher), size, sectorSize)
+	perWorker := (sectors + int64(workers) - 1) / int64(workers)
+	if perWorker == 0 {
+		return nil
+	}
+	errs := make([]error, (sectors+perWorker-1)/perWorker)
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			first := int64(i) * perWorker
+			errs[i] = decryptSectors(cipher, r, w, size, sectorSize, first, min(first+perWorker, sectors), &failed)
+			// other ranges keep going on truncated content, the first range truncated tells where content ends
+			if errs[i] != nil && !errors.Is(errs[i], ErrTruncatedContent) {
+				failed.Store(true)
 			}
-			sectorNumber++
+		}(i)
+	}
+	wg.Wait()
+	// the error of the first range is reported, e.g. where truncated content ends
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, errDecryptCanceled) {
+			return err
 		}
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+	}
+	return nil
+}
+
+// errDecryptCanceled stop a worker of DecryptContentParallel after another one failed
+var errDecryptCanceled = errors.New("decrypt canceled")
+
+// decryptSectors decrypt sectors in [first, last) of content, it stops early if failed is set
+func decryptSectors(cipher ContentCipher, r io.ReaderAt, w io.WriterAt, size int64, sectorSize int, first, last int64, failed *atomic.Bool) error {
+	stolen := stealsSectors(cipher)
+	plainBuf := make([]byte, sectorSize+aes.BlockSize)
+	cipherBuf := make([]byte, sectorSize+aes.BlockSize)
+	for sector := first; sector < last; sector++ {
+		if failed.Load() {
+			return errDecryptCanceled
+		}
+		offset := sector * int64(sectorSize)
+		length := sectorLength(stolen, size, sectorSize, sector)
+		n, err := r.ReadAt(cipherBuf[:length], offset)
+		if n < length {
+			if err == nil || errors.Is(err, io.EOF) {
+				return truncatedContentError(contentSize(stolen, size, sectorSize), offset+int64(n))
 			}
 			return err
 		}
+		decryptSector(cipher, plainBuf[:length], cipherBuf[:length], uint64(SectorNumberStart+sector))
+		if _, err := w.WriteAt(plainBuf[:min(int64(length), size-offset)], offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func truncatedContentError(expected, actual int64) error {
+	return fmt.Errorf("%w: %w, expected %d bytes, got %d bytes", ErrInvalidEmixFileContent, ErrTruncatedContent, expected, actual)
+}
+
+// EncryptedContentSize return the padded size of size plain bytes, version 3 content is not padded, see EmixHeader.CiphertextSize
+func EncryptedContentSize(size int64, sectorSize int) int64 {
+	sectors := (size + int64(sectorSize) - 1) / int64(sectorSize)
+	return sectors * int64(sectorSize)
+}
+
+// CheckContentScheme check if the content of src can be copied to dst verbatim,
+// both must use the same cipher suite, key, kdf, sector size and start sector,
+// with salted keys dst must use the same Salt as src, since version 4 also the same version and file mac
+func CheckContentScheme(dst, src *EmixHeader) error {
+	if dst.EncryptData != src.EncryptData {
+		return fmt.Errorf("%w: content encryption differs", ErrContentSchemeMismatch)
+	}
+	if !src.EncryptData {
+		return nil
+	}
+	if dst.CipherSuite != src.CipherSuite {
+		return fmt.Errorf("%w: cipher suite differs", ErrContentSchemeMismatch)
+	}
+	if dst.contentKey() != src.contentKey() || dst.SaltedKeys != src.SaltedKeys || !equalKDF(dst.KDF, src.KDF) {
+		return fmt.Errorf("%w: content key differs", ErrContentSchemeMismatch)
+	}
+	if dst.SaltedKeys && dst.Salt != src.Salt {
+		return fmt.Errorf("%w: content key salt differs", ErrContentSchemeMismatch)
+	}
+	if dst.ContentSectorSize() != src.ContentSectorSize() {
+		return fmt.Errorf("%w: sector size differs", ErrContentSchemeMismatch)
+	}
+	if dst.stealsSectors() != src.stealsSectors() {
+		return fmt.Errorf("%w: content padding differs", ErrContentSchemeMismatch)
+	}
+	// the content key is derived with them since version 4
+	dstSalt, err := dst.contentSalt()
+	if err != nil {
+		return err
+	}
+	srcSalt, err := src.contentSalt()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(dstSalt, srcSalt) {
+		return fmt.Errorf("%w: header version or file mac differs", ErrContentSchemeMismatch)
+	}
+	return nil
+}
+
+// CopyContent copy size bytes of raw content from src to dst without re-encrypting,
+// src must be positioned at the first sector so the sector numbering is preserved,
+// use CheckContentScheme to check the headers first
+func CopyContent(dst io.Writer, src io.Reader, size int64) error {
+	n, err := io.CopyN(dst, src, size)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return truncatedContentError(size, n)
+		}
+		return err
+	}
+	return nil
+}
+
+// contentReader decrypt content on demand, only the sector being read is decrypted
+type contentReader struct {
+	r          io.ReaderAt
+	base       int64
+	size       int64
+	sectorSize int
+	// nil if content is not encrypted
+	cipher ContentCipher
+	stolen bool
+
+	offset int64
+	// index of sector in plainBuf, -1 if none
+	sector    int64
+	plainBuf  []byte
+	cipherBuf []byte
+}
+
+// OpenContent return a reader of the plain content, r is the whole emix file and header is read from it,
+// the password of header is used to decrypt content. Seek maps offsets of plain content to sectors,
+// so the reader can be used with http.ServeContent, its length is header.PlaintextSize()
+func OpenContent(r io.ReaderAt, header *EmixHeader) (io.ReadSeeker, error) {
+	c := &contentReader{
+		r:      r,
+		base:   header.ContentOffset(),
+		size:   header.PlaintextSize(),
+		sector: -1,
+	}
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return nil, err
+		}
+		c.cipher = cipher
+		c.stolen = stealsSectors(cipher)
+		c.sectorSize = header.ContentSectorSize()
+		if err := ValidSectorSize(c.sectorSize); err != nil {
+			return nil, err
+		}
+		c.plainBuf = make([]byte, c.sectorSize+aes.BlockSize)
+		c.cipherBuf = make([]byte, c.sectorSize+aes.BlockSize)
+	}
+	return c, nil
+}
+
+func (c *contentReader) Read(p []byte) (int, error) {
+	if c.offset >= c.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), c.size-c.offset)]
+	if c.cipher == nil {
+		n, err := c.r.ReadAt(p, c.base+c.offset)
+		c.offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			if n < len(p) {
+				return n, truncatedContentError(c.size, c.offset)
+			}
+			err = nil
+		}
+		return n, err
+	}
+
+	// the last sector may take a short tail
+	sector := min(c.offset/int64(c.sectorSize), sectorCount(c.stolen, c.size, c.sectorSize)-1)
+	if sector != c.sector {
+		if err := c.readSector(sector); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plainBuf[c.offset-sector*int64(c.sectorSize):sectorLength(c.stolen, c.size, c.sectorSize, sector)])
+	c.offset += int64(n)
+	return n, nil
+}
+
+// readSector read and decrypt the sector into plainBuf
+func (c *contentReader) readSector(sector int64) error {
+	c.sector = -1
+	length := sectorLength(c.stolen, c.size, c.sectorSize, sector)
+	n, err := c.r.ReadAt(c.cipherBuf[:length], c.base+sector*int64(c.sectorSize))
+	if n < length {
+		if err == nil || errors.Is(err, io.EOF) {
+			return truncatedContentError(contentSize(c.stolen, c.size, c.sectorSize), sector*int64(c.sectorSize)+int64(n))
+		}
+		return err
 	}
+	decryptSector(c.cipher, c.plainBuf[:length], c.cipherBuf[:length], uint64(SectorNumberStart+sector))
+	c.sector = sector
 	return nil
 }
+
+func (c *contentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.offset = offset
+	return offset, nil
+}
+
+// contentReaderAt decrypt the sectors covering each read, see ContentReaderAt
+type contentReaderAt struct {
+	r          io.ReaderAt
+	cipher     ContentCipher
+	stolen     bool
+	base       int64
+	size       int64
+	sectorSize int
+}
+
+// ContentReaderAt return a reader of size plain bytes of the content encrypted by cipher at dataOffset of src,
+// a read only decrypts the sectors covering it, so ranges of a large file can be served without decrypting
+// the whole content. ReadAt is safe for concurrent use if src is
+func ContentReaderAt(src io.ReaderAt, cipher ContentCipher, dataOffset int64, size int64) io.ReaderAt {
+	r, _ := ContentReaderAtWithSectorSize(src, cipher, dataOffset, size, XTSSectorSize)
+	return r
+}
+
+// ContentReaderAtWithSectorSize is like ContentReaderAt but decrypt with the given sector size
+func ContentReaderAtWithSectorSize(src io.ReaderAt, cipher ContentCipher, dataOffset int64, size int64, sectorSize int) (io.ReaderAt, error) {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return nil, err
+	}
+	return &contentReaderAt{
+		r:          src,
+		cipher:     cipher,
+		stolen:     stealsSectors(cipher),
+		base:       dataOffset,
+		size:       size,
+		sectorSize: sectorSize,
+	}, nil
+}
+
+func (c *contentReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), c.size)
+	sectorSize := int64(c.sectorSize)
+	// the last sector may take a short tail
+	last := sectorCount(c.stolen, c.size, c.sectorSize) - 1
+	first := min(off/sectorSize, last)
+	plainBuf := make([]byte, c.sectorSize+aes.BlockSize)
+	cipherBuf := make([]byte, c.sectorSize+aes.BlockSize)
+	n := 0
+	for sector := first; sector <= last && off+int64(n) < end; sector++ {
+		length := sectorLength(c.stolen, c.size, c.sectorSize, sector)
+		m, err := c.r.ReadAt(cipherBuf[:length], c.base+sector*sectorSize)
+		if m < length {
+			if err == nil || errors.Is(err, io.EOF) {
+				return n, truncatedContentError(contentSize(c.stolen, c.size, c.sectorSize), sector*sectorSize+int64(m))
+			}
+			return n, err
+		}
+		decryptSector(c.cipher, plainBuf[:length], cipherBuf[:length], uint64(SectorNumberStart+sector))
+		start := off + int64(n) - sector*sectorSize
+		n += copy(p[n:end-off], plainBuf[start:min(int64(length), c.size-sector*sectorSize)])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
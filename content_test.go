@@ -4,7 +4,14 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/xts"
@@ -54,3 +61,492 @@ func TestContent(t *testing.T) {
 		})
 	}
 }
+
+func TestContentWithSectorSize(t *testing.T) {
+	password := make([]byte, 32)
+	rand.Read(password)
+	cipher, err := xts.NewCipher(aes.NewCipher, password)
+	assert.Nil(t, err)
+
+	plaintext := make([]byte, 100*1024+3)
+	rand.Read(plaintext)
+	for _, sectorSize := range []int{MinSectorSize, XTSSectorSize, 64 * 1024, MaxSectorSize} {
+		cipherbuffer := bytes.NewBuffer(nil)
+		err := EncryptContentWithSectorSize(cipher, bytes.NewReader(plaintext), cipherbuffer, sectorSize)
+		assert.Nil(t, err)
+		assert.Zero(t, cipherbuffer.Len()%sectorSize)
+
+		plainbuffer := bytes.NewBuffer(nil)
+		err = DecryptContentWithSectorSize(cipher, cipherbuffer, plainbuffer, int64(len(plaintext)), sectorSize)
+		assert.Nil(t, err)
+		assert.EqualValues(t, plaintext, plainbuffer.Bytes())
+	}
+
+	err = EncryptContentWithSectorSize(cipher, bytes.NewReader(plaintext), io.Discard, 1000)
+	assert.ErrorIs(t, err, ErrInvalidSectorSize)
+}
+
+func TestContentSmallInputs(t *testing.T) {
+	for id := range cipherSuites {
+		// content before version 3 is padded
+		header := &EmixHeader{
+			Version:     2,
+			EncryptData: true,
+			Password:    [16]byte{1, 2, 3},
+			SaltedKeys:  true,
+			CipherSuite: CipherSuiteID(id),
+		}
+		cipher, err := header.NewContentCipher()
+		assert.Nil(t, err)
+		for _, size := range []int{1, 15, 16, 17, 4095} {
+			name := fmt.Sprintf("%s/%d", header.CipherSuite, size)
+			plaintext := make([]byte, size)
+			rand.Read(plaintext)
+
+			// short reads still fill whole sectors
+			cipherbuffer := bytes.NewBuffer(nil)
+			assert.Nil(t, EncryptContent(cipher, iotest.OneByteReader(bytes.NewReader(plaintext)), cipherbuffer), name)
+			assert.EqualValues(t, EncryptedContentSize(int64(size), XTSSectorSize), cipherbuffer.Len(), name)
+			ciphertext := cipherbuffer.Bytes()
+
+			plainbuffer := bytes.NewBuffer(nil)
+			assert.Nil(t, DecryptContent(cipher, bytes.NewReader(ciphertext), plainbuffer, int64(size)), name)
+			assert.Equal(t, plaintext, plainbuffer.Bytes(), name)
+
+			// the padding is zero
+			sector := make([]byte, XTSSectorSize)
+			cipher.Decrypt(sector, ciphertext[:XTSSectorSize], SectorNumberStart)
+			assert.Equal(t, make([]byte, XTSSectorSize-size), sector[size:], name)
+		}
+	}
+}
+
+func TestContentStolenSectors(t *testing.T) {
+	for id := range cipherSuites {
+		header := &EmixHeader{
+			EncryptData: true,
+			Password:    [16]byte{1, 2, 3},
+			SaltedKeys:  true,
+			CipherSuite: CipherSuiteID(id),
+		}
+		cipher, err := header.NewContentCipher()
+		assert.Nil(t, err)
+		assert.True(t, stealsSectors(cipher))
+		for _, sectorSize := range []int{MinSectorSize, XTSSectorSize} {
+			for _, size := range []int{1, 15, 16, 17, 31, 511, 512, 513, 527, 528, 4095, 4096, 4097, 4111, 4112, 3*4096 + 100} {
+				name := fmt.Sprintf("%s/%d/%d", header.CipherSuite, sectorSize, size)
+				plaintext := make([]byte, size)
+				rand.Read(plaintext)
+
+				// encrypted content is as long as plain content, but at least an AES block
+				cipherbuffer := bytes.NewBuffer(nil)
+				assert.Nil(t, EncryptContentWithSectorSize(cipher, iotest.OneByteReader(bytes.NewReader(plaintext)), cipherbuffer, sectorSize), name)
+				assert.Equal(t, max(size, 16), cipherbuffer.Len(), name)
+				ciphertext := cipherbuffer.Bytes()
+
+				plainbuffer := bytes.NewBuffer(nil)
+				assert.Nil(t, DecryptContentWithSectorSize(cipher, bytes.NewReader(ciphertext), plainbuffer, int64(size), sectorSize), name)
+				assert.Equal(t, plaintext, plainbuffer.Bytes(), name)
+
+				out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+				assert.Nil(t, err)
+				assert.Nil(t, DecryptContentParallelWithSectorSize(cipher, bytes.NewReader(ciphertext), out, int64(size), 3, sectorSize), name)
+				data, err := os.ReadFile(out.Name())
+				assert.Nil(t, err)
+				assert.Equal(t, plaintext, data, name)
+				out.Close()
+
+				// the tail is read from the last sector
+				header.SectorSize = sectorSize
+				header.FileInfo.Size = uint64(size)
+				r, err := OpenContent(bytes.NewReader(append(make([]byte, header.ContentOffset()), ciphertext...)), header)
+				assert.Nil(t, err)
+				_, err = r.Seek(int64(size/2), io.SeekStart)
+				assert.Nil(t, err)
+				data, err = io.ReadAll(r)
+				assert.Nil(t, err)
+				assert.Equal(t, plaintext[size/2:], data, name)
+
+				// a truncated tail is detected
+				err = DecryptContentWithSectorSize(cipher, bytes.NewReader(ciphertext[:len(ciphertext)-1]), io.Discard, int64(size), sectorSize)
+				assert.ErrorIs(t, err, ErrTruncatedContent, name)
+			}
+		}
+	}
+}
+
+func TestStolenSectorVector(t *testing.T) {
+	// IEEE 1619 XTS-AES-128 test vector 15, a data unit of 17 bytes
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0bfbebdbcbbbab9b8b7b6b5b4b3b2b1b0")
+	plaintext, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f10")
+	expected, _ := hex.DecodeString("6c1625db4671522d3d7599601de7ca09ed")
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	assert.Nil(t, err)
+	ciphertext := make([]byte, len(plaintext))
+	encryptSector(cipher, ciphertext, plaintext, 0x123456789a)
+	assert.Equal(t, expected, ciphertext)
+	decrypted := make([]byte, len(ciphertext))
+	decryptSector(cipher, decrypted, ciphertext, 0x123456789a)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestValidSectorSize(t *testing.T) {
+	for _, n := range []int{512, 1024, 4096, 64 * 1024, 1024 * 1024} {
+		assert.Nil(t, ValidSectorSize(n), n)
+	}
+	for _, n := range []int{-4096, 0, 16, 256, 1000, 4097, 3 * 1024, 2 * 1024 * 1024} {
+		assert.ErrorIs(t, ValidSectorSize(n), ErrInvalidSectorSize, n)
+	}
+}
+
+func TestRecommendSectorSize(t *testing.T) {
+	tests := []struct {
+		fileSize   int64
+		sectorSize int
+	}{
+		{0, XTSSectorSize},
+		{1024, XTSSectorSize},
+		{16*1024*1024 - 1, XTSSectorSize},
+		{16 * 1024 * 1024, 64 * 1024},
+		{1024*1024*1024 - 1, 64 * 1024},
+		{1024 * 1024 * 1024, MaxSectorSize},
+		{100 * 1024 * 1024 * 1024, MaxSectorSize},
+	}
+	for _, test := range tests {
+		sectorSize := RecommendSectorSize(test.fileSize)
+		assert.Equal(t, test.sectorSize, sectorSize, test.fileSize)
+		assert.Nil(t, ValidSectorSize(sectorSize))
+	}
+}
+
+func TestCopyContent(t *testing.T) {
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	plaintext := make([]byte, 3*XTSSectorSize+100)
+	rand.Read(plaintext)
+
+	// bundle a
+	bufa := bytes.NewBuffer(nil)
+	bwa, err := NewBundleWriter(bufa)
+	assert.Nil(t, err)
+	assert.Nil(t, bwa.Add(&EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "a/file.bin"},
+	}, bytes.NewReader(plaintext)))
+	assert.Nil(t, bwa.Close())
+	bra, err := NewBundleReader(bytes.NewReader(bufa.Bytes()), int64(bufa.Len()), password)
+	assert.Nil(t, err)
+	src := bra.Entries()[0]
+	assert.EqualValues(t, src.Header.CiphertextSize(), src.Length)
+
+	// copy to bundle b with a new name
+	dst := &EmixHeader{
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    src.Header.FileInfo,
+	}
+	dst.FileInfo.Name = "b/file.bin"
+	assert.Nil(t, CheckContentScheme(dst, src.Header))
+	bufb := bytes.NewBuffer(nil)
+	bwb, err := NewBundleWriter(bufb)
+	assert.Nil(t, err)
+	assert.Nil(t, bwb.AddRaw(dst, bra.RawContent(src), src.Length))
+	assert.Nil(t, bwb.Close())
+	brb, err := NewBundleReader(bytes.NewReader(bufb.Bytes()), int64(bufb.Len()), password)
+	assert.Nil(t, err)
+	assert.Equal(t, "b/file.bin", brb.Entries()[0].Header.FileInfo.Name)
+	out := bytes.NewBuffer(nil)
+	assert.Nil(t, brb.Extract(brb.Entries()[0], out))
+	assert.True(t, bytes.Equal(plaintext, out.Bytes()))
+
+	// copy to a standalone emix file
+	cipher, err := src.Header.NewContentCipher()
+	assert.Nil(t, err)
+	raw := bytes.NewBuffer(nil)
+	assert.Nil(t, CopyContent(raw, bra.RawContent(src), src.Length))
+	out.Reset()
+	assert.Nil(t, DecryptContent(cipher, raw, out, int64(len(plaintext))))
+	assert.True(t, bytes.Equal(plaintext, out.Bytes()))
+
+	// short content
+	err = CopyContent(io.Discard, bytes.NewReader(make([]byte, 10)), 20)
+	assert.ErrorIs(t, err, ErrInvalidEmixFileContent)
+
+	// scheme mismatch
+	other := *dst
+	other.Password = [16]byte{1}
+	assert.ErrorIs(t, CheckContentScheme(&other, src.Header), ErrContentSchemeMismatch)
+	other = *dst
+	other.SectorSize = 64 * 1024
+	assert.ErrorIs(t, CheckContentScheme(&other, src.Header), ErrContentSchemeMismatch)
+	other = *dst
+	other.EncryptData = false
+	assert.ErrorIs(t, CheckContentScheme(&other, src.Header), ErrContentSchemeMismatch)
+	other = *dst
+	other.SaltedKeys = true
+	assert.ErrorIs(t, CheckContentScheme(&other, src.Header), ErrContentSchemeMismatch)
+	salted := *src.Header
+	salted.SaltedKeys = true
+	other = salted
+	assert.Nil(t, CheckContentScheme(&other, &salted))
+	other.Salt[0]++
+	assert.ErrorIs(t, CheckContentScheme(&other, &salted), ErrContentSchemeMismatch)
+	other = salted
+	other.FileMAC = !salted.FileMAC
+	assert.ErrorContains(t, CheckContentScheme(&other, &salted), "file mac differs")
+}
+
+func TestTruncatedContent(t *testing.T) {
+	password := make([]byte, 32)
+	rand.Read(password)
+	cipher, err := xts.NewCipher(aes.NewCipher, password)
+	assert.Nil(t, err)
+
+	plaintext := make([]byte, 3*XTSSectorSize+100)
+	rand.Read(plaintext)
+	cipherbuffer := bytes.NewBuffer(nil)
+	assert.Nil(t, EncryptContent(cipher, bytes.NewReader(plaintext), cipherbuffer))
+	ciphertext := cipherbuffer.Bytes()
+
+	for _, length := range []int{0, 100, XTSSectorSize, 2*XTSSectorSize + 1, len(ciphertext) - 1} {
+		err := DecryptContent(cipher, bytes.NewReader(ciphertext[:length]), io.Discard, int64(len(plaintext)))
+		assert.ErrorIs(t, err, ErrTruncatedContent, length)
+		assert.ErrorIs(t, err, ErrInvalidEmixFileContent, length)
+		assert.ErrorContains(t, err, fmt.Sprintf("expected %d bytes, got %d bytes", len(ciphertext), length))
+	}
+	assert.Nil(t, DecryptContent(cipher, bytes.NewReader(ciphertext), io.Discard, int64(len(plaintext))))
+
+	// plain content
+	err = CopyContent(io.Discard, bytes.NewReader(plaintext[:100]), int64(len(plaintext)))
+	assert.ErrorIs(t, err, ErrTruncatedContent)
+	assert.ErrorContains(t, err, fmt.Sprintf("expected %d bytes, got 100 bytes", len(plaintext)))
+}
+
+func TestOpenContent(t *testing.T) {
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	content := make([]byte, 3*4096+100)
+	rand.Read(content)
+
+	for _, encrypt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypt=%t", encrypt), func(t *testing.T) {
+			header := &EmixHeader{
+				EncryptData: encrypt,
+				Password:    password,
+				SaltedKeys:  true,
+				FileMAC:     encrypt,
+				FileInfo: FileInfo{
+					Name: "a.mp4",
+					Size: uint64(len(content)),
+				},
+			}
+			encodedHeader, err := header.MarshalBinary()
+			assert.Nil(t, err)
+			buf := bytes.NewBuffer(ZipHeader())
+			buf.Write(encodedHeader)
+			if encrypt {
+				cipher, err := header.NewContentCipher()
+				assert.Nil(t, err)
+				assert.Nil(t, EncryptContent(cipher, bytes.NewReader(content), buf))
+			} else {
+				buf.Write(content)
+			}
+
+			file := bytes.NewReader(withFileMAC(t, header, buf.Bytes()))
+			readHeader, err := ReadHeader(file, password)
+			assert.Nil(t, err)
+			r, err := OpenContent(file, readHeader)
+			assert.Nil(t, err)
+
+			all, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, content, all)
+
+			for _, offset := range []int64{0, 1, 4095, 4096, 4097, 8192 + 10, int64(len(content)) - 1, int64(len(content))} {
+				pos, err := r.Seek(offset, io.SeekStart)
+				assert.Nil(t, err)
+				assert.Equal(t, offset, pos)
+				data := make([]byte, 5000)
+				n, err := io.ReadFull(r, data)
+				if offset == int64(len(content)) {
+					assert.ErrorIs(t, err, io.EOF)
+				} else if offset+5000 > int64(len(content)) {
+					assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+				}
+				assert.Equal(t, content[offset:offset+int64(n)], data[:n], "offset %d", offset)
+			}
+
+			pos, err := r.Seek(-10, io.SeekEnd)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(content)-10), pos)
+			pos, err = r.Seek(-5, io.SeekCurrent)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(content)-15), pos)
+			tail, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, content[len(content)-15:], tail)
+
+			_, err = r.Seek(-1, io.SeekStart)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestContentSizes(t *testing.T) {
+	password := [16]byte{1, 2, 3}
+	for _, sectorSize := range []int{0, 512} {
+		for _, size := range []int64{0, 1, 511, 512, 4095, 4096, 4097, 3*4096 + 100} {
+			for _, encrypt := range []bool{false, true} {
+				header := &EmixHeader{
+					EncryptData: encrypt,
+					Password:    password,
+					SaltedKeys:  true,
+					FileInfo:    FileInfo{Name: "a.txt", Size: uint64(size)},
+				}
+				if encrypt {
+					header.SectorSize = sectorSize
+				}
+				name := fmt.Sprintf("sector=%d/size=%d/encrypt=%t", sectorSize, size, encrypt)
+				assert.Equal(t, size, header.PlaintextSize(), name)
+
+				content := make([]byte, size)
+				rand.Read(content)
+				encodedHeader, err := header.MarshalBinary()
+				assert.Nil(t, err)
+				buf := bytes.NewBuffer(ZipHeader())
+				buf.Write(encodedHeader)
+				if encrypt {
+					cipher, err := header.NewContentCipher()
+					assert.Nil(t, err)
+					assert.Nil(t, EncryptContentWithSectorSize(cipher, bytes.NewReader(content), buf, header.ContentSectorSize()))
+				} else {
+					buf.Write(content)
+				}
+				assert.Equal(t, header.CiphertextSize(), int64(buf.Len())-header.ContentOffset(), name)
+				if encrypt && size > 0 {
+					// content is not padded but to an AES block
+					assert.Equal(t, max(size, 16), header.CiphertextSize(), name)
+				} else {
+					assert.Equal(t, size, header.CiphertextSize(), name)
+				}
+
+				r, err := OpenContent(bytes.NewReader(buf.Bytes()), header)
+				assert.Nil(t, err)
+				end, err := r.Seek(0, io.SeekEnd)
+				assert.Nil(t, err)
+				assert.Equal(t, header.PlaintextSize(), end, name)
+			}
+		}
+	}
+}
+
+func TestDecryptContentParallel(t *testing.T) {
+	cipher, err := NewAESXTS([16]byte{1, 2, 3})
+	assert.Nil(t, err)
+	const sectorSize = MinSectorSize
+	for _, size := range []int{0, 1, sectorSize - 1, sectorSize, sectorSize + 1, 10*sectorSize + 100, 64 * sectorSize} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		assert.Nil(t, err)
+		encrypted := bytes.NewBuffer(nil)
+		assert.Nil(t, EncryptContentWithSectorSize(cipher, bytes.NewReader(plaintext), encrypted, sectorSize))
+		sequential := bytes.NewBuffer(nil)
+		assert.Nil(t, DecryptContentWithSectorSize(cipher, bytes.NewReader(encrypted.Bytes()), sequential, int64(size), sectorSize))
+
+		for _, workers := range []int{0, 1, 3, 8, 100} {
+			out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+			assert.Nil(t, err)
+			err = DecryptContentParallelWithSectorSize(cipher, bytes.NewReader(encrypted.Bytes()), out, int64(size), workers, sectorSize)
+			assert.Nil(t, err, "size %d workers %d", size, workers)
+			data, err := os.ReadFile(out.Name())
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(sequential.Bytes(), data), "size %d workers %d", size, workers)
+			out.Close()
+		}
+	}
+
+	// truncated content reports where it ends
+	size := 10 * sectorSize
+	encrypted := bytes.NewBuffer(nil)
+	assert.Nil(t, EncryptContentWithSectorSize(cipher, bytes.NewReader(make([]byte, size)), encrypted, sectorSize))
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	assert.Nil(t, err)
+	defer out.Close()
+	err = DecryptContentParallelWithSectorSize(cipher, bytes.NewReader(encrypted.Bytes()[:4*sectorSize+10]), out, int64(size), 4, sectorSize)
+	assert.ErrorIs(t, err, ErrTruncatedContent)
+	assert.ErrorContains(t, err, fmt.Sprintf("got %d bytes", 4*sectorSize+10))
+	assert.ErrorIs(t, DecryptContentParallelWithSectorSize(cipher, bytes.NewReader(nil), out, 1, 4, 1000), ErrInvalidSectorSize)
+}
+
+func TestContentReaderAt(t *testing.T) {
+	xtsCipher, err := NewAESXTS([16]byte{1, 2, 3})
+	assert.Nil(t, err)
+	const size = 3*1024*1024 + 100
+	plaintext := make([]byte, size)
+	_, err = rand.Read(plaintext)
+	assert.Nil(t, err)
+	for _, cipher := range []ContentCipher{xtsCipher, stolenSectors{xtsCipher}} {
+		const dataOffset = 64
+		encrypted := bytes.NewBuffer(make([]byte, dataOffset))
+		assert.Nil(t, EncryptContent(cipher, bytes.NewReader(plaintext), encrypted))
+		r := ContentReaderAt(bytes.NewReader(encrypted.Bytes()), cipher, dataOffset, size)
+
+		for i := 0; i < 200; i++ {
+			off := mrand.Int64N(size)
+			p := make([]byte, mrand.IntN(3*XTSSectorSize))
+			n, err := r.ReadAt(p, off)
+			if off+int64(len(p)) > size {
+				assert.ErrorIs(t, err, io.EOF)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, min(len(p), size-int(off)), n)
+			assert.True(t, bytes.Equal(plaintext[off:off+int64(n)], p[:n]), "offset %d length %d", off, len(p))
+		}
+		// the tail of content
+		p := make([]byte, 10)
+		n, err := r.ReadAt(p, size-5)
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, plaintext[size-5:], p[:n])
+		_, err = r.ReadAt(p, size)
+		assert.ErrorIs(t, err, io.EOF)
+
+		// truncated content reports where it ends
+		r = ContentReaderAt(bytes.NewReader(encrypted.Bytes()[:dataOffset+XTSSectorSize+10]), cipher, dataOffset, size)
+		_, err = r.ReadAt(p, 2*XTSSectorSize)
+		assert.ErrorIs(t, err, ErrTruncatedContent)
+	}
+	_, err = ContentReaderAtWithSectorSize(bytes.NewReader(nil), xtsCipher, 0, 1, 1000)
+	assert.ErrorIs(t, err, ErrInvalidSectorSize)
+}
+
+func BenchmarkDecryptContentParallel(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	cipher, err := NewAESXTS([16]byte{1, 2, 3})
+	if err != nil {
+		b.Fatal(err)
+	}
+	sectorSize := RecommendSectorSize(size)
+	encrypted := bytes.NewBuffer(nil)
+	if err := EncryptContentWithSectorSize(cipher, bytes.NewReader(make([]byte, size)), encrypted, sectorSize); err != nil {
+		b.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(b.TempDir(), "out"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				err := DecryptContentParallelWithSectorSize(cipher, bytes.NewReader(encrypted.Bytes()), out, size, workers, sectorSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -3,19 +3,51 @@ package emix
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/xts"
 )
 
+// Rand is the source of random bytes of header salt, AES-GCM nonce and generated password,
+// replace it before use for deterministic tests or to use an HSM/DRBG, reads are serialized
+var Rand io.Reader = rand.Reader
+
+var randMu sync.Mutex
+
+// readRandom fill b with random bytes from Rand
+func readRandom(b []byte) error {
+	randMu.Lock()
+	defer randMu.Unlock()
+	_, err := io.ReadFull(Rand, b)
+	return err
+}
+
+// aesgcmOverhead is the nonce and tag length added by aesgcmEncrypt
+var aesgcmOverhead = aeadOverhead(newAESGCM([16]byte{}, nil))
+
+// aeadOverhead return the length added by sealing with nonce prefix
+func aeadOverhead(aead cipher.AEAD, err error) int {
+	if err != nil {
+		panic(err)
+	}
+	return aead.NonceSize() + aead.Overhead()
+}
+
 // use aes-256-gcm
 func NewAESGCM(key [16]byte) (cipher.AEAD, error) {
-	ekey := HKDF(key[:], nil, []byte("aesgem key"), 32)
+	return newAESGCM(key, nil)
+}
+
+func newAESGCM(key [16]byte, salt []byte) (cipher.AEAD, error) {
+	ekey := HKDF(key[:], salt, []byte("aesgem key"), 32)
 	block, err := aes.NewCipher(ekey)
 	if err != nil {
 		return nil, err
@@ -32,12 +64,15 @@ func AESGCMEncrypt(plainText []byte, key [16]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return aesgcmEncrypt(aesgcm, plainText, nil)
+}
 
+func aesgcmEncrypt(aesgcm cipher.AEAD, plainText []byte, additionalData []byte) ([]byte, error) {
 	nonce := make([]byte, aesgcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
+	if err := readRandom(nonce); err != nil {
 		return nil, err
 	}
-	cipherText := aesgcm.Seal(nil, nonce, plainText, nil)
+	cipherText := aesgcm.Seal(nil, nonce, plainText, additionalData)
 	return append(nonce, cipherText...), nil
 }
 
@@ -46,22 +81,114 @@ func AESGCMDecrypt(cipherText []byte, key [16]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return aesgcmDecrypt(aesgcm, cipherText, nil)
+}
 
+func aesgcmDecrypt(aesgcm cipher.AEAD, cipherText []byte, additionalData []byte) ([]byte, error) {
 	nonceSize := aesgcm.NonceSize()
 	if len(cipherText) < nonceSize {
 		return nil, fmt.Errorf("cipherText too short")
 	}
 	nonce := cipherText[:nonceSize]
 	cipherText = cipherText[nonceSize:]
-	return aesgcm.Open(nil, nonce, cipherText, nil)
+	return aesgcm.Open(nil, nonce, cipherText, additionalData)
 }
 
 // NewAESXTS returns an xts.Cipher
 func NewAESXTS(key [16]byte) (*xts.Cipher, error) {
-	hkdfKey := HKDF(key[:], nil, []byte("aesxts key"), 32)
+	return newAESXTS(key, nil)
+}
+
+func newAESXTS(key [16]byte, salt []byte) (*xts.Cipher, error) {
+	hkdfKey := HKDF(key[:], salt, []byte("aesxts key"), 32)
 	return xts.NewCipher(aes.NewCipher, hkdfKey)
 }
 
+// max cached entries of CipherCache, the cache is reset when it is exceeded,
+// e.g. files with embedded passwords
+const cipherCacheMaxEntries = 64
+
+type cipherCacheKey struct {
+	key  [16]byte
+	salt string
+	kdf  KDFParams
+}
+
+// CipherCache caches derived ciphers by key and salt, so files with the same password
+// can reuse them instead of running key derivation for each file.
+// It is safe for concurrent use.
+type CipherCache struct {
+	mu     sync.Mutex
+	aesgcm map[cipherCacheKey]cipher.AEAD
+	aesxts map[cipherCacheKey]*xts.Cipher
+	// stretched keys of KDF
+	keys map[cipherCacheKey][16]byte
+}
+
+// NewCipherCache returns an empty CipherCache
+func NewCipherCache() *CipherCache {
+	return &CipherCache{
+		aesgcm: make(map[cipherCacheKey]cipher.AEAD),
+		aesxts: make(map[cipherCacheKey]*xts.Cipher),
+		keys:   make(map[cipherCacheKey][16]byte),
+	}
+}
+
+// AESGCM returns the cached aes-256-gcm cipher of key and salt, create it if not exists
+func (c *CipherCache) AESGCM(key [16]byte, salt []byte) (cipher.AEAD, error) {
+	cacheKey := cipherCacheKey{key: key, salt: string(salt)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aesgcm, ok := c.aesgcm[cacheKey]; ok {
+		return aesgcm, nil
+	}
+	aesgcm, err := newAESGCM(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.aesgcm) >= cipherCacheMaxEntries {
+		clear(c.aesgcm)
+	}
+	c.aesgcm[cacheKey] = aesgcm
+	return aesgcm, nil
+}
+
+// AESXTS returns the cached aes-xts cipher of key and salt, create it if not exists
+func (c *CipherCache) AESXTS(key [16]byte, salt []byte) (*xts.Cipher, error) {
+	cacheKey := cipherCacheKey{key: key, salt: string(salt)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aesxts, ok := c.aesxts[cacheKey]; ok {
+		return aesxts, nil
+	}
+	aesxts, err := newAESXTS(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.aesxts) >= cipherCacheMaxEntries {
+		clear(c.aesxts)
+	}
+	c.aesxts[cacheKey] = aesxts
+	return aesxts, nil
+}
+
+// Argon2idKey returns the cached key stretched by Argon2id with salt and params, derive it if not exists,
+// the file info and content of a file share it
+func (c *CipherCache) Argon2idKey(key [16]byte, salt []byte, params KDFParams) [16]byte {
+	cacheKey := cipherCacheKey{key: key, salt: string(salt), kdf: params}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stretched, ok := c.keys[cacheKey]; ok {
+		return stretched
+	}
+	stretched := argon2idKey(key, salt, params)
+	if len(c.keys) >= cipherCacheMaxEntries {
+		clear(c.keys)
+	}
+	c.keys[cacheKey] = stretched
+	return stretched
+}
+
 func HKDF(secret []byte, salt []byte, info []byte, length int) []byte {
 	hkdfReader := hkdf.New(sha256.New, secret, salt, info)
 	out := make([]byte, length)
@@ -69,6 +196,14 @@ func HKDF(secret []byte, salt []byte, info []byte, length int) []byte {
 	return out
 }
 
+// HashedFileName return an opaque and deterministic file name of name,
+// it's the hex encoded HMAC-SHA256 of name keyed by a key derived from password
+func HashedFileName(password [16]byte, name string) string {
+	mac := hmac.New(sha256.New, HKDF(password[:], nil, []byte("hashed file name"), 32))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
 // GeneratePasswordFromFile use a credential file to generate password
 // return 16-byte password
 func GeneratePasswordFromFile(filePath string) ([]byte, error) {
@@ -77,11 +212,17 @@ func GeneratePasswordFromFile(filePath string) ([]byte, error) {
 		return nil, fmt.Errorf("Open credential file error: %v", err)
 	}
 	defer f.Close()
+	return GeneratePasswordFromReader(f)
+}
 
-	// hash file
+// GeneratePasswordFromReader use the credential read from r to generate password, e.g. from a pipe,
+// the same content as a credential file generates the same password
+// return 16-byte password
+func GeneratePasswordFromReader(r io.Reader) ([]byte, error) {
+	// hash credential
 	hash := sha256.New()
-	if _, err := io.Copy(hash, f); err != nil {
-		return nil, fmt.Errorf("Read credential file error: %v", err)
+	if _, err := io.Copy(hash, r); err != nil {
+		return nil, fmt.Errorf("Read credential error: %v", err)
 	}
 	fileHash := hash.Sum(nil)
 
@@ -90,10 +231,22 @@ func GeneratePasswordFromFile(filePath string) ([]byte, error) {
 	return password, nil
 }
 
+// PasswordKey return the 16-byte key of a typed password, a password up to 16 bytes is the key padded with zeros
+// as before, a longer passphrase is hashed to the key by HKDF-SHA256, so no part of it is ignored
+func PasswordKey(password []byte) [16]byte {
+	var key [16]byte
+	if len(password) <= len(key) {
+		copy(key[:], password)
+		return key
+	}
+	copy(key[:], HKDF(password, nil, []byte("passphrase"), len(key)))
+	return key
+}
+
 // GenerateRandomPassword generate random length-byte password
 func GenerateRandomPassword(length int) ([]byte, error) {
 	password := make([]byte, length)
-	_, err := rand.Read(password)
+	err := readRandom(password)
 	if err != nil {
 		return nil, fmt.Errorf("Generate password error: %v", err)
 	}
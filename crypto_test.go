@@ -2,6 +2,10 @@ package emix
 
 import (
 	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -21,3 +25,300 @@ func TestAESGCM(t *testing.T) {
 		t.Fatal("not equal")
 	}
 }
+
+func TestCipherCache(t *testing.T) {
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	cache := NewCipherCache()
+
+	aesgcm, err := cache.AESGCM(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesgcm2, err := cache.AESGCM(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aesgcm != aesgcm2 {
+		t.Fatal("cipher should be reused")
+	}
+	aesxts, err := cache.AESXTS(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesxts2, err := cache.AESXTS(key, []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aesxts == aesxts2 {
+		t.Fatal("cipher with different salt should not be reused")
+	}
+
+	// cached cipher is compatible with the uncached one
+	cipherText, err := aesgcmEncrypt(aesgcm, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainText, err := AESGCMDecrypt(cipherText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText, []byte("hello world")) {
+		t.Fatal("not equal")
+	}
+
+	// concurrent use
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k := key
+				k[0] = byte(i)
+				if _, err := cache.AESXTS(k, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkCipherCache(b *testing.B) {
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	info := FileInfo{
+		Name: "small.txt",
+		Size: 1024,
+		Mode: 0644,
+	}
+	content := make([]byte, 1024)
+
+	// mix a small file: encrypt file info and content
+	mixSmallFile := func(b *testing.B, header *EmixHeader, aesxts ContentCipher) {
+		if _, err := header.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+		if err := EncryptContent(aesxts, bytes.NewReader(content), io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("new", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			header := &EmixHeader{EncryptInfo: true, EncryptData: true, Password: key, FileInfo: info}
+			aesxts, err := NewAESXTS(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			mixSmallFile(b, header, aesxts)
+		}
+	})
+	b.Run("cache", func(b *testing.B) {
+		cache := NewCipherCache()
+		for i := 0; i < b.N; i++ {
+			header := &EmixHeader{EncryptInfo: true, EncryptData: true, Password: key, FileInfo: info, Ciphers: cache}
+			aesxts, err := cache.AESXTS(key, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			mixSmallFile(b, header, aesxts)
+		}
+	})
+}
+
+func TestSaltedCredentialFileKey(t *testing.T) {
+	credentialFile := filepath.Join(t.TempDir(), "credential")
+	if err := os.WriteFile(credentialFile, []byte("credential"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	password, err := GeneratePasswordFromFile(credentialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("identical content"), 1000)
+
+	// encrypt the same content of two files with the same credential file
+	encrypt := func(header *EmixHeader) ([]byte, []byte) {
+		copy(header.Password[:], password)
+		header.FileInfo = FileInfo{Name: "file.txt"}
+		encodedHeader, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := EncryptContent(cipher, bytes.NewReader(content), buf); err != nil {
+			t.Fatal(err)
+		}
+		return encodedHeader, buf.Bytes()
+	}
+	decrypt := func(encodedHeader []byte, cipherText []byte) []byte {
+		header := &EmixHeader{}
+		copy(header.Password[:], password)
+		if err := header.UnmarshalBinary(encodedHeader); err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := DecryptContent(cipher, bytes.NewReader(cipherText), buf, int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	header1, cipherText1 := encrypt(&EmixHeader{EncryptInfo: true, EncryptData: true, SaltedKeys: true})
+	header2, cipherText2 := encrypt(&EmixHeader{EncryptInfo: true, EncryptData: true, SaltedKeys: true})
+	if bytes.Equal(cipherText1, cipherText2) {
+		t.Fatal("files with salted keys should have different cipher text")
+	}
+	if !bytes.Equal(decrypt(header1, cipherText1), content) || !bytes.Equal(decrypt(header2, cipherText2), content) {
+		t.Fatal("not equal")
+	}
+
+	// files without salted keys share the key
+	header3, cipherText3 := encrypt(&EmixHeader{EncryptInfo: true, EncryptData: true})
+	_, cipherText4 := encrypt(&EmixHeader{EncryptInfo: true, EncryptData: true})
+	if !bytes.Equal(cipherText3, cipherText4) {
+		t.Fatal("files without salted keys should have the same cipher text")
+	}
+	if !bytes.Equal(decrypt(header3, cipherText3), content) {
+		t.Fatal("not equal")
+	}
+}
+
+// countingReader return bytes 0, 1, 2, ...
+type countingReader struct {
+	n byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n
+		r.n++
+	}
+	return len(p), nil
+}
+
+func TestRand(t *testing.T) {
+	defer func(r io.Reader) {
+		Rand = r
+	}(Rand)
+
+	marshal := func() ([]byte, [16]byte) {
+		Rand = &countingReader{}
+		header := &EmixHeader{
+			EncryptInfo: true,
+			Password:    [16]byte{1},
+			FileInfo:    FileInfo{Name: "test.txt"},
+		}
+		encoded, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded, header.Salt
+	}
+	encoded1, salt1 := marshal()
+	encoded2, salt2 := marshal()
+	if salt1 != [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15} || salt1 != salt2 {
+		t.Fatal("salt should come from Rand", salt1, salt2)
+	}
+	// the nonce also comes from Rand
+	if !bytes.Equal(encoded1, encoded2) {
+		t.Fatal("header should be reproducible")
+	}
+
+	Rand = &countingReader{}
+	password, err := GenerateRandomPassword(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(password, []byte{0, 1, 2, 3}) {
+		t.Fatal("password should come from Rand", password)
+	}
+
+	// concurrent reads are serialized
+	Rand = &countingReader{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := GenerateRandomPassword(16); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGeneratePasswordFromReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credential")
+	if err := os.WriteFile(path, []byte("credential"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := GeneratePasswordFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := GeneratePasswordFromReader(bytes.NewReader([]byte("credential")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, password) {
+		t.Fatal("password of reader differs from password of file with the same content")
+	}
+}
+
+func TestPasswordKey(t *testing.T) {
+	// short passwords keep their key
+	if PasswordKey([]byte("secret")) != [16]byte{'s', 'e', 'c', 'r', 'e', 't'} {
+		t.Fatal("short password key changed")
+	}
+	passphrase := []byte("correct horse battery staple and a pony")
+	other := []byte("correct horse battery staple and a mule")
+	if len(passphrase) != 40-1 || PasswordKey(passphrase) == PasswordKey(other) {
+		t.Fatal("passphrases differing after 16 bytes should have different keys")
+	}
+	passphrase = append(passphrase, '!')
+
+	// a 40-character passphrase encrypts and decrypts
+	content := bytes.Repeat([]byte("content"), 1000)
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    PasswordKey(passphrase),
+		FileInfo:    FileInfo{Name: "a.txt", Size: uint64(len(content))},
+	}
+	path := filepath.Join(t.TempDir(), "a.zip")
+	writeTestEmixFile(t, path, header, content)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := ReadHeader(f, PasswordKey(passphrase[:16])); err == nil {
+		t.Fatal("the first 16 bytes of passphrase should not decrypt")
+	}
+	header2, err := ReadHeader(f, PasswordKey(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenContent(f, header2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainText, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText, content) {
+		t.Fatal("content not equal")
+	}
+}
@@ -0,0 +1,144 @@
+package emix
+
+import (
+	"crypto/aes"
+	"errors"
+	"io"
+)
+
+// encrypted content without padding since header version 3
+// content is split to sectors as before, but the last sector holds the rest of content: it is shorter than
+// a sector, or a sector and the tail if the tail is shorter than an AES block. A last sector which is not
+// a multiple of the AES block is encrypted with ciphertext stealing like IEEE 1619, so encrypted content is
+// as long as plain content. Content shorter than an AES block is padded with zero to one block
+
+// stolenSectors is the content cipher of content without padding, see NewContentCipher
+type stolenSectors struct {
+	ContentCipher
+}
+
+// stealsSectors report whether content of cipher is not padded to whole sectors
+func stealsSectors(cipher ContentCipher) bool {
+	if a, ok := cipher.(*authenticatedCipher); ok {
+		cipher = a.ContentCipher
+	}
+	_, ok := cipher.(stolenSectors)
+	return ok
+}
+
+// stealsSectors report whether encrypted content of header is not padded, streams are always padded
+func (e *EmixHeader) stealsSectors() bool {
+	return e.EncryptData && !e.Streamed && e.layoutVersion() >= 3
+}
+
+// contentSize return the encrypted content size of size plain bytes
+func contentSize(stolen bool, size int64, sectorSize int) int64 {
+	if !stolen {
+		return EncryptedContentSize(size, sectorSize)
+	}
+	if size == 0 {
+		return 0
+	}
+	return max(size, aes.BlockSize)
+}
+
+// sectorCount return the number of sectors of size plain bytes
+func sectorCount(stolen bool, size int64, sectorSize int) int64 {
+	sectors := (size + int64(sectorSize) - 1) / int64(sectorSize)
+	// a tail shorter than an AES block is in the sector before
+	if tail := size % int64(sectorSize); stolen && sectors > 1 && tail > 0 && tail < aes.BlockSize {
+		sectors--
+	}
+	return sectors
+}
+
+// sectorLength return the encrypted length of sector, it is sectorSize but the last sector
+func sectorLength(stolen bool, size int64, sectorSize int, sector int64) int {
+	if !stolen || sector < sectorCount(stolen, size, sectorSize)-1 {
+		return sectorSize
+	}
+	return int(contentSize(stolen, size, sectorSize) - sector*int64(sectorSize))
+}
+
+// encryptStolenContent is EncryptContentWithSectorSize without padding, a sector is held back until
+// the next one is read, so the last sector can take a tail shorter than an AES block
+func encryptStolenContent(cipher ContentCipher, reader io.Reader, writer io.Writer, sectorSize int) error {
+	plainBuf := make([]byte, 2*sectorSize)
+	cipherBuf := make([]byte, 2*sectorSize)
+	sectorNumber := uint64(SectorNumberStart)
+	n := 0
+	for {
+		m, err := io.ReadFull(reader, plainBuf[n:])
+		n += m
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		// two sectors are read, the first one is not the last
+		encryptSector(cipher, cipherBuf[:sectorSize], plainBuf[:sectorSize], sectorNumber)
+		if _, err := writer.Write(cipherBuf[:sectorSize]); err != nil {
+			return err
+		}
+		sectorNumber++
+		n = copy(plainBuf, plainBuf[sectorSize:])
+	}
+	// the rest is the last sector, or the last two
+	rest := int64(n)
+	for sector := int64(0); sector < sectorCount(true, rest, sectorSize); sector++ {
+		offset := int(sector) * sectorSize
+		length := sectorLength(true, rest, sectorSize, sector)
+		// content shorter than an AES block
+		clear(plainBuf[n:max(n, offset+length)])
+		encryptSector(cipher, cipherBuf[:length], plainBuf[offset:offset+length], sectorNumber)
+		if _, err := writer.Write(cipherBuf[:length]); err != nil {
+			return err
+		}
+		sectorNumber++
+	}
+	return nil
+}
+
+// encryptSector encrypt a sector of any length not shorter than an AES block
+func encryptSector(cipher ContentCipher, ciphertext, plaintext []byte, sectorNum uint64) {
+	full := len(plaintext) / aes.BlockSize * aes.BlockSize
+	if full == len(plaintext) {
+		cipher.Encrypt(ciphertext, plaintext, sectorNum)
+		return
+	}
+	tail := len(plaintext) - full
+	// the cipher tweaks each block by its index in sector, so a block is encrypted at an index
+	// by encrypting a buffer with the block at the index
+	buf := make([]byte, full+aes.BlockSize)
+	cipher.Encrypt(buf[:full], plaintext[:full], sectorNum)
+	last := buf[full-aes.BlockSize : full]
+	copy(ciphertext[:full-aes.BlockSize], buf)
+	// the head of the last full block is the short ciphertext, its tail pads the short block
+	copy(ciphertext[full:], last[:tail])
+	padded := make([]byte, full+aes.BlockSize)
+	copy(padded[full:], plaintext[full:])
+	copy(padded[full+tail:], last[tail:])
+	cipher.Encrypt(buf, padded, sectorNum)
+	copy(ciphertext[full-aes.BlockSize:full], buf[full:])
+}
+
+// decryptSector decrypt a sector encrypted by encryptSector
+func decryptSector(cipher ContentCipher, plaintext, ciphertext []byte, sectorNum uint64) {
+	full := len(ciphertext) / aes.BlockSize * aes.BlockSize
+	if full == len(ciphertext) {
+		cipher.Decrypt(plaintext, ciphertext, sectorNum)
+		return
+	}
+	tail := len(ciphertext) - full
+	// the block before the short ciphertext is the padded short block at the index after
+	buf := make([]byte, full+aes.BlockSize)
+	copy(buf[full:], ciphertext[full-aes.BlockSize:full])
+	padded := make([]byte, full+aes.BlockSize)
+	cipher.Decrypt(padded, buf, sectorNum)
+	copy(buf, ciphertext[:full-aes.BlockSize])
+	copy(buf[full-aes.BlockSize:], ciphertext[full:])
+	copy(buf[full-aes.BlockSize+tail:full], padded[full+tail:])
+	copy(plaintext[full:], padded[full:full+tail])
+	cipher.Decrypt(plaintext[:full], buf[:full], sectorNum)
+}
@@ -0,0 +1,64 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// detached content file structure
+// [4-byte magic] [16-byte file id] [content]
+// the header file is an emix file without content region, FileInfo.Detached is set
+// and FileInfo.ID links it to the content file
+
+const (
+	// DetachedHeaderExt is the extension of header files of detached content
+	DetachedHeaderExt = ".emixh"
+	// DetachedContentExt is the extension of detached content files
+	DetachedContentExt = ".emixc"
+	// DetachedContentOffset is the offset of content in a detached content file
+	DetachedContentOffset = int64(4 + FileIDLength)
+)
+
+var detachedContentMagic = [4]byte{0x45, 0x4d, 0x58, 0x43} // EMXC
+
+var ErrDetachedContentMismatch = errors.New("detached content does not match header")
+
+// DetachedContentPath return the content file path of header file path, e.g. a.txt.emixc for a.txt.emixh
+func DetachedContentPath(headerPath string) string {
+	return strings.TrimSuffix(headerPath, DetachedHeaderExt) + DetachedContentExt
+}
+
+// WriteDetachedContentPreamble write the magic and file id of header before the content of a detached content file
+func WriteDetachedContentPreamble(w io.Writer, header *EmixHeader) error {
+	if !header.FileInfo.Detached || len(header.FileInfo.ID) != FileIDLength {
+		return fmt.Errorf("%w: header has no detached content id", ErrDetachedContentMismatch)
+	}
+	_, err := w.Write(append(detachedContentMagic[:], header.FileInfo.ID...))
+	return err
+}
+
+// OpenDetachedContent open the content file of header file headerPath and check it has the file id of header,
+// the returned file is positioned at DetachedContentOffset
+func OpenDetachedContent(headerPath string, header *EmixHeader) (*os.File, error) {
+	f, err := os.Open(DetachedContentPath(headerPath))
+	if err != nil {
+		return nil, err
+	}
+	preamble := make([]byte, DetachedContentOffset)
+	if _, err := io.ReadFull(f, preamble); err != nil {
+		f.Close()
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, ErrDetachedContentMismatch
+		}
+		return nil, err
+	}
+	if !bytes.Equal(preamble[:4], detachedContentMagic[:]) || !bytes.Equal(preamble[4:], header.FileInfo.ID) {
+		f.Close()
+		return nil, ErrDetachedContentMismatch
+	}
+	return f, nil
+}
@@ -0,0 +1,94 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetachedContent(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("detached"), 3000)
+	id, err := NewRandomFileID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		SaltedKeys:  true,
+		Password:    [16]byte{1, 2, 3},
+		FileInfo: FileInfo{
+			Name:            "a.txt",
+			Size:            uint64(len(content)),
+			FileContentHash: sha256.Sum256(content),
+			ID:              id,
+			Detached:        true,
+		},
+	}
+
+	// content file
+	contentBuf := bytes.NewBuffer(nil)
+	if err := WriteDetachedContentPreamble(contentBuf, header); err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := header.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptContentWithSectorSize(cipher, bytes.NewReader(content), contentBuf, header.ContentSectorSize()); err != nil {
+		t.Fatal(err)
+	}
+	headerPath := filepath.Join(dir, "a.txt"+DetachedHeaderExt)
+	if DetachedContentPath(headerPath) != filepath.Join(dir, "a.txt"+DetachedContentExt) {
+		t.Fatal("unexpected content path")
+	}
+	if err := os.WriteFile(DetachedContentPath(headerPath), contentBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// header file
+	encoded, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(headerPath, append(ZipHeader(), encoded...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	header2, err := ReadHeaderFromPath(headerPath, header.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header2.FileInfo.Detached || !bytes.Equal(header2.FileInfo.ID, id) {
+		t.Fatal("detached content id not restored")
+	}
+	f, err := OpenDetachedContent(headerPath, header2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cipher, err = header2.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	if err := DecryptContentWithSectorSize(cipher, f, out, int64(header2.FileInfo.Size), header2.ContentSectorSize()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+
+	// the content file of another header
+	header2.FileInfo.ID = ContentFileID(header2.FileInfo.FileContentHash[:])
+	if _, err := OpenDetachedContent(headerPath, header2); !errors.Is(err, ErrDetachedContentMismatch) {
+		t.Fatal("content of another header should fail")
+	}
+	header2.FileInfo.ID = nil
+	if _, err := header2.MarshalBinary(); !errors.Is(err, ErrInvalidFileID) {
+		t.Fatal("detached content without id should fail")
+	}
+}
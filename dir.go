@@ -0,0 +1,83 @@
+package emix
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DirEntry is an emix file of directory
+type DirEntry struct {
+	Path   string
+	Header *EmixHeader
+}
+
+// ListDir read the emix headers of regular files in dir, non-emix files are skipped
+func ListDir(dir string, password [16]byte) ([]DirEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphers := NewCipherCache()
+	entries := make([]DirEntry, 0, len(files))
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		header, err := readHeaderFromPath(path, password, ciphers)
+		if err != nil {
+			if errors.Is(err, ErrInvalidEmixHeader) {
+				continue
+			}
+			return nil, err
+		}
+		entries = append(entries, DirEntry{
+			Path:   path,
+			Header: header,
+		})
+	}
+	return entries, nil
+}
+
+// WalkDirFunc is called by WalkDir for each emix file, returning filepath.SkipDir skips
+// the rest files of the directory, and filepath.SkipAll stops walking
+type WalkDirFunc func(path string, header *EmixHeader) error
+
+// WalkDir walk the file tree rooted at dir in lexical order and call fn with the header
+// of each regular emix file, non-emix files are skipped, headers are read one at a time
+func WalkDir(dir string, password [16]byte, fn WalkDirFunc) error {
+	ciphers := NewCipherCache()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		header, err := readHeaderFromPath(path, password, ciphers)
+		if err != nil {
+			if errors.Is(err, ErrInvalidEmixHeader) {
+				return nil
+			}
+			return err
+		}
+		return fn(path, header)
+	})
+}
+
+// ReadHeaderFromPath read the emix header of the file path
+func ReadHeaderFromPath(path string, password [16]byte) (*EmixHeader, error) {
+	return readHeaderFromPath(path, password, nil)
+}
+
+func readHeaderFromPath(path string, password [16]byte, ciphers *CipherCache) (*EmixHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHeader(f, password, ciphers)
+}
@@ -0,0 +1,126 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestEmixFile write an emix file with header and content to path
+func writeTestEmixFile(t *testing.T, path string, header *EmixHeader, content []byte) {
+	t.Helper()
+	header.FileInfo.Size = uint64(len(content))
+	header.FileInfo.FileContentHash = sha256.Sum256(content)
+	header.FileMAC = header.FileMAC || header.needsFileMAC()
+	encodedHeader, err := header.MarshalBinary()
+	assert.Nil(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	if !header.NoDisguise {
+		buf.Write(ZipHeader())
+	}
+	buf.Write(encodedHeader)
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		assert.Nil(t, err)
+		err = EncryptContentWithSectorSize(cipher, bytes.NewReader(content), buf, header.ContentSectorSize())
+		assert.Nil(t, err)
+	} else {
+		buf.Write(content)
+	}
+	assert.Nil(t, os.WriteFile(path, withFileMAC(t, header, buf.Bytes()), 0644))
+}
+
+func TestListDir(t *testing.T) {
+	dir := t.TempDir()
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	writeTestEmixFile(t, filepath.Join(dir, "1.zip"), &EmixHeader{
+		FileInfo: FileInfo{Name: "a.txt", Mode: 0644},
+	}, []byte("a"))
+	writeTestEmixFile(t, filepath.Join(dir, "2.zip"), &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "b.txt", Mode: 0600},
+	}, []byte("b"))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "3.txt"), []byte("not emix"), 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "4"), 0755))
+
+	entries, err := ListDir(dir, password)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, filepath.Join(dir, "1.zip"), entries[0].Path)
+	assert.Equal(t, "a.txt", entries[0].Header.FileInfo.Name)
+	assert.Equal(t, filepath.Join(dir, "2.zip"), entries[1].Path)
+	assert.Equal(t, "b.txt", entries[1].Header.FileInfo.Name)
+	assert.True(t, entries[1].Header.EncryptData)
+
+	// wrong password
+	_, err = ListDir(dir, [16]byte{})
+	assert.NotNil(t, err)
+
+	_, err = ReadHeaderFromPath(filepath.Join(dir, "3.txt"), password)
+	assert.ErrorIs(t, err, ErrInvalidEmixHeader)
+}
+
+func TestWalkDir(t *testing.T) {
+	dir := t.TempDir()
+	password := [16]byte{1, 2, 3}
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "c"), 0755))
+	for _, path := range []string{"1.zip", "a/1.zip", "a/2.zip", "a/b/1.zip", "c/1.zip"} {
+		writeTestEmixFile(t, filepath.Join(dir, path), &EmixHeader{
+			EncryptInfo: true,
+			Password:    password,
+			FileInfo:    FileInfo{Name: path, Mode: 0644},
+		}, []byte(path))
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a", "0.txt"), []byte("not emix"), 0644))
+
+	walk := func(fn func(path string) error) []string {
+		t.Helper()
+		var visited []string
+		err := WalkDir(dir, password, func(path string, header *EmixHeader) error {
+			rel, _ := filepath.Rel(dir, path)
+			assert.Equal(t, filepath.ToSlash(rel), header.FileInfo.Name)
+			visited = append(visited, header.FileInfo.Name)
+			return fn(header.FileInfo.Name)
+		})
+		assert.Nil(t, err)
+		return visited
+	}
+
+	all := walk(func(string) error { return nil })
+	assert.Equal(t, []string{"1.zip", "a/1.zip", "a/2.zip", "a/b/1.zip", "c/1.zip"}, all)
+
+	// skip the rest of directory a
+	visited := walk(func(path string) error {
+		if path == "a/1.zip" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"1.zip", "a/1.zip", "c/1.zip"}, visited)
+
+	// stop early
+	visited = walk(func(path string) error {
+		if path == "a/2.zip" {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"1.zip", "a/1.zip", "a/2.zip"}, visited)
+
+	// errors of callback are returned
+	err := WalkDir(dir, password, func(string, *EmixHeader) error { return os.ErrClosed })
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	// wrong password
+	err = WalkDir(dir, [16]byte{}, func(string, *EmixHeader) error { return nil })
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,386 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// EncryptOptions are the options of EncryptFile
+type EncryptOptions struct {
+	// Header describes the file, its mix type, Password and FileInfo are set by the caller,
+	// FileInfo.Size, FileInfo.FileContentHash and FileInfo.ChunkHashes are computed from content
+	Header *EmixHeader
+	// SectorSize of encrypted content, 0 keeps Header.SectorSize, see RecommendSectorSize
+	SectorSize int
+	// Transforms are applied to src in order before it is encrypted and recorded in FileInfo.Transforms with
+	// the size of src as FileInfo.OriginalSize, src is already encoded if only FileInfo.Transforms is set
+	Transforms []string
+	// Sparse store only the data extents of src if it is an *os.File with holes, they are recorded in FileInfo.Sparse
+	Sparse bool
+	// ChunkHashes record the hashes of content chunks of ChunkSizeFor(FileInfo.Size), FileInfo.Size must be the size of src
+	ChunkHashes bool
+	// Content receives the content of a split file, FileInfo.Detached is set and dst only holds the header
+	Content io.WriteSeeker
+	// Mmap encrypt by memory mapping if src and the content destination are *os.File, content is copied if it is unsupported
+	Mmap bool
+	// WrapWriter wrap the writer of content, e.g. to rate limit it, it is not used by Mmap
+	WrapWriter func(w io.Writer) io.Writer
+	// Progress receives a copy of the stored content as it is written, e.g. to count written bytes
+	Progress io.Writer
+	// BeforeHeader is called once the content is written and FileInfo is complete, before the header is written
+	BeforeHeader func(header *EmixHeader) error
+}
+
+// DecryptOptions are the options of DecryptFile
+type DecryptOptions struct {
+	// Password decrypts files without embedded password
+	Password [16]byte
+	// Ciphers caches keys across files, it can be nil
+	Ciphers *CipherCache
+	// CheckHeader is called before any content is written, e.g. to check the file name
+	CheckHeader func(header *EmixHeader) error
+	// AllowLargeKDF accept kdf params over the read limit, see EmixHeader.AllowLargeKDF
+	AllowLargeKDF bool
+	// Header is the already read header of src, CheckHeader is not called and the file mac is not verified
+	// again, the caller checks it before, see VerifyFileMAC
+	Header *EmixHeader
+	// Content is the content of a split file, see OpenDetachedContent
+	Content io.ReadSeeker
+	// Mmap decrypt by memory mapping if the content is an *os.File, it is read if mapping is unsupported
+	Mmap bool
+	// WrapWriter wrap dst, e.g. to rate limit it
+	WrapWriter func(w io.Writer) io.Writer
+	// Progress receives a copy of the restored content as it is written to dst, the holes of a sparse file are skipped
+	Progress io.Writer
+}
+
+// sparseFile is the dst of DecryptFile restoring the holes of a sparse file
+type sparseFile interface {
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// EncryptFile write an emix file of content src to dst from its start, the zip header, emix header,
+// content and file mac are written, the file mac is always written for encrypted content of new headers.
+// With FileInfo.Sparse set src is only the data extents. Streamed is not supported, see NewStreamWriter
+func EncryptFile(src io.Reader, dst io.WriteSeeker, opts EncryptOptions) error {
+	header := opts.Header
+	if header == nil {
+		return errors.New("missing header")
+	}
+	if header.Streamed {
+		return errors.New("can not encrypt stream to a writer")
+	}
+	info := &header.FileInfo
+	if opts.Content != nil {
+		info.Detached = true
+	}
+	if info.Detached && opts.Content == nil {
+		return errors.New("split file needs a content writer")
+	}
+	// encrypted content of new headers is always authenticated
+	if header.needsFileMAC() {
+		header.FileMAC = true
+	}
+	rw, ok := dst.(io.ReadWriteSeeker)
+	if header.FileMAC && !ok {
+		return errors.New("file mac needs a readable dst")
+	}
+	if opts.SectorSize != 0 && header.EncryptData {
+		// keep default sector size unset for compatibility
+		header.SectorSize = opts.SectorSize
+		if opts.SectorSize == XTSSectorSize {
+			header.SectorSize = 0
+		}
+	}
+
+	// the header length is known before content is written, its extensions are set first
+	file, _ := src.(*os.File)
+	content, plain := src, true
+	if opts.Sparse && file != nil {
+		content, plain = sparseContent(file, info)
+	}
+	// the size before transforms is recorded as OriginalSize
+	var original *countWriter
+	if len(opts.Transforms) > 0 {
+		original = &countWriter{w: io.Discard}
+		encoded, err := EncodeContent(io.TeeReader(content, original), opts.Transforms)
+		if err != nil {
+			return err
+		}
+		content, plain = encoded, false
+		info.Transforms = opts.Transforms
+	}
+	if opts.ChunkHashes {
+		info.ChunkSize = ChunkSizeFor(info.Size)
+	}
+	size := info.Size
+	if err := header.Validate(); err != nil {
+		return err
+	}
+
+	// write content first, Size and FileContentHash of header are known after
+	contentDst, contentOffset := dst, header.ContentOffset()
+	if opts.Content != nil {
+		contentDst, contentOffset = opts.Content, DetachedContentOffset
+	}
+	if _, err := contentDst.Seek(contentOffset, io.SeekStart); err != nil {
+		return err
+	}
+	w := io.Writer(contentDst)
+	if opts.WrapWriter != nil {
+		w = opts.WrapWriter(w)
+	}
+	hash := header.NewContentHash()
+	hashes := []io.Writer{hash}
+	var chunks *ChunkHasher
+	if info.ChunkSize != 0 {
+		chunks = NewChunkHasher(info.ChunkSize)
+		hashes = append(hashes, chunks)
+	}
+	if opts.Progress != nil {
+		hashes = append(hashes, opts.Progress)
+	}
+	counter := &countWriter{w: io.MultiWriter(hashes...)}
+	teer := io.TeeReader(content, counter)
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return err
+		}
+		err = ErrMmapUnsupported
+		if mf, ok := contentDst.(*os.File); ok && opts.Mmap && plain && file != nil {
+			err = EncryptFileMapped(cipher, file, mf, contentOffset, header.ContentSectorSize(), counter)
+		}
+		if errors.Is(err, ErrMmapUnsupported) {
+			err = EncryptContentWithSectorSize(cipher, teer, w, header.ContentSectorSize())
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		if _, err := io.Copy(w, teer); err != nil {
+			return err
+		}
+	}
+	// the chunk hashes of header are counted by the size before content is written
+	if chunks != nil && uint64(counter.n) != size {
+		return fmt.Errorf("content size %d differs from file info size %d", counter.n, size)
+	}
+	info.Size = uint64(counter.n)
+	if original != nil {
+		info.OriginalSize = uint64(original.n)
+	}
+	copy(info.FileContentHash[:], hash.Sum(nil))
+	if chunks != nil {
+		info.ChunkHashes = chunks.Sum()
+	}
+	if opts.BeforeHeader != nil {
+		if err := opts.BeforeHeader(header); err != nil {
+			return err
+		}
+	}
+
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !header.NoDisguise {
+		if _, err := dst.Write(ZipHeader()); err != nil {
+			return err
+		}
+	}
+	if _, err := dst.Write(encodedHeader); err != nil {
+		return err
+	}
+	if opts.Content != nil {
+		if _, err := opts.Content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := WriteDetachedContentPreamble(opts.Content, header); err != nil {
+			return err
+		}
+	}
+	if header.FileMAC {
+		return AppendFileMAC(rw, header)
+	}
+	_, err = dst.Seek(0, io.SeekEnd)
+	return err
+}
+
+// sparseContent return the data extents of f and record them in info if f has holes,
+// f itself and true are returned if it is dense or its holes can not be found
+func sparseContent(f *os.File, info *FileInfo) (io.Reader, bool) {
+	stat, err := f.Stat()
+	if err != nil {
+		return f, true
+	}
+	extents, err := DataExtents(f, stat.Size())
+	if err != nil {
+		return f, true
+	}
+	sparse := &SparseMap{Size: uint64(stat.Size()), Extents: extents}
+	if len(extents) > MaxSparseExtents || sparse.DataLength() == stat.Size() {
+		return f, true
+	}
+	info.Sparse = sparse
+	info.Size = uint64(sparse.DataLength())
+	return NewSparseReader(f, extents), false
+}
+
+// DecryptFile read the emix file src and write its restored content to dst, the content hash and
+// the file mac are verified. dst should be discarded if an error is returned, a hash mismatch is
+// only known after the content is written. The holes of a sparse file are restored if dst has
+// Seek and Truncate, e.g. an *os.File
+func DecryptFile(src io.ReadSeeker, dst io.Writer, opts DecryptOptions) error {
+	header := opts.Header
+	if header == nil {
+		header = &EmixHeader{
+			Password:      opts.Password,
+			Ciphers:       opts.Ciphers,
+			AllowLargeKDF: opts.AllowLargeKDF,
+		}
+		if err := header.UnmarshalFromFile(src); err != nil {
+			return err
+		}
+		if opts.CheckHeader != nil {
+			if err := opts.CheckHeader(header); err != nil {
+				return err
+			}
+		}
+		// the ciphertext is authenticated before anything is decrypted from it
+		if header.FileMAC && !header.Streamed {
+			if err := verifySeekerFileMAC(src, header); err != nil {
+				return contentAuthError(err, header)
+			}
+		}
+	}
+	w := dst
+	if opts.WrapWriter != nil {
+		w = opts.WrapWriter(w)
+	}
+	if opts.Progress != nil {
+		w = io.MultiWriter(w, opts.Progress)
+	}
+
+	// size and hash of stream are in the trailer, the stream reader validates them
+	if header.Streamed {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		sr, err := NewStreamReader(src, opts.Password)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, sr)
+		return err
+	}
+
+	// content of a split file is in its own file
+	content, contentOffset := src, header.ContentOffset()
+	if header.FileInfo.Detached {
+		if opts.Content == nil {
+			return errors.New("split file needs its content")
+		}
+		content, contentOffset = opts.Content, DetachedContentOffset
+	}
+	// garbage decrypted with a wrong password fails to be restored before the hash is checked,
+	// errors of restoring are told from errors of dst by recording both
+	out := &recordWriter{w: w}
+	w = out
+	sparse := header.FileInfo.Sparse
+	var sf sparseFile
+	if sparse != nil {
+		var ok bool
+		if sf, ok = dst.(sparseFile); !ok {
+			return errors.New("can not restore sparse file to a writer without Seek and Truncate")
+		}
+		w = NewSparseWriter(w, sf, sparse.Extents)
+	}
+	var decoder io.WriteCloser
+	if len(header.FileInfo.Transforms) > 0 {
+		var err error
+		if decoder, err = NewDecodeContentWriter(w, header.FileInfo.Transforms); err != nil {
+			return err
+		}
+		defer decoder.Close()
+		w = decoder
+	}
+	restoring := &recordWriter{w: w}
+	hash := header.NewContentHash()
+	mw := io.MultiWriter(restoring, hash)
+
+	if _, err := content.Seek(contentOffset, io.SeekStart); err != nil {
+		return err
+	}
+	size := int64(header.FileInfo.Size)
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return err
+		}
+		// the file mac is verified before
+		if a, ok := cipher.(*authenticatedCipher); ok {
+			cipher = a.ContentCipher
+		}
+		err = ErrMmapUnsupported
+		if mf, ok := content.(*os.File); ok && opts.Mmap {
+			err = DecryptFileMapped(cipher, mf, contentOffset, mw, size, header.ContentSectorSize())
+		}
+		if errors.Is(err, ErrMmapUnsupported) {
+			err = DecryptContentWithSectorSize(cipher, content, mw, size, header.ContentSectorSize())
+		}
+		if err != nil {
+			if restoring.err != nil && out.err == nil {
+				err = restoreError(err, header)
+			}
+			return err
+		}
+	} else {
+		if err := CopyContent(mw, content, size); err != nil {
+			return err
+		}
+	}
+	if decoder != nil {
+		if err := decoder.Close(); err != nil {
+			if out.err == nil {
+				err = restoreError(err, header)
+			}
+			return err
+		}
+	}
+	// recreate the trailing hole
+	if sparse != nil {
+		if err := sf.Truncate(int64(sparse.Size)); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(hash.Sum(nil), header.FileInfo.FileContentHash[:]) {
+		// garbage is decrypted with a wrong password
+		if header.EncryptData {
+			return fmt.Errorf("%w: content hash mismatch of %s, %w or corrupted content", ErrInvalidEmixFileContent, header.FileInfo.Name, ErrWrongPassword)
+		}
+		return fmt.Errorf("%w: content hash mismatch of %s", ErrInvalidEmixFileContent, header.FileInfo.Name)
+	}
+	return nil
+}
+
+// recordWriter write to w and record the last error of writing
+type recordWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,274 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// memFile is an in-memory io.ReadWriteSeeker
+type memFile struct {
+	data   []byte
+	offset int64
+}
+
+func (m *memFile) Read(p []byte) (int, error) {
+	if m.offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.offset:])
+	m.offset += int64(n)
+	return n, nil
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if end := m.offset + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	n := copy(m.data[m.offset:], p)
+	m.offset += int64(n)
+	return n, nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func TestEncryptDecryptFile(t *testing.T) {
+	content := bytes.Repeat([]byte("content of file"), 1000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		name   string
+		header EmixHeader
+	}{
+		{
+			name:   "plain",
+			header: EmixHeader{FileInfo: FileInfo{Name: "plain.txt"}},
+		},
+		{
+			name:   "encrypt info",
+			header: EmixHeader{EncryptInfo: true, Password: password, SaltedKeys: true, BindHeader: true, FileInfo: FileInfo{Name: "info.txt"}},
+		},
+		{
+			name:   "encrypt data",
+			header: EmixHeader{EncryptData: true, Password: password, SaltedKeys: true, BindHeader: true, SectorSize: 512, FileInfo: FileInfo{Name: "data.txt"}},
+		},
+		{
+			name:   "file mac",
+			header: EmixHeader{EncryptInfo: true, EncryptData: true, Password: password, SaltedKeys: true, BindHeader: true, FileMAC: true, FileInfo: FileInfo{Name: "mac.txt"}},
+		},
+		{
+			name:   "no disguise",
+			header: EmixHeader{EncryptData: true, Password: password, NoDisguise: true, FileInfo: FileInfo{Name: "nodisguise.txt"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &memFile{}
+			if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: &tt.header}); err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(f.data)) != tt.header.ContentOffset()+tt.header.CiphertextSize()+tt.header.TrailerLength() {
+				t.Fatal("file size not equal")
+			}
+			ok, err := IsEmixFile(bytes.NewReader(f.data))
+			if err != nil || !ok {
+				t.Fatal("should be an emix file", err)
+			}
+
+			var name string
+			plainText := bytes.NewBuffer(nil)
+			opts := DecryptOptions{
+				Password: password,
+				CheckHeader: func(header *EmixHeader) error {
+					name = header.FileInfo.Name
+					return nil
+				},
+			}
+			if err := DecryptFile(bytes.NewReader(f.data), plainText, opts); err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.header.FileInfo.Name || !bytes.Equal(plainText.Bytes(), content) {
+				t.Fatal("file not equal")
+			}
+
+			// a flipped content byte is detected
+			tampered := bytes.Clone(f.data)
+			tampered[tt.header.ContentOffset()+100] ^= 0x01
+			err = DecryptFile(bytes.NewReader(tampered), io.Discard, opts)
+			if tt.header.FileMAC {
+				if !errors.Is(err, ErrContentAuthFailed) {
+					t.Fatal("tampered content should fail authentication", err)
+				}
+			} else if !errors.Is(err, ErrInvalidEmixFileContent) {
+				t.Fatal("tampered content should fail", err)
+			}
+		})
+	}
+
+	// the header check stops before content is written
+	f := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: &EmixHeader{FileInfo: FileInfo{Name: "a.txt"}}}); err != nil {
+		t.Fatal(err)
+	}
+	errCheck := errors.New("check failed")
+	plainText := bytes.NewBuffer(nil)
+	err := DecryptFile(bytes.NewReader(f.data), plainText, DecryptOptions{CheckHeader: func(*EmixHeader) error { return errCheck }})
+	if !errors.Is(err, errCheck) || plainText.Len() != 0 {
+		t.Fatal("header check should stop decrypting", err)
+	}
+}
+
+func (m *memFile) Truncate(size int64) error {
+	if size < int64(len(m.data)) {
+		m.data = m.data[:size]
+	} else {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+	return nil
+}
+
+func TestEncryptDecryptFileOptions(t *testing.T) {
+	content := bytes.Repeat([]byte("content of file"), 100000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	newHeader := func() *EmixHeader {
+		return &EmixHeader{EncryptData: true, Password: password, SaltedKeys: true, BindHeader: true, FileMAC: true,
+			FileInfo: FileInfo{Name: "a.txt", Size: uint64(len(content))}}
+	}
+
+	// sector size, transforms, chunk hashes and progress
+	for _, opts := range []EncryptOptions{
+		{SectorSize: 512},
+		{SectorSize: XTSSectorSize},
+		{Transforms: []string{"gzip"}},
+		{ChunkHashes: true},
+		{Progress: &bytes.Buffer{}},
+	} {
+		opts.Header = newHeader()
+		f := &memFile{}
+		if err := EncryptFile(bytes.NewReader(content), f, opts); err != nil {
+			t.Fatal(err)
+		}
+		header := opts.Header
+		if opts.SectorSize != 0 && header.ContentSectorSize() != opts.SectorSize {
+			t.Fatal("sector size not set", header.ContentSectorSize())
+		}
+		if len(opts.Transforms) > 0 && (len(header.FileInfo.Transforms) == 0 || header.FileInfo.Size >= uint64(len(content)) ||
+			header.FileInfo.OriginalSize != uint64(len(content))) {
+			t.Fatal("content not transformed", header.FileInfo.Size, header.FileInfo.OriginalSize)
+		}
+		if opts.ChunkHashes && len(header.FileInfo.ChunkHashes) != 2 {
+			t.Fatal("chunk hashes not recorded", len(header.FileInfo.ChunkHashes))
+		}
+		if opts.Progress != nil && !bytes.Equal(opts.Progress.(*bytes.Buffer).Bytes(), content) {
+			t.Fatal("progress not written")
+		}
+		progress := &countWriter{w: io.Discard}
+		plainText := &bytes.Buffer{}
+		checkSize := func(header *EmixHeader) error {
+			if header.FileInfo.RestoredSize() != uint64(len(content)) {
+				return fmt.Errorf("restored size %d", header.FileInfo.RestoredSize())
+			}
+			return nil
+		}
+		if err := DecryptFile(bytes.NewReader(f.data), plainText, DecryptOptions{Password: password, Progress: progress, CheckHeader: checkSize}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plainText.Bytes(), content) || progress.n != int64(len(content)) {
+			t.Fatal("file not equal")
+		}
+	}
+
+	// a split file, dst only holds the header
+	header := newHeader()
+	header.FileInfo.ID = bytes.Repeat([]byte{1}, FileIDLength)
+	f, content2 := &memFile{}, &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header, Content: content2}); err != nil {
+		t.Fatal(err)
+	}
+	if !header.FileInfo.Detached || int64(len(f.data)) != header.ContentOffset()+header.TrailerLength() {
+		t.Fatal("content should be split")
+	}
+	plainText := &bytes.Buffer{}
+	if err := DecryptFile(bytes.NewReader(f.data), plainText, DecryptOptions{Password: password}); err == nil {
+		t.Fatal("split file needs its content")
+	}
+	err := DecryptFile(bytes.NewReader(f.data), plainText, DecryptOptions{Password: password, Content: bytes.NewReader(content2.data)})
+	if err != nil || !bytes.Equal(plainText.Bytes(), content) {
+		t.Fatal("file not equal", err)
+	}
+
+	// src of a sparse file is its data extents, dst is seeked and truncated to restore the holes
+	sparse := make([]byte, 1<<20)
+	copy(sparse[4096:], "data")
+	copy(sparse[8192:], "more")
+	header = newHeader()
+	header.FileInfo.Sparse = &SparseMap{Size: uint64(len(sparse)), Extents: []Extent{{4096, 4}, {8192, 4}}}
+	f = &memFile{}
+	if err := EncryptFile(bytes.NewReader([]byte("datamore")), f, EncryptOptions{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFile(bytes.NewReader(f.data), &bytes.Buffer{}, DecryptOptions{Password: password}); err == nil {
+		t.Fatal("sparse file needs a seekable dst")
+	}
+	restored := &memFile{}
+	if err := DecryptFile(bytes.NewReader(f.data), restored, DecryptOptions{Password: password}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored.data, sparse) {
+		t.Fatal("sparse file not equal")
+	}
+
+	// a wrong password fails the file mac
+	header = newHeader()
+	f = &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	err = DecryptFile(bytes.NewReader(f.data), io.Discard, DecryptOptions{Password: [16]byte{1}})
+	if !errors.Is(err, ErrWrongPassword) || !errors.Is(err, ErrContentAuthFailed) {
+		t.Fatal("wrong password should fail", err)
+	}
+
+	// garbage of a wrong password fails to be decoded before the hash of legacy files without file mac is checked
+	header = &EmixHeader{Version: 4, EncryptData: true, Password: password, SaltedKeys: true, FileInfo: FileInfo{Name: "a.txt"}}
+	f = &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header, Transforms: []string{"gzip"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = DecryptFile(bytes.NewReader(f.data), io.Discard, DecryptOptions{Password: [16]byte{1}})
+	if !errors.Is(err, ErrWrongPassword) || !errors.Is(err, ErrInvalidEmixFileContent) {
+		t.Fatal("wrong password should fail", err)
+	}
+	_, rc, err := Open(bytes.NewReader(f.data), [16]byte{1})
+	if err == nil {
+		_, err = io.Copy(io.Discard, rc)
+	}
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Fatal("wrong password should fail", err)
+	}
+	// errors of dst are not of the password
+	err = DecryptFile(bytes.NewReader(f.data), errWriter{}, DecryptOptions{Password: password})
+	if err == nil || errors.Is(err, ErrWrongPassword) {
+		t.Fatal("write error should fail", err)
+	}
+}
+
+// errWriter fails every write
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
@@ -0,0 +1,49 @@
+package emix
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// FileIDLength is the length of FileInfo.ID
+const FileIDLength = 16
+
+// fileIDDomain separates content derived file ids from other uses of the content hash
+const fileIDDomain = "emix file id"
+
+var ErrInvalidFileID = errors.New("invalid file id")
+
+// NewRandomFileID return a random version 4 UUID, unique for each call
+func NewRandomFileID() ([]byte, error) {
+	id := make([]byte, FileIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	setUUIDVersion(id, 4)
+	return id, nil
+}
+
+// ContentFileID return a version 8 UUID derived from contentHash, the same content hashed by the same cipher suite
+// always yields the same id
+func ContentFileID(contentHash []byte) []byte {
+	sum := sha256.Sum256(append([]byte(fileIDDomain), contentHash...))
+	id := sum[:FileIDLength]
+	setUUIDVersion(id, 8)
+	return id
+}
+
+// setUUIDVersion set the version and the RFC 9562 variant bits of id
+func setUUIDVersion(id []byte, version byte) {
+	id[6] = id[6]&0x0f | version<<4
+	id[8] = id[8]&0x3f | 0x80
+}
+
+// FormatFileID format id as a UUID string, e.g. 9f1c2a4e-7b3d-4c5e-8f6a-1b2c3d4e5f60
+func FormatFileID(id []byte) string {
+	if len(id) != FileIDLength {
+		return fmt.Sprintf("%x", id)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,48 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestFileID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([48])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	// random ids are unique
+	id1, err := NewRandomFileID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := NewRandomFileID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(id1, id2) {
+		t.Fatal("random ids should differ")
+	}
+	if m := uuid.FindStringSubmatch(FormatFileID(id1)); m == nil || m[1] != "4" {
+		t.Fatalf("invalid random id %s", FormatFileID(id1))
+	}
+
+	// content ids only depend on the content hash
+	hash := sha256.Sum256([]byte("content"))
+	id := ContentFileID(hash[:])
+	if !bytes.Equal(id, ContentFileID(hash[:])) {
+		t.Fatal("content ids of the same content should be equal")
+	}
+	other := sha256.Sum256([]byte("other"))
+	if bytes.Equal(id, ContentFileID(other[:])) {
+		t.Fatal("content ids of different content should differ")
+	}
+	if m := uuid.FindStringSubmatch(FormatFileID(id)); m == nil || m[1] != "8" {
+		t.Fatalf("invalid content id %s", FormatFileID(id))
+	}
+
+	info := FileInfo{Name: "a.txt", ID: id[:8]}
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrInvalidFileID) {
+		t.Fatal("short id should fail")
+	}
+}
@@ -0,0 +1,276 @@
+package emix
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// emixFS is a read-only fs.FS of a directory of emix files, see NewFS
+type emixFS struct {
+	dir      string
+	password [16]byte
+	ciphers  *CipherCache
+}
+
+// NewFS return a read-only fs.FS of the emix files in dir, a file is named by the base of its FileInfo.Name
+// in the directory it is in and reads its decrypted content, non-emix files are skipped. Directories keep
+// their names. Reading a file returns the restored file, ErrInvalidEmixFileContent is returned at the end
+// if the content hash mismatches, see Open
+func NewFS(dir string, password [16]byte) (fs.FS, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: errors.New("not a directory")}
+	}
+	return &emixFS{
+		dir:      dir,
+		password: password,
+		ciphers:  NewCipherCache(),
+	}, nil
+}
+
+// fsEntry is a file or directory of emixFS
+type fsEntry struct {
+	info fs.FileInfo
+	// path of the emix file or directory on disk
+	path string
+}
+
+// Open open the file or directory name
+func (e *emixFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := e.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.info.IsDir() {
+		entries, err := e.readDir(entry.path)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &fsDir{info: entry.info, entries: entries}, nil
+	}
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return nil, err
+	}
+	header := &EmixHeader{Password: e.password, Ciphers: e.ciphers}
+	err = header.UnmarshalFromFile(f)
+	var content io.ReadCloser
+	if err == nil {
+		content, err = openFile(f, header)
+	}
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{info: entry.info, f: f, content: content}, nil
+}
+
+// ReadDir read the directory name, entries are sorted by name
+func (e *emixFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := e.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !entry.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := e.readDir(entry.path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return dirEntries(entries), nil
+}
+
+// lookup find the entry of name, directories of name are directories on disk
+func (e *emixFS) lookup(name string) (fsEntry, error) {
+	if name == "." {
+		info, err := os.Stat(e.dir)
+		if err != nil {
+			return fsEntry{}, err
+		}
+		return fsEntry{info: info, path: e.dir}, nil
+	}
+	dir := e.dir
+	if parent := path.Dir(name); parent != "." {
+		dir = filepath.Join(e.dir, filepath.FromSlash(parent))
+	}
+	entries, err := e.readDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fsEntry{}, fs.ErrNotExist
+		}
+		return fsEntry{}, err
+	}
+	i, ok := slices.BinarySearchFunc(entries, path.Base(name), func(entry fsEntry, name string) int {
+		return strings.Compare(entry.info.Name(), name)
+	})
+	if !ok {
+		return fsEntry{}, fs.ErrNotExist
+	}
+	return entries[i], nil
+}
+
+// readDir return the directories and emix files of dir on disk sorted by name,
+// a directory takes the name before an emix file, and an emix file in lexical order before another
+func (e *emixFS) readDir(dir string) ([]fsEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fsEntry, 0, len(files))
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		names[file.Name()] = true
+		entries = append(entries, fsEntry{info: info, path: filepath.Join(dir, file.Name())})
+	}
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		p := filepath.Join(dir, file.Name())
+		header, err := readHeaderFromPath(p, e.password, e.ciphers)
+		if err != nil {
+			if errors.Is(err, ErrInvalidEmixHeader) {
+				continue
+			}
+			return nil, err
+		}
+		info := &fsFileInfo{header: header}
+		if names[info.Name()] {
+			continue
+		}
+		names[info.Name()] = true
+		entries = append(entries, fsEntry{info: info, path: p})
+	}
+	slices.SortFunc(entries, func(a, b fsEntry) int {
+		return strings.Compare(a.info.Name(), b.info.Name())
+	})
+	return entries, nil
+}
+
+func dirEntries(entries []fsEntry) []fs.DirEntry {
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, entry := range entries {
+		dirEntries[i] = fs.FileInfoToDirEntry(entry.info)
+	}
+	return dirEntries
+}
+
+// fsFileInfo is the fs.FileInfo of an emix file, Sys return its *FileInfo
+type fsFileInfo struct {
+	header *EmixHeader
+}
+
+func (i *fsFileInfo) Name() string {
+	return path.Base(i.header.FileInfo.Name)
+}
+
+func (i *fsFileInfo) Size() int64 {
+	return int64(i.header.FileInfo.RestoredSize())
+}
+
+func (i *fsFileInfo) Mode() fs.FileMode {
+	return fs.FileMode(i.header.FileInfo.Mode) &^ fs.ModeType
+}
+
+func (i *fsFileInfo) ModTime() time.Time {
+	return time.Unix(0, int64(i.header.FileInfo.ModifyTime))
+}
+
+func (i *fsFileInfo) IsDir() bool {
+	return false
+}
+
+func (i *fsFileInfo) Sys() any {
+	return &i.header.FileInfo
+}
+
+// fsFile is an emix file of emixFS
+type fsFile struct {
+	info    fs.FileInfo
+	f       *os.File
+	content io.ReadCloser
+	err     error
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Read read the restored file, the content hash is verified at the end
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.content.Read(p)
+	if errors.Is(err, io.EOF) {
+		// fs.ReadFile ignores the error of Close
+		if err = f.content.Close(); err == nil {
+			err = io.EOF
+		}
+	}
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Close close the file, the content hash is only verified by reading to the end
+func (f *fsFile) Close() error {
+	return f.f.Close()
+}
+
+// fsDir is a directory of emixFS
+type fsDir struct {
+	info    fs.FileInfo
+	entries []fsEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir read n entries of directory, all the rest if n is not positive
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(n, len(rest))]
+	}
+	d.offset += len(rest)
+	return dirEntries(rest), nil
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
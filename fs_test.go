@@ -0,0 +1,102 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	modifyTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeTestEmixFile(t, filepath.Join(dir, "1.zip"), &EmixHeader{
+		FileInfo: FileInfo{Name: "a.txt", Mode: 0644, ModifyTime: uint64(modifyTime.UnixNano())},
+	}, []byte("a"))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	large := bytes.Repeat([]byte("content of b"), 1000)
+	writeTestEmixFile(t, filepath.Join(dir, "sub", "2.zip"), &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "b.txt", Mode: 0600},
+	}, large)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "3.txt"), []byte("not emix"), 0644))
+	// transformed and sparse files read restored
+	f := &memFile{}
+	err := EncryptFile(bytes.NewReader(large), f, EncryptOptions{Header: &EmixHeader{
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "c.txt", Mode: 0644},
+	}, Transforms: []string{"gzip"}})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "4.zip"), f.data, 0644))
+	sparse := make([]byte, 1<<16)
+	copy(sparse[4096:], "data")
+	f = &memFile{}
+	err = EncryptFile(bytes.NewReader([]byte("data")), f, EncryptOptions{Header: &EmixHeader{
+		FileInfo: FileInfo{Name: "d.bin", Mode: 0644, Sparse: &SparseMap{Size: uint64(len(sparse)), Extents: []Extent{{4096, 4}}}},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "5.zip"), f.data, 0644))
+
+	fsys, err := NewFS(dir, password)
+	assert.Nil(t, err)
+	assert.Nil(t, fstest.TestFS(fsys, "a.txt", "sub/b.txt", "c.txt", "d.bin"))
+
+	data, err := fs.ReadFile(fsys, "a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), data)
+	data, err = fs.ReadFile(fsys, "sub/b.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+	data, err = fs.ReadFile(fsys, "c.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+	data, err = fs.ReadFile(fsys, "d.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, sparse, data)
+	info, err := fs.Stat(fsys, "c.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(large)), info.Size())
+
+	info, err = fs.Stat(fsys, "a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt", info.Name())
+	assert.Equal(t, int64(1), info.Size())
+	assert.Equal(t, fs.FileMode(0644), info.Mode())
+	assert.True(t, info.ModTime().Equal(modifyTime))
+	assert.Equal(t, "a.txt", info.Sys().(*FileInfo).Name)
+
+	// non-emix files are skipped
+	entries, err := fs.ReadDir(fsys, ".")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "a.txt", entries[0].Name())
+	assert.Equal(t, "sub", entries[3].Name())
+	assert.True(t, entries[3].IsDir())
+	_, err = fs.ReadFile(fsys, "3.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = fs.ReadFile(fsys, "1.zip")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// tampered content fails the file mac before reading
+	path := filepath.Join(dir, "sub", "2.zip")
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	raw[len(raw)-FileMACLength-1] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, raw, 0600))
+	_, err = fs.ReadFile(fsys, "sub/b.txt")
+	assert.True(t, errors.Is(err, ErrContentAuthFailed))
+
+	_, err = NewFS(filepath.Join(dir, "3.txt"), password)
+	assert.NotNil(t, err)
+}
@@ -2,49 +2,124 @@ package emix
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math/bits"
 	"os"
 )
 
 // emix file structure
 // [zip header] [emix header] [file content]
+// the zip header is omitted if the file is not disguised
+// versioned emix header starts with [4-byte versioned magic] [1-byte version], unversioned header written before
+// versions starts with [4-byte magic], the random bytes and mix type follow in all versions,
+// version 2 adds the kdf after mix type, see KDFParams, version 3 does not pad encrypted content, see stolenSectors,
+// version 4 derives the content key with the version and the file mac bit, see contentSalt,
+// version 5 encrypted content always has the file mac, see needsFileMAC
 
 var (
 	zipHeaderMagic  = [4]byte{0x50, 0x4b, 0x03, 0x04}
 	zipHeaderLength = 64
 
 	emixHeaderMagic              = [4]byte{0x45, 0x4d, 0x49, 0x58} // EMIX
+	emixHeaderVersionedMagic     = [4]byte{0x45, 0x4d, 0x58, 0x56} // EMXV
 	emixHeaderMixTypeStandard    = [2]byte{0x00, 0x00}
 	emixHeaderMixTypeEncryptInfo = [2]byte{0x00, 0x01}
 	emixHeaderMixTypeEncryptData = [2]byte{0x00, 0x02}
+	// streamed mix type means file size and content hash are in the stream trailer
+	emixHeaderMixTypeStreamed = [2]byte{0x00, 0x04}
+	// file mac mix type means the file ends with a HMAC-SHA256 of all preceding bytes
+	emixHeaderMixTypeFileMAC = [2]byte{0x00, 0x08}
 	// embed password mask use mix type first byte
 	emixHeaderEmbedPasswordMask = byte(0x01)
+	// no disguise mask use mix type first byte, the file has no zip header
+	emixHeaderNoDisguiseMask = byte(0x02)
+	// salted keys mask use mix type first byte, keys are derived with the random bytes as salt
+	emixHeaderSaltedKeysMask = byte(0x04)
+	// bind header mask use mix type first byte, encrypted file info authenticates the preceding header bytes
+	emixHeaderBindHeaderMask = byte(0x08)
+	// cipher suite use the high 4 bits of mix type second byte, see CipherSuiteID
+	// sector size use the high 4 bits of mix type first byte,
+	// 0 means XTSSectorSize, n means 1 << (n + 8)
+	emixHeaderSectorSizeShift = 4
+
+	// HeaderVersion is the latest emix header version, headers are written with it by default
+	HeaderVersion = uint8(5)
 
 	// [4-byte magic] [16-byte random] [2-byte mix type] [16-byte password]
 	// [2-byte file info length] [bytes min file info] [32-byte hash]
+	// unversioned header is the shortest
 	emixHeaderMinLength = 4 + 16 + 2 + 16 + 2 + fileInfoEncodedMinLength + 32
-	// [4-byte magic] [16-byte random] [2-byte mix type] [16-byte password]
+	// [4-byte magic] [1-byte version] [16-byte random] [2-byte mix type] [4-byte kdf] [16-byte password]
 	// [2-byte file info length] [bytes max encrypted file info] [32-byte hash]
-	// encrypted file info add 28 bytes
-	emixHeaderMaxLength = 4 + 16 + 2 + 16 + 2 + fileInfoEncodedMaxLength + 28 + 32
+	// encrypted file info add the AEAD nonce and tag
+	emixHeaderMaxLength = 4 + 1 + 16 + 2 + kdfEncodedLength + 16 + 2 + fileInfoEncodedMaxLength + fileInfoMaxOverhead + 32
 
 	fileNameMinLength = 1
 	fileNameMaxLength = 255
 	// [2-byte file name length] [file name] [8-byte file size] [4-byte mode]
 	// [8-byte create time] [8-byte modify time] [32-byte file content hash]
+	// [extensions]
 	fileInfoEncodedMinLength = 2 + fileNameMinLength + 8 + 4 + 8 + 8 + 32
-	fileInfoEncodedMaxLength = 2 + fileNameMaxLength + 8 + 4 + 8 + 8 + 32
+	// file info length use 2 bytes, keep room for encryption
+	fileInfoEncodedMaxLength = 0xffff - fileInfoMaxOverhead
+	// max AEAD overhead of encrypted file info among supported algorithms
+	fileInfoMaxOverhead = aesgcmOverhead
+
+	// extension: [2-byte type] [2-byte length] [value]
+	// unknown extension types are skipped when parsing
+	fileInfoExtensionHeaderLength = 2 + 2
+	fileInfoExtensionPreview      = uint16(1)
+	fileInfoExtensionToolVersion  = uint16(2)
+	fileInfoExtensionChunkHashes  = uint16(3)
+	fileInfoExtensionOwner        = uint16(4)
+	fileInfoExtensionTransforms   = uint16(5)
+	fileInfoExtensionSparse       = uint16(6)
+	fileInfoExtensionXattrs       = uint16(7)
+	fileInfoExtensionLinkTarget   = uint16(8)
+	fileInfoExtensionID           = uint16(9)
+	fileInfoExtensionDetached     = uint16(10)
+	fileInfoExtensionCDCChunks    = uint16(11)
+	// [8-byte size of content before transforms]
+	fileInfoExtensionOriginalSize = uint16(12)
+	originalSizeEncodedLength     = 8
+
+	// PreviewMaxLength is the max length of FileInfo.Preview
+	PreviewMaxLength = 48 * 1024
+	// ToolVersionMaxLength is the max length of FileInfo.ToolVersion
+	ToolVersionMaxLength = 64
 
 	/// errors
 	ErrNameTooShort           = errors.New("name too short")
 	ErrNameTooLong            = errors.New("name too long")
 	ErrInvalidEmixHeader      = errors.New("invalid emix header")
 	ErrInvalidEmixFileContent = errors.New("invalid emix file content")
+	ErrTruncatedContent       = errors.New("truncated content")
 	ErrInvalidEncodedFileInfo = errors.New("invalid file info")
+	ErrInvalidSectorSize      = errors.New("invalid sector size")
+	ErrPreviewTooLarge        = errors.New("preview too large")
+	ErrToolVersionTooLong     = errors.New("tool version too long")
+	ErrFileInfoTooLong        = errors.New("file info too long")
+	ErrContentSchemeMismatch  = errors.New("content scheme mismatch")
+	ErrHeaderLengthChanged    = errors.New("header length changed")
+	ErrUnsupportedCipherSuite = errors.New("unsupported cipher suite")
+	ErrFileMACUnsupported     = errors.New("file mac unsupported with embed password or stream")
+	ErrFileMACMismatch        = errors.New("file mac mismatch")
+	ErrMissingKey             = errors.New("missing key, the password is all zero")
+	ErrInvalidMixType         = errors.New("invalid mix type")
+	// ErrContentAuthFailed means the file mac does not match before content is decrypted, the ciphertext is not trusted
+	ErrContentAuthFailed = errors.New("content authentication failed")
+	// ErrUnsupportedVersion means the header is written by a newer emix, it can not be read
+	ErrUnsupportedVersion = errors.New("unsupported emix header version")
+	// ErrUnsafeFileName means the name is absolute or escapes the directory it is restored to, e.g. ../a.txt
+	ErrUnsafeFileName = errors.New("unsafe file name")
+	// ErrWrongPassword means encrypted file info failed authentication, the password is wrong or the header is tampered
+	ErrWrongPassword = errors.New("wrong password")
 )
 
 // ZipHeader return zip header
@@ -58,17 +133,58 @@ func ZipHeaderLength() int {
 }
 
 type EmixHeader struct {
+	// Version is the header version, it is set to HeaderVersion on marshaling if it is 0
+	Version uint8
+	// Unversioned means the header has the layout before versions, without version byte,
+	// it is set when reading such a header so rewriting it keeps the layout
+	Unversioned bool
 	EncryptInfo bool
 	EncryptData bool
 	// EmbedPassword must only use auto generated 16-byte password
 	EmbedPassword bool
 	Password      [16]byte
-	FileInfo      FileInfo
+	// SectorSize is the AES-XTS sector size of content, 0 means XTSSectorSize
+	SectorSize int
+	FileInfo   FileInfo
+	// NoDisguise means the file has no zip header and starts with the emix header
+	NoDisguise bool
+	// Salt is the random bytes of header, it is generated on first use if not set
+	Salt [16]byte
+	// SaltedKeys means keys are derived from Password with Salt, so each file is uniquely keyed
+	SaltedKeys bool
+	// BindHeader means magic, random bytes and mix type are additional data of encrypted file info,
+	// so tampering with them fails the decryption
+	BindHeader bool
+	// Streamed means the file is an emix stream, file size and content hash are in the trailer
+	Streamed bool
+	// FileMAC means the file ends with a HMAC-SHA256 of all preceding bytes, see NewFileMAC,
+	// EncryptFile sets it for encrypted content of version 5
+	FileMAC bool
+	// CipherSuite select the file info AEAD, content cipher and content hash,
+	// suites other than DefaultCipherSuite need SaltedKeys
+	CipherSuite CipherSuiteID
+	// KDF stretch Password by Argon2id before keys are derived, it needs SaltedKeys and version 2,
+	// Password is used as is if nil
+	KDF *KDFParams
+	// Ciphers is optional, reuse derived ciphers across headers if set
+	Ciphers *CipherCache
+	// AllowLargeKDF means KDF over MaxReadKDFMemory or MaxReadKDFTime is accepted on unmarshal,
+	// only for files of a trusted source, otherwise it fails with ErrKDFOverLimit
+	AllowLargeKDF bool
+	// AllowZeroKey means an all-zero Password is used to encrypt on purpose,
+	// otherwise marshaling an encrypted header without EmbedPassword fails with ErrMissingKey
+	AllowZeroKey bool
+
+	// head is the bytes of file before content, it is read by UnmarshalFromFile if the content is
+	// authenticated by the file mac, so DecryptContent checks the file mac, see NewContentCipher
+	head []byte
 
 	// raw data
 	// magic          [4]byte
+	// version        [1]byte, only in versioned header
 	// random         [16]byte
 	// mixType        [2]byte
+	// kdf            [4]byte, since version 2
 	// password       [16]byte
 	// fileInfoLength [2]byte
 	// fileInfo       []byte
@@ -76,13 +192,25 @@ type EmixHeader struct {
 }
 
 func (e *EmixHeader) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, 0, emixHeaderMaxLength)
-	// add magic
-	buf = append(buf, emixHeaderMagic[:]...)
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, e.EncodedLength())
+	// add magic and version
+	if e.Unversioned {
+		buf = append(buf, emixHeaderMagic[:]...)
+	} else {
+		buf = append(buf, emixHeaderVersionedMagic[:]...)
+		if e.Version == 0 {
+			e.Version = HeaderVersion
+		}
+		buf = append(buf, e.Version)
+	}
 	// add random bytes
-	random := make([]byte, 16)
-	rand.Read(random)
-	buf = append(buf, random...)
+	if err := e.ensureSalt(); err != nil {
+		return nil, err
+	}
+	buf = append(buf, e.Salt[:]...)
 	// add mix type
 	mixType := [2]byte{}
 	if e.EncryptInfo {
@@ -91,12 +219,35 @@ func (e *EmixHeader) MarshalBinary() ([]byte, error) {
 	if e.EncryptData {
 		mixType[1] = mixType[1] | emixHeaderMixTypeEncryptData[1]
 	}
+	if e.Streamed {
+		mixType[1] = mixType[1] | emixHeaderMixTypeStreamed[1]
+	}
+	if e.FileMAC {
+		mixType[1] = mixType[1] | emixHeaderMixTypeFileMAC[1]
+	}
+	mixType[1] = mixType[1] | byte(e.CipherSuite)<<emixHeaderCipherSuiteShift
+	if e.SectorSize != 0 {
+		mixType[0] = byte(bits.TrailingZeros(uint(e.SectorSize))-8) << emixHeaderSectorSizeShift
+	}
+	if e.NoDisguise {
+		mixType[0] = mixType[0] | emixHeaderNoDisguiseMask
+	}
+	if e.SaltedKeys {
+		mixType[0] = mixType[0] | emixHeaderSaltedKeysMask
+	}
+	if e.BindHeader {
+		mixType[0] = mixType[0] | emixHeaderBindHeaderMask
+	}
+	if e.EmbedPassword {
+		mixType[0] = mixType[0] | emixHeaderEmbedPasswordMask
+	}
+	buf = append(buf, mixType[:]...)
+	if e.hasKDF() {
+		buf = append(buf, marshalKDF(e.KDF)...)
+	}
 	if e.EmbedPassword {
-		mixType[0] = emixHeaderEmbedPasswordMask
-		buf = append(buf, mixType[:]...)
 		buf = append(buf, e.Password[:]...)
 	} else {
-		buf = append(buf, mixType[:]...)
 		buf = append(buf, make([]byte, 16)...)
 	}
 
@@ -107,7 +258,11 @@ func (e *EmixHeader) MarshalBinary() ([]byte, error) {
 	}
 	// encrypt fileinfo if needed
 	if e.EncryptInfo {
-		cipherFileInfo, err := AESGCMEncrypt(encodedFileInfo, e.Password)
+		aead, err := e.aead()
+		if err != nil {
+			return nil, err
+		}
+		cipherFileInfo, err := aesgcmEncrypt(aead, encodedFileInfo, e.additionalData(buf))
 		if err != nil {
 			return nil, err
 		}
@@ -141,21 +296,62 @@ func (e *EmixHeader) UnmarshalBinaryFromReader(r io.Reader) error {
 	}
 	buf = buf[:n]
 
-	// magic
+	// magic and version
 	i := 0
-	if !bytes.Equal(buf[i:4], emixHeaderMagic[:]) {
+	switch {
+	case bytes.Equal(buf[i:4], emixHeaderMagic[:]):
+		e.Unversioned = true
+		e.Version = 0
+		i += 4
+	case bytes.Equal(buf[i:4], emixHeaderVersionedMagic[:]):
+		e.Unversioned = false
+		e.Version = buf[4]
+		if e.Version == 0 || e.Version > HeaderVersion {
+			return fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+		}
+		i += 4 + 1
+	default:
 		return ErrInvalidEmixHeader
 	}
 	// random bytes
-	i += 4
+	copy(e.Salt[:], buf[i:i+16])
 	// mix type
 	i += 16
 	mixType := buf[i : i+2]
 	e.EncryptInfo = (mixType[1] & emixHeaderMixTypeEncryptInfo[1]) > 0
 	e.EncryptData = (mixType[1] & emixHeaderMixTypeEncryptData[1]) > 0
+	e.Streamed = (mixType[1] & emixHeaderMixTypeStreamed[1]) > 0
+	e.FileMAC = (mixType[1] & emixHeaderMixTypeFileMAC[1]) > 0
 	e.EmbedPassword = (mixType[0] & emixHeaderEmbedPasswordMask) > 0
-	// password
+	e.NoDisguise = (mixType[0] & emixHeaderNoDisguiseMask) > 0
+	e.SaltedKeys = (mixType[0] & emixHeaderSaltedKeysMask) > 0
+	e.BindHeader = (mixType[0] & emixHeaderBindHeaderMask) > 0
+	e.CipherSuite = CipherSuiteID(mixType[1] >> emixHeaderCipherSuiteShift)
+	if _, err := e.CipherSuite.suite(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEmixHeader, err)
+	}
+	e.SectorSize = 0
+	if sectorSizeBits := mixType[0] >> emixHeaderSectorSizeShift; sectorSizeBits > 0 {
+		e.SectorSize = 1 << (sectorSizeBits + 8)
+		if err := ValidSectorSize(e.SectorSize); err != nil {
+			return ErrInvalidEmixHeader
+		}
+	}
+	// kdf
 	i += 2
+	e.KDF = nil
+	if e.hasKDF() {
+		kdf, err := unmarshalKDF(buf[i : i+kdfEncodedLength])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEmixHeader, err)
+		}
+		if kdf != nil && kdf.OverReadLimit() && !e.AllowLargeKDF {
+			return fmt.Errorf("%w: %s", ErrKDFOverLimit, kdf)
+		}
+		e.KDF = kdf
+		i += kdfEncodedLength
+	}
+	// password
 	if e.EmbedPassword {
 		copy(e.Password[:], buf[i:i+16])
 	}
@@ -169,10 +365,14 @@ func (e *EmixHeader) UnmarshalBinaryFromReader(r io.Reader) error {
 	}
 	encodedFileInfo := buf[i : i+encodedFileInfoLength]
 	if e.EncryptInfo {
-		decodedFileInfo, err := AESGCMDecrypt(encodedFileInfo, e.Password)
+		aead, err := e.aead()
 		if err != nil {
 			return err
 		}
+		decodedFileInfo, err := aesgcmDecrypt(aead, encodedFileInfo, e.additionalData(buf))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrongPassword, err)
+		}
 		encodedFileInfo = decodedFileInfo
 	}
 	fileInfo := &FileInfo{}
@@ -193,23 +393,337 @@ func (e *EmixHeader) UnmarshalBinaryFromReader(r io.Reader) error {
 	return nil
 }
 
+// additionalData return the AEAD additional data of file info from the encoded header,
+// it is magic, version, random bytes, mix type and kdf if BindHeader is set
+func (e *EmixHeader) additionalData(encoded []byte) []byte {
+	if !e.BindHeader {
+		return nil
+	}
+	return encoded[:e.passwordOffset()]
+}
+
+// needsFileMAC report whether the file mac must authenticate the content, it is encrypted content of
+// version 5 keyed by password, streams and split content have no trailer after content
+func (e *EmixHeader) needsFileMAC() bool {
+	return e.EncryptData && !e.EmbedPassword && !e.Streamed && !e.FileInfo.Detached && e.layoutVersion() >= 5
+}
+
+// layoutVersion return the version of encoded header, 0 if it is unversioned
+func (e *EmixHeader) layoutVersion() uint8 {
+	switch {
+	case e.Unversioned:
+		return 0
+	case e.Version == 0:
+		return HeaderVersion
+	}
+	return e.Version
+}
+
+// hasKDF return if the encoded header has the kdf field
+func (e *EmixHeader) hasKDF() bool {
+	return e.layoutVersion() >= 2
+}
+
+// mixTypeOffset return the offset of mix type in the encoded header
+func (e *EmixHeader) mixTypeOffset() int {
+	if e.Unversioned {
+		return 4 + 16
+	}
+	return 4 + 1 + 16
+}
+
+// passwordOffset return the offset of password in the encoded header
+func (e *EmixHeader) passwordOffset() int {
+	offset := e.mixTypeOffset() + 2
+	if e.hasKDF() {
+		offset += kdfEncodedLength
+	}
+	return offset
+}
+
+// encodedMixTypeOffset return the offset of mix type in the encoded header starting with magic,
+// the random bytes and mix type follow the version byte of any version
+func encodedMixTypeOffset(magic []byte) int {
+	if bytes.Equal(magic, emixHeaderVersionedMagic[:]) {
+		return 4 + 1 + 16
+	}
+	return 4 + 16
+}
+
+// encodedFileInfoLengthOffset return the offset of file info length in the encoded header,
+// encoded must hold the header until mix type
+func encodedFileInfoLengthOffset(encoded []byte) int {
+	header := &EmixHeader{Unversioned: !bytes.Equal(encoded[:4], emixHeaderVersionedMagic[:])}
+	if !header.Unversioned {
+		header.Version = encoded[4]
+	}
+	return header.passwordOffset() + 16
+}
+
+// Validate check the combination of mix flags and the presence of key, MarshalBinary calls it so invalid headers
+// can not be written. Embedding the password with EncryptData is weak, anyone can de-mix the file, but it is valid
+// as a disguise.
+func (e *EmixHeader) Validate() error {
+	if e.Version > HeaderVersion || (e.Unversioned && e.Version != 0) {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+	if e.KDF != nil {
+		if !e.hasKDF() {
+			return fmt.Errorf("%w: kdf needs version 2", ErrUnsupportedVersion)
+		}
+		if !e.SaltedKeys {
+			return fmt.Errorf("%w: kdf needs salted keys", ErrInvalidKDFParams)
+		}
+		if err := e.KDF.Valid(); err != nil {
+			return err
+		}
+	}
+	if _, err := e.CipherSuite.suite(); err != nil {
+		return err
+	}
+	if e.CipherSuite != DefaultCipherSuite && !e.SaltedKeys {
+		return fmt.Errorf("%w: %s needs salted keys", ErrUnsupportedCipherSuite, e.CipherSuite)
+	}
+	if e.SectorSize != 0 {
+		if !e.EncryptData {
+			return fmt.Errorf("%w: sector size needs encrypt data", ErrInvalidMixType)
+		}
+		if err := ValidSectorSize(e.SectorSize); err != nil {
+			return err
+		}
+	}
+	if e.FileMAC && (e.EmbedPassword || e.Streamed) {
+		return ErrFileMACUnsupported
+	}
+	if e.Streamed && e.FileInfo.Detached {
+		return fmt.Errorf("%w: streamed file can not be detached", ErrInvalidMixType)
+	}
+	return e.CheckKey()
+}
+
+// CheckKey return ErrMissingKey if encryption is requested with an all-zero Password,
+// unless the password is embedded or AllowZeroKey is set, see Validate.
+func (e *EmixHeader) CheckKey() error {
+	if (e.EncryptInfo || e.EncryptData) && !e.EmbedPassword && !e.AllowZeroKey && e.Password == [16]byte{} {
+		return ErrMissingKey
+	}
+	return nil
+}
+
+func (e *EmixHeader) ensureSalt() error {
+	if e.Salt != [16]byte{} {
+		return nil
+	}
+	return readRandom(e.Salt[:])
+}
+
+// keySalt return the salt of key derivation, nil if keys are not salted
+func (e *EmixHeader) keySalt() ([]byte, error) {
+	if !e.SaltedKeys {
+		return nil, nil
+	}
+	if err := e.ensureSalt(); err != nil {
+		return nil, err
+	}
+	return e.Salt[:], nil
+}
+
+// aead return the file info AEAD of cipher suite
+func (e *EmixHeader) aead() (cipher.AEAD, error) {
+	suite, err := e.CipherSuite.suite()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := e.keySalt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.stretchKey(e.Password)
+	if err != nil {
+		return nil, err
+	}
+	// only the default suite is cached
+	if e.Ciphers != nil && e.CipherSuite == DefaultCipherSuite {
+		return e.Ciphers.AESGCM(key, salt)
+	}
+	return suite.newAEAD(key, salt)
+}
+
+// NewContentCipher return the content cipher of cipher suite, AES-XTS by default. Content functions
+// do not pad the last sector with the cipher of a version 3 header, see stolenSectors. DecryptContent
+// checks the file mac with the cipher of a header read by UnmarshalFromFile, see authenticatedCipher
+func (e *EmixHeader) NewContentCipher() (ContentCipher, error) {
+	suite, err := e.CipherSuite.suite()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := e.contentSalt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.stretchKey(e.contentKey())
+	if err != nil {
+		return nil, err
+	}
+	var cipher ContentCipher
+	if e.Ciphers != nil && e.CipherSuite == DefaultCipherSuite {
+		cipher, err = e.Ciphers.AESXTS(key, salt)
+	} else {
+		cipher, err = suite.newContentCipher(key, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.stealsSectors() {
+		cipher = stolenSectors{cipher}
+	}
+	if e.head != nil {
+		cipher = &authenticatedCipher{ContentCipher: cipher, header: e}
+	}
+	return cipher, nil
+}
+
+// contentSalt return the salt of content cipher, since version 4 the version and the file mac bit follow
+// the key salt, so content does not decrypt after the file mac is stripped or the version is changed,
+// the header is not authenticated without encrypted file info
+func (e *EmixHeader) contentSalt() ([]byte, error) {
+	salt, err := e.keySalt()
+	if err != nil || e.layoutVersion() < 4 {
+		return salt, err
+	}
+	binding := []byte{e.layoutVersion(), 0}
+	if e.FileMAC {
+		binding[1] = 1
+	}
+	return append(bytes.Clone(salt), binding...), nil
+}
+
+// contentKey return the key content cipher is derived from
+func (e *EmixHeader) contentKey() [16]byte {
+	if e.EmbedPassword && !e.SaltedKeys {
+		// files before salted keys encrypt content of embed password files with an empty password
+		return [16]byte{}
+	}
+	return e.Password
+}
+
+// NewContentHash return the hash of file content of cipher suite, SHA256 by default
+func (e *EmixHeader) NewContentHash() hash.Hash {
+	suite, err := e.CipherSuite.suite()
+	if err != nil {
+		return sha256.New()
+	}
+	return suite.newHash()
+}
+
+// fileInfoOverhead return the length added by encrypting file info, the AEAD nonce and tag
+func (e *EmixHeader) fileInfoOverhead() int {
+	suite, err := e.CipherSuite.suite()
+	if err != nil {
+		return aesgcmOverhead
+	}
+	return suite.overhead
+}
+
+// ContentSectorSize return the AES-XTS sector size used by content
+func (e *EmixHeader) ContentSectorSize() int {
+	if e.SectorSize == 0 {
+		return XTSSectorSize
+	}
+	return e.SectorSize
+}
+
+// RestoredSize return the size of the restored file, Sparse.Size of a sparse file, OriginalSize of
+// transformed content if it is recorded, otherwise Size
+func (f *FileInfo) RestoredSize() uint64 {
+	if f.Sparse != nil {
+		return f.Sparse.Size
+	}
+	if len(f.Transforms) > 0 && f.OriginalSize != 0 {
+		return f.OriginalSize
+	}
+	return f.Size
+}
+
+// PlaintextSize return the length of plain content, it is FileInfo.Size. With Transforms or Sparse set it is
+// the length of transformed content or data extents, not the size of the restored file
+func (e *EmixHeader) PlaintextSize() int64 {
+	return int64(e.FileInfo.Size)
+}
+
+// CiphertextSize return the length of content region stored in the file, encrypted content before version 3
+// and of streams is padded to whole sectors so it is PlaintextSize rounded up to ContentSectorSize,
+// otherwise it equals PlaintextSize, but at least an AES block if encrypted
+func (e *EmixHeader) CiphertextSize() int64 {
+	if !e.EncryptData {
+		return e.PlaintextSize()
+	}
+	return contentSize(e.stealsSectors(), e.PlaintextSize(), e.ContentSectorSize())
+}
+
+// ContentOffset return the file content offset of emix file
+func (e *EmixHeader) ContentOffset() int64 {
+	offset := int64(e.EncodedLength())
+	if !e.NoDisguise {
+		offset += int64(zipHeaderLength)
+	}
+	return offset
+}
+
 // EncodedLength return EmixHeader encoded length
 func (e *EmixHeader) EncodedLength() int {
-	length := 4 + 16 + 2 + 16 + 2 + e.FileInfo.EncodedLength() + 32
+	length := e.passwordOffset() + 16 + 2 + e.FileInfo.EncodedLength() + 32
 	if e.EncryptInfo {
-		length += 28
+		length += e.fileInfoOverhead()
 	}
 	return length
 }
 
 type FileInfo struct {
-	Name            string
-	Size            uint64
-	Mode            uint32
+	// Name is the base name of source file, or the slash-separated path of a bundle entry,
+	// it must be local, see ErrUnsafeFileName
+	Name string
+	Size uint64
+	Mode uint32
+	// CreateTime is the birth time of source file in unix nanoseconds, the modify time if the filesystem does not
+	// record it. Files written by older versions on linux hold the inode change time
 	CreateTime      uint64
 	ModifyTime      uint64
 	FileContentHash [32]byte
 
+	// optional extensions
+	// Preview is a small thumbnail of file, e.g. JPEG
+	Preview []byte
+	// ToolVersion is the version of emix tool which wrote the file, e.g. v1.2.0
+	ToolVersion string
+	// ChunkSize is a power of two and ChunkHashes are the sha256 of each ChunkSize bytes of content,
+	// they are set if ChunkSize is not zero, see VerifyContentRange
+	ChunkSize   uint64
+	ChunkHashes [][32]byte
+	// Owner is the owner of source file, nil if it was not recorded
+	Owner *Owner
+	// Transforms are the names of content transforms applied before encryption in order,
+	// Size and FileContentHash are of the transformed content if set, see ContentTransform
+	Transforms []string
+	// OriginalSize is the size of content before Transforms, it is recorded with Transforms,
+	// 0 for files written without it, see RestoredSize
+	OriginalSize uint64
+	// Sparse is the data extents of a sparse source file, content is only the data extents if set,
+	// Size is the length of content and Sparse.Size is the size of file
+	Sparse *SparseMap
+	// Xattrs are the extended attributes of source file, encrypted with file info
+	Xattrs []Xattr
+	// LinkTarget is the name of an earlier bundle entry this entry is a hard link of, the entry has no content
+	// and Size and FileContentHash are of the target
+	LinkTarget string
+	// ID is an optional FileIDLength bytes identifier of the file, random or derived from content, see ContentFileID
+	ID []byte
+	// Detached means content is in a separate content file linked by ID, see OpenDetachedContent
+	Detached bool
+	// CDCChunks are the content defined chunks of plain content, their sizes add up to Size,
+	// see WriteChunks and NewChunkReader
+	CDCChunks []ContentChunk
+
 	// raw data
 	// nameLength      [2]byte
 	// name            []byte
@@ -218,15 +732,51 @@ type FileInfo struct {
 	// createTime      [8]byte
 	// modifyTime      [8]byte
 	// fileContentHash [32]byte
+	// extensions      []byte
 }
 
 // EncodedLength measure encoded length
 func (f *FileInfo) EncodedLength() int {
-	return fileInfoEncodedMinLength + len(f.Name) - fileNameMinLength
+	length := fileInfoEncodedMinLength + len(f.Name) - fileNameMinLength
+	if len(f.Preview) > 0 {
+		length += fileInfoExtensionHeaderLength + len(f.Preview)
+	}
+	if len(f.ToolVersion) > 0 {
+		length += fileInfoExtensionHeaderLength + len(f.ToolVersion)
+	}
+	if f.ChunkSize != 0 {
+		length += fileInfoExtensionHeaderLength + f.chunkHashesEncodedLength()
+	}
+	if f.Owner != nil {
+		length += fileInfoExtensionHeaderLength + f.Owner.encodedLength()
+	}
+	if len(f.Transforms) > 0 {
+		length += fileInfoExtensionHeaderLength + transformsEncodedLength(f.Transforms)
+		length += fileInfoExtensionHeaderLength + originalSizeEncodedLength
+	}
+	if f.Sparse != nil {
+		length += fileInfoExtensionHeaderLength + f.Sparse.encodedLength()
+	}
+	if len(f.Xattrs) > 0 {
+		length += fileInfoExtensionHeaderLength + xattrsEncodedLength(f.Xattrs)
+	}
+	if len(f.LinkTarget) > 0 {
+		length += fileInfoExtensionHeaderLength + len(f.LinkTarget)
+	}
+	if len(f.ID) > 0 {
+		length += fileInfoExtensionHeaderLength + len(f.ID)
+	}
+	if f.Detached {
+		length += fileInfoExtensionHeaderLength
+	}
+	if len(f.CDCChunks) > 0 {
+		length += fileInfoExtensionHeaderLength + cdcChunkEncodedLength*len(f.CDCChunks)
+	}
+	return length
 }
 
 // MarshalBinary serialize FileInfo
-// format: namelength + name + size + mode + create time + modify time
+// format: namelength + name + size + mode + create time + modify time + content hash + extensions
 // namelength use 2 bytes
 func (f *FileInfo) MarshalBinary() ([]byte, error) {
 	if len(f.Name) < fileNameMinLength {
@@ -235,6 +785,48 @@ func (f *FileInfo) MarshalBinary() ([]byte, error) {
 	if len(f.Name) > fileNameMaxLength {
 		return nil, ErrNameTooLong
 	}
+	if !isLocalSlashPath(f.Name) {
+		return nil, fmt.Errorf("%w: %q", ErrUnsafeFileName, f.Name)
+	}
+	if len(f.Preview) > PreviewMaxLength {
+		return nil, ErrPreviewTooLarge
+	}
+	if len(f.ToolVersion) > ToolVersionMaxLength {
+		return nil, ErrToolVersionTooLong
+	}
+	if f.ChunkSize != 0 {
+		if err := f.validChunkHashes(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Owner != nil && (len(f.Owner.User) > OwnerNameMaxLength || len(f.Owner.Group) > OwnerNameMaxLength) {
+		return nil, ErrOwnerNameTooLong
+	}
+	if err := validTransforms(f.Transforms); err != nil {
+		return nil, err
+	}
+	if f.Sparse != nil {
+		if err := f.Sparse.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validXattrs(f.Xattrs); err != nil {
+		return nil, err
+	}
+	if len(f.LinkTarget) > fileNameMaxLength {
+		return nil, ErrNameTooLong
+	}
+	if len(f.ID) > 0 && len(f.ID) != FileIDLength || f.Detached && len(f.ID) == 0 {
+		return nil, ErrInvalidFileID
+	}
+	if len(f.CDCChunks) > 0 {
+		if err := f.validCDCChunks(); err != nil {
+			return nil, err
+		}
+	}
+	if f.EncodedLength() > fileInfoEncodedMaxLength {
+		return nil, ErrFileInfoTooLong
+	}
 
 	buf := make([]byte, 0, f.EncodedLength())
 	// name length
@@ -245,9 +837,50 @@ func (f *FileInfo) MarshalBinary() ([]byte, error) {
 	buf = binary.LittleEndian.AppendUint64(buf, f.CreateTime)
 	buf = binary.LittleEndian.AppendUint64(buf, f.ModifyTime)
 	buf = append(buf, f.FileContentHash[:]...)
+	// extensions
+	if len(f.Preview) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionPreview, f.Preview)
+	}
+	if len(f.ToolVersion) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionToolVersion, []byte(f.ToolVersion))
+	}
+	if f.ChunkSize != 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionChunkHashes, f.marshalChunkHashes())
+	}
+	if f.Owner != nil {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionOwner, f.Owner.marshal())
+	}
+	if len(f.Transforms) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionTransforms, marshalTransforms(f.Transforms))
+		buf = appendFileInfoExtension(buf, fileInfoExtensionOriginalSize, binary.LittleEndian.AppendUint64(nil, f.OriginalSize))
+	}
+	if f.Sparse != nil {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionSparse, f.Sparse.marshal())
+	}
+	if len(f.Xattrs) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionXattrs, marshalXattrs(f.Xattrs))
+	}
+	if len(f.LinkTarget) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionLinkTarget, []byte(f.LinkTarget))
+	}
+	if len(f.ID) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionID, f.ID)
+	}
+	if f.Detached {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionDetached, nil)
+	}
+	if len(f.CDCChunks) > 0 {
+		buf = appendFileInfoExtension(buf, fileInfoExtensionCDCChunks, marshalCDCChunks(f.CDCChunks))
+	}
 	return buf, nil
 }
 
+func appendFileInfoExtension(buf []byte, extensionType uint16, value []byte) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, extensionType)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
 // UnmarshalBinary deserialize FileInfo
 func (f *FileInfo) UnmarshalBinary(data []byte) error {
 	if len(data) < fileInfoEncodedMinLength {
@@ -260,9 +893,16 @@ func (f *FileInfo) UnmarshalBinary(data []byte) error {
 	if int(fileNameLength) < fileNameMinLength || int(fileNameLength) > fileNameMaxLength {
 		return ErrInvalidEncodedFileInfo
 	}
+	if len(data) < fileInfoEncodedMinLength+int(fileNameLength)-fileNameMinLength {
+		return ErrInvalidEncodedFileInfo
+	}
 	// name
 	i += 2
 	f.Name = string(data[i : i+int(fileNameLength)])
+	// a crafted name must not escape the output directory
+	if !isLocalSlashPath(f.Name) {
+		return fmt.Errorf("%w: %q", ErrUnsafeFileName, f.Name)
+	}
 	i += int(fileNameLength)
 	f.Size = binary.LittleEndian.Uint64(data[i : i+8])
 	// mode
@@ -278,6 +918,101 @@ func (f *FileInfo) UnmarshalBinary(data []byte) error {
 	i += 8
 	copy(f.FileContentHash[:], data[i:i+32])
 
+	// extensions
+	i += 32
+	f.Preview = nil
+	f.ToolVersion = ""
+	f.ChunkSize = 0
+	f.ChunkHashes = nil
+	f.Owner = nil
+	f.Transforms = nil
+	f.OriginalSize = 0
+	f.Sparse = nil
+	f.Xattrs = nil
+	f.LinkTarget = ""
+	f.ID = nil
+	f.Detached = false
+	f.CDCChunks = nil
+	for i < len(data) {
+		if len(data) < i+fileInfoExtensionHeaderLength {
+			return ErrInvalidEncodedFileInfo
+		}
+		extensionType := binary.LittleEndian.Uint16(data[i : i+2])
+		extensionLength := int(binary.LittleEndian.Uint16(data[i+2 : i+4]))
+		i += fileInfoExtensionHeaderLength
+		if len(data) < i+extensionLength {
+			return ErrInvalidEncodedFileInfo
+		}
+		value := data[i : i+extensionLength]
+		switch extensionType {
+		case fileInfoExtensionPreview:
+			if extensionLength > PreviewMaxLength {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.Preview = bytes.Clone(value)
+		case fileInfoExtensionToolVersion:
+			if extensionLength > ToolVersionMaxLength {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.ToolVersion = string(value)
+		case fileInfoExtensionChunkHashes:
+			if err := f.unmarshalChunkHashes(value); err != nil {
+				return err
+			}
+		case fileInfoExtensionOwner:
+			owner, err := unmarshalOwner(value)
+			if err != nil {
+				return err
+			}
+			f.Owner = owner
+		case fileInfoExtensionTransforms:
+			names, err := unmarshalTransforms(value)
+			if err != nil {
+				return err
+			}
+			f.Transforms = names
+		case fileInfoExtensionSparse:
+			sparse, err := unmarshalSparseMap(value)
+			if err != nil {
+				return err
+			}
+			f.Sparse = sparse
+		case fileInfoExtensionXattrs:
+			xattrs, err := unmarshalXattrs(value)
+			if err != nil {
+				return err
+			}
+			f.Xattrs = xattrs
+		case fileInfoExtensionLinkTarget:
+			if extensionLength > fileNameMaxLength {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.LinkTarget = string(value)
+		case fileInfoExtensionID:
+			if extensionLength != FileIDLength {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.ID = bytes.Clone(value)
+		case fileInfoExtensionDetached:
+			if extensionLength != 0 {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.Detached = true
+		case fileInfoExtensionCDCChunks:
+			chunks, err := unmarshalCDCChunks(value)
+			if err != nil {
+				return err
+			}
+			f.CDCChunks = chunks
+		case fileInfoExtensionOriginalSize:
+			if extensionLength != originalSizeEncodedLength {
+				return ErrInvalidEncodedFileInfo
+			}
+			f.OriginalSize = binary.LittleEndian.Uint64(value)
+		}
+		i += extensionLength
+	}
+
 	return nil
 }
 
@@ -298,27 +1033,143 @@ func IsEmixFileByPath(path string) (bool, error) {
 
 // IsEmixFile check if the file is emix file
 func IsEmixFile(r io.Reader) (bool, error) {
+	_, ok, err := detectEmixFile(r)
+	return ok, err
+}
+
+// detectEmixFile check if the file is emix file and return the emix header offset,
+// the emix header follows the zip header, or starts the file if it is not disguised
+func detectEmixFile(r io.Reader) (int, bool, error) {
 	buf := make([]byte, zipHeaderLength+emixHeaderMinLength)
 	n, err := io.ReadFull(r, buf)
 	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
-		return false, err
+		return 0, false, err
+	}
+
+	// check emix header without disguise, mix type records it
+	if n >= emixHeaderMinLength && isEmixHeaderMagic(buf[:4]) {
+		return 0, buf[encodedMixTypeOffset(buf[:4])]&emixHeaderNoDisguiseMask > 0, nil
 	}
+
 	if n < zipHeaderLength+emixHeaderMinLength {
-		return false, nil
+		return 0, false, nil
 	}
 
 	// check zip header
 	if !bytes.Equal(buf[:4], zipHeaderMagic[:]) {
-		return false, nil
+		return 0, false, nil
 	}
 	if !bytes.Equal(buf[4:64], make([]byte, 60)) {
-		return false, nil
+		return 0, false, nil
 	}
 
 	// check emix header
-	if !bytes.Equal(buf[64:68], emixHeaderMagic[:]) {
-		return false, nil
+	if !isEmixHeaderMagic(buf[64:68]) {
+		return 0, false, nil
+	}
+	if buf[64+encodedMixTypeOffset(buf[64:68])]&emixHeaderNoDisguiseMask > 0 {
+		return 0, false, nil
+	}
+
+	return zipHeaderLength, true, nil
+}
+
+// isEmixHeaderMagic check if magic is the magic of versioned or unversioned emix header
+func isEmixHeaderMagic(magic []byte) bool {
+	return bytes.Equal(magic, emixHeaderMagic[:]) || bytes.Equal(magic, emixHeaderVersionedMagic[:])
+}
+
+// ReadHeader check and read the emix header from r, password is used if file info is encrypted
+func ReadHeader(r io.ReadSeeker, password [16]byte) (*EmixHeader, error) {
+	return readHeader(r, password, nil)
+}
+
+func readHeader(r io.ReadSeeker, password [16]byte, ciphers *CipherCache) (*EmixHeader, error) {
+	emixHeader := &EmixHeader{
+		Password: password,
+		Ciphers:  ciphers,
+	}
+	if err := emixHeader.UnmarshalFromFile(r); err != nil {
+		return nil, err
+	}
+	return emixHeader, nil
+}
+
+// UnmarshalFromFile check and read the emix header from the start of an emix file,
+// ErrInvalidEmixHeader is returned if r is not an emix file
+func (e *EmixHeader) UnmarshalFromFile(r io.ReadSeeker) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	headerOffset, ok, err := detectEmixFile(r)
+	if err != nil {
+		return err
 	}
+	if !ok {
+		return ErrInvalidEmixHeader
+	}
+	if _, err := r.Seek(int64(headerOffset), io.SeekStart); err != nil {
+		return err
+	}
+	e.head = nil
+	if err := e.UnmarshalBinaryFromReader(r); err != nil {
+		return err
+	}
+	// plain content is only read from legacy files
+	if e.needsFileMAC() && !e.FileMAC {
+		return fmt.Errorf("%w: version %d encrypted content has no file mac", ErrContentAuthFailed, e.Version)
+	}
+	if !e.FileMAC || !e.EncryptData || e.Streamed || e.FileInfo.Detached {
+		return nil
+	}
+	head := make([]byte, e.ContentOffset())
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	e.head = head
+	return nil
+}
+
+// RewriteHeader rewrite the emix header of file in place, content is not touched,
+// header must keep the encoded length, content scheme and file mac of the current header,
+// password and ciphers of header are used to read the current header
+func RewriteHeader(f io.ReadWriteSeeker, header *EmixHeader) error {
+	return RewrapHeader(f, header.Password, header)
+}
 
-	return true, nil
+// RewrapHeader is like RewriteHeader but password is used to read the current header,
+// so header can change the password or embed it if the content key is kept
+func RewrapHeader(f io.ReadWriteSeeker, password [16]byte, header *EmixHeader) error {
+	current := &EmixHeader{
+		Password: password,
+		Ciphers:  header.Ciphers,
+	}
+	if err := current.UnmarshalFromFile(f); err != nil {
+		return err
+	}
+	if current.EncodedLength() != header.EncodedLength() || current.NoDisguise != header.NoDisguise || current.FileMAC != header.FileMAC {
+		return ErrHeaderLengthChanged
+	}
+	if err := CheckContentScheme(header, current); err != nil {
+		return err
+	}
+
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(header.ContentOffset()-int64(len(encodedHeader)), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(encodedHeader); err != nil {
+		return err
+	}
+	// the mac covers the header
+	if header.FileMAC {
+		return updateFileMAC(f, header)
+	}
+	return nil
 }
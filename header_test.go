@@ -1,7 +1,14 @@
 package emix
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,7 +39,7 @@ func TestEmixHeader(t *testing.T) {
 		if err := header2.UnmarshalBinary(buf); err != nil {
 			t.Fatal(err)
 		}
-		if header2 != header {
+		if !reflect.DeepEqual(header2, header) {
 			t.Fatal("not equal")
 		}
 	})
@@ -55,10 +62,69 @@ func TestEmixHeader(t *testing.T) {
 		if err := header2.UnmarshalBinary(buf); err != nil {
 			t.Fatal(err)
 		}
-		if header2 != header {
+		if !reflect.DeepEqual(header2, header) {
 			t.Fatal("not equal")
 		}
 	})
+
+	t.Run("sector size", func(t *testing.T) {
+		header := EmixHeader{
+			EncryptData:   true,
+			EmbedPassword: true,
+			Password:      [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			SectorSize:    64 * 1024,
+			FileInfo:      info,
+		}
+		buf, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var header2 EmixHeader
+		if err := header2.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header2, header) {
+			t.Fatal("not equal")
+		}
+		if header2.ContentSectorSize() != 64*1024 {
+			t.Fatal("sector size not equal")
+		}
+
+		header.SectorSize = 1000
+		if _, err := header.MarshalBinary(); !errors.Is(err, ErrInvalidSectorSize) {
+			t.Fatal("invalid sector size should fail")
+		}
+	})
+
+	t.Run("zero key", func(t *testing.T) {
+		header := EmixHeader{
+			EncryptInfo: true,
+			EncryptData: true,
+			FileInfo:    info,
+		}
+		if _, err := header.MarshalBinary(); !errors.Is(err, ErrMissingKey) {
+			t.Fatalf("zero key should fail, got %v", err)
+		}
+		var bundle bytes.Buffer
+		bw, err := NewBundleWriter(&bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Add(&header, strings.NewReader("test")); !errors.Is(err, ErrMissingKey) {
+			t.Fatalf("zero key should fail, got %v", err)
+		}
+
+		header.AllowZeroKey = true
+		if _, err := header.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+		header.AllowZeroKey = false
+		header.EncryptInfo = false
+		header.EncryptData = false
+		if _, err := header.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 func TestFileInfo(t *testing.T) {
@@ -79,7 +145,397 @@ func TestFileInfo(t *testing.T) {
 	if err := info2.UnmarshalBinary(buf); err != nil {
 		t.Fatal(err)
 	}
-	if info != info2 {
+	if !reflect.DeepEqual(info, info2) {
+		t.Fatal("not equal")
+	}
+
+	// names escaping the output directory are refused
+	for _, name := range []string{"../test.txt", "a/../../test.txt", "/etc/test.txt"} {
+		info.Name = name
+		if _, err := info.MarshalBinary(); !errors.Is(err, ErrUnsafeFileName) {
+			t.Fatalf("name %q should be unsafe, got %v", name, err)
+		}
+	}
+}
+
+func TestFileInfoPreview(t *testing.T) {
+	now := time.Now().UnixNano()
+	info := FileInfo{
+		Name:            "photo.jpg",
+		Size:            1024 * 1024,
+		Mode:            0644,
+		CreateTime:      uint64(now),
+		ModifyTime:      uint64(now),
+		FileContentHash: sha256.Sum256([]byte("photo")),
+		Preview:         bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 1000),
+		ToolVersion:     "v1.2.3",
+		Owner:           &Owner{UID: 1000, GID: 100, User: "alice", Group: "users"},
+		ID:              ContentFileID([]byte("photo")),
+	}
+
+	for _, encryptInfo := range []bool{false, true} {
+		header := EmixHeader{
+			EncryptInfo:   encryptInfo,
+			EmbedPassword: true,
+			Password:      [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			FileInfo:      info,
+		}
+		buf, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != header.EncodedLength() {
+			t.Fatal("EncodedLength not equal")
+		}
+		if bytes.Contains(buf, info.Preview) == encryptInfo {
+			t.Fatal("preview should be encrypted with file info")
+		}
+		var header2 EmixHeader
+		if err := header2.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header2, header) {
+			t.Fatal("not equal")
+		}
+	}
+
+	// unknown extensions are skipped
+	buf, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = appendFileInfoExtension(buf, 0xfff0, []byte("unknown"))
+	var info2 FileInfo
+	if err := info2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, info2) {
+		t.Fatal("not equal")
+	}
+
+	// truncated extension
+	if err := info2.UnmarshalBinary(buf[:len(buf)-1]); !errors.Is(err, ErrInvalidEncodedFileInfo) {
+		t.Fatal("truncated extension should fail")
+	}
+
+	info.Preview = make([]byte, PreviewMaxLength+1)
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrPreviewTooLarge) {
+		t.Fatal("large preview should fail")
+	}
+	info.Preview = nil
+	info.ToolVersion = strings.Repeat("v", ToolVersionMaxLength+1)
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrToolVersionTooLong) {
+		t.Fatal("long tool version should fail")
+	}
+	info.ToolVersion = ""
+	info.Owner.User = strings.Repeat("u", OwnerNameMaxLength+1)
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrOwnerNameTooLong) {
+		t.Fatal("long owner name should fail")
+	}
+
+	// unresolved names are empty, owner is the last extension without id
+	info.Owner = &Owner{UID: 1000, GID: 100}
+	info.ID = nil
+	buf, err = info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := info2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, info2) {
 		t.Fatal("not equal")
 	}
+	// invalid owner name length
+	buf[len(buf)-1] = 1
+	if err := info2.UnmarshalBinary(buf); !errors.Is(err, ErrInvalidEncodedFileInfo) {
+		t.Fatal("invalid owner should fail")
+	}
+}
+
+func TestNoDisguise(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("content")
+	for _, noDisguise := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("%t.emix", noDisguise))
+		header := &EmixHeader{
+			NoDisguise: noDisguise,
+			FileInfo:   FileInfo{Name: "test.txt", Mode: 0644},
+		}
+		writeTestEmixFile(t, path, header, content)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(data, zipHeaderMagic[:]) == noDisguise {
+			t.Fatal("unexpected zip header")
+		}
+
+		ok, err := IsEmixFileByPath(path)
+		if err != nil || !ok {
+			t.Fatal("should be emix file", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		header2, err := ReadHeader(f, [16]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header2.NoDisguise != noDisguise || header2.FileInfo.Name != "test.txt" {
+			t.Fatal("not equal")
+		}
+		if !bytes.Equal(data[header2.ContentOffset():], content) {
+			t.Fatal("content offset mismatch")
+		}
+	}
+
+	// the flag must match the layout
+	header := &EmixHeader{
+		NoDisguise: true,
+		FileInfo:   FileInfo{Name: "test.txt"},
+	}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := IsEmixFileByData(append(ZipHeader(), encodedHeader...)); ok {
+		t.Fatal("zip header with no disguise flag should not be emix file")
+	}
+	header.NoDisguise = false
+	encodedHeader, err = header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := IsEmixFileByData(encodedHeader); ok {
+		t.Fatal("missing zip header without no disguise flag should not be emix file")
+	}
+}
+
+func TestHeaderVersion(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("content")
+	for _, unversioned := range []bool{false, true} {
+		for _, noDisguise := range []bool{false, true} {
+			path := filepath.Join(dir, fmt.Sprintf("%t-%t.emix", unversioned, noDisguise))
+			header := &EmixHeader{
+				Unversioned: unversioned,
+				NoDisguise:  noDisguise,
+				EncryptInfo: true,
+				BindHeader:  true,
+				Password:    [16]byte{1, 2, 3},
+				FileInfo:    FileInfo{Name: "test.txt", Mode: 0644},
+			}
+			writeTestEmixFile(t, path, header, content)
+			expectedVersion := HeaderVersion
+			if unversioned {
+				expectedVersion = 0
+			}
+			if header.Version != expectedVersion {
+				t.Fatalf("version %d, expected %d", header.Version, expectedVersion)
+			}
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			header2, err := ReadHeader(f, header.Password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header2.Version != expectedVersion || header2.Unversioned != unversioned || header2.NoDisguise != noDisguise {
+				t.Fatal("not equal")
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data[header2.ContentOffset():], content) {
+				t.Fatal("content offset mismatch")
+			}
+
+			// rewriting keeps the layout
+			header2.FileInfo.ModifyTime = 2
+			if err := RewriteHeader(f, header2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// newer versions can not be read
+	header := &EmixHeader{FileInfo: FileInfo{Name: "test.txt"}}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedHeader[4] = HeaderVersion + 1
+	if err := (&EmixHeader{}).UnmarshalBinary(encodedHeader); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal("should be unsupported version error", err)
+	}
+	header.Version = HeaderVersion + 1
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal("should be unsupported version error", err)
+	}
+}
+
+func TestRewriteHeader(t *testing.T) {
+	dir := t.TempDir()
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	content := []byte("content")
+	path := filepath.Join(dir, "a.zip")
+	writeTestEmixFile(t, path, &EmixHeader{
+		EncryptInfo: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "test.txt", Mode: 0644, ModifyTime: 1},
+	}, content)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header, err := ReadHeader(f, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.FileInfo.ModifyTime = 2
+	if err := RewriteHeader(f, header); err != nil {
+		t.Fatal(err)
+	}
+	header2, err := ReadHeader(f, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header2.FileInfo.ModifyTime != 2 || header2.FileInfo.Name != "test.txt" {
+		t.Fatal("header not rewritten")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[header2.ContentOffset():], content) {
+		t.Fatal("content changed")
+	}
+
+	// the encoded length must not change
+	header2.FileInfo.Name = "longer.txt"
+	if err := RewriteHeader(f, header2); !errors.Is(err, ErrHeaderLengthChanged) {
+		t.Fatal("should be header length changed error", err)
+	}
+}
+
+func TestEncodedLength(t *testing.T) {
+	if aesgcmOverhead != 28 {
+		t.Fatal("unexpected aes-gcm overhead", aesgcmOverhead)
+	}
+	for _, encryptInfo := range []bool{false, true} {
+		for _, encryptData := range []bool{false, true} {
+			for _, embedPassword := range []bool{false, true} {
+				for _, preview := range [][]byte{nil, make([]byte, 100)} {
+					header := &EmixHeader{
+						EncryptInfo:   encryptInfo,
+						EncryptData:   encryptData,
+						EmbedPassword: embedPassword,
+						SaltedKeys:    true,
+						Password:      [16]byte{1},
+						FileInfo:      FileInfo{Name: "test.txt", Preview: preview},
+					}
+					encoded, err := header.MarshalBinary()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if header.EncodedLength() != len(encoded) {
+						t.Fatalf("encoded length %d, marshaled %d bytes, info %t, data %t, embed %t, preview %d",
+							header.EncodedLength(), len(encoded), encryptInfo, encryptData, embedPassword, len(preview))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBindHeader(t *testing.T) {
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	for _, bindHeader := range []bool{false, true} {
+		header := &EmixHeader{
+			EncryptInfo: true,
+			EncryptData: true,
+			Password:    password,
+			SaltedKeys:  true,
+			BindHeader:  bindHeader,
+			FileInfo:    FileInfo{Name: "test.txt"},
+		}
+		encoded, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header2 := &EmixHeader{Password: password}
+		if err := header2.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if header2.BindHeader != bindHeader || header2.FileInfo.Name != "test.txt" {
+			t.Fatal("not equal")
+		}
+
+		// flip the encrypt data bit of mix type and recompute the header hash
+		tampered := bytes.Clone(encoded)
+		tampered[header.mixTypeOffset()+1] ^= emixHeaderMixTypeEncryptData[1]
+		hash := sha256.Sum256(tampered[:len(tampered)-32])
+		copy(tampered[len(tampered)-32:], hash[:])
+		header3 := &EmixHeader{Password: password}
+		err = header3.UnmarshalBinary(tampered)
+		if bindHeader && err == nil {
+			t.Fatal("tampered mix type should fail decryption")
+		}
+		if !bindHeader && (err != nil || header3.EncryptData) {
+			t.Fatal("mix type is not authenticated without bind header", err)
+		}
+	}
+}
+
+func TestEmixHeaderValidate(t *testing.T) {
+	info := FileInfo{Name: "test.txt", ID: make([]byte, FileIDLength), Detached: true}
+	password := [16]byte{1}
+	valid := []EmixHeader{
+		{},
+		{FileInfo: info, BindHeader: true, SaltedKeys: true},
+		{EncryptInfo: true, Password: password},
+		{EncryptData: true, Password: password, SectorSize: 64 * 1024},
+		{EncryptInfo: true, EncryptData: true, EmbedPassword: true, Password: password},
+		{EncryptData: true, SaltedKeys: true, CipherSuite: CipherSuiteChaCha20, Password: password},
+		{EncryptInfo: true, FileMAC: true, Password: password},
+		{Streamed: true, EncryptData: true, Password: password},
+		{EncryptInfo: true, AllowZeroKey: true},
+	}
+	for i, header := range valid {
+		if err := header.Validate(); err != nil {
+			t.Fatalf("header %d should be valid: %v", i, err)
+		}
+	}
+
+	invalid := []struct {
+		header EmixHeader
+		err    error
+	}{
+		{EmixHeader{EncryptInfo: true}, ErrMissingKey},
+		{EmixHeader{EncryptData: true}, ErrMissingKey},
+		{EmixHeader{CipherSuite: CipherSuiteID(15)}, ErrUnsupportedCipherSuite},
+		{EmixHeader{CipherSuite: CipherSuiteChaCha20}, ErrUnsupportedCipherSuite},
+		{EmixHeader{SectorSize: 64 * 1024}, ErrInvalidMixType},
+		{EmixHeader{EncryptData: true, Password: password, SectorSize: 1000}, ErrInvalidSectorSize},
+		{EmixHeader{EncryptInfo: true, EmbedPassword: true, FileMAC: true, Password: password}, ErrFileMACUnsupported},
+		{EmixHeader{Streamed: true, FileMAC: true, Password: password}, ErrFileMACUnsupported},
+		{EmixHeader{Streamed: true, FileInfo: info}, ErrInvalidMixType},
+	}
+	for i, c := range invalid {
+		if err := c.header.Validate(); !errors.Is(err, c.err) {
+			t.Fatalf("header %d should fail with %v, got %v", i, c.err, err)
+		}
+		if _, err := c.header.MarshalBinary(); !errors.Is(err, c.err) {
+			t.Fatalf("marshal header %d should fail with %v, got %v", i, c.err, err)
+		}
+	}
 }
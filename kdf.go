@@ -0,0 +1,117 @@
+package emix
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// key derivation function of header since version 2, it follows the mix type
+// [1-byte kdf id] [1-byte time] [1-byte log2 of memory in KiB] [1-byte threads]
+// kdf id 0 means Password is the key of cipher suites, they derive their keys from it by HKDF as before,
+// 1 means Password is stretched by Argon2id with Salt first, so guessing a weak password is expensive
+
+const (
+	kdfEncodedLength = 4
+	kdfIDNone        = byte(0)
+	kdfIDArgon2id    = byte(1)
+
+	// MaxKDFMemory is the max Argon2id memory in KiB a file can be encrypted with
+	MaxKDFMemory = 1024 * 1024
+	// MaxReadKDFMemory and MaxReadKDFTime bound the params of a header read before it is authenticated,
+	// so a crafted header can not ask for a lot of memory and time, see EmixHeader.AllowLargeKDF
+	MaxReadKDFMemory = 256 * 1024
+	MaxReadKDFTime   = 16
+)
+
+var (
+	// DefaultKDFParams are the Argon2id parameters used by domix if not set
+	DefaultKDFParams = KDFParams{Time: 2, Memory: 32 * 1024, Threads: 4}
+
+	ErrInvalidKDFParams = errors.New("invalid kdf params")
+	ErrKDFOverLimit     = errors.New("kdf params over the read limit")
+)
+
+// KDFParams are the Argon2id parameters stretching Password, Salt of header is the salt
+type KDFParams struct {
+	// Time is the number of passes over memory
+	Time uint8
+	// Memory is the memory size in KiB, a power of two not larger than MaxKDFMemory
+	Memory  uint32
+	Threads uint8
+}
+
+// Valid check the params can be encoded in header
+func (p KDFParams) Valid() error {
+	if p.Time == 0 || p.Threads == 0 || p.Memory&(p.Memory-1) != 0 || p.Memory < 8*uint32(p.Threads) || p.Memory > MaxKDFMemory {
+		return fmt.Errorf("%w: time %d, memory %d KiB, threads %d", ErrInvalidKDFParams, p.Time, p.Memory, p.Threads)
+	}
+	return nil
+}
+
+// OverReadLimit report whether a header with the params is rejected on read without EmixHeader.AllowLargeKDF
+func (p KDFParams) OverReadLimit() bool {
+	return p.Memory > MaxReadKDFMemory || p.Time > MaxReadKDFTime
+}
+
+// String return the params like argon2id t=2,m=32768,p=4
+func (p KDFParams) String() string {
+	return fmt.Sprintf("argon2id t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+}
+
+func marshalKDF(p *KDFParams) []byte {
+	if p == nil {
+		return []byte{kdfIDNone, 0, 0, 0}
+	}
+	return []byte{kdfIDArgon2id, p.Time, byte(bits.TrailingZeros32(p.Memory)), p.Threads}
+}
+
+func unmarshalKDF(data []byte) (*KDFParams, error) {
+	switch data[0] {
+	case kdfIDNone:
+		return nil, nil
+	case kdfIDArgon2id:
+		if data[2] > 31 {
+			return nil, ErrInvalidKDFParams
+		}
+		p := &KDFParams{Time: data[1], Memory: 1 << data[2], Threads: data[3]}
+		if err := p.Valid(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown kdf %d", ErrInvalidKDFParams, data[0])
+	}
+}
+
+// argon2idKey stretch password with salt
+func argon2idKey(password [16]byte, salt []byte, p KDFParams) [16]byte {
+	var key [16]byte
+	copy(key[:], argon2.IDKey(password[:], salt, uint32(p.Time), p.Memory, p.Threads, uint32(len(key))))
+	return key
+}
+
+// stretchKey return key stretched by KDF, key itself if KDF is not set
+func (e *EmixHeader) stretchKey(key [16]byte) ([16]byte, error) {
+	if e.KDF == nil {
+		return key, nil
+	}
+	salt, err := e.keySalt()
+	if err != nil {
+		return key, err
+	}
+	if e.Ciphers != nil {
+		return e.Ciphers.Argon2idKey(key, salt, *e.KDF), nil
+	}
+	return argon2idKey(key, salt, *e.KDF), nil
+}
+
+// equalKDF check if a and b stretch keys the same way
+func equalKDF(a, b *KDFParams) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,202 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// testKDFParams are cheap params for tests
+var testKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestArgon2idKey(t *testing.T) {
+	password := [16]byte{1, 2, 3}
+	key := argon2idKey(password, []byte("salt of file one"), testKDFParams)
+	if key == password {
+		t.Fatal("key is not stretched")
+	}
+	if argon2idKey(password, []byte("salt of file one"), testKDFParams) != key {
+		t.Fatal("same password and salt should derive the same key")
+	}
+	if argon2idKey(password, []byte("salt of file two"), testKDFParams) == key {
+		t.Fatal("different salts should derive different keys")
+	}
+	params := testKDFParams
+	params.Time = 2
+	if argon2idKey(password, []byte("salt of file one"), params) == key {
+		t.Fatal("different params should derive different keys")
+	}
+	if NewCipherCache().Argon2idKey(password, []byte("salt of file one"), testKDFParams) != key {
+		t.Fatal("cached key not equal")
+	}
+}
+
+func TestHeaderKDF(t *testing.T) {
+	content := bytes.Repeat([]byte("content of kdf"), 1000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	kdf := testKDFParams
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		SaltedKeys:  true,
+		BindHeader:  true,
+		FileMAC:     true,
+		KDF:         &kdf,
+		FileInfo:    FileInfo{Name: "kdf.txt", Size: uint64(len(content)), FileContentHash: sha256.Sum256(content)},
+	}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encodedHeader) != header.EncodedLength() {
+		t.Fatal("EncodedLength not equal")
+	}
+	cipher, err := header.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText := bytes.NewBuffer(nil)
+	if err := EncryptContent(cipher, bytes.NewReader(content), cipherText); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same password reads the params back and decrypts
+	header2 := &EmixHeader{Password: password, Ciphers: NewCipherCache()}
+	if err := header2.UnmarshalBinary(encodedHeader); err != nil {
+		t.Fatal(err)
+	}
+	if header2.KDF == nil || *header2.KDF != kdf || header2.FileInfo.Name != "kdf.txt" {
+		t.Fatal("header not equal")
+	}
+	cipher2, err := header2.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainText := bytes.NewBuffer(nil)
+	if err := DecryptContent(cipher2, cipherText, plainText, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+	if err := CheckContentScheme(header2, header); err != nil {
+		t.Fatal(err)
+	}
+	header2.KDF = nil
+	if err := CheckContentScheme(header2, header); !errors.Is(err, ErrContentSchemeMismatch) {
+		t.Fatal("kdf should be part of content scheme", err)
+	}
+
+	// the password is not the key
+	header3 := &EmixHeader{Password: password}
+	if err := header3.UnmarshalBinary(encodedHeader); err != nil {
+		t.Fatal(err)
+	}
+	header3.KDF = nil
+	aead, err := header3.aead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aesgcmDecrypt(aead, encodedHeader[header3.passwordOffset()+16+2:len(encodedHeader)-32], header3.additionalData(encodedHeader)); err == nil {
+		t.Fatal("file info should not decrypt with the unstretched password")
+	}
+	if err := (&EmixHeader{Password: [16]byte{1}}).UnmarshalBinary(encodedHeader); !errors.Is(err, ErrWrongPassword) {
+		t.Fatal("should be wrong password error", err)
+	}
+}
+
+func TestHeaderKDFValidate(t *testing.T) {
+	kdf := testKDFParams
+	tests := []struct {
+		name   string
+		header EmixHeader
+		err    error
+	}{
+		{
+			name:   "unsalted",
+			header: EmixHeader{EncryptInfo: true, Password: [16]byte{1}, KDF: &kdf},
+			err:    ErrInvalidKDFParams,
+		},
+		{
+			name:   "version 1",
+			header: EmixHeader{Version: 1, EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, KDF: &kdf},
+			err:    ErrUnsupportedVersion,
+		},
+		{
+			name:   "unversioned",
+			header: EmixHeader{Unversioned: true, EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, KDF: &kdf},
+			err:    ErrUnsupportedVersion,
+		},
+		{
+			name:   "memory not power of two",
+			header: EmixHeader{EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, KDF: &KDFParams{Time: 1, Memory: 100, Threads: 1}},
+			err:    ErrInvalidKDFParams,
+		},
+		{
+			name:   "memory too large",
+			header: EmixHeader{EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, KDF: &KDFParams{Time: 1, Memory: 2 * MaxKDFMemory, Threads: 1}},
+			err:    ErrInvalidKDFParams,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.FileInfo = FileInfo{Name: "a.txt"}
+			if _, err := tt.header.MarshalBinary(); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// version 1 headers keep deriving keys from the password by HKDF
+	header := &EmixHeader{Version: 1, EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, FileInfo: FileInfo{Name: "a.txt"}}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header2 := &EmixHeader{Password: [16]byte{1}}
+	if err := header2.UnmarshalBinary(encodedHeader); err != nil {
+		t.Fatal(err)
+	}
+	if header2.Version != 1 || header2.KDF != nil || header2.FileInfo.Name != "a.txt" {
+		t.Fatal("header not equal")
+	}
+}
+
+func TestHeaderKDFReadLimit(t *testing.T) {
+	kdf := testKDFParams
+	header := &EmixHeader{EncryptInfo: true, Password: [16]byte{1}, SaltedKeys: true, KDF: &kdf, FileInfo: FileInfo{Name: "a.txt"}}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(encodedHeader, marshalKDF(&kdf))
+	if i < 0 {
+		t.Fatal("kdf not found in header")
+	}
+	for _, params := range []KDFParams{
+		{Time: 1, Memory: 2 * MaxReadKDFMemory, Threads: 1},
+		{Time: MaxReadKDFTime + 1, Memory: 64, Threads: 1},
+	} {
+		if !params.OverReadLimit() {
+			t.Fatal("params should be over the read limit", params)
+		}
+		crafted := bytes.Clone(encodedHeader)
+		copy(crafted[i:], marshalKDF(&params))
+		// rejected before the password is stretched
+		if err := (&EmixHeader{Password: [16]byte{1}}).UnmarshalBinary(crafted); !errors.Is(err, ErrKDFOverLimit) {
+			t.Fatal("should be kdf over limit error", params, err)
+		}
+	}
+	if testKDFParams.OverReadLimit() || DefaultKDFParams.OverReadLimit() {
+		t.Fatal("default params should be readable")
+	}
+
+	// accepted if allowed, the cheap params stretch the key
+	crafted := bytes.Clone(encodedHeader)
+	copy(crafted[i:], marshalKDF(&KDFParams{Time: MaxReadKDFTime + 1, Memory: 64, Threads: 1}))
+	if err := (&EmixHeader{Password: [16]byte{1}, AllowLargeKDF: true}).UnmarshalBinary(crafted); errors.Is(err, ErrKDFOverLimit) {
+		t.Fatal("large kdf should be allowed", err)
+	}
+}
@@ -0,0 +1,224 @@
+package emix
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// emix file with file mac
+// [zip header] [emix header] [file content] [32-byte HMAC-SHA256 of all preceding bytes]
+// the mac key is derived from password, the content offset is not changed
+
+// FileMACLength is the length of the file mac trailer
+const FileMACLength = sha256.Size
+
+// NewFileMAC return the HMAC-SHA256 of the whole file, keyed by a subkey of Password
+func (e *EmixHeader) NewFileMAC() (hash.Hash, error) {
+	if e.EmbedPassword || e.Streamed {
+		return nil, ErrFileMACUnsupported
+	}
+	salt, err := e.keySalt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.stretchKey(e.Password)
+	if err != nil {
+		return nil, err
+	}
+	return hmac.New(sha256.New, HKDF(key[:], salt, []byte("file mac"), 32)), nil
+}
+
+// TrailerLength return the length after the content, FileMACLength if FileMAC is set
+func (e *EmixHeader) TrailerLength() int64 {
+	if e.FileMAC {
+		return FileMACLength
+	}
+	return 0
+}
+
+// fileMAC compute the mac of the first size bytes of r
+func fileMAC(r io.Reader, size int64, header *EmixHeader) ([]byte, error) {
+	mac, err := header.NewFileMAC()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(mac, r, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrFileMACMismatch
+		}
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// AppendFileMAC compute the mac of all bytes of f and append it, header must have FileMAC set
+func AppendFileMAC(f io.ReadWriteSeeker, header *EmixHeader) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	return writeFileMAC(f, size, header)
+}
+
+// updateFileMAC recompute the mac of f in place, e.g. after the header is rewritten
+func updateFileMAC(f io.ReadWriteSeeker, header *EmixHeader) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < FileMACLength {
+		return ErrFileMACMismatch
+	}
+	return writeFileMAC(f, size-FileMACLength, header)
+}
+
+// writeFileMAC write the mac of the first size bytes of f at size
+func writeFileMAC(f io.ReadWriteSeeker, size int64, header *EmixHeader) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	mac, err := fileMAC(f, size, header)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.Write(mac)
+	return err
+}
+
+// VerifyFileMAC check the mac trailer of r, size is the length of r,
+// ErrFileMACMismatch is returned if any byte of the file is changed
+func VerifyFileMAC(r io.ReaderAt, size int64, header *EmixHeader) error {
+	if !header.FileMAC {
+		return errors.New("file has no file mac")
+	}
+	if size < FileMACLength {
+		return ErrFileMACMismatch
+	}
+	mac, err := fileMAC(io.NewSectionReader(r, 0, size-FileMACLength), size-FileMACLength, header)
+	if err != nil {
+		return err
+	}
+	expected := make([]byte, FileMACLength)
+	if _, err := r.ReadAt(expected, size-FileMACLength); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return ErrFileMACMismatch
+	}
+	return nil
+}
+
+// verifySeekerFileMAC is VerifyFileMAC of a reader without ReadAt, the length of r is its end
+func verifySeekerFileMAC(r io.ReadSeeker, header *EmixHeader) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < FileMACLength {
+		return ErrFileMACMismatch
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	mac, err := fileMAC(r, size-FileMACLength, header)
+	if err != nil {
+		return err
+	}
+	expected := make([]byte, FileMACLength)
+	if _, err := io.ReadFull(r, expected); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return ErrFileMACMismatch
+	}
+	return nil
+}
+
+// authenticatedCipher is the content cipher of a file with file mac, DecryptContent checks the file mac of
+// the head of file, the content and the trailer after it, so a changed byte is not decrypted unnoticed
+type authenticatedCipher struct {
+	ContentCipher
+	header *EmixHeader
+}
+
+// decryptContent verify the file mac before content is decrypted if reader is an io.Seeker,
+// otherwise it is verified after content is written
+func (a *authenticatedCipher) decryptContent(reader io.Reader, writer io.Writer, size int64, sectorSize int) error {
+	mac, err := a.header.NewFileMAC()
+	if err != nil {
+		return err
+	}
+	mac.Write(a.header.head)
+	length := contentSize(stealsSectors(a), size, sectorSize)
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(mac, seeker, length); err != nil {
+			if errors.Is(err, io.EOF) {
+				return contentAuthError(ErrFileMACMismatch, a.header)
+			}
+			return err
+		}
+		if err := checkFileMAC(mac, seeker); err != nil {
+			return contentAuthError(err, a.header)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return DecryptContentWithSectorSize(a.ContentCipher, seeker, writer, size, sectorSize)
+	}
+	if err := DecryptContentWithSectorSize(a.ContentCipher, io.TeeReader(reader, mac), writer, size, sectorSize); err != nil {
+		return err
+	}
+	return contentAuthError(checkFileMAC(mac, reader), a.header)
+}
+
+// checkFileMAC read the trailer from r and compare it with the sum of mac
+func checkFileMAC(mac hash.Hash, r io.Reader) error {
+	expected := make([]byte, FileMACLength)
+	if _, err := io.ReadFull(r, expected); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrFileMACMismatch
+		}
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrFileMACMismatch
+	}
+	return nil
+}
+
+// contentAuthError wrap a file mac mismatch in ErrContentAuthFailed, also in ErrWrongPassword if the password
+// is not checked by encrypted file info before
+func contentAuthError(err error, header *EmixHeader) error {
+	if !errors.Is(err, ErrFileMACMismatch) {
+		return err
+	}
+	if !header.EncryptInfo {
+		return fmt.Errorf("%w: %w, %w or tampered file", ErrContentAuthFailed, err, ErrWrongPassword)
+	}
+	return fmt.Errorf("%w: %w", ErrContentAuthFailed, err)
+}
+
+// DecryptContentAuthenticated verify the file mac of r before its content is decrypted to w, size is the length of r,
+// ErrContentAuthFailed is returned and nothing is written if any byte of the file is changed
+func DecryptContentAuthenticated(r io.ReaderAt, size int64, header *EmixHeader, w io.Writer) error {
+	if err := VerifyFileMAC(r, size, header); err != nil {
+		return contentAuthError(err, header)
+	}
+	content, err := OpenContent(r, header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
@@ -0,0 +1,274 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMAC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mac.zip")
+	content := bytes.Repeat([]byte("content"), 1000)
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SaltedKeys:  true,
+		BindHeader:  true,
+		FileMAC:     true,
+		FileInfo:    FileInfo{Name: "mac.txt", Size: uint64(len(content))},
+	}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := header.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(ZipHeader())
+	buf.Write(encodedHeader)
+	if err := EncryptContent(cipher, bytes.NewReader(content), buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendFileMAC(f, header); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != header.ContentOffset()+header.CiphertextSize()+header.TrailerLength() {
+		t.Fatal("file size not equal")
+	}
+	if err := VerifyFileMAC(bytes.NewReader(data), int64(len(data)), header); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a byte of each region
+	regions := map[string]int{
+		"zip header":  10,
+		"emix header": zipHeaderLength + 30,
+		"content":     int(header.ContentOffset()) + 100,
+		"mac":         len(data) - 1,
+	}
+	for name, i := range regions {
+		tampered := bytes.Clone(data)
+		tampered[i] ^= 0x01
+		if err := VerifyFileMAC(bytes.NewReader(tampered), int64(len(tampered)), header); !errors.Is(err, ErrFileMACMismatch) {
+			t.Fatalf("tampered %s should fail", name)
+		}
+	}
+	// truncated
+	if err := VerifyFileMAC(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1), header); !errors.Is(err, ErrFileMACMismatch) {
+		t.Fatal("truncated file should fail")
+	}
+	// another password
+	other := *header
+	other.Password = [16]byte{}
+	if err := VerifyFileMAC(bytes.NewReader(data), int64(len(data)), &other); !errors.Is(err, ErrFileMACMismatch) {
+		t.Fatal("another password should fail")
+	}
+
+	// rewriting the header updates the mac
+	header.FileInfo.ModifyTime = 1
+	if err := RewriteHeader(f, header); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rewritten) != len(data) || bytes.Equal(rewritten, data) {
+		t.Fatal("header not rewritten")
+	}
+	if err := VerifyFileMAC(bytes.NewReader(rewritten), int64(len(rewritten)), header); err != nil {
+		t.Fatal(err)
+	}
+
+	// embed password can not key the mac
+	header.EmbedPassword = true
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrFileMACUnsupported) {
+		t.Fatal("file mac with embed password should fail")
+	}
+}
+
+func TestDecryptContentAuthenticated(t *testing.T) {
+	content := bytes.Repeat([]byte("authenticated content"), 1000)
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SaltedKeys:  true,
+		BindHeader:  true,
+		FileMAC:     true,
+		FileInfo:    FileInfo{Name: "auth.txt", Size: uint64(len(content))},
+	}
+	path := filepath.Join(t.TempDir(), "auth.zip")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := header.NewContentCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(ZipHeader())
+	buf.Write(encodedHeader)
+	if err := EncryptContent(cipher, bytes.NewReader(content), buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendFileMAC(f, header); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainText := bytes.NewBuffer(nil)
+	if err := DecryptContentAuthenticated(bytes.NewReader(data), int64(len(data)), header, plainText); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+
+	// a flipped ciphertext byte fails before anything is written
+	tampered := bytes.Clone(data)
+	tampered[header.ContentOffset()+5000] ^= 0x01
+	plainText.Reset()
+	if err := DecryptContentAuthenticated(bytes.NewReader(tampered), int64(len(tampered)), header, plainText); !errors.Is(err, ErrContentAuthFailed) {
+		t.Fatal("tampered ciphertext should fail authentication", err)
+	}
+	if plainText.Len() != 0 {
+		t.Fatal("content of tampered file should not be written")
+	}
+}
+
+func TestStrippedFileMAC(t *testing.T) {
+	content := bytes.Repeat([]byte("content of mac"), 1000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	// the header of encrypted data without encrypted info is not authenticated
+	header := &EmixHeader{EncryptData: true, Password: password, SaltedKeys: true, FileMAC: true, FileInfo: FileInfo{Name: "mac.txt"}}
+	f := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	headerStart := ZipHeaderLength()
+	headerEnd := int(header.ContentOffset())
+	// strip return the file without the file mac bit and trailer, the version is set if it is not zero,
+	// the content is intact so only the key binding fails the decryption
+	strip := func(version byte) []byte {
+		data := bytes.Clone(f.data[:len(f.data)-int(header.TrailerLength())])
+		data[headerStart+header.mixTypeOffset()+1] &^= emixHeaderMixTypeFileMAC[1]
+		if version != 0 {
+			data[headerStart+4] = version
+		}
+		hash := sha256.Sum256(data[headerStart : headerEnd-32])
+		copy(data[headerEnd-32:], hash[:])
+		return data
+	}
+	for _, version := range []byte{0, 3, 4} {
+		stripped := strip(version)
+		ok, err := IsEmixFile(bytes.NewReader(stripped))
+		if err != nil || !ok {
+			t.Fatal("stripped file should be an emix file", err)
+		}
+		err = DecryptFile(bytes.NewReader(stripped), io.Discard, DecryptOptions{Password: password})
+		// encrypted content of version 5 must have the file mac
+		if version == 0 && !errors.Is(err, ErrContentAuthFailed) {
+			t.Fatal("stripped file should fail authentication", err)
+		}
+		if version != 0 && !errors.Is(err, ErrInvalidEmixFileContent) {
+			t.Fatal("stripped file should fail to decrypt", version, err)
+		}
+	}
+	if err := DecryptFile(bytes.NewReader(f.data), io.Discard, DecryptOptions{Password: password}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withFileMAC return data of an emix file with the file mac of header appended if it has one
+func withFileMAC(t *testing.T, header *EmixHeader, data []byte) []byte {
+	t.Helper()
+	if !header.FileMAC {
+		return data
+	}
+	f := &memFile{data: bytes.Clone(data)}
+	if err := AppendFileMAC(f, header); err != nil {
+		t.Fatal(err)
+	}
+	return f.data
+}
+
+func TestDecryptContentFileMAC(t *testing.T) {
+	content := bytes.Repeat([]byte("content of mac"), 1000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	header := &EmixHeader{EncryptData: true, Password: password, SaltedKeys: true, FileInfo: FileInfo{Name: "mac.txt"}}
+	f := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	if !header.FileMAC {
+		t.Fatal("encrypted content should have the file mac")
+	}
+
+	// decrypt return the content read from a seeker or a plain reader
+	decrypt := func(data []byte, seekable bool) ([]byte, error) {
+		read, err := ReadHeader(bytes.NewReader(data), password)
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := read.NewContentCipher()
+		if err != nil {
+			return nil, err
+		}
+		r := io.Reader(bytes.NewReader(data[read.ContentOffset():]))
+		if !seekable {
+			r = io.MultiReader(r)
+		}
+		plainText := bytes.NewBuffer(nil)
+		err = DecryptContent(cipher, r, plainText, int64(read.FileInfo.Size))
+		return plainText.Bytes(), err
+	}
+	tampered := bytes.Clone(f.data)
+	tampered[header.ContentOffset()+100] ^= 0x01
+	for _, seekable := range []bool{true, false} {
+		plainText, err := decrypt(f.data, seekable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plainText, content) {
+			t.Fatal("content not equal")
+		}
+		// a flipped ciphertext byte fails, nothing is written if the reader seeks
+		plainText, err = decrypt(tampered, seekable)
+		if !errors.Is(err, ErrContentAuthFailed) {
+			t.Fatal("tampered ciphertext should fail authentication", seekable, err)
+		}
+		if seekable && len(plainText) != 0 {
+			t.Fatal("content of tampered file should not be written")
+		}
+	}
+}
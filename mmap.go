@@ -0,0 +1,126 @@
+package emix
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// MmapMinSize is the file size from which mapping content is preferred over the streaming path,
+// below it the per-sector read and write loop is as fast
+const MmapMinSize = 64 * 1024 * 1024
+
+// ErrMmapUnsupported means the file can not be mapped, e.g. a pipe or an unsupported OS,
+// callers fall back to the streaming path
+var ErrMmapUnsupported = errors.New("mmap unsupported")
+
+// mapFile map the first length bytes of f, f must be a regular file
+func mapFile(f *os.File, length int64, writable bool) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || length <= 0 || length > math.MaxInt {
+		return nil, ErrMmapUnsupported
+	}
+	data, err := mmap(f, int(length), writable)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMmapUnsupported, err)
+	}
+	return data, nil
+}
+
+// EncryptFileMapped encrypt the content of src to dst starting at offset of dst, both files are mapped
+// and sectors are encrypted from the source mapping to the destination mapping directly.
+// dst is grown to hold the encrypted content, h is optional and written with the plain content.
+// ErrMmapUnsupported is returned before any content is written if either file can not be mapped.
+// Like any mapping, a file truncated by others during the call faults the process
+func EncryptFileMapped(cipher ContentCipher, src *os.File, dst *os.File, offset int64, sectorSize int, h io.Writer) error {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return err
+	}
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		return ErrMmapUnsupported
+	}
+	plain, err := mapFile(src, size, false)
+	if err != nil {
+		return err
+	}
+	defer munmap(plain)
+
+	stolen := stealsSectors(cipher)
+	dstSize := offset + contentSize(stolen, size, sectorSize)
+	if err := dst.Truncate(dstSize); err != nil {
+		return err
+	}
+	mapped, err := mapFile(dst, dstSize, true)
+	if err != nil {
+		return err
+	}
+	defer munmap(mapped)
+	cipherData := mapped[offset:]
+
+	if h != nil {
+		if _, err := h.Write(plain); err != nil {
+			return err
+		}
+	}
+	for sector := int64(0); sector < sectorCount(stolen, size, sectorSize); sector++ {
+		i := sector * int64(sectorSize)
+		length := int64(sectorLength(stolen, size, sectorSize, sector))
+		data := plain[i:min(i+length, size)]
+		if int64(len(data)) < length {
+			// pad the last sector
+			data = append(make([]byte, 0, length), data...)
+			data = data[:length]
+		}
+		encryptSector(cipher, cipherData[i:i+length], data, uint64(SectorNumberStart+sector))
+	}
+	return nil
+}
+
+// DecryptFileMapped decrypt size plain bytes of content starting at offset of src to writer,
+// src is mapped and sectors are decrypted from the mapping without reading them to a buffer first.
+// ErrMmapUnsupported is returned before anything is written if src can not be mapped
+func DecryptFileMapped(cipher ContentCipher, src *os.File, offset int64, writer io.Writer, size int64, sectorSize int) error {
+	if err := ValidSectorSize(sectorSize); err != nil {
+		return err
+	}
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	stolen := stealsSectors(cipher)
+	cipherSize := contentSize(stolen, size, sectorSize)
+	if actual := info.Size() - offset; actual < cipherSize {
+		return truncatedContentError(cipherSize, actual)
+	}
+	if size == 0 {
+		return ErrMmapUnsupported
+	}
+	mapped, err := mapFile(src, offset+cipherSize, false)
+	if err != nil {
+		return err
+	}
+	defer munmap(mapped)
+	cipherData := mapped[offset:]
+
+	plainBuf := make([]byte, sectorSize+aes.BlockSize)
+	for sector := int64(0); sector < sectorCount(stolen, size, sectorSize); sector++ {
+		i := sector * int64(sectorSize)
+		length := int64(sectorLength(stolen, size, sectorSize, sector))
+		decryptSector(cipher, plainBuf[:length], cipherData[i:i+length], uint64(SectorNumberStart+sector))
+		if _, err := writer.Write(plainBuf[:min(length, size-i)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
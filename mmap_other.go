@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package emix
+
+import (
+	"os"
+)
+
+func mmap(f *os.File, length int, writable bool) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap(b []byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,164 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFileMapped(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("mmap unsupported")
+	}
+	dir := t.TempDir()
+	xtsCipher, err := NewAESXTS([16]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(zipHeaderLength + 100)
+
+	// content of version 3 headers is not padded
+	for _, cipher := range []ContentCipher{xtsCipher, stolenSectors{xtsCipher}} {
+		for _, size := range []int{1, 4096, 13*1024 + 7} {
+			content := bytes.Repeat([]byte{byte(size)}, size)
+			srcPath := filepath.Join(dir, "src")
+			if err := os.WriteFile(srcPath, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			src, err := os.Open(srcPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			dst, err := os.Create(filepath.Join(dir, "dst"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			// mapped encryption equals the streaming path
+			hash := sha256.New()
+			if err := EncryptFileMapped(cipher, src, dst, offset, XTSSectorSize, hash); err != nil {
+				t.Fatal(err)
+			}
+			if sum := sha256.Sum256(content); !bytes.Equal(hash.Sum(nil), sum[:]) {
+				t.Fatal("hash not equal")
+			}
+			expected := bytes.NewBuffer(make([]byte, offset))
+			if err := EncryptContent(cipher, bytes.NewReader(content), expected); err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := os.ReadFile(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// padding of the last sector may differ
+			fullSectors := offset + int64(size/XTSSectorSize*XTSSectorSize)
+			if len(encrypted) != expected.Len() || !bytes.Equal(encrypted[:fullSectors], expected.Bytes()[:fullSectors]) {
+				t.Fatal("mapped encryption not equal")
+			}
+			streamDecrypted := bytes.NewBuffer(nil)
+			if err := DecryptContent(cipher, bytes.NewReader(encrypted[offset:]), streamDecrypted, int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(streamDecrypted.Bytes(), content) {
+				t.Fatal("mapped encryption not equal")
+			}
+
+			decrypted := bytes.NewBuffer(nil)
+			if err := DecryptFileMapped(cipher, dst, offset, decrypted, int64(size), XTSSectorSize); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), content) {
+				t.Fatal("mapped decryption not equal")
+			}
+
+			// truncated content
+			if err := dst.Truncate(int64(len(encrypted) - 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := DecryptFileMapped(cipher, dst, offset, io.Discard, int64(size), XTSSectorSize); !errors.Is(err, ErrTruncatedContent) {
+				t.Fatal("truncated content should fail")
+			}
+		}
+	}
+
+	// pipes can not be mapped
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := mapFile(r, 4096, false); !errors.Is(err, ErrMmapUnsupported) {
+		t.Fatal("pipe should not be mapped")
+	}
+}
+
+func BenchmarkFileMapped(b *testing.B) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		b.Skip("mmap unsupported")
+	}
+	const size = 256 * 1024 * 1024
+	dir := b.TempDir()
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, make([]byte, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+	cipher, err := NewAESXTS([16]byte{1, 2, 3})
+	if err != nil {
+		b.Fatal(err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dst.Close()
+	sectorSize := RecommendSectorSize(size)
+
+	b.Run("encrypt/stream", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			src.Seek(0, io.SeekStart)
+			dst.Seek(0, io.SeekStart)
+			if err := EncryptContentWithSectorSize(cipher, src, dst, sectorSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("encrypt/mmap", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			if err := EncryptFileMapped(cipher, src, dst, 0, sectorSize, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decrypt/stream", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			dst.Seek(0, io.SeekStart)
+			if err := DecryptContentWithSectorSize(cipher, dst, io.Discard, size, sectorSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decrypt/mmap", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			if err := DecryptFileMapped(cipher, dst, 0, io.Discard, size, sectorSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin
+
+package emix
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap map length bytes from the start of f, the mapping is shared so writes reach the file
+func mmap(f *os.File, length int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, length, prot, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
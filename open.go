@@ -0,0 +1,169 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// fileReader read the restored file of an emix file and verify the content hash on Close
+type fileReader struct {
+	r io.Reader
+	// stored content under r, the content hash is of it
+	stored *recordReader
+	// nil if the reader validates content itself, e.g. stream reader
+	hash   hash.Hash
+	header *EmixHeader
+	closed bool
+}
+
+// Open read the header of emix file r and return its file info and a reader decrypting content on demand,
+// password is used if it is not embedded. The reader returns the restored file of FileInfo.RestoredSize bytes,
+// transforms are decoded and the holes of a sparse file read as zeros, it has no ReadAt or Seek.
+// Close reads the rest of content and verifies the content hash, ErrInvalidEmixFileContent is returned
+// on mismatch
+func Open(r io.ReadSeeker, password [16]byte) (*FileInfo, io.ReadCloser, error) {
+	header := &EmixHeader{Password: password}
+	if err := header.UnmarshalFromFile(r); err != nil {
+		return nil, nil, err
+	}
+	content, err := openFile(r, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &header.FileInfo, content, nil
+}
+
+// openFile return the content reader of Open, header is read from r
+func openFile(r io.ReadSeeker, header *EmixHeader) (io.ReadCloser, error) {
+	// size and hash of stream are in the trailer, the stream reader validates them
+	if header.Streamed {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		sr, err := NewStreamReader(r, header.Password)
+		if err != nil {
+			return nil, err
+		}
+		stored := &recordReader{r: sr}
+		restored, err := restoreContent(stored, header)
+		if err != nil {
+			if stored.err == nil {
+				err = restoreError(err, header)
+			}
+			return nil, err
+		}
+		return &fileReader{r: restored, stored: stored, header: header}, nil
+	}
+	if header.FileInfo.Detached {
+		return nil, errors.New("can not open split file without its content file")
+	}
+	// the ciphertext is authenticated before anything is decrypted from it
+	if header.FileMAC {
+		if err := verifySeekerFileMAC(r, header); err != nil {
+			return nil, contentAuthError(err, header)
+		}
+	}
+	content, err := OpenContent(seekReaderAt{r}, header)
+	if err != nil {
+		return nil, err
+	}
+	hash := header.NewContentHash()
+	stored := &recordReader{r: io.TeeReader(content, hash)}
+	restored, err := restoreContent(stored, header)
+	if err != nil {
+		if stored.err == nil {
+			err = restoreError(err, header)
+		}
+		return nil, err
+	}
+	return &fileReader{r: restored, stored: stored, hash: hash, header: header}, nil
+}
+
+// restoreContent return a reader of the restored file of the stored content r, transforms are decoded
+// and the holes of a sparse file read as zeros
+func restoreContent(r io.Reader, header *EmixHeader) (io.Reader, error) {
+	info := &header.FileInfo
+	if len(info.Transforms) > 0 {
+		var err error
+		if r, err = DecodeContent(r, info.Transforms); err != nil {
+			return nil, err
+		}
+	}
+	if info.Sparse != nil {
+		r = NewSparseFileReader(r, info.Sparse)
+	}
+	return r, nil
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("read of closed file")
+	}
+	n, err := f.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && f.stored.err == nil {
+		err = restoreError(err, f.header)
+	}
+	return n, err
+}
+
+// restoreError return err of restoring the stored content, not of reading or writing it. Garbage decrypted
+// with a wrong password fails to be restored before the content hash is checked, so ErrWrongPassword is wrapped
+func restoreError(err error, header *EmixHeader) error {
+	if !header.EncryptData || errors.Is(err, ErrUnknownTransform) {
+		return err
+	}
+	return fmt.Errorf("%w: restore content of %s: %w, %w or corrupted content", ErrInvalidEmixFileContent, header.FileInfo.Name, err, ErrWrongPassword)
+}
+
+// Close verify the content hash, it does not close the underlying reader
+func (f *fileReader) Close() error {
+	if f.closed {
+		return nil
+	}
+	// the stored content may go on after the restored file ends, e.g. it is corrupted
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		f.closed = true
+		return err
+	}
+	f.closed = true
+	if _, err := io.Copy(io.Discard, f.stored); err != nil {
+		return err
+	}
+	if f.hash != nil && !bytes.Equal(f.hash.Sum(nil), f.header.FileInfo.FileContentHash[:]) {
+		return fmt.Errorf("%w: content hash mismatch of %s", ErrInvalidEmixFileContent, f.header.FileInfo.Name)
+	}
+	return nil
+}
+
+// seekReaderAt read r at offsets by seeking, it is not safe for concurrent use
+type seekReaderAt struct {
+	r io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.r, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// recordReader read from r and record the last error of reading except io.EOF
+type recordReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	content := make([]byte, 13*1024*1024+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	header := &EmixHeader{
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		SaltedKeys:  true,
+		BindHeader:  true,
+		FileInfo:    FileInfo{Name: "large.bin"},
+	}
+	f := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), f, EncryptOptions{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+
+	// read in small chunks
+	info, rc, err := Open(bytes.NewReader(f.data), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "large.bin" || info.Size != uint64(len(content)) {
+		t.Fatal("file info not equal")
+	}
+	plainText := bytes.NewBuffer(nil)
+	buf := make([]byte, 1000)
+	for {
+		n, err := rc.Read(buf)
+		plainText.Write(buf[:n])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(plainText.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tampered content fails the file mac before anything is read
+	tampered := bytes.Clone(f.data)
+	tampered[header.ContentOffset()+int64(len(content)/2)] ^= 0x01
+	if _, _, err := Open(bytes.NewReader(tampered), password); !errors.Is(err, ErrContentAuthFailed) {
+		t.Fatal("tampered content should fail authentication", err)
+	}
+
+	// close verifies the content not read of legacy files without file mac
+	legacy := &EmixHeader{
+		Version:     4,
+		EncryptInfo: true,
+		EncryptData: true,
+		Password:    password,
+		SaltedKeys:  true,
+		BindHeader:  true,
+		FileInfo:    FileInfo{Name: "large.bin"},
+	}
+	lf := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content), lf, EncryptOptions{Header: legacy}); err != nil {
+		t.Fatal(err)
+	}
+	tampered = bytes.Clone(lf.data)
+	tampered[legacy.ContentOffset()+int64(len(content)/2)] ^= 0x01
+	_, rc, err = Open(bytes.NewReader(tampered), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); !errors.Is(err, ErrInvalidEmixFileContent) {
+		t.Fatal("tampered content should fail on close", err)
+	}
+
+	// wrong password
+	if _, _, err := Open(bytes.NewReader(f.data), [16]byte{1}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatal("should be wrong password error", err)
+	}
+
+	// transformed content is decoded
+	gz := &memFile{}
+	if err := EncryptFile(bytes.NewReader(content[:1<<20]), gz, EncryptOptions{Header: &EmixHeader{
+		EncryptData: true,
+		Password:    password,
+		FileInfo:    FileInfo{Name: "large.bin"},
+	}, Transforms: []string{"gzip"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err = Open(bytes.NewReader(gz.data), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainText.Reset()
+	if _, err := io.Copy(plainText, rc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText.Bytes(), content[:1<<20]) {
+		t.Fatal("decoded content not equal")
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
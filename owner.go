@@ -0,0 +1,64 @@
+package emix
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// owner extension of file info
+// [4-byte uid] [4-byte gid] [1-byte user name length] [user name] [1-byte group name length] [group name]
+
+const (
+	ownerEncodedMinLength = 4 + 4 + 1 + 1
+	// OwnerNameMaxLength is the max length of Owner.User and Owner.Group
+	OwnerNameMaxLength = 0xff
+)
+
+var ErrOwnerNameTooLong = errors.New("owner name too long")
+
+// Owner is the owner of source file, names are empty if they were not resolved when the file was written
+type Owner struct {
+	UID   uint32
+	GID   uint32
+	User  string
+	Group string
+}
+
+func (o *Owner) encodedLength() int {
+	return ownerEncodedMinLength + len(o.User) + len(o.Group)
+}
+
+func (o *Owner) marshal() []byte {
+	buf := make([]byte, 0, o.encodedLength())
+	buf = binary.LittleEndian.AppendUint32(buf, o.UID)
+	buf = binary.LittleEndian.AppendUint32(buf, o.GID)
+	buf = append(buf, byte(len(o.User)))
+	buf = append(buf, o.User...)
+	buf = append(buf, byte(len(o.Group)))
+	return append(buf, o.Group...)
+}
+
+func unmarshalOwner(value []byte) (*Owner, error) {
+	if len(value) < ownerEncodedMinLength {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	o := &Owner{
+		UID: binary.LittleEndian.Uint32(value[0:4]),
+		GID: binary.LittleEndian.Uint32(value[4:8]),
+	}
+	i := 8
+	userLength := int(value[i])
+	i++
+	if len(value) < ownerEncodedMinLength+userLength {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	o.User = string(value[i : i+userLength])
+	i += userLength
+	groupLength := int(value[i])
+	i++
+	if len(value) != ownerEncodedMinLength+userLength+groupLength {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	o.Group = string(value[i : i+groupLength])
+	return o, nil
+}
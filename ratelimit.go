@@ -0,0 +1,37 @@
+package emix
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitWriter wait for tokens of limiter before each write
+type rateLimitWriter struct {
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+// NewRateLimitWriter return a writer limiting the bytes written to w per second by limiter,
+// content codecs write a sector each time so the limit is applied per sector.
+// A write larger than the burst of limiter is split
+func NewRateLimitWriter(w io.Writer, limiter *rate.Limiter) io.Writer {
+	return &rateLimitWriter{w: w, limiter: limiter}
+}
+
+func (r *rateLimitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, r.limiter.Burst())
+		if err := r.limiter.WaitN(context.Background(), n); err != nil {
+			return written, err
+		}
+		n, err := r.w.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,55 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/xts"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitWriter(t *testing.T) {
+	cipher, err := xts.NewCipher(aes.NewCipher, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 96*1024)
+	rand.Read(plain)
+
+	// 64KiB per second with a burst of a sector, 96KiB take 1.5 seconds
+	limit := 64 * 1024
+	limiter := rate.NewLimiter(rate.Limit(limit), XTSSectorSize)
+	encrypted := bytes.NewBuffer(nil)
+	start := time.Now()
+	if err := EncryptContent(cipher, bytes.NewReader(plain), NewRateLimitWriter(encrypted, limiter)); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 1200*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("encrypt took %s, expected about 1.5s", elapsed)
+	}
+
+	// decrypt writes share the limiter
+	decrypted := bytes.NewBuffer(nil)
+	start = time.Now()
+	if err := DecryptContent(cipher, encrypted, NewRateLimitWriter(decrypted, limiter), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 1200*time.Millisecond {
+		t.Fatalf("decrypt took %s, expected about 1.5s", elapsed)
+	}
+	if !bytes.Equal(plain, decrypted.Bytes()) {
+		t.Fatal("decrypted content not equal")
+	}
+
+	// writes larger than burst are split
+	limiter = rate.NewLimiter(rate.Limit(limit), 1024)
+	buf := bytes.NewBuffer(nil)
+	n, err := NewRateLimitWriter(buf, limiter).Write(plain[:8*1024])
+	if err != nil || n != 8*1024 {
+		t.Fatal(n, err)
+	}
+}
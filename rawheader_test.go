@@ -0,0 +1,185 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// rawHeaderFileInfoOffset return the offset of file info in the encoded header
+func rawHeaderFileInfoOffset(header *EmixHeader) int {
+	return header.passwordOffset() + 16 + 2
+}
+
+// RawHeaderOptions select how MakeRawHeader breaks an encoded header, the zero value is a valid header
+type RawHeaderOptions struct {
+	// Header is marshaled first, a plain header of a.txt is used if nil
+	Header *EmixHeader
+	// BadMagic corrupt the magic
+	BadMagic bool
+	// BadVersion set the version byte of a versioned header to a version newer than HeaderVersion
+	BadVersion bool
+	// MixType replace the mix type if not nil
+	MixType *[2]byte
+	// FileInfo replace the encoded file info if not nil, the file info length is updated
+	FileInfo []byte
+	// FileInfoLength replace the stored file info length if not zero, the file info is not changed
+	FileInfoLength int
+	// BadHash corrupt the header hash, otherwise the hash is recomputed after the changes above
+	BadHash bool
+	// Truncate cut the header to Truncate bytes if not zero
+	Truncate int
+}
+
+// MakeRawHeader return an encoded emix header broken as opts select, so each error path of
+// UnmarshalBinary can be reached, it panics if the header can not be marshaled
+func MakeRawHeader(opts RawHeaderOptions) []byte {
+	header := opts.Header
+	if header == nil {
+		header = &EmixHeader{FileInfo: FileInfo{Name: "a.txt", Size: 1}}
+	}
+	buf, err := header.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	if opts.BadMagic {
+		buf[0] ^= 0xff
+	}
+	if opts.BadVersion {
+		buf[4] = HeaderVersion + 1
+	}
+	if opts.MixType != nil {
+		copy(buf[header.mixTypeOffset():], opts.MixType[:])
+	}
+	fileInfoOffset := rawHeaderFileInfoOffset(header)
+	if opts.FileInfo != nil {
+		rest := append([]byte{}, opts.FileInfo...)
+		buf = append(buf[:fileInfoOffset], append(rest, make([]byte, 32)...)...)
+		binary.BigEndian.PutUint16(buf[fileInfoOffset-2:], uint16(len(opts.FileInfo)))
+	}
+	if opts.FileInfoLength != 0 {
+		binary.BigEndian.PutUint16(buf[fileInfoOffset-2:], uint16(opts.FileInfoLength))
+	}
+	hash := sha256.Sum256(buf[:len(buf)-32])
+	copy(buf[len(buf)-32:], hash[:])
+	if opts.BadHash {
+		buf[len(buf)-1] ^= 0xff
+	}
+	if opts.Truncate != 0 {
+		buf = buf[:opts.Truncate]
+	}
+	return buf
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	password := [16]byte{1, 2, 3}
+	validInfo, err := (&FileInfo{Name: "a.txt"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names can not be marshaled unsafe, patch a placeholder of the same length
+	unsafeInfo, err := (&FileInfo{Name: "__/a.txt"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsafeInfo = bytes.Replace(unsafeInfo, []byte("__/"), []byte("../"), 1)
+	longName := &EmixHeader{FileInfo: FileInfo{Name: "a-long-name-to-pass-min-length.txt"}}
+	tests := []struct {
+		name     string
+		opts     RawHeaderOptions
+		password [16]byte
+		err      error
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "bad magic",
+			opts: RawHeaderOptions{BadMagic: true},
+			err:  ErrInvalidEmixHeader,
+		},
+		{
+			name: "unsupported version",
+			opts: RawHeaderOptions{BadVersion: true},
+			err:  ErrUnsupportedVersion,
+		},
+		{
+			name: "unversioned",
+			opts: RawHeaderOptions{Header: &EmixHeader{Unversioned: true, FileInfo: FileInfo{Name: "a.txt", Size: 1}}},
+		},
+		{
+			name: "bad hash",
+			opts: RawHeaderOptions{BadHash: true},
+			err:  ErrInvalidEmixHeader,
+		},
+		{
+			name: "oversized file info length",
+			opts: RawHeaderOptions{FileInfoLength: 0xffff},
+			err:  ErrInvalidEmixHeader,
+		},
+		{
+			name: "truncated below min length",
+			opts: RawHeaderOptions{Truncate: emixHeaderMinLength - 1},
+			err:  ErrInvalidEmixHeader,
+		},
+		{
+			name: "truncated hash",
+			opts: RawHeaderOptions{
+				Header:   longName,
+				Truncate: rawHeaderFileInfoOffset(longName) + len(longName.FileInfo.Name) + fileInfoEncodedMinLength - 1,
+			},
+			err: ErrInvalidEmixHeader,
+		},
+		{
+			name: "unsupported cipher suite",
+			opts: RawHeaderOptions{MixType: &[2]byte{0x00, 0xf0}},
+			err:  ErrUnsupportedCipherSuite,
+		},
+		{
+			name: "invalid sector size",
+			opts: RawHeaderOptions{MixType: &[2]byte{0xf0, 0x02}},
+			err:  ErrInvalidEmixHeader,
+		},
+		{
+			name: "invalid file info",
+			opts: RawHeaderOptions{FileInfo: append([]byte{0xff, 0xff}, validInfo[2:]...)},
+			err:  ErrInvalidEncodedFileInfo,
+		},
+		{
+			name: "truncated file info extension",
+			opts: RawHeaderOptions{FileInfo: append(validInfo, 0x01)},
+			err:  ErrInvalidEncodedFileInfo,
+		},
+		{
+			name: "unsafe file name",
+			opts: RawHeaderOptions{FileInfo: unsafeInfo},
+			err:  ErrUnsafeFileName,
+		},
+		{
+			name: "wrong password",
+			opts: RawHeaderOptions{
+				Header: &EmixHeader{EncryptInfo: true, Password: password, FileInfo: FileInfo{Name: "a.txt"}},
+			},
+			password: [16]byte{4, 5, 6},
+			err:      ErrWrongPassword,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := &EmixHeader{Password: tt.password}
+			err := header.UnmarshalBinary(MakeRawHeader(tt.opts))
+			if tt.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
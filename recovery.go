@@ -0,0 +1,58 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// recovery code structure, base32 of [16-byte key] [4-byte sha256 checksum of key],
+// 32 characters in 8 groups of 4 separated by `-`
+
+const (
+	recoveryCodeChecksumLength = 4
+	recoveryCodeGroupLength    = 4
+	recoveryCodeLength         = 32
+)
+
+var ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// EncodeRecoveryCode encode key as a recovery code to be written down, e.g. ABCD-EFGH-...
+func EncodeRecoveryCode(key [16]byte) string {
+	checksum := sha256.Sum256(key[:])
+	data := append(key[:], checksum[:recoveryCodeChecksumLength]...)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data)
+
+	groups := make([]string, 0, len(encoded)/recoveryCodeGroupLength)
+	for i := 0; i < len(encoded); i += recoveryCodeGroupLength {
+		groups = append(groups, encoded[i:i+recoveryCodeGroupLength])
+	}
+	return strings.Join(groups, "-")
+}
+
+// DecodeRecoveryCode decode the key of a recovery code, case, spaces and `-` are ignored,
+// a mistyped code fails the checksum
+func DecodeRecoveryCode(code string) ([16]byte, error) {
+	var key [16]byte
+	code = strings.Map(func(c rune) rune {
+		if c == '-' || c == ' ' {
+			return -1
+		}
+		return c
+	}, strings.ToUpper(code))
+	if len(code) != recoveryCodeLength {
+		return key, ErrInvalidRecoveryCode
+	}
+	data, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(code)
+	if err != nil || len(data) != len(key)+recoveryCodeChecksumLength {
+		return key, ErrInvalidRecoveryCode
+	}
+	checksum := sha256.Sum256(data[:len(key)])
+	if !bytes.Equal(checksum[:recoveryCodeChecksumLength], data[len(key):]) {
+		return key, ErrInvalidRecoveryCode
+	}
+	copy(key[:], data)
+	return key, nil
+}
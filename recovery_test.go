@@ -0,0 +1,42 @@
+package emix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCode(t *testing.T) {
+	password, err := GenerateRandomPassword(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key [16]byte
+	copy(key[:], password)
+
+	code := EncodeRecoveryCode(key)
+	if len(code) != 39 || strings.Count(code, "-") != 7 {
+		t.Fatalf("unexpected recovery code format %s", code)
+	}
+	for _, input := range []string{code, strings.ToLower(code), strings.ReplaceAll(code, "-", " "), strings.ReplaceAll(code, "-", "")} {
+		decoded, err := DecodeRecoveryCode(input)
+		if err != nil {
+			t.Fatalf("decode %s error: %v", input, err)
+		}
+		if decoded != key {
+			t.Fatalf("decode %s got %x, expected %x", input, decoded, key)
+		}
+	}
+
+	// one mistyped character
+	corrupted := []byte(code)
+	if corrupted[0] == 'A' {
+		corrupted[0] = 'B'
+	} else {
+		corrupted[0] = 'A'
+	}
+	for _, input := range []string{string(corrupted), code[:len(code)-1], code + "A", "1234"} {
+		if _, err := DecodeRecoveryCode(input); err != ErrInvalidRecoveryCode {
+			t.Fatalf("decode %s expected ErrInvalidRecoveryCode, got %v", input, err)
+		}
+	}
+}
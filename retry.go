@@ -0,0 +1,53 @@
+package emix
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// IsTemporary report if err is transient, e.g. EAGAIN or a network timeout, so the operation can be retried.
+// err is temporary if an error in its chain has a Temporary() or Timeout() method reporting true
+func IsTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// Retry call fn until it succeeds, fails with an error not IsTemporary, or fails retries more times,
+// it sleeps backoff before the first retry and doubles it after each retry
+func Retry(retries int, backoff time.Duration, fn func() error) error {
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= retries || !IsTemporary(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryWriter retry writes failed with temporary errors
+type retryWriter struct {
+	w       io.Writer
+	retries int
+	backoff time.Duration
+}
+
+// NewRetryWriter return a writer retrying each Write with Retry, the bytes left by a failed Write are written again
+func NewRetryWriter(w io.Writer, retries int, backoff time.Duration) io.Writer {
+	return &retryWriter{w: w, retries: retries, backoff: backoff}
+}
+
+func (r *retryWriter) Write(p []byte) (int, error) {
+	written := 0
+	err := Retry(r.retries, r.backoff, func() error {
+		n, err := r.w.Write(p[written:])
+		written += n
+		return err
+	})
+	return written, err
+}
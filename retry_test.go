@@ -0,0 +1,81 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// flakyWriter fail writes with err until failures is zero, half of p is written by a failed write
+type flakyWriter struct {
+	bytes.Buffer
+	failures int
+	err      error
+	writes   int
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if f.failures > 0 {
+		f.failures--
+		n, _ := f.Buffer.Write(p[:len(p)/2])
+		return n, f.err
+	}
+	return f.Buffer.Write(p)
+}
+
+func TestRetryWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 1000)
+	temporary := &os.PathError{Op: "write", Path: "nfs", Err: syscall.EAGAIN}
+	if !IsTemporary(temporary) || !IsTemporary(fmt.Errorf("write: %w", temporary)) {
+		t.Fatal("EAGAIN should be temporary")
+	}
+	if IsTemporary(errors.New("disk full")) || IsTemporary(syscall.ENOSPC) {
+		t.Fatal("ENOSPC should not be temporary")
+	}
+
+	// fail transiently then succeed
+	w := &flakyWriter{failures: 3, err: temporary}
+	n, err := NewRetryWriter(w, 3, 0).Write(content)
+	if err != nil || n != len(content) || !bytes.Equal(w.Bytes(), content) {
+		t.Fatal("write should succeed after retries")
+	}
+	if w.writes != 4 {
+		t.Fatalf("expected 4 writes, got %d", w.writes)
+	}
+
+	// too many failures
+	w = &flakyWriter{failures: 3, err: temporary}
+	if _, err := NewRetryWriter(w, 2, 0).Write(content); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatal("write should fail after retries")
+	}
+	if w.writes != 3 {
+		t.Fatalf("expected 3 writes, got %d", w.writes)
+	}
+
+	// permanent errors are not retried
+	w = &flakyWriter{failures: 1, err: syscall.ENOSPC}
+	if _, err := NewRetryWriter(w, 3, 0).Write(content); !errors.Is(err, syscall.ENOSPC) || w.writes != 1 {
+		t.Fatal("permanent error should not be retried")
+	}
+
+	// content encryption through a flaky writer
+	cipher, err := NewAESXTS([16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = &flakyWriter{failures: 2, err: temporary}
+	if err := EncryptContent(cipher, bytes.NewReader(content), NewRetryWriter(w, 2, 0)); err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.NewBuffer(nil)
+	if err := DecryptContent(cipher, &w.Buffer, plain, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+}
@@ -0,0 +1,187 @@
+package emix
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// sparse extension of file info
+// [8-byte file size] [8-byte offset of data extent] [8-byte length of data extent] ...
+// content is the data extents one after another, the rest of file are holes
+
+const (
+	sparseEncodedMinLength = 8
+	extentEncodedLength    = 8 + 8
+	// MaxSparseExtents is the max number of data extents of a sparse file, files with more are stored dense
+	MaxSparseExtents = 1024
+)
+
+var (
+	// ErrSparseUnsupported means holes of the file can not be found, e.g. an unsupported OS or filesystem
+	ErrSparseUnsupported = errors.New("sparse unsupported")
+	ErrInvalidSparseMap  = errors.New("invalid sparse map")
+)
+
+// Extent is a range of bytes in file
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// SparseMap record the data extents of a sparse file, content of the emix file is only the data extents
+type SparseMap struct {
+	// Size is the size of file with holes
+	Size    uint64
+	Extents []Extent
+}
+
+// DataLength return the total length of data extents, the length of content
+func (s *SparseMap) DataLength() int64 {
+	var length int64
+	for _, e := range s.Extents {
+		length += e.Length
+	}
+	return length
+}
+
+func (s *SparseMap) valid() error {
+	if len(s.Extents) > MaxSparseExtents {
+		return ErrInvalidSparseMap
+	}
+	end := int64(0)
+	for _, e := range s.Extents {
+		if e.Offset < end || e.Length <= 0 || e.Offset+e.Length < e.Offset {
+			return ErrInvalidSparseMap
+		}
+		end = e.Offset + e.Length
+	}
+	if uint64(end) > s.Size {
+		return ErrInvalidSparseMap
+	}
+	return nil
+}
+
+func (s *SparseMap) encodedLength() int {
+	return sparseEncodedMinLength + len(s.Extents)*extentEncodedLength
+}
+
+func (s *SparseMap) marshal() []byte {
+	buf := make([]byte, 0, s.encodedLength())
+	buf = binary.LittleEndian.AppendUint64(buf, s.Size)
+	for _, e := range s.Extents {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.Offset))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.Length))
+	}
+	return buf
+}
+
+func unmarshalSparseMap(value []byte) (*SparseMap, error) {
+	if len(value) < sparseEncodedMinLength || (len(value)-sparseEncodedMinLength)%extentEncodedLength != 0 {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	s := &SparseMap{Size: binary.LittleEndian.Uint64(value[0:8])}
+	for i := sparseEncodedMinLength; i < len(value); i += extentEncodedLength {
+		s.Extents = append(s.Extents, Extent{
+			Offset: int64(binary.LittleEndian.Uint64(value[i : i+8])),
+			Length: int64(binary.LittleEndian.Uint64(value[i+8 : i+16])),
+		})
+	}
+	if err := s.valid(); err != nil {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	return s, nil
+}
+
+// NewSparseReader return a reader of the data extents of r one after another
+func NewSparseReader(r io.ReaderAt, extents []Extent) io.Reader {
+	readers := make([]io.Reader, 0, len(extents))
+	for _, e := range extents {
+		readers = append(readers, io.NewSectionReader(r, e.Offset, e.Length))
+	}
+	return io.MultiReader(readers...)
+}
+
+// sparseReader read the file of a sparse map, the holes are zeros and the data extents are read from r one after another
+type sparseReader struct {
+	r       io.Reader
+	extents []Extent
+	size    int64
+	offset  int64
+}
+
+// NewSparseFileReader return a reader of the whole file of sparse, the data extents are read from r one after another
+// and the holes read as zeros, it is the inverse of NewSparseReader
+func NewSparseFileReader(r io.Reader, sparse *SparseMap) io.Reader {
+	return &sparseReader{r: r, extents: sparse.Extents, size: int64(sparse.Size)}
+}
+
+func (sr *sparseReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.size {
+		return 0, io.EOF
+	}
+	for len(sr.extents) > 0 && sr.offset >= sr.extents[0].Offset+sr.extents[0].Length {
+		sr.extents = sr.extents[1:]
+	}
+	// the hole before the next extent or the trailing hole
+	end := sr.size
+	if len(sr.extents) > 0 {
+		end = sr.extents[0].Offset
+	}
+	if sr.offset < end {
+		n := int(min(int64(len(p)), end-sr.offset))
+		clear(p[:n])
+		sr.offset += int64(n)
+		return n, nil
+	}
+	e := sr.extents[0]
+	n, err := sr.r.Read(p[:min(int64(len(p)), e.Offset+e.Length-sr.offset)])
+	sr.offset += int64(n)
+	if errors.Is(err, io.EOF) {
+		if sr.offset < e.Offset+e.Length {
+			// content ends before the data extents
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// sparseWriter seek to the offset of each data extent before writing its bytes
+type sparseWriter struct {
+	w       io.Writer
+	s       io.Seeker
+	extents []Extent
+	// bytes left of the current extent
+	left int64
+}
+
+// NewSparseWriter return a writer writing content to the data extents, s is the seeker of the file under w,
+// e.g. w is a rate limited writer of s. The file should be truncated to SparseMap.Size after the content is written
+// to create the trailing hole
+func NewSparseWriter(w io.Writer, s io.Seeker, extents []Extent) io.Writer {
+	return &sparseWriter{w: w, s: s, extents: extents}
+}
+
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if sw.left == 0 {
+			if len(sw.extents) == 0 {
+				return written, ErrInvalidSparseMap
+			}
+			if _, err := sw.s.Seek(sw.extents[0].Offset, io.SeekStart); err != nil {
+				return written, err
+			}
+			sw.left = sw.extents[0].Length
+			sw.extents = sw.extents[1:]
+		}
+		n, err := sw.w.Write(p[written : written+int(min(int64(len(p)-written), sw.left))])
+		written += n
+		sw.left -= int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package emix
+
+import (
+	"os"
+)
+
+func DataExtents(f *os.File, size int64) ([]Extent, error) {
+	return nil, ErrSparseUnsupported
+}
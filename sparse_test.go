@@ -0,0 +1,126 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSparseMap(t *testing.T) {
+	info := FileInfo{
+		Name: "disk.img",
+		Size: 8,
+		Sparse: &SparseMap{
+			Size:    1 << 30,
+			Extents: []Extent{{Offset: 0, Length: 4}, {Offset: 1 << 20, Length: 4}},
+		},
+	}
+	buf, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != info.EncodedLength() {
+		t.Fatal("EncodedLength not equal")
+	}
+	var info2 FileInfo
+	if err := info2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, info2) {
+		t.Fatal("not equal")
+	}
+
+	for _, extents := range [][]Extent{
+		{{Offset: 4, Length: 4}, {Offset: 0, Length: 4}},
+		{{Offset: 0, Length: 0}},
+		{{Offset: 1 << 30, Length: 1}},
+	} {
+		info.Sparse.Extents = extents
+		if _, err := info.MarshalBinary(); !errors.Is(err, ErrInvalidSparseMap) {
+			t.Fatal("invalid extents should fail", extents)
+		}
+	}
+}
+
+func TestSparseReaderWriter(t *testing.T) {
+	file := make([]byte, 100)
+	copy(file[10:], "data")
+	copy(file[50:], "more data")
+	extents := []Extent{{Offset: 10, Length: 4}, {Offset: 50, Length: 9}}
+
+	content, err := io.ReadAll(NewSparseReader(bytes.NewReader(file), extents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "datamore data" {
+		t.Fatalf("unexpected content %q", content)
+	}
+
+	path := filepath.Join(t.TempDir(), "restored")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewSparseWriter(f, f, extents)
+	// writes across extents
+	for i := 0; i < len(content); i += 3 {
+		if _, err := w.Write(content[i:min(i+3, len(content))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(int64(len(file))); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file, restored) {
+		t.Fatal("restored file not equal")
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrInvalidSparseMap) {
+		t.Fatal("content longer than extents should fail")
+	}
+}
+
+func TestDataExtents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// data, a 64MB hole, data and a trailing hole
+	if _, err := f.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(128 << 20)
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := DataExtents(f, size)
+	if errors.Is(err, ErrSparseUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) == 1 && extents[0].Length == size {
+		t.Skip("filesystem does not report holes")
+	}
+	if len(extents) != 2 || extents[0].Offset != 0 || extents[1].Offset > 64<<20 || extents[1].Offset+extents[1].Length < 64<<20+4 {
+		t.Fatalf("unexpected extents %v", extents)
+	}
+	if offset, _ := f.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Fatal("file position should be reset")
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin
+
+package emix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DataExtents return the data extents of the first size bytes of f by SEEK_DATA and SEEK_HOLE,
+// a filesystem without holes report a single extent. The file position is reset to the start
+func DataExtents(f *os.File, size int64) ([]Extent, error) {
+	defer f.Seek(0, io.SeekStart)
+	var extents []Extent
+	for offset := int64(0); offset < size; {
+		data, err := f.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data after offset
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSparseUnsupported, err)
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSparseUnsupported, err)
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, Extent{Offset: data, Length: hole - data})
+		}
+		offset = hole
+	}
+	return extents, nil
+}
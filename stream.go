@@ -0,0 +1,293 @@
+package emix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// emix stream structure, written in one pass without seeking
+// [zip header] [emix header] [file content] [8-byte file size] [32-byte file content hash] [4-byte trailer magic]
+// FileInfo.Size and FileInfo.FileContentHash of header are zero, the trailer carries them
+
+var (
+	streamTrailerMagic  = [4]byte{0x45, 0x4d, 0x58, 0x54} // EMXT
+	streamTrailerLength = 8 + 32 + 4
+
+	streamReadSize = 32 * 1024
+
+	ErrInvalidStreamTrailer = errors.New("invalid emix stream trailer")
+)
+
+// StreamWriter write an emix stream, content is written after the header and the trailer is written on Close
+type StreamWriter struct {
+	w          io.Writer
+	header     *EmixHeader
+	cipher     ContentCipher
+	sectorSize int
+
+	// plain bytes of the current sector
+	sectorBuf    []byte
+	cipherBuf    []byte
+	sectorNumber uint64
+	hash         hash.Hash
+	size         int64
+	closed       bool
+}
+
+// NewStreamWriter write the header and return a StreamWriter, header.Streamed is set,
+// FileInfo.Size and FileInfo.FileContentHash are computed from content and set on Close
+func NewStreamWriter(w io.Writer, header *EmixHeader) (*StreamWriter, error) {
+	header.Streamed = true
+	header.FileInfo.Size = 0
+	header.FileInfo.FileContentHash = [32]byte{}
+	s := &StreamWriter{
+		w:            w,
+		header:       header,
+		sectorNumber: SectorNumberStart,
+		hash:         header.NewContentHash(),
+	}
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return nil, err
+		}
+		s.cipher = cipher
+		s.sectorSize = header.ContentSectorSize()
+		if err := ValidSectorSize(s.sectorSize); err != nil {
+			return nil, err
+		}
+		s.sectorBuf = make([]byte, 0, s.sectorSize)
+		s.cipherBuf = make([]byte, s.sectorSize)
+	}
+
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if !header.NoDisguise {
+		encodedHeader = append(ZipHeader(), encodedHeader...)
+	}
+	if _, err := w.Write(encodedHeader); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("stream writer is closed")
+	}
+	s.hash.Write(p)
+	s.size += int64(len(p))
+	if s.cipher == nil {
+		return s.w.Write(p)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		m := min(len(p), s.sectorSize-len(s.sectorBuf))
+		s.sectorBuf = append(s.sectorBuf, p[:m]...)
+		p = p[m:]
+		if len(s.sectorBuf) == s.sectorSize {
+			if err := s.writeSector(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeSector encrypt and write the current sector, a partial sector is padded with zero
+func (s *StreamWriter) writeSector() error {
+	clear(s.sectorBuf[len(s.sectorBuf):s.sectorSize])
+	s.cipher.Encrypt(s.cipherBuf, s.sectorBuf[:s.sectorSize], s.sectorNumber)
+	s.sectorNumber++
+	s.sectorBuf = s.sectorBuf[:0]
+	_, err := s.w.Write(s.cipherBuf)
+	return err
+}
+
+// Close write the last sector and the trailer, it does not close the underlying writer
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.cipher != nil && len(s.sectorBuf) > 0 {
+		if err := s.writeSector(); err != nil {
+			return err
+		}
+	}
+
+	s.header.FileInfo.Size = uint64(s.size)
+	copy(s.header.FileInfo.FileContentHash[:], s.hash.Sum(nil))
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(s.size))
+	trailer = append(trailer, s.header.FileInfo.FileContentHash[:]...)
+	trailer = append(trailer, streamTrailerMagic[:]...)
+	_, err := s.w.Write(trailer)
+	return err
+}
+
+// StreamReader read the plain content of an emix stream and validate the trailer,
+// data is returned before the trailer is read, so an error at the end means the content is invalid
+type StreamReader struct {
+	// Header is the header of stream, FileInfo.Size and FileInfo.FileContentHash are set at the end
+	Header *EmixHeader
+
+	r          *bufio.Reader
+	cipher     ContentCipher
+	sectorSize int
+
+	// raw bytes not processed yet, the trailer is kept back until the end
+	pending      []byte
+	plain        []byte
+	sectorNumber uint64
+	hash         hash.Hash
+	size         int64
+	err          error
+}
+
+// NewStreamReader read the header of stream from r, password is used if file info or content is encrypted
+func NewStreamReader(r io.Reader, password [16]byte) (*StreamReader, error) {
+	br := bufio.NewReaderSize(r, zipHeaderLength+emixHeaderMaxLength)
+	data, err := br.Peek(zipHeaderLength + emixHeaderMinLength)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	headerOffset, ok, err := detectEmixFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidEmixHeader
+	}
+	// header length is known by the file info length
+	fileInfoLengthOffset := headerOffset + encodedFileInfoLengthOffset(data[headerOffset:])
+	headerLength := fileInfoLengthOffset + 2 + int(binary.BigEndian.Uint16(data[fileInfoLengthOffset:])) + 32
+	data, err = br.Peek(headerLength)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrInvalidEmixHeader
+		}
+		return nil, err
+	}
+	header := &EmixHeader{Password: password}
+	if err := header.UnmarshalBinary(data[headerOffset:]); err != nil {
+		return nil, err
+	}
+	if !header.Streamed {
+		return nil, fmt.Errorf("%w: not an emix stream", ErrInvalidEmixHeader)
+	}
+	br.Discard(headerLength)
+
+	s := &StreamReader{
+		Header:       header,
+		r:            br,
+		sectorNumber: SectorNumberStart,
+		hash:         header.NewContentHash(),
+	}
+	if header.EncryptData {
+		cipher, err := header.NewContentCipher()
+		if err != nil {
+			return nil, err
+		}
+		s.cipher = cipher
+		s.sectorSize = header.ContentSectorSize()
+		if err := ValidSectorSize(s.sectorSize); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.fill()
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// fill read raw bytes and produce plain bytes, the trailer is validated at the end
+func (s *StreamReader) fill() {
+	buf := make([]byte, streamReadSize)
+	n, err := io.ReadFull(s.r, buf)
+	s.pending = append(s.pending, buf[:n]...)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.err = s.finish()
+			return
+		}
+		s.err = err
+		return
+	}
+
+	// keep back the trailer, and the last sector whose padding is unknown
+	keep := streamTrailerLength
+	if s.cipher != nil {
+		keep += s.sectorSize
+	}
+	if available := len(s.pending) - keep; available > 0 {
+		if s.cipher != nil {
+			available -= available % s.sectorSize
+		}
+		s.produce(s.pending[:available], int64(available))
+		s.pending = bytes.Clone(s.pending[available:])
+	}
+}
+
+// produce decrypt raw content and append the first size plain bytes
+func (s *StreamReader) produce(raw []byte, size int64) {
+	plain := raw
+	if s.cipher != nil {
+		plain = make([]byte, len(raw))
+		for i := 0; i < len(raw); i += s.sectorSize {
+			s.cipher.Decrypt(plain[i:i+s.sectorSize], raw[i:i+s.sectorSize], s.sectorNumber)
+			s.sectorNumber++
+		}
+	}
+	plain = plain[:size]
+	s.hash.Write(plain)
+	s.size += size
+	s.plain = append(s.plain, plain...)
+}
+
+// finish validate the trailer and produce the rest content, return io.EOF if the stream is valid
+func (s *StreamReader) finish() error {
+	if len(s.pending) < streamTrailerLength {
+		return fmt.Errorf("%w: %w", ErrInvalidStreamTrailer, ErrTruncatedContent)
+	}
+	raw := s.pending[:len(s.pending)-streamTrailerLength]
+	trailer := s.pending[len(raw):]
+	if !bytes.Equal(trailer[40:], streamTrailerMagic[:]) {
+		return fmt.Errorf("%w: %w", ErrInvalidStreamTrailer, ErrTruncatedContent)
+	}
+	size := int64(binary.BigEndian.Uint64(trailer[:8]))
+
+	rest := size - s.size
+	expected := rest
+	if s.cipher != nil {
+		expected = EncryptedContentSize(rest, s.sectorSize)
+	}
+	if rest < 0 || int64(len(raw)) != expected {
+		return fmt.Errorf("%w: content size mismatch", ErrInvalidStreamTrailer)
+	}
+	s.produce(raw, rest)
+	s.pending = nil
+
+	if !bytes.Equal(s.hash.Sum(nil), trailer[8:40]) {
+		return fmt.Errorf("%w: content hash mismatch", ErrInvalidEmixFileContent)
+	}
+	s.Header.FileInfo.Size = uint64(size)
+	copy(s.Header.FileInfo.FileContentHash[:], trailer[8:40])
+	return io.EOF
+}
@@ -0,0 +1,116 @@
+package emix
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// writerOnly hide all methods except Write, so the writer is not seekable
+type writerOnly struct {
+	w io.Writer
+}
+
+func (w writerOnly) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func TestStream(t *testing.T) {
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	for _, size := range []int{0, 1, 4096, 4097, 100*1024 + 3} {
+		for _, encrypt := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d-%t", size, encrypt), func(t *testing.T) {
+				content := make([]byte, size)
+				rand.Read(content)
+				header := &EmixHeader{
+					EncryptInfo: encrypt,
+					EncryptData: encrypt,
+					Password:    password,
+					SaltedKeys:  true,
+					BindHeader:  true,
+					FileInfo:    FileInfo{Name: "stream.bin", Mode: 0644},
+				}
+				buf := bytes.NewBuffer(nil)
+				sw, err := NewStreamWriter(writerOnly{buf}, header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// write in small pieces
+				for i := 0; i < len(content); i += 1000 {
+					if _, err := sw.Write(content[i:min(i+1000, len(content))]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := sw.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if header.FileInfo.Size != uint64(size) || header.FileInfo.FileContentHash != sha256.Sum256(content) {
+					t.Fatal("header should be updated on close")
+				}
+				if ok, _ := IsEmixFileByData(buf.Bytes()); !ok {
+					t.Fatal("should be emix file")
+				}
+
+				sr, err := NewStreamReader(bytes.NewReader(buf.Bytes()), password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sr.Header.FileInfo.Name != "stream.bin" || !sr.Header.Streamed {
+					t.Fatal("header not equal")
+				}
+				plain, err := io.ReadAll(sr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plain, content) {
+					t.Fatal("content not equal")
+				}
+				if sr.Header.FileInfo.Size != uint64(size) || sr.Header.FileInfo.FileContentHash != sha256.Sum256(content) {
+					t.Fatal("header should be updated from trailer")
+				}
+
+				// truncated trailer
+				data := buf.Bytes()
+				sr, err = NewStreamReader(bytes.NewReader(data[:len(data)-1]), password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadAll(sr); !errors.Is(err, ErrInvalidStreamTrailer) {
+					t.Fatal("should be invalid trailer error", err)
+				}
+
+				// tampered content
+				if size > 0 {
+					tampered := bytes.Clone(data)
+					tampered[len(tampered)-streamTrailerLength-1] ^= 0xff
+					if encrypt && size%XTSSectorSize != 0 {
+						// the last byte is padding, tamper the first byte of last sector
+						tampered = bytes.Clone(data)
+						tampered[len(tampered)-streamTrailerLength-XTSSectorSize] ^= 0xff
+					}
+					sr, err = NewStreamReader(bytes.NewReader(tampered), password)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := io.ReadAll(sr); !errors.Is(err, ErrInvalidEmixFileContent) {
+						t.Fatal("should be content hash mismatch", err)
+					}
+				}
+			})
+		}
+	}
+
+	// a regular emix file is not a stream
+	header := &EmixHeader{FileInfo: FileInfo{Name: "a.txt"}}
+	encoded, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStreamReader(bytes.NewReader(append(ZipHeader(), encoded...)), password); !errors.Is(err, ErrInvalidEmixHeader) {
+		t.Fatal("should be invalid header error", err)
+	}
+}
@@ -0,0 +1,125 @@
+package emix
+
+import (
+	"bytes"
+	"math"
+)
+
+// commonPasswordWords are frequent choices of passwords, a match counts as one guess among them
+var commonPasswordWords = []string{
+	"password", "passwd", "qwerty", "letmein", "welcome", "admin", "login", "master", "monkey", "dragon",
+	"shadow", "sunshine", "princess", "football", "baseball", "soccer", "iloveyou", "superman", "batman",
+	"trustno", "secret", "freedom", "whatever", "michael", "jennifer", "jordan", "hunter", "ranger",
+	"charlie", "summer", "winter", "hello", "love", "test", "guest", "root", "user", "pass", "emix",
+}
+
+// keyboardRows are rows of a qwerty keyboard, adjacent keys of a row are easy to guess
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// leetReplacer map common l33t substitutions back to letters
+var leetReplacer = map[byte]byte{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i'}
+
+// EstimatePasswordStrength return the estimated entropy of password in bits, in the spirit of zxcvbn:
+// each character counts log2 of the size of character classes used, characters repeating, continuing a
+// sequence or a keyboard row of the previous one count 1 bit, and common words count as one guess among them
+func EstimatePasswordStrength(password []byte) int {
+	if len(password) == 0 {
+		return 0
+	}
+	normalized := normalizePassword(password)
+	// characters covered by common words
+	common := make([]bool, len(password))
+	words := 0
+	for _, word := range commonPasswordWords {
+		for i := 0; i+len(word) <= len(normalized); {
+			j := bytes.Index(normalized[i:], []byte(word))
+			if j < 0 {
+				break
+			}
+			// a word inside a longer word is not another guess, e.g. pass in password
+			if !common[i+j] {
+				words++
+			}
+			for k := i + j; k < i+j+len(word); k++ {
+				common[k] = true
+			}
+			i += j + len(word)
+		}
+	}
+
+	charBits := math.Log2(float64(passwordPoolSize(password)))
+	bits := float64(words) * math.Log2(float64(len(commonPasswordWords)))
+	for i, c := range password {
+		switch {
+		case common[i]:
+		case i > 0 && isGuessableAfter(password[i-1], c):
+			bits++
+		default:
+			bits += charBits
+		}
+	}
+	return int(bits)
+}
+
+// normalizePassword lower case and undo l33t substitutions to match common words
+func normalizePassword(password []byte) []byte {
+	normalized := bytes.ToLower(password)
+	for i, c := range normalized {
+		if r, ok := leetReplacer[c]; ok {
+			normalized[i] = r
+		}
+	}
+	return normalized
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// passwordPoolSize return the number of characters of the classes used in password
+func passwordPoolSize(password []byte) int {
+	var lower, upper, digit, symbol, other bool
+	for _, c := range password {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c >= 0x20 && c < 0x7f:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 128}} {
+		if class.used {
+			size += class.size
+		}
+	}
+	return size
+}
+
+// isGuessableAfter report if c repeats prev, continues an alphabet or digit sequence, or is next to prev on a keyboard row
+func isGuessableAfter(prev, c byte) bool {
+	prev, c = lowerByte(prev), lowerByte(c)
+	if c == prev || c == prev+1 || c == prev-1 {
+		return true
+	}
+	for _, row := range keyboardRows {
+		i := bytes.IndexByte([]byte(row), prev)
+		j := bytes.IndexByte([]byte(row), c)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
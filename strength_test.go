@@ -0,0 +1,28 @@
+package emix
+
+import (
+	"testing"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	for _, password := range []string{
+		"", "a", "aaaaaaaaaaaaaaaa", "1234567890123456", "abcdefgh", "qwertyuiop",
+		"password", "P@ssw0rd", "Password123", "iloveyou2024", "letmein!",
+	} {
+		if bits := EstimatePasswordStrength([]byte(password)); bits >= 50 {
+			t.Fatalf("%q should be weak, got %d bits", password, bits)
+		}
+	}
+	for _, password := range []string{
+		"x7#Kq9!vL2@mZp4w", "tR8$wQz&1nVb", "correct-Horse-9", "G4h!kP2#sW9z",
+	} {
+		if bits := EstimatePasswordStrength([]byte(password)); bits < 50 {
+			t.Fatalf("%q should be strong, got %d bits", password, bits)
+		}
+	}
+
+	// longer is stronger
+	if EstimatePasswordStrength([]byte("x7#Kq9")) >= EstimatePasswordStrength([]byte("x7#Kq9!vL2")) {
+		t.Fatal("longer password should be stronger")
+	}
+}
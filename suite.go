@@ -0,0 +1,205 @@
+package emix
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuiteID identify the file info AEAD, content cipher and content hash of a file,
+// it use the high 4 bits of mix type second byte, 0 is the suite of files before cipher suites
+type CipherSuiteID uint8
+
+const (
+	CipherSuiteAESGCM   CipherSuiteID = 0
+	CipherSuiteChaCha20 CipherSuiteID = 1
+
+	// DefaultCipherSuite is the suite used if not set
+	DefaultCipherSuite = CipherSuiteAESGCM
+
+	emixHeaderCipherSuiteShift = 4
+)
+
+// ContentCipher encrypt and decrypt content sector by sector, sectorNum tweaks each sector,
+// *xts.Cipher implements it
+type ContentCipher interface {
+	Encrypt(ciphertext, plaintext []byte, sectorNum uint64)
+	Decrypt(plaintext, ciphertext []byte, sectorNum uint64)
+}
+
+// cipherSuite is a registered combination of crypto algorithms
+type cipherSuite struct {
+	name             string
+	newAEAD          func(key [16]byte, salt []byte) (cipher.AEAD, error)
+	newContentCipher func(key [16]byte, salt []byte) (ContentCipher, error)
+	newHash          func() hash.Hash
+	// length added by encrypting file info
+	overhead int
+}
+
+// cipherSuites is the registry of supported suites indexed by id
+var cipherSuites = []*cipherSuite{
+	CipherSuiteAESGCM: {
+		name:    "aes-gcm+aes-xts+sha256",
+		newAEAD: newAESGCM,
+		newContentCipher: func(key [16]byte, salt []byte) (ContentCipher, error) {
+			return newAESXTS(key, salt)
+		},
+		newHash:  sha256.New,
+		overhead: aesgcmOverhead,
+	},
+	CipherSuiteChaCha20: {
+		name:    "chacha20+chacha20+blake2b",
+		newAEAD: newChaCha20Poly1305,
+		newContentCipher: func(key [16]byte, salt []byte) (ContentCipher, error) {
+			return newChaCha20Sectors(key, salt), nil
+		},
+		newHash: func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		},
+		overhead: aeadOverhead(newChaCha20Poly1305([16]byte{}, nil)),
+	},
+}
+
+// ParseCipherSuite return the id of the suite named name, e.g. aes-gcm+aes-xts+sha256
+func ParseCipherSuite(name string) (CipherSuiteID, error) {
+	for id, suite := range cipherSuites {
+		if suite.name == name {
+			return CipherSuiteID(id), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s, supported: %s", ErrUnsupportedCipherSuite, name, strings.Join(CipherSuiteNames(), ", "))
+}
+
+// CipherSuiteNames return the names of supported suites
+func CipherSuiteNames() []string {
+	names := make([]string, 0, len(cipherSuites))
+	for _, suite := range cipherSuites {
+		names = append(names, suite.name)
+	}
+	return names
+}
+
+// String return the name of suite
+func (id CipherSuiteID) String() string {
+	if suite, err := id.suite(); err == nil {
+		return suite.name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(id))
+}
+
+func (id CipherSuiteID) suite() (*cipherSuite, error) {
+	if int(id) >= len(cipherSuites) {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCipherSuite, uint8(id))
+	}
+	return cipherSuites[id], nil
+}
+
+func newChaCha20Poly1305(key [16]byte, salt []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(HKDF(key[:], salt, []byte("chacha20poly1305 key"), chacha20poly1305.KeySize))
+}
+
+// chacha20Sectors encrypt each sector with chacha20, the sector number is the nonce,
+// keys must be salted so sectors of different files never share a key stream
+type chacha20Sectors struct {
+	key []byte
+}
+
+func newChaCha20Sectors(key [16]byte, salt []byte) *chacha20Sectors {
+	return &chacha20Sectors{key: HKDF(key[:], salt, []byte("chacha20 content key"), chacha20.KeySize)}
+}
+
+func (c *chacha20Sectors) xorSector(dst, src []byte, sectorNum uint64) {
+	nonce := make([]byte, chacha20.NonceSize)
+	binary.LittleEndian.PutUint64(nonce, sectorNum)
+	stream, err := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+	if err != nil {
+		// key and nonce have fixed valid sizes
+		panic(err)
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+func (c *chacha20Sectors) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	c.xorSector(ciphertext, plaintext, sectorNum)
+}
+
+func (c *chacha20Sectors) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	c.xorSector(plaintext, ciphertext, sectorNum)
+}
+
+// cipherSuiteBenchmarkLength is the plain bytes processed by each suite in FastestCipherSuite
+const cipherSuiteBenchmarkLength = 256 * 1024
+
+var (
+	cipherSuiteDurationsOnce sync.Once
+	cipherSuiteDurations     []time.Duration
+)
+
+// FastestCipherSuite return the suite of candidates encrypting and hashing content fastest on this machine,
+// e.g. AES is slower than ChaCha20 without AES instructions. All supported suites are candidates if none is given.
+// Suites are benchmarked on a small buffer once per process, the results are reused by later calls
+func FastestCipherSuite(candidates ...CipherSuiteID) CipherSuiteID {
+	cipherSuiteDurationsOnce.Do(func() {
+		cipherSuiteDurations = make([]time.Duration, len(cipherSuites))
+		for id := range cipherSuites {
+			cipherSuiteDurations[id] = benchmarkCipherSuite(CipherSuiteID(id))
+		}
+	})
+	return fastestCipherSuite(cipherSuiteDurations, candidates)
+}
+
+// fastestCipherSuite return the candidate with the least duration, the first one of a tie,
+// DefaultCipherSuite if no candidate is supported
+func fastestCipherSuite(durations []time.Duration, candidates []CipherSuiteID) CipherSuiteID {
+	if len(candidates) == 0 {
+		for id := range durations {
+			candidates = append(candidates, CipherSuiteID(id))
+		}
+	}
+	fastest, found := DefaultCipherSuite, false
+	for _, id := range candidates {
+		if int(id) >= len(durations) {
+			continue
+		}
+		if !found || durations[id] < durations[fastest] {
+			fastest, found = id, true
+		}
+	}
+	return fastest
+}
+
+// benchmarkCipherSuite return the duration of encrypting and hashing cipherSuiteBenchmarkLength bytes by suite id,
+// the fastest of a few runs to ignore scheduling noise
+func benchmarkCipherSuite(id CipherSuiteID) time.Duration {
+	suite := cipherSuites[id]
+	content, err := suite.newContentCipher([16]byte{}, make([]byte, 16))
+	if err != nil {
+		return time.Duration(math.MaxInt64)
+	}
+	plain := make([]byte, cipherSuiteBenchmarkLength)
+	encrypted := make([]byte, XTSSectorSize)
+	fastest := time.Duration(math.MaxInt64)
+	for range 3 {
+		start := time.Now()
+		h := suite.newHash()
+		for i := 0; i < len(plain); i += XTSSectorSize {
+			content.Encrypt(encrypted, plain[i:i+XTSSectorSize], uint64(i/XTSSectorSize))
+		}
+		h.Write(plain)
+		h.Sum(nil)
+		fastest = min(fastest, time.Since(start))
+	}
+	return fastest
+}
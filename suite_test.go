@@ -0,0 +1,132 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCipherSuites(t *testing.T) {
+	content := bytes.Repeat([]byte("content of cipher suite"), 1000)
+	password := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	for id := range cipherSuites {
+		suite := CipherSuiteID(id)
+		t.Run(suite.String(), func(t *testing.T) {
+			parsed, err := ParseCipherSuite(suite.String())
+			if err != nil || parsed != suite {
+				t.Fatal("parse suite name failed")
+			}
+			if (&EmixHeader{CipherSuite: suite}).fileInfoOverhead() > fileInfoMaxOverhead {
+				t.Fatal("file info overhead exceeds fileInfoMaxOverhead")
+			}
+
+			header := &EmixHeader{
+				EncryptInfo: true,
+				EncryptData: true,
+				Password:    password,
+				SaltedKeys:  true,
+				BindHeader:  true,
+				CipherSuite: suite,
+				FileInfo:    FileInfo{Name: "suite.txt", Size: uint64(len(content))},
+			}
+			hash := header.NewContentHash()
+			hash.Write(content)
+			copy(header.FileInfo.FileContentHash[:], hash.Sum(nil))
+			encodedHeader, err := header.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encodedHeader) != header.EncodedLength() {
+				t.Fatal("EncodedLength not equal")
+			}
+			cipher, err := header.NewContentCipher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cipherText := bytes.NewBuffer(nil)
+			if err := EncryptContent(cipher, bytes.NewReader(content), cipherText); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(cipherText.Bytes(), content[:64]) {
+				t.Fatal("content is not encrypted")
+			}
+
+			header2 := &EmixHeader{Password: password}
+			if err := header2.UnmarshalBinary(encodedHeader); err != nil {
+				t.Fatal(err)
+			}
+			if header2.CipherSuite != suite || !reflect.DeepEqual(header2.FileInfo, header.FileInfo) {
+				t.Fatal("header not equal")
+			}
+			cipher2, err := header2.NewContentCipher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			plainText := bytes.NewBuffer(nil)
+			hash2 := header2.NewContentHash()
+			if err := DecryptContent(cipher2, cipherText, plainText, int64(len(content))); err != nil {
+				t.Fatal(err)
+			}
+			hash2.Write(plainText.Bytes())
+			if !bytes.Equal(plainText.Bytes(), content) || !bytes.Equal(hash2.Sum(nil), header.FileInfo.FileContentHash[:]) {
+				t.Fatal("content not equal")
+			}
+
+			// a different suite can not decrypt file info
+			encodedHeader[header.mixTypeOffset()+1] ^= byte(1) << emixHeaderCipherSuiteShift
+			if err := (&EmixHeader{Password: password}).UnmarshalBinary(encodedHeader); err == nil {
+				t.Fatal("suite should be authenticated")
+			}
+		})
+	}
+
+	if _, err := ParseCipherSuite("rot13+rot13+crc32"); !errors.Is(err, ErrUnsupportedCipherSuite) {
+		t.Fatal("unknown suite name should fail")
+	}
+
+	// suites other than default need salted keys
+	header := &EmixHeader{CipherSuite: CipherSuiteChaCha20, FileInfo: FileInfo{Name: "a"}}
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrUnsupportedCipherSuite) {
+		t.Fatal("unsalted suite should fail")
+	}
+
+	// unknown suite id
+	header = &EmixHeader{SaltedKeys: true, FileInfo: FileInfo{Name: "a"}}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedHeader[header.mixTypeOffset()+1] |= 0xf << emixHeaderCipherSuiteShift
+	if err := (&EmixHeader{}).UnmarshalBinary(encodedHeader); !errors.Is(err, ErrUnsupportedCipherSuite) {
+		t.Fatal("unknown suite id should fail")
+	}
+}
+
+func TestFastestCipherSuite(t *testing.T) {
+	durations := []time.Duration{CipherSuiteAESGCM: 2 * time.Millisecond, CipherSuiteChaCha20: time.Millisecond}
+	if id := fastestCipherSuite(durations, nil); id != CipherSuiteChaCha20 {
+		t.Fatal("fastest suite should be chacha20, got", id)
+	}
+	if id := fastestCipherSuite(durations, []CipherSuiteID{CipherSuiteAESGCM}); id != CipherSuiteAESGCM {
+		t.Fatal("only candidate should be selected, got", id)
+	}
+	durations[CipherSuiteAESGCM] = time.Millisecond
+	if id := fastestCipherSuite(durations, []CipherSuiteID{CipherSuiteChaCha20, CipherSuiteAESGCM}); id != CipherSuiteChaCha20 {
+		t.Fatal("first candidate of a tie should be selected, got", id)
+	}
+	if id := fastestCipherSuite(durations, []CipherSuiteID{15}); id != DefaultCipherSuite {
+		t.Fatal("unsupported candidates should select the default suite, got", id)
+	}
+
+	// the benchmark selects a supported suite and caches it
+	id := FastestCipherSuite()
+	if _, err := id.suite(); err != nil {
+		t.Fatal(err)
+	}
+	if FastestCipherSuite() != id {
+		t.Fatal("selection should be cached")
+	}
+}
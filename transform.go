@@ -0,0 +1,228 @@
+package emix
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// transforms extension of file info
+// [1-byte count] [1-byte name length] [name] ...
+// names are in the order applied on encode, decode applies the inverses in reverse order
+
+const (
+	// TransformNameMaxLength is the max length of ContentTransform.Name
+	TransformNameMaxLength = 0xff
+	// MaxTransforms is the max length of FileInfo.Transforms
+	MaxTransforms = 0xff
+)
+
+var (
+	ErrUnknownTransform  = errors.New("unknown content transform")
+	ErrInvalidTransforms = errors.New("invalid content transforms")
+)
+
+// ContentTransform is a custom processing of plain content, e.g. compression or redaction,
+// applied before encryption on mix and after decryption on demix.
+// Name is stored in file info to find the transform on decode, so it must not change once files are written
+type ContentTransform interface {
+	Name() string
+	// Wrap return a reader of the encoded r
+	Wrap(r io.Reader) io.Reader
+	// Unwrap return a reader of the decoded r, the inverse of Wrap
+	Unwrap(r io.Reader) (io.Reader, error)
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]ContentTransform{}
+)
+
+// RegisterContentTransform make t available by its name, a transform registered with the same name is replaced
+func RegisterContentTransform(t ContentTransform) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[t.Name()] = t
+}
+
+// LookupContentTransform return the transform registered with name
+func LookupContentTransform(name string) (ContentTransform, error) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	t, ok := transforms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransform, name)
+	}
+	return t, nil
+}
+
+// lookupContentTransforms return the registered transforms of names
+func lookupContentTransforms(names []string) ([]ContentTransform, error) {
+	chain := make([]ContentTransform, 0, len(names))
+	for _, name := range names {
+		t, err := LookupContentTransform(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// EncodeContent return a reader of r encoded by the transforms of names in order
+func EncodeContent(r io.Reader, names []string) (io.Reader, error) {
+	chain, err := lookupContentTransforms(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range chain {
+		r = t.Wrap(r)
+	}
+	return r, nil
+}
+
+// DecodeContent return a reader of r decoded by the inverses of the transforms of names in reverse order
+func DecodeContent(r io.Reader, names []string) (io.Reader, error) {
+	chain, err := lookupContentTransforms(names)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapContent(r, chain)
+}
+
+// unwrapContent return a reader of r decoded by chain in reverse order
+func unwrapContent(r io.Reader, chain []ContentTransform) (io.Reader, error) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		if r, err = chain[i].Unwrap(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// decodeWriter write the decoded content to w in a goroutine
+type decodeWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+// NewDecodeContentWriter return a writer decoding the content encoded by the transforms of names and writing it to w,
+// Close must be called after the content is written and return the error of decoding, it can be called again
+func NewDecodeContentWriter(w io.Writer, names []string) (io.WriteCloser, error) {
+	chain, err := lookupContentTransforms(names)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	d := &decodeWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		r, err := unwrapContent(pr, chain)
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		// unblock writes if decoding stopped early
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d, nil
+}
+
+func (d *decodeWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *decodeWriter) Close() error {
+	d.once.Do(func() {
+		d.pw.Close()
+		d.err = <-d.done
+	})
+	return d.err
+}
+
+// gzipTransform compress content with gzip
+type gzipTransform struct{}
+
+func (gzipTransform) Name() string {
+	return "gzip"
+}
+
+func (gzipTransform) Wrap(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (gzipTransform) Unwrap(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func init() {
+	RegisterContentTransform(gzipTransform{})
+}
+
+func validTransforms(names []string) error {
+	if len(names) > MaxTransforms {
+		return ErrInvalidTransforms
+	}
+	for _, name := range names {
+		if len(name) == 0 || len(name) > TransformNameMaxLength {
+			return ErrInvalidTransforms
+		}
+	}
+	return nil
+}
+
+func transformsEncodedLength(names []string) int {
+	length := 1
+	for _, name := range names {
+		length += 1 + len(name)
+	}
+	return length
+}
+
+func marshalTransforms(names []string) []byte {
+	buf := make([]byte, 0, transformsEncodedLength(names))
+	buf = append(buf, byte(len(names)))
+	for _, name := range names {
+		buf = append(buf, byte(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+func unmarshalTransforms(value []byte) ([]string, error) {
+	if len(value) < 1 {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	count := int(value[0])
+	names := make([]string, 0, count)
+	i := 1
+	for range count {
+		if len(value) < i+1 {
+			return nil, ErrInvalidEncodedFileInfo
+		}
+		nameLength := int(value[i])
+		i++
+		if nameLength == 0 || len(value) < i+nameLength {
+			return nil, ErrInvalidEncodedFileInfo
+		}
+		names = append(names, string(value[i:i+nameLength]))
+		i += nameLength
+	}
+	if i != len(value) {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	return names, nil
+}
@@ -0,0 +1,114 @@
+package emix
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// base64Transform encode content as base64 text
+type base64Transform struct{}
+
+func (base64Transform) Name() string {
+	return "test-base64"
+}
+
+func (base64Transform) Wrap(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (base64Transform) Unwrap(r io.Reader) (io.Reader, error) {
+	return base64.NewDecoder(base64.StdEncoding, r), nil
+}
+
+func TestContentTransforms(t *testing.T) {
+	RegisterContentTransform(base64Transform{})
+	plain := []byte(strings.Repeat("content transform ", 10000))
+	names := []string{"gzip", "test-base64"}
+
+	r, err := EncodeContent(bytes.NewReader(plain), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base64 of gzip, compressed first
+	compressed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(compressed, []byte{0x1f, 0x8b}) || len(compressed) >= len(plain) {
+		t.Fatal("content should be compressed by gzip then encoded by base64")
+	}
+
+	decoded := bytes.NewBuffer(nil)
+	w, err := NewDecodeContentWriter(decoded, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in small pieces like sectors
+	for i := 0; i < len(encoded); i += 4096 {
+		if _, err := w.Write(encoded[i:min(i+4096, len(encoded))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, decoded.Bytes()) {
+		t.Fatal("decoded content not equal")
+	}
+
+	// inverses in the wrong order fail
+	w, err = NewDecodeContentWriter(io.Discard, []string{"test-base64", "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(encoded)
+	if err := w.Close(); err == nil {
+		t.Fatal("decode in wrong order should fail")
+	}
+
+	if _, err := EncodeContent(bytes.NewReader(plain), []string{"unknown"}); !errors.Is(err, ErrUnknownTransform) {
+		t.Fatal("unknown transform should fail")
+	}
+	if _, err := NewDecodeContentWriter(io.Discard, []string{"unknown"}); !errors.Is(err, ErrUnknownTransform) {
+		t.Fatal("unknown transform should fail")
+	}
+
+	// names are stored in file info
+	info := FileInfo{Name: "a.txt", Transforms: names}
+	buf, err := info.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != info.EncodedLength() {
+		t.Fatal("EncodedLength not equal")
+	}
+	var info2 FileInfo
+	if err := info2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, info2) {
+		t.Fatal("not equal")
+	}
+	info.Transforms = []string{""}
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrInvalidTransforms) {
+		t.Fatal("empty transform name should fail")
+	}
+}
@@ -0,0 +1,91 @@
+package emix
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// xattrs extension of file info
+// [2-byte count] [1-byte name length] [name] [2-byte value length] [value] ...
+
+const (
+	// XattrsMaxLength is the max encoded length of FileInfo.Xattrs, so file info keeps room for other extensions
+	XattrsMaxLength    = 32 * 1024
+	xattrNameMaxLength = 0xff
+)
+
+var (
+	// ErrXattrsUnsupported means extended attributes are unavailable, e.g. an unsupported OS or filesystem
+	ErrXattrsUnsupported = errors.New("xattrs unsupported")
+	ErrXattrsTooLarge    = errors.New("xattrs too large")
+)
+
+// Xattr is an extended attribute of file, e.g. user.comment or com.apple.quarantine
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+func xattrsEncodedLength(xattrs []Xattr) int {
+	length := 2
+	for _, x := range xattrs {
+		length += 1 + len(x.Name) + 2 + len(x.Value)
+	}
+	return length
+}
+
+func validXattrs(xattrs []Xattr) error {
+	if xattrsEncodedLength(xattrs) > XattrsMaxLength {
+		return ErrXattrsTooLarge
+	}
+	for _, x := range xattrs {
+		if len(x.Name) == 0 || len(x.Name) > xattrNameMaxLength {
+			return ErrXattrsTooLarge
+		}
+	}
+	return nil
+}
+
+func marshalXattrs(xattrs []Xattr) []byte {
+	buf := make([]byte, 0, xattrsEncodedLength(xattrs))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(xattrs)))
+	for _, x := range xattrs {
+		buf = append(buf, byte(len(x.Name)))
+		buf = append(buf, x.Name...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(x.Value)))
+		buf = append(buf, x.Value...)
+	}
+	return buf
+}
+
+func unmarshalXattrs(value []byte) ([]Xattr, error) {
+	if len(value) < 2 {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	count := int(binary.LittleEndian.Uint16(value[0:2]))
+	xattrs := make([]Xattr, 0, count)
+	i := 2
+	for range count {
+		if len(value) < i+1 {
+			return nil, ErrInvalidEncodedFileInfo
+		}
+		nameLength := int(value[i])
+		i++
+		if nameLength == 0 || len(value) < i+nameLength+2 {
+			return nil, ErrInvalidEncodedFileInfo
+		}
+		name := string(value[i : i+nameLength])
+		i += nameLength
+		valueLength := int(binary.LittleEndian.Uint16(value[i : i+2]))
+		i += 2
+		if len(value) < i+valueLength {
+			return nil, ErrInvalidEncodedFileInfo
+		}
+		xattrs = append(xattrs, Xattr{Name: name, Value: append([]byte{}, value[i:i+valueLength]...)})
+		i += valueLength
+	}
+	if i != len(value) {
+		return nil, ErrInvalidEncodedFileInfo
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package emix
+
+func ReadXattrs(path string) ([]Xattr, error) {
+	return nil, ErrXattrsUnsupported
+}
+
+func WriteXattr(path string, x Xattr) error {
+	return ErrXattrsUnsupported
+}
@@ -0,0 +1,48 @@
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFileInfoXattrs(t *testing.T) {
+	info := FileInfo{
+		Name: "a.txt",
+		Xattrs: []Xattr{
+			{Name: "user.comment", Value: []byte("comment")},
+			{Name: "user.empty", Value: []byte{}},
+		},
+	}
+	for _, encryptInfo := range []bool{false, true} {
+		header := EmixHeader{
+			EncryptInfo:   encryptInfo,
+			EmbedPassword: true,
+			Password:      [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			FileInfo:      info,
+		}
+		buf, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != header.EncodedLength() {
+			t.Fatal("EncodedLength not equal")
+		}
+		if bytes.Contains(buf, []byte("user.comment")) == encryptInfo {
+			t.Fatal("xattrs should be encrypted with file info")
+		}
+		var header2 EmixHeader
+		if err := header2.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header2, header) {
+			t.Fatal("not equal")
+		}
+	}
+
+	info.Xattrs = []Xattr{{Name: "user.large", Value: make([]byte, XattrsMaxLength)}}
+	if _, err := info.MarshalBinary(); !errors.Is(err, ErrXattrsTooLarge) {
+		t.Fatal("large xattrs should fail")
+	}
+}
@@ -0,0 +1,71 @@
+//go:build linux || darwin
+
+package emix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadXattrs return the extended attributes of the file at path sorted by name
+func ReadXattrs(path string) ([]Xattr, error) {
+	names, err := xattrBuffer(func(dest []byte) (int, error) {
+		return unix.Listxattr(path, dest)
+	})
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, fmt.Errorf("%w: %v", ErrXattrsUnsupported, err)
+		}
+		return nil, err
+	}
+	var xattrs []Xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrBuffer(func(dest []byte) (int, error) {
+			return unix.Getxattr(path, string(name), dest)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read xattr %s error: %w", name, err)
+		}
+		xattrs = append(xattrs, Xattr{Name: string(name), Value: value})
+	}
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	return xattrs, nil
+}
+
+// xattrBuffer call fn with a nil buffer for the size, then with a buffer of the size, again if it grew
+func xattrBuffer(fn func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// WriteXattr set an extended attribute of the file at path
+func WriteXattr(path string, x Xattr) error {
+	err := unix.Setxattr(path, x.Name, x.Value, 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		return fmt.Errorf("%w: %v", ErrXattrsUnsupported, err)
+	}
+	return err
+}
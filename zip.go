@@ -0,0 +1,30 @@
+package emix
+
+import (
+	"archive/zip"
+	"fmt"
+)
+
+// ZipEmixEntries return the entries of a real zip archive that are emix files, e.g. emix files zipped to be emailed,
+// directories and ordinary entries are skipped
+func ZipEmixEntries(r *zip.Reader) ([]*zip.File, error) {
+	var entries []*zip.File
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open zip entry %s error: %w", f.Name, err)
+		}
+		ok, err := IsEmixFile(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read zip entry %s error: %w", f.Name, err)
+		}
+		if ok {
+			entries = append(entries, f)
+		}
+	}
+	return entries, nil
+}
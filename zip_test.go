@@ -0,0 +1,52 @@
+package emix
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestZipEmixEntries(t *testing.T) {
+	header := &EmixHeader{FileInfo: FileInfo{Name: "a.txt", Mode: 0644}}
+	encoded, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	emixFile := append(ZipHeader(), encoded...)
+
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	for _, entry := range []struct {
+		name   string
+		data   []byte
+		method uint16
+	}{
+		{"a.zip", emixFile, zip.Deflate},
+		{"docs/", nil, zip.Store},
+		{"docs/b.zip", emixFile, zip.Store},
+		{"readme.txt", []byte("not emix"), zip.Deflate},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ZipEmixEntries(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "a.zip" || entries[1].Name != "docs/b.zip" {
+		t.Fatal("unexpected entries", entries)
+	}
+}